@@ -0,0 +1,415 @@
+package main
+
+// Security advisories in OSV format (https://ossf.github.io/osv-schema/) are imported
+// from a directory (config.AdvisoryDir) or through the API, and matched against
+// the installed packages on each host (see packages.go).
+//
+// Note that the Debian and Ubuntu advisories are for source packages,
+// which are matched against binary package names. That works for packages where
+// the names are the same (e.g. openssl), but e.g. libssl3 won't be found.
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/fs"
+	"log"
+	"nivlheim/utility"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type osvAdvisory struct {
+	ID        string     `json:"id"`
+	Modified  time.Time  `json:"modified"`
+	Withdrawn *time.Time `json:"withdrawn"`
+	Summary   string     `json:"summary"`
+	Aliases   []string   `json:"aliases"`
+	Affected  []struct {
+		Package struct {
+			Ecosystem string `json:"ecosystem"`
+			Name      string `json:"name"`
+		} `json:"package"`
+		Ranges []struct {
+			Type   string              `json:"type"`
+			Events []map[string]string `json:"events"`
+		} `json:"ranges"`
+		Versions []string `json:"versions"`
+	} `json:"affected"`
+}
+
+// advisoryRange is a row in the advisory_ranges table
+type advisoryRange struct {
+	advisoryID   string
+	source       string
+	distribution string
+	osRelease    string
+	pkg          string
+	introduced   string
+	fixed        sql.NullString
+	lastAffected sql.NullString
+}
+
+// osvEcosystems maps the OSV ecosystem name to the package system,
+// and the name used for the os column in hostinfo
+var osvEcosystems = map[string]struct {
+	source, os string
+}{
+	"Debian":      {"dpkg", "Debian"},
+	"Ubuntu":      {"dpkg", "Ubuntu"},
+	"AlmaLinux":   {"rpm", "AlmaLinux"},
+	"Rocky Linux": {"rpm", "Rocky Linux"},
+	"Red Hat":     {"rpm", "RHEL"},
+	"SUSE":        {"rpm", "SLES"},
+	"openSUSE":    {"rpm", "openSUSE Leap"},
+}
+
+var reReleaseNumber = regexp.MustCompile(`^\d+(\.\d+)*$`)
+
+// ecosystemRelease returns the package system, distribution and OS release for an OSV ecosystem
+// like "Debian:11" or "Ubuntu:22.04:LTS". The release is empty if the ecosystem
+// doesn't specify a version (e.g. "SUSE:Linux Enterprise Server 15 SP5").
+// Returns an empty source if the ecosystem isn't supported.
+func ecosystemRelease(ecosystem string) (string, string, string) {
+	parts := strings.Split(ecosystem, ":")
+	eco, ok := osvEcosystems[parts[0]]
+	if !ok {
+		return "", "", ""
+	}
+	for _, p := range parts[1:] {
+		if reReleaseNumber.MatchString(p) {
+			return eco.source, eco.os, eco.os + " " + p
+		}
+	}
+	return eco.source, eco.os, ""
+}
+
+// ranges converts the affected versions of the advisory to a list of ranges
+func (adv *osvAdvisory) ranges() []advisoryRange {
+	list := make([]advisoryRange, 0)
+	for _, aff := range adv.Affected {
+		source, distribution, release := ecosystemRelease(aff.Package.Ecosystem)
+		if source == "" || aff.Package.Name == "" {
+			continue
+		}
+		newRange := func(introduced string) advisoryRange {
+			return advisoryRange{advisoryID: adv.ID, source: source, distribution: distribution,
+				osRelease: release, pkg: aff.Package.Name, introduced: introduced}
+		}
+		for _, rng := range aff.Ranges {
+			// Git commits and semantic versions aren't useful for OS packages
+			if rng.Type != "ECOSYSTEM" {
+				continue
+			}
+			var current *advisoryRange
+			for _, event := range rng.Events {
+				if v, ok := event["introduced"]; ok {
+					if current != nil {
+						list = append(list, *current)
+					}
+					r := newRange(v)
+					current = &r
+				}
+				if current == nil {
+					continue
+				}
+				if v, ok := event["fixed"]; ok {
+					current.fixed = sql.NullString{String: v, Valid: true}
+				} else if v, ok := event["limit"]; ok {
+					current.fixed = sql.NullString{String: v, Valid: true}
+				} else if v, ok := event["last_affected"]; ok {
+					current.lastAffected = sql.NullString{String: v, Valid: true}
+				} else {
+					continue
+				}
+				list = append(list, *current)
+				current = nil
+			}
+			if current != nil {
+				list = append(list, *current)
+			}
+		}
+		// Single versions that are affected
+		for _, v := range aff.Versions {
+			r := newRange(v)
+			r.lastAffected = sql.NullString{String: v, Valid: true}
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+// affects returns true if the range includes the given version of the package
+func (r *advisoryRange) affects(source string, osName string, version string) bool {
+	if r.source != source || (r.osRelease != "" && r.osRelease != osName) {
+		return false
+	}
+	// Several distributions use the same package system, so check it even if there's no release.
+	// osName is e.g. "SLES 15", or just "openSUSE Tumbleweed" if it has no version.
+	if r.distribution != "" && osName != r.distribution && !strings.HasPrefix(osName, r.distribution+" ") {
+		return false
+	}
+	if r.introduced != "0" && compareVersions(source, version, r.introduced) < 0 {
+		return false
+	}
+	if r.fixed.Valid {
+		return compareVersions(source, version, r.fixed.String) < 0
+	}
+	if r.lastAffected.Valid {
+		return compareVersions(source, version, r.lastAffected.String) <= 0
+	}
+	return true
+}
+
+// parseAdvisories parses a single advisory, or a list of them
+func parseAdvisories(data []byte) ([]osvAdvisory, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var list []osvAdvisory
+		err := json.Unmarshal(data, &list)
+		return list, err
+	}
+	var adv osvAdvisory
+	if err := json.Unmarshal(data, &adv); err != nil {
+		return nil, err
+	}
+	return []osvAdvisory{adv}, nil
+}
+
+// importAdvisories stores the advisories in the database.
+// Advisories that haven't been modified since the last import are skipped,
+// and withdrawn advisories are removed.
+// Returns the number of advisories that were added or updated.
+func importAdvisories(db *sql.DB, advisories []osvAdvisory) (int, error) {
+	count := 0
+	err := utility.RunInTransaction(db, func(tx *sql.Tx) error {
+		for i := range advisories {
+			adv := &advisories[i]
+			if adv.ID == "" {
+				continue
+			}
+			if adv.Withdrawn != nil {
+				if _, err := tx.Exec("DELETE FROM advisories WHERE advisoryid=$1", adv.ID); err != nil {
+					return err
+				}
+				continue
+			}
+			var modified pq.NullTime
+			err := tx.QueryRow("SELECT modified FROM advisories WHERE advisoryid=$1", adv.ID).
+				Scan(&modified)
+			// The database stores timestamps with microsecond precision
+			if err == nil && modified.Valid && modified.Time.Equal(adv.Modified.Truncate(time.Microsecond)) {
+				continue
+			}
+			if err == sql.ErrNoRows {
+				_, err = tx.Exec("INSERT INTO advisories(advisoryid,summary,aliases,modified) "+
+					"VALUES($1,$2,$3,$4)", adv.ID, adv.Summary, strings.Join(adv.Aliases, " "), adv.Modified)
+			} else if err == nil {
+				// Update instead of delete+insert, to keep the history in host_vulnerabilities
+				_, err = tx.Exec("UPDATE advisories SET summary=$1, aliases=$2, modified=$3, "+
+					"imported=now() WHERE advisoryid=$4",
+					adv.Summary, strings.Join(adv.Aliases, " "), adv.Modified, adv.ID)
+			}
+			if err != nil {
+				return err
+			}
+			if _, err = tx.Exec("DELETE FROM advisory_ranges WHERE advisoryid=$1", adv.ID); err != nil {
+				return err
+			}
+			for _, r := range adv.ranges() {
+				_, err = tx.Exec("INSERT INTO advisory_ranges(advisoryid,source,distribution,osrelease,"+
+					"package,introduced,fixed,last_affected) VALUES($1,$2,$3,$4,$5,$6,$7,$8)",
+					r.advisoryID, r.source, r.distribution, r.osRelease, r.pkg, r.introduced,
+					r.fixed, r.lastAffected)
+				if err != nil {
+					return err
+				}
+			}
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// advisoryFileModTimes remembers the files in AdvisoryDir that have been imported,
+// so they aren't read again unless they change
+var advisoryFileModTimes = make(map[string]time.Time)
+
+// importAdvisoryDir imports the .json files in the directory and its subdirectories
+func importAdvisoryDir(db *sql.DB, dir string) (int, error) {
+	advisories := make([]osvAdvisory, 0)
+	modTimes := make(map[string]time.Time)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(d.Name(), ".json") {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if t, ok := advisoryFileModTimes[path]; ok && t.Equal(info.ModTime()) {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		list, err := parseAdvisories(data)
+		if err != nil {
+			// A broken file shouldn't stop the others from being imported
+			log.Printf("Unable to parse the advisory file %s: %s", path, err)
+			return nil
+		}
+		advisories = append(advisories, list...)
+		modTimes[path] = info.ModTime()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	count, err := importAdvisories(db, advisories)
+	if err != nil {
+		return 0, err
+	}
+	// Only remember the files after they have been imported successfully
+	for path, t := range modTimes {
+		advisoryFileModTimes[path] = t
+	}
+	return count, nil
+}
+
+type hostVulnerability struct {
+	certfp, advisoryID, pkg, version string
+}
+
+// matchVulnerabilities compares the installed packages on all hosts to the advisories,
+// and updates the host_vulnerabilities table
+func matchVulnerabilities(db *sql.DB) error {
+	// Load all the ranges, grouped by package name
+	rows, err := db.Query("SELECT advisoryid, source, distribution, osrelease, package, " +
+		"introduced, fixed, last_affected FROM advisory_ranges")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	ranges := make(map[string][]advisoryRange)
+	for rows.Next() {
+		var r advisoryRange
+		err = rows.Scan(&r.advisoryID, &r.source, &r.distribution, &r.osRelease, &r.pkg,
+			&r.introduced, &r.fixed, &r.lastAffected)
+		if err != nil {
+			return err
+		}
+		ranges[r.pkg] = append(ranges[r.pkg], r)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	names := make([]string, 0, len(ranges))
+	for name := range ranges {
+		names = append(names, name)
+	}
+
+	// Check the installed packages that have advisories
+	found := make(map[hostVulnerability]bool)
+	rows, err = db.Query("SELECT p.certfp, p.source, p.name, p.version, COALESCE(h.os,'') "+
+		"FROM host_packages p JOIN hostinfo h ON h.certfp = p.certfp "+
+		"WHERE p.name = ANY($1)", pq.Array(names))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var certfp, source, name, version, osName string
+		if err = rows.Scan(&certfp, &source, &name, &version, &osName); err != nil {
+			return err
+		}
+		for i := range ranges[name] {
+			r := &ranges[name][i]
+			if r.affects(source, osName, version) {
+				found[hostVulnerability{certfp, r.advisoryID, name, version}] = true
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	// Only write the differences
+	return utility.RunInTransaction(db, func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT certfp, advisoryid, package, version FROM host_vulnerabilities")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		gone := make([]hostVulnerability, 0)
+		for rows.Next() {
+			var v hostVulnerability
+			if err = rows.Scan(&v.certfp, &v.advisoryID, &v.pkg, &v.version); err != nil {
+				return err
+			}
+			if found[v] {
+				delete(found, v)
+			} else {
+				gone = append(gone, v)
+			}
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+		for _, v := range gone {
+			_, err = tx.Exec("DELETE FROM host_vulnerabilities WHERE certfp=$1 AND advisoryid=$2 "+
+				"AND package=$3 AND version=$4", v.certfp, v.advisoryID, v.pkg, v.version)
+			if err != nil {
+				return err
+			}
+		}
+		for v := range found {
+			_, err = tx.Exec("INSERT INTO host_vulnerabilities(certfp,advisoryid,package,version) "+
+				"VALUES($1,$2,$3,$4)", v.certfp, v.advisoryID, v.pkg, v.version)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Job
+type matchVulnerabilitiesJob struct{}
+
+func init() {
+	RegisterJob(matchVulnerabilitiesJob{})
+}
+
+func (job matchVulnerabilitiesJob) HowOften() time.Duration {
+	return time.Hour
+}
+
+func (job matchVulnerabilitiesJob) Run(ctx context.Context, db *sql.DB) {
+	if config.AdvisoryDir != "" {
+		n, err := importAdvisoryDir(db, config.AdvisoryDir)
+		if err != nil {
+			log.Panic(err)
+		}
+		if n > 0 {
+			log.Printf("Imported %d advisories from %s", n, config.AdvisoryDir)
+		}
+	}
+	if err := matchVulnerabilities(db); err != nil {
+		log.Panic(err)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+)
+
+const testAdvisory = `{
+	"id": "DSA-5139-1",
+	"modified": "2022-05-03T12:00:00.123456789Z",
+	"summary": "openssl - security update",
+	"aliases": ["CVE-2022-1292"],
+	"affected": [
+		{
+			"package": {"ecosystem": "Debian:11", "name": "openssl"},
+			"ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}, {"fixed": "1.1.1n-0+deb11u2"}]}]
+		},
+		{
+			"package": {"ecosystem": "AlmaLinux:8", "name": "openssl"},
+			"ranges": [
+				{"type": "ECOSYSTEM", "events": [{"introduced": "1:1.1.1"}, {"last_affected": "1:1.1.1k-5.el8"}]},
+				{"type": "GIT", "events": [{"introduced": "abcdef"}, {"fixed": "123456"}]}
+			],
+			"versions": ["1.0.2k-19.el8"]
+		},
+		{
+			"package": {"ecosystem": "PyPI", "name": "cryptography"},
+			"ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}]}]
+		}
+	]
+}`
+
+func TestAdvisoryRanges(t *testing.T) {
+	list, err := parseAdvisories([]byte(testAdvisory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("Expected one advisory, got %d", len(list))
+	}
+	valid := func(s string) sql.NullString { return sql.NullString{String: s, Valid: true} }
+	expect := []advisoryRange{
+		{advisoryID: "DSA-5139-1", source: "dpkg", distribution: "Debian", osRelease: "Debian 11", pkg: "openssl",
+			introduced: "0", fixed: valid("1.1.1n-0+deb11u2")},
+		{advisoryID: "DSA-5139-1", source: "rpm", distribution: "AlmaLinux", osRelease: "AlmaLinux 8", pkg: "openssl",
+			introduced: "1:1.1.1", lastAffected: valid("1:1.1.1k-5.el8")},
+		{advisoryID: "DSA-5139-1", source: "rpm", distribution: "AlmaLinux", osRelease: "AlmaLinux 8", pkg: "openssl",
+			introduced: "1.0.2k-19.el8", lastAffected: valid("1.0.2k-19.el8")},
+	}
+	ranges := list[0].ranges()
+	if !reflect.DeepEqual(ranges, expect) {
+		t.Errorf("Got ranges:\n%v\nexpected:\n%v", ranges, expect)
+	}
+
+	tests := []struct {
+		source, os, version string
+		expect              bool
+	}{
+		{"dpkg", "Debian 11", "1.1.1k-1+deb11u1", true},
+		{"dpkg", "Debian 11", "1.1.1n-0+deb11u2", false},
+		{"dpkg", "Debian 12", "1.1.1k-1+deb11u1", false},
+		{"rpm", "AlmaLinux 8", "1:1.1.1k-5.el8", true},
+		{"rpm", "AlmaLinux 8", "1:1.1.1k-6.el8", false},
+		{"rpm", "AlmaLinux 8", "1.0.2k-19.el8", true},
+		{"rpm", "AlmaLinux 8", "1.0.2k-20.el8", false},
+	}
+	for _, test := range tests {
+		affected := false
+		for i := range ranges {
+			if ranges[i].affects(test.source, test.os, test.version) {
+				affected = true
+			}
+		}
+		if affected != test.expect {
+			t.Errorf("%s %s on %s: affected=%v, expected %v",
+				test.source, test.version, test.os, affected, test.expect)
+		}
+	}
+}
+
+func TestAdvisoryRangeWithoutRelease(t *testing.T) {
+	list, err := parseAdvisories([]byte(`{
+		"id": "SUSE-SU-2023:1234-1",
+		"affected": [{
+			"package": {"ecosystem": "SUSE:Linux Enterprise Server 15 SP5", "name": "openssl"},
+			"ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}, {"fixed": "1.1.1l-150500.17.9.1"}]}]
+		}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges := list[0].ranges()
+	if len(ranges) != 1 || ranges[0].distribution != "SLES" || ranges[0].osRelease != "" {
+		t.Fatalf("Got ranges: %v", ranges)
+	}
+	tests := []struct {
+		os     string
+		expect bool
+	}{
+		{"SLES 15", true},
+		{"SLES", true},
+		{"RHEL 9", false},
+		{"AlmaLinux 9", false},
+		{"SLESX 15", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if ranges[0].affects("rpm", test.os, "1.1.1k-1") != test.expect {
+			t.Errorf("A SUSE advisory on %q: expected affected=%v", test.os, test.expect)
+		}
+	}
+}
+
+// The ranges for RHEL and its clones have an epoch, which plain "rpm -qa" leaves out.
+// The versions must come from the parser, in the form the clients send them.
+func TestAdvisoryRangeWithRpmEpoch(t *testing.T) {
+	list, err := parseAdvisories([]byte(`{
+		"id": "ALSA-2022:5818",
+		"affected": [
+			{
+				"package": {"ecosystem": "AlmaLinux:8", "name": "openssl"},
+				"ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}, {"fixed": "1:1.1.1k-7.el8_6"}]}]
+			},
+			{
+				"package": {"ecosystem": "AlmaLinux:8", "name": "bash"},
+				"ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}, {"fixed": "4.4.20-4.el8_6"}]}]
+			}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges := list[0].ranges()
+	packages, err := parseRpmQa("openssl-1:1.1.1k-6.el8_5.x86_64\n" +
+		"openssl-libs-1:1.1.1k-7.el8_6.x86_64\n" +
+		"bash-0:4.4.20-3.el8.x86_64\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	installed := map[string]string{}
+	for _, p := range packages {
+		installed[p.name] = p.version
+	}
+	tests := []struct {
+		name, version string
+		expect        bool
+	}{
+		{"openssl", installed["openssl"], true},
+		{"openssl", "1:1.1.1k-7.el8_6", false},
+		{"openssl", "1:1.1.1n-1.el8", false},
+		{"bash", installed["bash"], true},
+		{"bash", "4.4.20-4.el8_6", false},
+	}
+	for _, test := range tests {
+		affected := false
+		for i := range ranges {
+			if ranges[i].pkg == test.name && ranges[i].affects("rpm", "AlmaLinux 8", test.version) {
+				affected = true
+			}
+		}
+		if affected != test.expect {
+			t.Errorf("%s %s: affected=%v, expected %v", test.name, test.version, affected, test.expect)
+		}
+	}
+}
+
+func TestVulnerabilityMatching(t *testing.T) {
+	if os.Getenv("NOPOSTGRES") != "" {
+		t.Log("No Postgres, skipping test")
+		return
+	}
+	db := getDBconnForTesting(t)
+	defer db.Close()
+
+	hosts := []struct {
+		certfp, hostname, os, version string
+	}{
+		{"AA", "old.example.com", "Debian 11", "1.1.1k-1+deb11u1"},
+		{"BB", "new.example.com", "Debian 11", "1.1.1n-0+deb11u3"},
+	}
+	for _, h := range hosts {
+		_, err := db.Exec("INSERT INTO hostinfo(certfp,hostname,os) VALUES($1,$2,$3)",
+			h.certfp, h.hostname, h.os)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec("INSERT INTO host_packages(certfp,source,name,version,arch) "+
+			"VALUES($1,'dpkg','openssl',$2,'amd64')", h.certfp, h.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	api := createAPImuxer(db, false)
+	testAPIcalls(t, api, []apiCall{
+		{
+			methodAndPath: "POST /api/v2/advisories",
+			body:          testAdvisory,
+			expectStatus:  http.StatusOK,
+			expectJSON:    `{"imported":1}`,
+		},
+		// The same advisory again isn't imported, since it hasn't been modified
+		{
+			methodAndPath: "POST /api/v2/advisories",
+			body:          "[" + testAdvisory + "]",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `{"imported":0}`,
+		},
+		{
+			methodAndPath: "POST /api/v2/advisories",
+			body:          "{not json",
+			expectStatus:  http.StatusBadRequest,
+		},
+		{
+			methodAndPath: "POST /api/v2/advisories",
+			body:          testAdvisory,
+			accessProfile: &AccessProfile{isAdmin: false, groups: map[string]bool{"x": true}},
+			expectStatus:  http.StatusForbidden,
+		},
+	})
+
+	matchVulnerabilitiesJob{}.Run(context.Background(), db)
+	testAPIcalls(t, api, []apiCall{
+		{
+			methodAndPath: "GET /api/v2/hostlist?fields=hostname,vulnCount&sort=hostname",
+			expectStatus:  http.StatusOK,
+			expectJSON: `[{"hostname":"new.example.com","vulnCount":"0"},` +
+				`{"hostname":"old.example.com","vulnCount":"1"}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/hostlist?fields=hostname&vulnCount=1",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"hostname":"old.example.com"}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/host/old.example.com?fields=vulnerabilities",
+			expectStatus:  http.StatusOK,
+			expectContent: `"advisoryID": "DSA-5139-1"`,
+		},
+		{
+			methodAndPath: "GET /api/v2/advisories?fields=advisoryID,aliases,hostCount",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"advisoryID":"DSA-5139-1","aliases":["CVE-2022-1292"],"hostCount":1}]`,
+		},
+	})
+
+	// When the package is upgraded, the vulnerability goes away
+	_, err := db.Exec("UPDATE host_packages SET version='1.1.1n-0+deb11u3' WHERE certfp='AA'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	matchVulnerabilitiesJob{}.Run(context.Background(), db)
+	testAPIcalls(t, api, []apiCall{
+		{
+			methodAndPath: "GET /api/v2/host/old.example.com?fields=vulnerabilities",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `{"vulnerabilities":[]}`,
+		},
+		{
+			methodAndPath: "DELETE /api/v2/advisories/DSA-5139-1",
+			expectStatus:  http.StatusNoContent,
+		},
+		{
+			methodAndPath: "DELETE /api/v2/advisories/DSA-5139-1",
+			expectStatus:  http.StatusNotFound,
+		},
+	})
+}
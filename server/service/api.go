@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -30,6 +31,10 @@ func createAPImuxer(theDB *sql.DB, devmode bool) *http.ServeMux {
 	api := http.NewServeMux()
 	api.Handle("/api/v2/file",
 		wrapRequireAuth(&apiMethodFile{db: theDB}, theDB))
+	api.Handle("/api/v2/file/diff",
+		wrapRequireAuth(&apiMethodFileDiff{db: theDB}, theDB))
+	api.Handle("/api/v2/file/changes",
+		wrapRequireAuth(&apiMethodFileChanges{db: theDB}, theDB))
 	api.Handle("/api/v2/grep",
 		wrapRequireAuth(&apiMethodGrep{db: theDB}, theDB))
 	api.Handle("/api/v2/host",
@@ -52,6 +57,12 @@ func createAPImuxer(theDB *sql.DB, devmode bool) *http.ServeMux {
 		wrapRequireAuth(&apiMethodKeys{db: theDB}, theDB))
 	api.Handle("/api/v2/keys/",
 		wrapRequireAuth(&apiMethodKeys{db: theDB}, theDB))
+	api.Handle("/api/v2/savedsearches",
+		wrapRequireAuth(&apiMethodSavedSearches{db: theDB}, theDB))
+	api.Handle("/api/v2/savedsearches/",
+		wrapRequireAuth(&apiMethodSavedSearches{db: theDB}, theDB))
+	api.Handle("/api/v2/packages",
+		wrapRequireAuth(&apiMethodPackages{db: theDB}, theDB))
 
 	// API functions that are only available to administrators
 	api.Handle("/api/v2/manualApproval",
@@ -64,6 +75,20 @@ func createAPImuxer(theDB *sql.DB, devmode bool) *http.ServeMux {
 		wrapRequireAdmin(&apiMethodIpRanges{db: theDB}, theDB))
 	api.Handle("/api/v2/resetWaitingTimeForFailedTasks",
 		wrapRequireAdmin(&apiMethodResetWaitingTime{db: theDB}, theDB))
+	api.Handle("/api/v2/parsers",
+		wrapRequireAdmin(&apiMethodParsers{db: theDB}, theDB))
+	api.Handle("/api/v2/advisories",
+		wrapRequireAdmin(&apiMethodAdvisories{db: theDB}, theDB))
+	api.Handle("/api/v2/advisories/",
+		wrapRequireAdmin(&apiMethodAdvisories{db: theDB}, theDB))
+	api.Handle("/api/v2/jobs",
+		wrapRequireAdmin(&apiMethodJobs{db: theDB}, theDB))
+	api.Handle("/api/v2/tasks",
+		wrapRequireAdmin(&apiMethodTasks{db: theDB}, theDB))
+	api.Handle("/api/v2/tasks/",
+		wrapRequireAdmin(&apiMethodTasks{db: theDB}, theDB))
+	api.Handle("/api/v2/jobs/",
+		wrapRequireAdmin(&apiMethodJobs{db: theDB}, theDB))
 
 	// API functions that don't require authentication
 	api.Handle("/api/v2/status", &apiMethodStatus{db: theDB})
@@ -97,18 +122,33 @@ func createAPImuxer(theDB *sql.DB, devmode bool) *http.ServeMux {
 	return mux
 }
 
-func runAPI(theDB *sql.DB, address string, devmode bool) {
+// runAPI serves API requests until ctx is cancelled
+func runAPI(ctx context.Context, theDB *sql.DB, address string, devmode bool) {
 	var h http.Handler = createAPImuxer(theDB, devmode)
 	if devmode {
 		// In development mode, log every request to stdout, and
 		// add CORS headers to responses to local requests.
 		h = wrapLog(wrapAllowLocalhostCORS(h))
 	}
+	server := &http.Server{Addr: address, Handler: h}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		// Let requests that are in progress finish, but don't wait forever
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Shutting down the API server: %v", err)
+		}
+	}()
 	log.Printf("Serving API requests on %s.\n", address)
-	err := http.ListenAndServe(address, h)
-	if err != nil {
+	err := server.ListenAndServe()
+	if err != http.ErrServerClosed {
 		log.Fatal(err.Error())
 	}
+	<-stopped
+	log.Println("The API server has stopped.")
 }
 
 // returnJSON marshals the given object and writes it as the response,
@@ -311,6 +351,7 @@ func wrapCSRFprotection(h http.Handler) http.Handler {
 type jsonTime pq.NullTime
 type jsonString sql.NullString
 type jsonBool sql.NullBool
+type jsonInt sql.NullInt64
 
 func (jst jsonTime) MarshalJSON() ([]byte, error) {
 	if jst.Valid && !jst.Time.IsZero() {
@@ -333,6 +374,13 @@ func (b jsonBool) MarshalJSON() ([]byte, error) {
 	return []byte("null"), nil
 }
 
+func (n jsonInt) MarshalJSON() ([]byte, error) {
+	if n.Valid {
+		return json.Marshal(n.Int64)
+	}
+	return []byte("null"), nil
+}
+
 type httpError struct {
 	message string
 	code    int
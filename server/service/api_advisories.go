@@ -0,0 +1,125 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+//  GET    /api/v2/advisories        - list the imported advisories
+//  POST   /api/v2/advisories        - import advisories in OSV format (one, or a list) from the request body
+//  DELETE /api/v2/advisories/<id>   - remove an advisory
+
+type apiMethodAdvisories struct {
+	db *sql.DB
+}
+
+func (vars *apiMethodAdvisories) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case httpGET:
+		vars.list(w, req)
+	case httpPOST:
+		vars.upload(w, req)
+	case httpDELETE:
+		vars.delete(w, req)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (vars *apiMethodAdvisories) list(w http.ResponseWriter, req *http.Request) {
+	fields, hErr := unpackFieldParam(req.FormValue("fields"),
+		[]string{"advisoryID", "summary", "aliases", "modified", "imported", "hostCount"})
+	if hErr != nil {
+		http.Error(w, hErr.message, hErr.code)
+		return
+	}
+	rows, err := vars.db.Query("SELECT a.advisoryid, a.summary, a.aliases, a.modified, a.imported, " +
+		"(SELECT count(DISTINCT certfp) FROM host_vulnerabilities v WHERE v.advisoryid=a.advisoryid) " +
+		"FROM advisories a ORDER BY a.advisoryid")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	result := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		var id string
+		var summary, aliases sql.NullString
+		var modified, imported pq.NullTime
+		var hostCount int
+		err = rows.Scan(&id, &summary, &aliases, &modified, &imported, &hostCount)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		item := make(map[string]interface{})
+		if fields["advisoryID"] {
+			item["advisoryID"] = id
+		}
+		if fields["summary"] {
+			item["summary"] = jsonString(summary)
+		}
+		if fields["aliases"] {
+			item["aliases"] = strings.Fields(aliases.String)
+		}
+		if fields["modified"] {
+			item["modified"] = jsonTime(modified)
+		}
+		if fields["imported"] {
+			item["imported"] = jsonTime(imported)
+		}
+		if fields["hostCount"] {
+			item["hostCount"] = hostCount
+		}
+		result = append(result, item)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	returnJSON(w, req, result)
+}
+
+func (vars *apiMethodAdvisories) upload(w http.ResponseWriter, req *http.Request) {
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	advisories, err := parseAdvisories(data)
+	if err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	count, err := importAdvisories(vars.db, advisories)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if count > 0 {
+		triggerJob(matchVulnerabilitiesJob{})
+	}
+	returnJSON(w, req, map[string]int{"imported": count})
+}
+
+func (vars *apiMethodAdvisories) delete(w http.ResponseWriter, req *http.Request) {
+	i := strings.LastIndex(req.URL.Path, "/advisories/")
+	if i == -1 || len(req.URL.Path) <= i+12 {
+		http.Error(w, "Missing advisory ID in the URL path", http.StatusBadRequest)
+		return
+	}
+	res, err := vars.db.Exec("DELETE FROM advisories WHERE advisoryid=$1", req.URL.Path[i+12:])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
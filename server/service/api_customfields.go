@@ -4,15 +4,28 @@ import (
 	"database/sql"
 	"fmt"
 	"net/http"
+	"net/url"
+	"nivlheim/utility"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 //  GET  /api/v2/customfields            - list all
 //  POST /api/v2/customfields            - create a new
+//  POST /api/v2/customfields?dryRun=1   - try a new one on the current files, without saving it
+//
+// A field is either extracted from files (filename + regexp and/or jsonPath),
+// or computed from other fields of the host (expression, see fieldExpression.go).
 //  GET  /api/v2/customfields/<name>     - show details for one
 //  PUT  /api/v2/customfields/<name>     - update(replace) one
 //  DELETE  /api/v2/customfields/<name>  - delete one
+//
+// A field that computed fields refer to can't be renamed, deleted or made computed (409 Conflict).
+
+var customFieldAPIFields = []string{"name", "filename", "regexp", "type", "multiple", "jsonPath", "expression"}
 
 type apiMethodCustomFieldsCollection struct {
 	db *sql.DB
@@ -26,7 +39,7 @@ func (vars *apiMethodCustomFieldsCollection) ServeHTTP(w http.ResponseWriter, re
 	switch req.Method {
 	case httpGET:
 		// List all
-		fields, hErr := unpackFieldParam(req.FormValue("fields"), []string{"name", "filename", "regexp"})
+		fields, hErr := unpackFieldParam(req.FormValue("fields"), customFieldAPIFields)
 		if hErr != nil {
 			http.Error(w, hErr.message, hErr.code)
 			return
@@ -34,8 +47,11 @@ func (vars *apiMethodCustomFieldsCollection) ServeHTTP(w http.ResponseWriter, re
 		keys := make([]string, len(fields))
 		i := 0
 		for k := range fields {
-			if k == "filename" {
+			switch k {
+			case "filename":
 				k = "replace(filename,'%','*') as filename"
+			case "jsonPath":
+				k = "jsonpath as \"jsonPath\""
 			}
 			keys[i] = k
 			i++
@@ -61,16 +77,11 @@ func (vars *apiMethodCustomFieldsCollection) ServeHTTP(w http.ResponseWriter, re
 				http.StatusBadRequest)
 			return
 		}
+		// With dryRun, the field is tried on the current files instead of being saved
+		dryRun := isTrueish(formValue(req.Form, "dryRun"))
 		// Create a new item. Check parameters
-		requiredParams := []string{"name", "filename", "regexp"}
-		missingParams := make([]string, 0)
-		for _, paramName := range requiredParams {
-			if formValue(req.PostForm, paramName) == "" {
-				missingParams = append(missingParams, paramName)
-			}
-		}
-		if len(missingParams) > 0 {
-			http.Error(w, "Missing parameters: "+strings.Join(missingParams, ","), http.StatusBadRequest)
+		if !dryRun && formValue(req.PostForm, "name") == "" {
+			http.Error(w, "Missing parameters: name", http.StatusBadRequest)
 			return
 		}
 		// if the name contains special or uppercase characters, it isn't valid
@@ -79,16 +90,38 @@ func (vars *apiMethodCustomFieldsCollection) ServeHTTP(w http.ResponseWriter, re
 			http.Error(w, "The name contains invalid characters. Only a-z, 0-9, and _ is allowed, and no uppercase", http.StatusBadRequest)
 			return
 		}
+		field := &customField{
+			name:      name,
+			filename:  strings.Replace(formValue(req.PostForm, "filename"), "*", "%", -1),
+			regexp:    formValue(req.PostForm, "regexp"),
+			valueType: customFieldTypes[0],
+		}
+		if hErr := field.setFromForm(req.PostForm); hErr != nil {
+			http.Error(w, hErr.message, hErr.code)
+			return
+		}
+		if hErr := field.validateSource(vars.db, req.PostForm); hErr != nil {
+			http.Error(w, hErr.message, hErr.code)
+			return
+		}
+		if dryRun {
+			if field.expression != "" {
+				http.Error(w, "dryRun is only supported for fields that are extracted from files",
+					http.StatusBadRequest)
+				return
+			}
+			vars.serveDryRun(w, req, field)
+			return
+		}
 		// Everything checks out, insert
-		filename := strings.Replace(formValue(req.PostForm, "filename"), "*", "%", -1)
-		_, err = vars.db.Exec("INSERT INTO customfields(name, filename, regexp) VALUES($1,$2,$3)",
-			name, filename, formValue(req.PostForm, "regexp"))
+		_, err = vars.db.Exec("INSERT INTO customfields(name, filename, regexp, type, multiple, jsonpath, expression) "+
+			"VALUES($1,$2,$3,$4,$5,$6,$7)", name, nullIfEmpty(field.filename), nullIfEmpty(field.regexp),
+			field.valueType, field.multiple, nullIfEmpty(field.jsonPath), nullIfEmpty(field.expression))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		// Mark relevant files for re-parsing
-		vars.db.Exec("UPDATE files SET parsed=false WHERE current AND filename LIKE $1", filename)
+		field.refreshValues(vars.db)
 		// Return
 		w.Header().Set("Location", req.URL.RequestURI()+"/"+name)
 		http.Error(w, "", http.StatusCreated) // 201 Created
@@ -99,6 +132,68 @@ func (vars *apiMethodCustomFieldsCollection) ServeHTTP(w http.ResponseWriter, re
 	}
 }
 
+// serveDryRun returns how many of the current files the field would find a value in,
+// and a sample of the values, without saving the field.
+func (vars *apiMethodCustomFieldsCollection) serveDryRun(w http.ResponseWriter, req *http.Request, field *customField) {
+	limit := 20
+	if req.FormValue("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(req.FormValue("limit"))
+		if err != nil || limit < 0 {
+			http.Error(w, "Invalid value for parameter: limit", http.StatusBadRequest)
+			return
+		}
+	}
+	// The files are read from the search cache, since the database would be too slow
+	if !isReadyForSearch() {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Not ready yet, still loading data", http.StatusServiceUnavailable)
+		return
+	}
+	// The regular expression gets the same time limit as in a search
+	preview, err := previewCustomField(field, limit, time.Now().Add(regexTimeLimit()))
+	if err == errPreviewTimeLimit {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Grab hostnames from the database, they're not in memory
+	rows, err := vars.db.Query("SELECT certfp,COALESCE(hostname,host(ipaddr)) FROM hostinfo")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	certfp2hostname := make(map[string]string, 100)
+	for rows.Next() {
+		var certfp string
+		var hostname sql.NullString
+		if err = rows.Scan(&certfp, &hostname); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		certfp2hostname[certfp] = hostname.String
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range preview.Samples {
+		preview.Samples[i].Hostname = certfp2hostname[preview.Samples[i].certfp]
+	}
+	sort.Slice(preview.Samples, func(i, j int) bool {
+		a, b := preview.Samples[i], preview.Samples[j]
+		if a.Hostname != b.Hostname {
+			return a.Hostname < b.Hostname
+		}
+		return a.Filename < b.Filename
+	})
+	returnJSON(w, req, preview)
+}
+
 func (vars *apiMethodCustomFieldsItem) ServeHTTP(w http.ResponseWriter, req *http.Request, access *AccessProfile) {
 	switch req.Method {
 	case httpGET:
@@ -108,14 +203,16 @@ func (vars *apiMethodCustomFieldsItem) ServeHTTP(w http.ResponseWriter, req *htt
 			http.Error(w, "Missing field name in URL path", http.StatusUnprocessableEntity)
 			return
 		}
-		fields, hErr := unpackFieldParam(req.FormValue("fields"), []string{"name", "filename", "regexp"})
+		fields, hErr := unpackFieldParam(req.FormValue("fields"), customFieldAPIFields)
 		if hErr != nil {
 			http.Error(w, hErr.message, hErr.code)
 			return
 		}
-		var name, filename, re sql.NullString
-		err := vars.db.QueryRow("SELECT name, filename, regexp FROM customfields "+
-			"WHERE name=$1", match[1]).Scan(&name, &filename, &re)
+		var name, filename, re, valueType, jsonPath, expression sql.NullString
+		var multiple bool
+		err := vars.db.QueryRow("SELECT name, filename, regexp, type, multiple, jsonpath, expression "+
+			"FROM customfields WHERE name=$1", match[1]).
+			Scan(&name, &filename, &re, &valueType, &multiple, &jsonPath, &expression)
 		switch {
 		case err == sql.ErrNoRows:
 			http.Error(w, "Not Found", http.StatusNotFound)
@@ -137,6 +234,18 @@ func (vars *apiMethodCustomFieldsItem) ServeHTTP(w http.ResponseWriter, req *htt
 		if fields["regexp"] {
 			result["regexp"] = jsonString(re)
 		}
+		if fields["type"] {
+			result["type"] = jsonString(valueType)
+		}
+		if fields["multiple"] {
+			result["multiple"] = multiple
+		}
+		if fields["jsonPath"] {
+			result["jsonPath"] = jsonString(jsonPath)
+		}
+		if fields["expression"] {
+			result["expression"] = jsonString(expression)
+		}
 		returnJSON(w, req, result)
 
 	case httpDELETE:
@@ -151,6 +260,9 @@ func (vars *apiMethodCustomFieldsItem) ServeHTTP(w http.ResponseWriter, req *htt
 			http.Error(w, "Missing field name in URL path", http.StatusUnprocessableEntity)
 			return
 		}
+		if !checkFieldDependants(w, vars.db, match[1]) {
+			return
+		}
 		res, err := vars.db.Exec("DELETE FROM customfields WHERE name=$1", match[1])
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -187,29 +299,63 @@ func (vars *apiMethodCustomFieldsItem) ServeHTTP(w http.ResponseWriter, req *htt
 			return
 		}
 		name := match[1]
-		requiredParams := []string{"filename", "regexp"}
-		missingParams := make([]string, 0)
-		for _, paramName := range requiredParams {
-			if formValue(req.PostForm, paramName) == "" {
-				missingParams = append(missingParams, paramName)
-			}
+		// The type, multiple, jsonPath and expression parameters are optional, and keep their values if not given.
+		// A filename turns a computed field into one that is extracted from files.
+		var jsonPath, expression sql.NullString
+		field := &customField{}
+		err = vars.db.QueryRow("SELECT fieldid, type, multiple, jsonpath, expression FROM customfields "+
+			"WHERE name=$1", name).Scan(&field.fieldID, &field.valueType, &field.multiple, &jsonPath, &expression)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Not Found", http.StatusNotFound) // 404 Not Found
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		field.jsonPath, field.expression = jsonPath.String, expression.String
+		oldType, oldMultiple, wasComputed := field.valueType, field.multiple, field.expression != ""
+		field.filename = strings.Replace(formValue(req.PostForm, "filename"), "*", "%", -1)
+		field.regexp = formValue(req.PostForm, "regexp")
+		if field.filename != "" {
+			field.expression = ""
+		}
+		if hErr := field.setFromForm(req.PostForm); hErr != nil {
+			http.Error(w, hErr.message, hErr.code)
+			return
 		}
-		if len(missingParams) > 0 {
-			http.Error(w, "Missing parameters: "+strings.Join(missingParams, ","), http.StatusBadRequest)
+		if hErr := field.validateSource(vars.db, req.PostForm); hErr != nil {
+			http.Error(w, hErr.message, hErr.code)
 			return
 		}
 		newName := formValue(req.PostForm, "name")
 		if newName == "" {
 			newName = name
 		}
-		filename := strings.Replace(formValue(req.PostForm, "filename"), "*", "%", -1)
-		res, err := vars.db.Exec("UPDATE customfields SET name=$1, filename=$2, regexp=$3 "+
-			"WHERE name=$4", newName, filename, formValue(req.PostForm, "regexp"), name)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		// Computed fields can't depend on computed fields, and must be able to find the field by its name
+		if (newName != name || (!wasComputed && field.expression != "")) &&
+			!checkFieldDependants(w, vars.db, name) {
 			return
 		}
-		rowsAffected, err := res.RowsAffected()
+		var rowsAffected int64
+		err = utility.RunInTransaction(vars.db, func(tx *sql.Tx) error {
+			res, err := tx.Exec("UPDATE customfields SET name=$1, filename=$2, regexp=$3, "+
+				"type=$4, multiple=$5, jsonpath=$6, expression=$7 WHERE name=$8", newName,
+				nullIfEmpty(field.filename), nullIfEmpty(field.regexp), field.valueType, field.multiple,
+				nullIfEmpty(field.jsonPath), nullIfEmpty(field.expression), name)
+			if err != nil {
+				return err
+			}
+			if rowsAffected, err = res.RowsAffected(); err != nil || rowsAffected == 0 {
+				return err
+			}
+			// The old values may not be valid for the new type, and would make comparisons fail.
+			// Computed values would stay forever if the field is now extracted from files instead.
+			if field.valueType != oldType || field.multiple != oldMultiple || (wasComputed && field.expression == "") {
+				_, err = tx.Exec("DELETE FROM hostinfo_customfields WHERE fieldid=$1", field.fieldID)
+			}
+			return err
+		})
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -218,8 +364,7 @@ func (vars *apiMethodCustomFieldsItem) ServeHTTP(w http.ResponseWriter, req *htt
 			http.Error(w, "Not Found", http.StatusNotFound) // 404 Not Found
 			return
 		}
-		// Mark relevant files for re-parsing
-		vars.db.Exec("UPDATE files SET parsed=false WHERE current AND filename LIKE $1", filename)
+		field.refreshValues(vars.db)
 		http.Error(w, "OK", http.StatusNoContent) // 204 No Content
 
 	default:
@@ -227,3 +372,76 @@ func (vars *apiMethodCustomFieldsItem) ServeHTTP(w http.ResponseWriter, req *htt
 		return
 	}
 }
+
+// setFromForm sets the type, multiple, jsonPath and expression attributes from the form values that are present
+func (f *customField) setFromForm(form url.Values) *httpError {
+	for k := range form {
+		switch strings.ToLower(k) {
+		case "type":
+			f.valueType = strings.ToLower(formValue(form, "type"))
+			if !contains(f.valueType, customFieldTypes) {
+				return &httpError{
+					message: "Unsupported type. Supported types are: " + strings.Join(customFieldTypes, ","),
+					code:    http.StatusBadRequest,
+				}
+			}
+		case "multiple":
+			f.multiple = isTrueish(formValue(form, "multiple"))
+		case "jsonpath":
+			f.jsonPath = formValue(form, "jsonPath")
+			if _, err := parseJSONPath(f.jsonPath); err != nil {
+				return &httpError{message: err.Error(), code: http.StatusBadRequest}
+			}
+		case "expression":
+			f.expression = formValue(form, "expression")
+		}
+	}
+	return nil
+}
+
+// validateSource checks that the field either has an expression, or a filename and a way to find the value
+func (f *customField) validateSource(q queryer, form url.Values) *httpError {
+	if f.expression != "" {
+		for _, paramName := range []string{"filename", "regexp", "jsonPath"} {
+			if formValue(form, paramName) != "" {
+				return &httpError{
+					message: "A computed field can't have a " + paramName,
+					code:    http.StatusBadRequest,
+				}
+			}
+		}
+		f.filename, f.regexp, f.jsonPath = "", "", ""
+		if err := validateFieldExpression(q, f.expression); err != nil {
+			return &httpError{message: "Invalid expression: " + err.Error(), code: http.StatusBadRequest}
+		}
+		return nil
+	}
+	missingParams := make([]string, 0)
+	if f.filename == "" {
+		missingParams = append(missingParams, "filename")
+	}
+	if f.regexp == "" && f.jsonPath == "" {
+		// Without a JSON path, the regexp is the only way to find the value
+		missingParams = append(missingParams, "regexp")
+	}
+	if len(missingParams) > 0 {
+		return &httpError{
+			message: "Missing parameters: " + strings.Join(missingParams, ","),
+			code:    http.StatusBadRequest,
+		}
+	}
+	if _, err := f.compile(); err != nil {
+		return &httpError{message: "Invalid regexp: " + err.Error(), code: http.StatusBadRequest}
+	}
+	return nil
+}
+
+// refreshValues makes the values of a new or changed field appear for all hosts
+func (f *customField) refreshValues(db *sql.DB) {
+	if f.expression != "" {
+		triggerJob(computedFieldsJob{})
+		return
+	}
+	// Mark relevant files for re-parsing
+	db.Exec("UPDATE files SET parsed=false WHERE current AND filename LIKE $1", f.filename)
+}
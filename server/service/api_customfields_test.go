@@ -96,3 +96,59 @@ func TestApiMethodCustomFields(t *testing.T) {
 
 	testAPIcalls(t, mux, tests)
 }
+
+func TestCustomFieldDryRun(t *testing.T) {
+	if os.Getenv("NOPOSTGRES") != "" {
+		t.Log("No Postgres, skipping test")
+		return
+	}
+	db := getDBconnForTesting(t)
+	defer db.Close()
+
+	_, err := db.Exec("INSERT INTO hostinfo(certfp,hostname) VALUES('AA','one.example.com'),('BB','two.example.com')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeHostFromFastSearch("AA")
+	defer removeHostFromFastSearch("BB")
+	addFileToFastSearch(1, "AA", "/etc/hwinfo", "cores=8")
+	addFileToFastSearch(2, "BB", "/etc/hwinfo", "cores=lots")
+	fsReady = 1
+
+	api := createAPImuxer(db, false)
+	testAPIcalls(t, api, []apiCall{
+		{
+			methodAndPath: "POST /api/v2/settings/customfields?dryRun=1",
+			body:          "filename=/etc/hw*&regexp=cores%3D(.*)&type=int",
+			expectStatus:  http.StatusOK,
+			expectJSON: `{"files":2,"hits":1,"notFound":0,"invalid":1,"samples":[` +
+				`{"hostname":"one.example.com","filename":"/etc/hwinfo","value":"8"},` +
+				`{"hostname":"two.example.com","filename":"/etc/hwinfo","value":null,"error":"\"lots\" isn't an integer"}]}`,
+		},
+		{
+			methodAndPath: "POST /api/v2/settings/customfields?dryRun=1&limit=1",
+			body:          "filename=/etc/hwinfo&regexp=cores%3D(.*)",
+			expectStatus:  http.StatusOK,
+			expectJSON: `{"files":2,"hits":2,"notFound":0,"invalid":0,"samples":[` +
+				`{"hostname":"one.example.com","filename":"/etc/hwinfo","value":"8"}]}`,
+		},
+		// Compile errors are returned, both with and without dryRun
+		{
+			methodAndPath: "POST /api/v2/settings/customfields?dryRun=1",
+			body:          "filename=/etc/hwinfo&regexp=cores%3D(.*",
+			expectStatus:  http.StatusBadRequest,
+			expectContent: "Invalid regexp: error parsing regexp: missing closing ): `cores=(.*`",
+		},
+		{
+			methodAndPath: "POST /api/v2/settings/customfields",
+			body:          "name=cores&filename=/etc/hwinfo&regexp=cores%3D(.*",
+			expectStatus:  http.StatusBadRequest,
+		},
+		// Nothing was saved
+		{
+			methodAndPath: "GET /api/v2/settings/customfields?fields=name",
+			expectStatus:  http.StatusOK,
+			expectJSON:    "[]",
+		},
+	})
+}
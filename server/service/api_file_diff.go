@@ -0,0 +1,336 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+//  GET /api/v2/file/diff?fileId=<old>&fileId2=<new>
+//  GET /api/v2/file/diff?hostname=<hostname>&filename=<filename>[&from=<time>][&to=<time>]
+//      - the differences between two versions of a file, as a unified diff.
+//        Without "to", the newest version is used. Without "from", the version before "to".
+//  GET /api/v2/file/changes[?since=<time>|24h][&hostname=...][&filename=...][&limit=n]
+//      - a list of files that have changed recently, newest first.
+//        Files that have no earlier version are included too, with "added": true
+
+type apiMethodFileDiff struct {
+	db *sql.DB
+}
+
+type apiMethodFileChanges struct {
+	db *sql.DB
+}
+
+// fileVersion is a row in the files table
+type fileVersion struct {
+	fileID     int64
+	filename   string
+	certfp     string
+	hostname   sql.NullString
+	ownerGroup sql.NullString
+	received   pq.NullTime
+	content    string
+}
+
+// apiFileDiff is the JSON output from the diff API
+type apiFileDiff struct {
+	FileID       *int64     `json:"fileId"`
+	FileID2      int64      `json:"fileId2"`
+	Filename     string     `json:"filename"`
+	Hostname     jsonString `json:"hostname"`
+	LinesAdded   int        `json:"linesAdded"`
+	LinesRemoved int        `json:"linesRemoved"`
+	Diff         string     `json:"diff"`
+}
+
+// apiFileChange is an item in the list from the changes API
+type apiFileChange struct {
+	Hostname       jsonString `json:"hostname"`
+	Certfp         string     `json:"certfp"`
+	Filename       string     `json:"filename"`
+	FileID         int64      `json:"fileId"`
+	PreviousFileID *int64     `json:"previousFileId"`
+	Added          bool       `json:"added"`
+	Received       jsonTime   `json:"received"`
+	LinesAdded     int        `json:"linesAdded"`
+	LinesRemoved   int        `json:"linesRemoved"`
+}
+
+func loadFileVersion(db *sql.DB, fileID int64) (*fileVersion, error) {
+	var f fileVersion
+	var content sql.NullString
+	err := db.QueryRow("SELECT fileid,filename,certfp,h.ownergroup,COALESCE(h.hostname,host(h.ipaddr)),"+
+		"received,content FROM files f LEFT JOIN hostinfo h USING (certfp) WHERE fileid=$1", fileID).
+		Scan(&f.fileID, &f.filename, &f.certfp, &f.ownerGroup, &f.hostname, &f.received, &content)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.content = content.String
+	return &f, nil
+}
+
+// findFileVersion returns the ID of the version of a file that was current at the given time,
+// or the newest version if the time is zero. If before is true, the time itself isn't included.
+// Returns 0 if there's no such version.
+func findFileVersion(db *sql.DB, certfp, filename string, t time.Time, before bool) (int64, error) {
+	statement := "SELECT fileid FROM files WHERE certfp=$1 AND filename=$2"
+	args := []interface{}{certfp, filename}
+	if !t.IsZero() {
+		if before {
+			statement += " AND received < $3"
+		} else {
+			statement += " AND received <= $3"
+		}
+		args = append(args, t)
+	}
+	var fileID int64
+	err := db.QueryRow(statement+" ORDER BY received DESC, fileid DESC LIMIT 1", args...).Scan(&fileID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return fileID, err
+}
+
+func (vars *apiMethodFileDiff) ServeHTTP(w http.ResponseWriter, req *http.Request, access *AccessProfile) {
+	if req.Method != httpGET {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	context := 3
+	if s := req.FormValue("context"); s != "" {
+		var err error
+		context, err = strconv.Atoi(s)
+		if err != nil || context < 0 {
+			http.Error(w, "Invalid value for parameter: context", http.StatusBadRequest)
+			return
+		}
+	}
+	var asJSON bool
+	switch req.FormValue("format") {
+	case "", "text":
+	case "json":
+		asJSON = true
+	default:
+		http.Error(w, "Unsupported format: "+req.FormValue("format"), http.StatusBadRequest)
+		return
+	}
+
+	// Find the IDs of the two versions. The old one can be missing (0), which means an empty file.
+	var oldID, newID int64
+	var err error
+	if req.FormValue("fileId") != "" || req.FormValue("fileId2") != "" {
+		oldID, err = strconv.ParseInt(req.FormValue("fileId"), 10, 64)
+		if err != nil {
+			http.Error(w, "Unable to parse fileId", http.StatusBadRequest)
+			return
+		}
+		newID, err = strconv.ParseInt(req.FormValue("fileId2"), 10, 64)
+		if err != nil {
+			http.Error(w, "Unable to parse fileId2", http.StatusBadRequest)
+			return
+		}
+	} else if req.FormValue("filename") != "" && (req.FormValue("hostname") != "" || req.FormValue("certfp") != "") {
+		certfp := req.FormValue("certfp")
+		if certfp == "" {
+			err = vars.db.QueryRow("SELECT certfp FROM hostinfo WHERE hostname=$1",
+				req.FormValue("hostname")).Scan(&certfp)
+			if err == sql.ErrNoRows {
+				http.Error(w, "Host not found.", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		var from, to time.Time
+		for _, p := range []struct {
+			name  string
+			value *time.Time
+		}{{"from", &from}, {"to", &to}} {
+			if s := req.FormValue(p.name); s != "" {
+				var hErr *httpError
+				if *p.value, hErr = parseTimeParam(p.name, s); hErr != nil {
+					http.Error(w, hErr.message, hErr.code)
+					return
+				}
+			}
+		}
+		filename := req.FormValue("filename")
+		newID, err = findFileVersion(vars.db, certfp, filename, to, false)
+		if err == nil && newID > 0 {
+			if !from.IsZero() {
+				oldID, err = findFileVersion(vars.db, certfp, filename, from, false)
+			} else {
+				var newest *fileVersion
+				newest, err = loadFileVersion(vars.db, newID)
+				if err == nil && newest.received.Valid {
+					oldID, err = findFileVersion(vars.db, certfp, filename, newest.received.Time, true)
+				}
+			}
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		http.Error(w, "Missing parameters. Requires either fileId and fileId2, or filename + hostname/certfp",
+			http.StatusUnprocessableEntity)
+		return
+	}
+
+	newFile, err := loadFileVersion(vars.db, newID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	oldFile := &fileVersion{}
+	if oldID > 0 {
+		oldFile, err = loadFileVersion(vars.db, oldID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if newFile == nil || oldFile == nil {
+		http.Error(w, "File not found.", http.StatusNotFound)
+		return
+	}
+	if !access.HasAccessToGroup(newFile.ownerGroup.String) ||
+		(oldID > 0 && !access.HasAccessToGroup(oldFile.ownerGroup.String)) {
+		http.Error(w, "You don't have access to that resource.", http.StatusForbidden)
+		return
+	}
+
+	a, b := contentLines(oldFile.content), contentLines(newFile.content)
+	edits := diffLines(a, b)
+	diff := unifiedDiff(edits, a, b, versionLabel(oldFile), versionLabel(newFile), context)
+	if !asJSON {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(diff))
+		return
+	}
+	result := apiFileDiff{
+		FileID2:  newFile.fileID,
+		Filename: newFile.filename,
+		Hostname: jsonString(newFile.hostname),
+		Diff:     diff,
+	}
+	if oldID > 0 {
+		result.FileID = &oldFile.fileID
+	}
+	result.LinesAdded, result.LinesRemoved = diffStats(edits)
+	returnJSON(w, req, result)
+}
+
+// versionLabel is used in the header lines of the diff
+func versionLabel(f *fileVersion) string {
+	if f.fileID == 0 {
+		return "/dev/null"
+	}
+	if !f.received.Valid {
+		return f.filename
+	}
+	return f.filename + "\t" + f.received.Time.Format(time.RFC3339)
+}
+
+var reRelativeTime = regexp.MustCompile(`^(\d+)([smhd])$`)
+
+func (vars *apiMethodFileChanges) ServeHTTP(w http.ResponseWriter, req *http.Request, access *AccessProfile) {
+	if req.Method != httpGET {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// "since" is a timestamp, or a time span like 30m, 12h or 7d. The default is 24 hours.
+	since := time.Now().Add(-24 * time.Hour)
+	if s := req.FormValue("since"); s != "" {
+		if m := reRelativeTime.FindStringSubmatch(s); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			unit := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour, "d": 24 * time.Hour}[m[2]]
+			since = time.Now().Add(-time.Duration(n) * unit)
+		} else {
+			var hErr *httpError
+			if since, hErr = parseTimeParam("since", s); hErr != nil {
+				http.Error(w, hErr.message, hErr.code)
+				return
+			}
+		}
+	}
+	limit := 100
+	if s := req.FormValue("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 {
+			http.Error(w, "Invalid value for parameter: limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// A file has changed if there's an older version with a different checksum,
+	// and it has been added if there's no older version
+	statement := "SELECT f.fileid, f.filename, f.certfp, f.received, f.content, p.fileid, p.content, " +
+		"COALESCE(h.hostname,host(h.ipaddr)) FROM files f JOIN hostinfo h ON h.certfp=f.certfp " +
+		"LEFT JOIN LATERAL (SELECT fileid, content, crc32 FROM files p WHERE p.certfp=f.certfp " +
+		"AND p.filename=f.filename AND p.received < f.received ORDER BY p.received DESC LIMIT 1) p ON true " +
+		"WHERE f.received > $1 AND (p.fileid IS NULL OR f.crc32 IS DISTINCT FROM p.crc32)"
+	args := []interface{}{since}
+	if s := req.FormValue("hostname"); s != "" {
+		args = append(args, s)
+		statement += fmt.Sprintf(" AND h.hostname=$%d", len(args))
+	}
+	if s := req.FormValue("filename"); s != "" {
+		args = append(args, s)
+		statement += fmt.Sprintf(" AND f.filename=$%d", len(args))
+	}
+	if !access.HasAccessToAllGroups() {
+		statement += " AND h.ownergroup IN (" + access.GetGroupListForSQLWHERE() + ")"
+	}
+	if config.HideUnknownHosts {
+		statement += " AND h.hostname IS NOT NULL"
+	}
+	args = append(args, limit)
+	statement += fmt.Sprintf(" ORDER BY f.received DESC, f.fileid DESC LIMIT $%d", len(args))
+	rows, err := vars.db.Query(statement, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	result := make([]apiFileChange, 0)
+	for rows.Next() {
+		var c apiFileChange
+		var received pq.NullTime
+		var content, oldContent, hostname sql.NullString
+		var previousFileID sql.NullInt64
+		err = rows.Scan(&c.FileID, &c.Filename, &c.Certfp, &received, &content,
+			&previousFileID, &oldContent, &hostname)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if previousFileID.Valid {
+			c.PreviousFileID = &previousFileID.Int64
+		} else {
+			c.Added = true
+		}
+		c.Hostname = jsonString(hostname)
+		c.Received = jsonTime(received)
+		c.LinesAdded, c.LinesRemoved = diffStats(diffLines(contentLines(oldContent.String),
+			contentLines(content.String)))
+		result = append(result, c)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	returnJSON(w, req, result)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestApiMethodFileDiff(t *testing.T) {
+	if os.Getenv("NOPOSTGRES") != "" {
+		t.Log("No Postgres, skipping test")
+		return
+	}
+	db := getDBconnForTesting(t)
+	defer db.Close()
+
+	_, err := db.Exec("INSERT INTO hostinfo(certfp,hostname) VALUES('AA','one.example.com'),('BB','two.example.com')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Three versions of a file on one host, and a file that was added recently on another
+	_, err = db.Exec("INSERT INTO files(fileid,certfp,filename,content,crc32,received,current) VALUES " +
+		"(1,'AA','/etc/hosts','127.0.0.1 localhost\n10.0.0.1 gw\n',1,'2020-01-01T10:00:00Z',false)," +
+		"(2,'AA','/etc/hosts','127.0.0.1 localhost\n10.0.0.2 gw\n10.0.0.3 ns\n',2,'2020-01-02T10:00:00Z',false)," +
+		"(3,'AA','/etc/hosts','127.0.0.1 localhost\n10.0.0.3 ns\n',3,now()-interval '1 hour',true)," +
+		"(4,'BB','/etc/hosts','127.0.0.1 localhost\n',4,now()-interval '1 hour',true)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := createAPImuxer(db, false)
+	testAPIcalls(t, api, []apiCall{
+		{
+			methodAndPath: "GET /api/v2/file/diff?fileId=1&fileId2=2",
+			expectStatus:  http.StatusOK,
+			expectContent: "@@ -1,2 +1,3 @@\n 127.0.0.1 localhost\n-10.0.0.1 gw\n+10.0.0.2 gw\n+10.0.0.3 ns\n",
+		},
+		// Without from/to, the newest version is compared to the one before
+		{
+			methodAndPath: "GET /api/v2/file/diff?hostname=one.example.com&filename=/etc/hosts&context=0",
+			expectStatus:  http.StatusOK,
+			expectContent: "--- /etc/hosts\t2020-01-02T",
+		},
+		{
+			methodAndPath: "GET /api/v2/file/diff?hostname=one.example.com&filename=/etc/hosts&context=0",
+			expectStatus:  http.StatusOK,
+			expectContent: "\n@@ -2 +1,0 @@\n-10.0.0.2 gw\n",
+		},
+		{
+			methodAndPath: "GET /api/v2/file/diff?hostname=one.example.com&filename=/etc/hosts&format=json",
+			expectStatus:  http.StatusOK,
+			expectContent: `"fileId": 2,
+  "fileId2": 3,
+  "filename": "/etc/hosts",
+  "hostname": "one.example.com",
+  "linesAdded": 0,
+  "linesRemoved": 1,`,
+		},
+		{
+			methodAndPath: "GET /api/v2/file/diff?certfp=AA&filename=/etc/hosts&from=2020-01-01&to=2020-01-02&format=json",
+			expectStatus:  http.StatusOK,
+			expectContent: `"fileId": 2`,
+		},
+		// The first version is compared to an empty file
+		{
+			methodAndPath: "GET /api/v2/file/diff?hostname=one.example.com&filename=/etc/hosts&to=2020-01-01T12:00:00Z",
+			expectStatus:  http.StatusOK,
+			expectContent: "--- /dev/null\n",
+		},
+		{
+			methodAndPath: "GET /api/v2/file/diff?fileId=1&fileId2=99",
+			expectStatus:  http.StatusNotFound,
+		},
+		{
+			methodAndPath: "GET /api/v2/file/diff?hostname=nosuchhost&filename=/etc/hosts",
+			expectStatus:  http.StatusNotFound,
+		},
+		{
+			methodAndPath: "GET /api/v2/file/diff?filename=/etc/hosts",
+			expectStatus:  http.StatusUnprocessableEntity,
+		},
+		// Only the newest version has changed within the last day
+		{
+			methodAndPath: "GET /api/v2/file/changes",
+			expectStatus:  http.StatusOK,
+			expectContent: `"fileId": 3,
+    "previousFileId": 2,
+    "added": false,`,
+		},
+		// A file without an earlier version has been added
+		{
+			methodAndPath: "GET /api/v2/file/changes?hostname=two.example.com",
+			expectStatus:  http.StatusOK,
+			expectContent: `"fileId": 4,
+    "previousFileId": null,
+    "added": true,`,
+		},
+		{
+			methodAndPath: "GET /api/v2/file/changes?since=2020-01-01T12:00:00Z&hostname=one.example.com",
+			expectStatus:  http.StatusOK,
+			expectContent: `"added": false`,
+		},
+		{
+			methodAndPath: "GET /api/v2/file/changes?since=2019-12-31&hostname=one.example.com&limit=5",
+			expectStatus:  http.StatusOK,
+			expectContent: `"previousFileId": 1`,
+		},
+		{
+			methodAndPath: "GET /api/v2/file/changes?since=10m",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/file/changes?since=yesterday",
+			expectStatus:  http.StatusBadRequest,
+		},
+	})
+}
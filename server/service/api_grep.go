@@ -8,23 +8,52 @@ import (
 	"math"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
 type apiMethodGrep struct {
 	db *sql.DB
 }
 
+// apiGrepLine is a matching line in the JSON output from the grep API
+type apiGrepLine struct {
+	Hostname   string         `json:"hostname"`
+	Filename   string         `json:"filename"`
+	LineNumber int            `json:"lineNumber"`
+	Line       string         `json:"line"`
+	Context    apiGrepContext `json:"context"`
+}
+
+// apiGrepContext holds the lines before and after a matching line
+type apiGrepContext struct {
+	Before []string `json:"before"`
+	After  []string `json:"after"`
+}
+
+// apiGrepFile is used in the JSON output when the filesOnly or countOnly
+// parameters are given. Count is the number of matching lines.
+type apiGrepFile struct {
+	Hostname string `json:"hostname"`
+	Filename string `json:"filename"`
+	Count    int    `json:"count,omitempty"`
+}
+
 func (vars *apiMethodGrep) ServeHTTP(w http.ResponseWriter, req *http.Request, access *AccessProfile) {
 	if req.Method != httpGET {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	query := req.FormValue("q")
+	query, opts := searchStringFromRequest(req, "q", "re")
 	if query == "" {
 		http.Error(w, "Missing or empty parameter: q", http.StatusUnprocessableEntity)
 		return
 	}
+	sq, hErr := newSearchQuery(query, opts)
+	if hErr != nil {
+		http.Error(w, hErr.message, hErr.code)
+		return
+	}
 
 	var limit int
 	limit, err := strconv.Atoi(req.FormValue("limit"))
@@ -32,6 +61,34 @@ func (vars *apiMethodGrep) ServeHTTP(w http.ResponseWriter, req *http.Request, a
 		limit = math.MaxInt64
 	}
 
+	// Parameters that work like the grep options -B, -A, -c and -l
+	var before, after int
+	for _, p := range []struct {
+		name  string
+		value *int
+	}{{"before", &before}, {"after", &after}} {
+		if req.FormValue(p.name) == "" {
+			continue
+		}
+		*p.value, err = strconv.Atoi(req.FormValue(p.name))
+		if err != nil || *p.value < 0 {
+			http.Error(w, "Invalid value for parameter: "+p.name, http.StatusBadRequest)
+			return
+		}
+	}
+	countOnly := isTrueish(req.FormValue("countOnly"))
+	filesOnly := isTrueish(req.FormValue("filesOnly"))
+
+	var asJSON bool
+	switch req.FormValue("format") {
+	case "", "text":
+	case "json":
+		asJSON = true
+	default:
+		http.Error(w, "Unsupported format: "+req.FormValue("format"), http.StatusBadRequest)
+		return
+	}
+
 	if !isReadyForSearch() {
 		w.Header().Set("Retry-After", "60")
 		http.Error(w, "Not ready yet, still loading data", http.StatusServiceUnavailable)
@@ -41,7 +98,7 @@ func (vars *apiMethodGrep) ServeHTTP(w http.ResponseWriter, req *http.Request, a
 	filename := req.FormValue("filename")
 	var hitIDs []int64
 	if access.HasAccessToAllGroups() {
-		hitIDs, _ = searchFiles(query, filename)
+		hitIDs, _, hErr = searchFiles(sq, filename)
 	} else {
 		// Compute a list of which certificates the user has access to,
 		// based on current hosts in hostinfo owned by one of the groups the user has access to.
@@ -61,10 +118,12 @@ func (vars *apiMethodGrep) ServeHTTP(w http.ResponseWriter, req *http.Request, a
 			}
 		}
 		// Finally, we can perform the search
-		hitIDs, _ = searchFilesWithFilter(query, filename, validCerts)
+		hitIDs, _, hErr = searchFilesWithFilter(sq, filename, validCerts)
+	}
+	if hErr != nil {
+		http.Error(w, hErr.message, hErr.code)
+		return
 	}
-
-	w.Header().Set("Content-Type", "text/plain")
 
 	// Grab hostnames from the database, they're not in memory
 	var stmt string
@@ -101,13 +160,17 @@ func (vars *apiMethodGrep) ServeHTTP(w http.ResponseWriter, req *http.Request, a
 	}
 	defer pstmt.Close()
 
+	if !asJSON {
+		w.Header().Set("Content-Type", "text/plain")
+	}
 	bw := bufio.NewWriter(w)
-	lineCount := 0
+	records := make([]interface{}, 0)
+	count := 0         // number of lines (or files) in the output so far
+	hasOutput := false // used to decide where to put separators between context groups
 outer:
 	for _, fileID := range hitIDs {
-		matches := findMatchesInFile(fileID, query, math.MaxInt64)
+		matches := findMatchesInFile(fileID, sq, math.MaxInt64)
 		certfp, filename := getCertAndFilenameFromFileID(fileID)
-		previousStart := -1
 
 		// Possibly filter out hosts with undetermined hostnames
 		if config.HideUnknownHosts {
@@ -115,6 +178,7 @@ outer:
 				continue
 			}
 		}
+		hostname := certfp2hostname[certfp]
 
 		// Retrieve the file content from the database
 		var nstr sql.NullString
@@ -126,27 +190,117 @@ outer:
 		if err == sql.ErrNoRows || !nstr.Valid {
 			continue
 		}
-		content := nstr.String
+		lines := splitLines(nstr.String)
+		lineNumbers := matchingLines(lines, matches)
+		if len(lineNumbers) == 0 {
+			continue
+		}
 
-		for _, index := range matches {
-			// Find the start and end of the line where the match occurred
-			start := index
-			for ; start > 0 && content[start-1] != '\n'; start-- {
+		switch {
+		case filesOnly || countOnly:
+			record := apiGrepFile{Hostname: hostname, Filename: filename}
+			if countOnly {
+				record.Count = len(lineNumbers)
 			}
-			if start == previousStart {
-				continue
+			if asJSON {
+				records = append(records, record)
+			} else if countOnly {
+				fmt.Fprintf(bw, "%s:%s:%d\n", hostname, filename, record.Count)
+			} else {
+				fmt.Fprintf(bw, "%s:%s\n", hostname, filename)
 			}
-			previousStart = start
-			end := index
-			for ; end < len(content) && content[end] != '\n'; end++ {
-			}
-			// Write the whole line to the output
-			fmt.Fprintf(bw, "%s:%s:%s\n", certfp2hostname[certfp], filename, content[start:end])
-			lineCount++
-			if lineCount >= limit {
+			count++
+			if count >= limit {
 				break outer
 			}
+
+		case asJSON:
+			for _, n := range lineNumbers {
+				records = append(records, apiGrepLine{
+					Hostname:   hostname,
+					Filename:   filename,
+					LineNumber: n + 1,
+					Line:       lines[n],
+					Context: apiGrepContext{
+						Before: lines[Max(n-before, 0):n],
+						After:  lines[n+1 : Min(n+1+after, len(lines))],
+					},
+				})
+				count++
+				if count >= limit {
+					break outer
+				}
+			}
+
+		default:
+			// Like grep, matching lines are written as hostname:filename:line
+			// and context lines as hostname:filename-line. Groups of lines that
+			// aren't adjacent are separated by "--".
+			written := -1    // lines up to and including this one have been written
+			contextEnd := -1 // the last line of context after the previous match
+			writeContext := func(from, to int) {
+				for i := from; i <= to; i++ {
+					fmt.Fprintf(bw, "%s:%s-%s\n", hostname, filename, lines[i])
+				}
+				written = Max(written, to)
+			}
+			for _, n := range lineNumbers {
+				writeContext(written+1, Min(contextEnd, n-1))
+				from := Max(n-before, written+1)
+				if (before > 0 || after > 0) && hasOutput && (written < 0 || from > written+1) {
+					bw.WriteString("--\n")
+				}
+				writeContext(from, n-1)
+				fmt.Fprintf(bw, "%s:%s:%s\n", hostname, filename, lines[n])
+				written = n
+				contextEnd = Min(n+after, len(lines)-1)
+				hasOutput = true
+				count++
+				if count >= limit {
+					writeContext(written+1, contextEnd)
+					break outer
+				}
+			}
+			writeContext(written+1, contextEnd)
 		}
 	}
+	if asJSON {
+		returnJSON(w, req, records)
+		return
+	}
 	bw.Flush()
 }
+
+// splitLines splits the content into lines, without the line breaks.
+// A line break at the end of the content doesn't start another line.
+func splitLines(content string) []string {
+	lines := strings.Split(content, "\n")
+	if len(lines) > 1 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// matchingLines returns the line numbers (counting from 0) of the lines
+// where the matches start. The matches must be sorted by position,
+// as returned from findMatchesInFile. Each line is only listed once.
+func matchingLines(lines []string, matches [][]int) []int {
+	result := make([]int, 0, len(matches))
+	line := 0
+	lineEnd := len(lines[0]) // the position of the line break
+	for _, match := range matches {
+		for match[0] > lineEnd && line < len(lines)-1 {
+			line++
+			lineEnd += 1 + len(lines[line])
+		}
+		if match[0] > lineEnd {
+			// The position is beyond the end of the content. This can happen
+			// if the content has changed since it was cached.
+			break
+		}
+		if len(result) == 0 || result[len(result)-1] != line {
+			result = append(result, line)
+		}
+	}
+	return result
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMatchingLines(t *testing.T) {
+	const content = "first line\nsecond line\n\nfourth line\n"
+	lines := splitLines(content)
+	if !reflect.DeepEqual(lines, []string{"first line", "second line", "", "fourth line"}) {
+		t.Fatalf("splitLines returned %q", lines)
+	}
+	q, _ := newSearchQuery("line", searchOptions{})
+	result := matchingLines(lines, q.findAll(content, 100))
+	if !reflect.DeepEqual(result, []int{0, 1, 3}) {
+		t.Errorf("matchingLines returned %v", result)
+	}
+	// A match at the line break belongs to the line before it
+	result = matchingLines(lines, [][]int{{10, 11}, {22, 23}})
+	if !reflect.DeepEqual(result, []int{0, 1}) {
+		t.Errorf("matchingLines returned %v", result)
+	}
+	// Positions beyond the end of the content are ignored
+	result = matchingLines(lines, [][]int{{0, 1}, {100, 101}})
+	if !reflect.DeepEqual(result, []int{0}) {
+		t.Errorf("matchingLines returned %v", result)
+	}
+}
+
+func TestGrepOptions(t *testing.T) {
+	if os.Getenv("NOPOSTGRES") != "" {
+		t.Log("No Postgres, skipping test")
+		return
+	}
+
+	db := getDBconnForTesting(t)
+	defer db.Close()
+
+	// Prepare some data for the tests
+	const fileID int64 = 1
+	const certfp = "ABFF"
+	const filename = "/etc/hosts"
+	const content = "127.0.0.1 localhost\n# comment\n::1 localhost\n\n" +
+		"10.0.0.1 gateway\n10.0.0.2 printer\n10.0.0.3 localhost\n"
+	const hostname = "acme.example.com"
+	_, err := db.Exec("INSERT INTO files(fileid,filename,certfp,content) "+
+		"VALUES($1,$2,$3,$4)", fileID, filename, certfp, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO hostinfo(certfp,hostname) VALUES($1,$2)",
+		certfp, hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addFileToFastSearch(fileID, certfp, filename, content)
+	defer removeFileFromFastSearch(fileID)
+	fsReady = 1
+
+	const prefix = hostname + ":" + filename
+	api := createAPImuxer(db, false)
+	tests := []apiCall{
+		{
+			methodAndPath: "GET /api/v2/grep?q=localhost&before=1&after=1",
+			expectStatus:  http.StatusOK,
+			expectContent: prefix + ":127.0.0.1 localhost\n" +
+				prefix + "-# comment\n" +
+				prefix + ":::1 localhost\n" +
+				prefix + "-\n" +
+				"--\n" +
+				prefix + "-10.0.0.2 printer\n" +
+				prefix + ":10.0.0.3 localhost\n",
+		},
+		{
+			methodAndPath: "GET /api/v2/grep?q=localhost&countOnly=true",
+			expectStatus:  http.StatusOK,
+			expectContent: prefix + ":3\n",
+		},
+		{
+			methodAndPath: "GET /api/v2/grep?q=localhost&filesOnly=true",
+			expectStatus:  http.StatusOK,
+			expectContent: prefix + "\n",
+		},
+		{
+			methodAndPath: "GET /api/v2/grep?q=gateway&before=1&after=2&format=json",
+			expectStatus:  http.StatusOK,
+			expectJSON: `[{"hostname":"` + hostname + `","filename":"` + filename + `",` +
+				`"lineNumber":5,"line":"10.0.0.1 gateway","context":` +
+				`{"before":[""],"after":["10.0.0.2 printer","10.0.0.3 localhost"]}}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/grep?q=localhost&countOnly=true&format=json",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"hostname":"` + hostname + `","filename":"` + filename + `","count":3}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/grep?q=localhost&limit=1&format=json",
+			expectStatus:  http.StatusOK,
+			expectJSON: `[{"hostname":"` + hostname + `","filename":"` + filename + `",` +
+				`"lineNumber":1,"line":"127.0.0.1 localhost","context":{"before":[],"after":[]}}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/grep?q=localhost&before=-1",
+			expectStatus:  http.StatusBadRequest,
+		},
+		{
+			methodAndPath: "GET /api/v2/grep?q=localhost&format=xml",
+			expectStatus:  http.StatusBadRequest,
+		},
+	}
+	testAPIcalls(t, api, tests)
+}
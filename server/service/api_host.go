@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"nivlheim/utility"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
@@ -68,7 +69,8 @@ func (vars *apiMethodHost) serveGET(w http.ResponseWriter, req *http.Request, ac
 	// Make a complete list of allowed field names (standard + custom)
 	allowedFields := []string{"ipAddress", "hostname", "lastseen", "os", "osEdition",
 		"osFamily", "kernel", "manufacturer", "product", "serialNo", "certfp",
-		"clientVersion", "files", "support", "overrideHostname", "ownerGroup"}
+		"clientVersion", "files", "support", "overrideHostname", "ownerGroup", "vulnerabilities",
+		"cpuModel", "cpuSockets", "cpuCores", "memoryMB", "disks", "interfaces", "ipAddresses"}
 	allowedFields = append(allowedFields, customFields...)
 
 	// The "fields" parameter says which fields I am supposed to return
@@ -80,17 +82,19 @@ func (vars *apiMethodHost) serveGET(w http.ResponseWriter, req *http.Request, ac
 
 	// Make a sql statement.
 	statement := "SELECT ipaddr, COALESCE(hostname,host(ipaddr)) as hostname, lastseen, os, os_edition, " +
-		"os_family, kernel, manufacturer, product, serialno, clientversion, override_hostname " +
+		"os_family, kernel, manufacturer, product, serialno, clientversion, override_hostname, " +
+		"cpu_model, cpu_sockets, cpu_cores, memory_mb " +
 		"FROM hostinfo WHERE certfp=$1"
 
 	// Query the database for one row from the hostinfo table
 	var ipaddr, hostname, os, osEdition, osFamily, kernel, manufacturer,
-		product, serialNo, clientversion, overrideHostname sql.NullString
+		product, serialNo, clientversion, overrideHostname, cpuModel sql.NullString
+	var cpuSockets, cpuCores, memoryMB sql.NullInt64
 	var lastseen pq.NullTime
 	err = vars.db.QueryRow(statement, certfp).
 		Scan(&ipaddr, &hostname, &lastseen, &os, &osEdition, &osFamily,
 			&kernel, &manufacturer, &product, &serialNo, &clientversion,
-			&overrideHostname)
+			&overrideHostname, &cpuModel, &cpuSockets, &cpuCores, &memoryMB)
 	if err == sql.ErrNoRows {
 		// No host found. Return a "not found" status
 		http.Error(w, "Host not found.", http.StatusNotFound)
@@ -137,6 +141,18 @@ func (vars *apiMethodHost) serveGET(w http.ResponseWriter, req *http.Request, ac
 	if fields["certfp"] {
 		res["certfp"] = certfp
 	}
+	if fields["cpuModel"] {
+		res["cpuModel"] = jsonString(cpuModel)
+	}
+	if fields["cpuSockets"] {
+		res["cpuSockets"] = jsonInt(cpuSockets)
+	}
+	if fields["cpuCores"] {
+		res["cpuCores"] = jsonInt(cpuCores)
+	}
+	if fields["memoryMB"] {
+		res["memoryMB"] = jsonInt(memoryMB)
+	}
 	if fields["clientVersion"] {
 		res["clientVersion"] = jsonString(clientversion)
 	}
@@ -162,7 +178,44 @@ func (vars *apiMethodHost) serveGET(w http.ResponseWriter, req *http.Request, ac
 		}
 		res["support"] = support
 	}
+	if fields["vulnerabilities"] {
+		vulnerabilities, err := makeVulnerabilityList(vars.db, certfp)
+		if err != nil {
+			http.Error(w, err.message, err.code)
+			return
+		}
+		res["vulnerabilities"] = vulnerabilities
+	}
+	if fields["disks"] {
+		disks, err := makeDiskList(vars.db, certfp)
+		if err != nil {
+			http.Error(w, err.message, err.code)
+			return
+		}
+		res["disks"] = disks
+	}
+	if fields["interfaces"] {
+		interfaces, err := makeInterfaceList(vars.db, certfp)
+		if err != nil {
+			http.Error(w, err.message, err.code)
+			return
+		}
+		res["interfaces"] = interfaces
+	}
+	if fields["ipAddresses"] {
+		addresses, err := makeAddressList(vars.db, certfp)
+		if err != nil {
+			http.Error(w, err.message, err.code)
+			return
+		}
+		res["ipAddresses"] = addresses
+	}
 	// add the custom fields to the result
+	customFieldMap, err := getCustomFieldMap(vars.db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	for _, name := range customFields {
 		if fields[name] {
 			var value sql.NullString
@@ -177,7 +230,7 @@ func (vars *apiMethodHost) serveGET(w http.ResponseWriter, req *http.Request, ac
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			res[name] = jsonString(value)
+			res[name] = customFieldJSON(customFieldMap[name], value)
 		}
 	}
 	returnJSON(w, req, res)
@@ -255,6 +308,134 @@ func makeSupportList(db *sql.DB, serialNo string) ([]apiSupport, *httpError) {
 	return supportList, nil
 }
 
+type apiVulnerability struct {
+	AdvisoryID string     `json:"advisoryID"`
+	Summary    jsonString `json:"summary"`
+	Aliases    []string   `json:"aliases"`
+	Package    string     `json:"package"`
+	Version    string     `json:"version"`
+	Found      jsonTime   `json:"found"`
+}
+
+func makeVulnerabilityList(db *sql.DB, certfp string) ([]apiVulnerability, *httpError) {
+	rows, err := db.Query("SELECT v.advisoryid, a.summary, a.aliases, v.package, v.version, v.found "+
+		"FROM host_vulnerabilities v JOIN advisories a ON a.advisoryid = v.advisoryid "+
+		"WHERE v.certfp=$1 ORDER BY v.package, v.advisoryid", certfp)
+	if err != nil {
+		return nil, &httpError{code: http.StatusInternalServerError, message: err.Error()}
+	}
+	defer rows.Close()
+	list := make([]apiVulnerability, 0)
+	for rows.Next() {
+		var v apiVulnerability
+		var summary, aliases sql.NullString
+		var found pq.NullTime
+		err = rows.Scan(&v.AdvisoryID, &summary, &aliases, &v.Package, &v.Version, &found)
+		if err != nil {
+			return nil, &httpError{code: http.StatusInternalServerError, message: err.Error()}
+		}
+		v.Summary = jsonString(summary)
+		v.Aliases = strings.Fields(aliases.String)
+		v.Found = jsonTime(found)
+		list = append(list, v)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, &httpError{code: http.StatusInternalServerError, message: err.Error()}
+	}
+	return list, nil
+}
+
+type apiDisk struct {
+	Name  string     `json:"name"`
+	Model jsonString `json:"model"`
+	Size  jsonInt    `json:"size"`
+}
+
+func makeDiskList(db *sql.DB, certfp string) ([]apiDisk, *httpError) {
+	rows, err := db.Query("SELECT name, model, size FROM host_disks WHERE certfp=$1 ORDER BY name", certfp)
+	if err != nil {
+		return nil, &httpError{code: http.StatusInternalServerError, message: err.Error()}
+	}
+	defer rows.Close()
+	list := make([]apiDisk, 0)
+	for rows.Next() {
+		var d apiDisk
+		var model sql.NullString
+		var size sql.NullInt64
+		if err = rows.Scan(&d.Name, &model, &size); err != nil {
+			return nil, &httpError{code: http.StatusInternalServerError, message: err.Error()}
+		}
+		d.Model = jsonString(model)
+		d.Size = jsonInt(size)
+		list = append(list, d)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, &httpError{code: http.StatusInternalServerError, message: err.Error()}
+	}
+	return list, nil
+}
+
+type apiInterface struct {
+	Name  string     `json:"name"`
+	MAC   jsonString `json:"mac"`
+	MTU   jsonInt    `json:"mtu"`
+	State jsonString `json:"state"`
+}
+
+func makeInterfaceList(db *sql.DB, certfp string) ([]apiInterface, *httpError) {
+	rows, err := db.Query("SELECT name, mac, mtu, state FROM host_interfaces "+
+		"WHERE certfp=$1 ORDER BY name", certfp)
+	if err != nil {
+		return nil, &httpError{code: http.StatusInternalServerError, message: err.Error()}
+	}
+	defer rows.Close()
+	list := make([]apiInterface, 0)
+	for rows.Next() {
+		var n apiInterface
+		var mac, state sql.NullString
+		var mtu sql.NullInt64
+		if err = rows.Scan(&n.Name, &mac, &mtu, &state); err != nil {
+			return nil, &httpError{code: http.StatusInternalServerError, message: err.Error()}
+		}
+		n.MAC = jsonString(mac)
+		n.MTU = jsonInt(mtu)
+		n.State = jsonString(state)
+		list = append(list, n)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, &httpError{code: http.StatusInternalServerError, message: err.Error()}
+	}
+	return list, nil
+}
+
+type apiAddress struct {
+	IPAddress string     `json:"ipAddress"`
+	Interface jsonString `json:"interface"`
+}
+
+func makeAddressList(db *sql.DB, certfp string) ([]apiAddress, *httpError) {
+	rows, err := db.Query("SELECT host(ipaddr), ifname FROM host_addresses "+
+		"WHERE certfp=$1 ORDER BY ipaddr", certfp)
+	if err != nil {
+		return nil, &httpError{code: http.StatusInternalServerError, message: err.Error()}
+	}
+	defer rows.Close()
+	list := make([]apiAddress, 0)
+	for rows.Next() {
+		var a apiAddress
+		var ifname sql.NullString
+		if err = rows.Scan(&a.IPAddress, &ifname); err != nil {
+			return nil, &httpError{code: http.StatusInternalServerError, message: err.Error()}
+		}
+		a.Interface = jsonString(ifname)
+		list = append(list, a)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, &httpError{code: http.StatusInternalServerError, message: err.Error()}
+	}
+	return list, nil
+}
+
 func (vars *apiMethodHost) serveDELETE(w http.ResponseWriter, req *http.Request, access *AccessProfile) {
 	// Get the certificate fingerprint (possibly based on a hostname) from the URL path
 	certfp, err := getHostFromURLPath(req.URL.Path, vars.db)
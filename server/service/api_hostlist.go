@@ -6,12 +6,16 @@ import (
 	"fmt"
 	"hash/fnv"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 type apiMethodHostList struct {
@@ -23,12 +27,13 @@ type apiHostListStandardField struct {
 	publicName string
 	columnName string
 	expression string
+	valueType  string // like the type of a custom field, decides how the values are sorted
 }
 
 var apiHostListStandardFields = []apiHostListStandardField{
 	{publicName: "ipAddress", columnName: "ipaddr", expression: "host(ipaddr)"},
 	{publicName: "hostname", columnName: "hostname", expression: "COALESCE(hostname,host(ipaddr))"},
-	{publicName: "lastseen", columnName: "lastseen"},
+	{publicName: "lastseen", columnName: "lastseen", valueType: "date"},
 	{publicName: "os", columnName: "os"},
 	{publicName: "osEdition", columnName: "os_edition"},
 	{publicName: "osFamily", columnName: "os_family"},
@@ -36,9 +41,23 @@ var apiHostListStandardFields = []apiHostListStandardField{
 	{publicName: "manufacturer", columnName: "manufacturer"},
 	{publicName: "product", columnName: "product"},
 	{publicName: "serialNo", columnName: "serialno"},
+	{publicName: "cpuModel", columnName: "cpu_model"},
+	{publicName: "cpuSockets", columnName: "cpu_sockets", valueType: "int"},
+	{publicName: "cpuCores", columnName: "cpu_cores", valueType: "int"},
+	{publicName: "memoryMB", columnName: "memory_mb", valueType: "int"},
+	{publicName: "diskCount", columnName: "diskcount", valueType: "int",
+		expression: "(SELECT count(*) FROM host_disks d WHERE d.certfp=h.certfp)"},
+	{publicName: "diskSizeGB", columnName: "disksizegb", valueType: "int",
+		expression: "(SELECT round(sum(size)/1e9) FROM host_disks d WHERE d.certfp=h.certfp)"},
+	{publicName: "interfaceCount", columnName: "interfacecount", valueType: "int",
+		expression: "(SELECT count(*) FROM host_interfaces n WHERE n.certfp=h.certfp)"},
+	{publicName: "ipAddresses", columnName: "ipaddresses",
+		expression: "(SELECT string_agg(host(a.ipaddr), ' ' ORDER BY a.ipaddr) FROM host_addresses a WHERE a.certfp=h.certfp)"},
 	{publicName: "certfp", columnName: "certfp"},
 	{publicName: "clientVersion", columnName: "clientversion"},
 	{publicName: "ownerGroup", columnName: "ownergroup"},
+	{publicName: "vulnCount", columnName: "vulncount", valueType: "int",
+		expression: "(SELECT count(DISTINCT advisoryid) FROM host_vulnerabilities v WHERE v.certfp=h.certfp)"},
 }
 
 func (vars *apiMethodHostList) ServeHTTP(w http.ResponseWriter, req *http.Request, access *AccessProfile) {
@@ -59,6 +78,12 @@ func (vars *apiMethodHostList) ServeGET(w http.ResponseWriter, req *http.Request
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	// The type of each custom field decides how it is compared
+	customFieldMap, err := getCustomFieldMap(vars.db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	// Make a complete list of allowed field names (standard + custom)
 	allowedFields := make([]string, len(apiHostListStandardFields))
@@ -74,6 +99,17 @@ func (vars *apiMethodHostList) ServeGET(w http.ResponseWriter, req *http.Request
 		return
 	}
 
+	// The list can be restricted to hosts with certain file content,
+	// using the same parameters as the multi-stage search API
+	searchResult, hErr := hostsMatchingContentSearch(vars.db, req, allowedFields, customFieldIDs)
+	if hErr == errNotReadyForSearch {
+		w.Header().Set("Retry-After", "60")
+	}
+	if hErr != nil {
+		http.Error(w, hErr.message, hErr.code)
+		return
+	}
+
 	// Reduce the customfields array and map
 	// down to the actual fields used in the query
 	for i := 0; i < len(customFields); {
@@ -95,32 +131,25 @@ func (vars *apiMethodHostList) ServeGET(w http.ResponseWriter, req *http.Request
 
 	// Call a function that assembles the "WHERE" clause with associated
 	// parameter values based on the query
-	where, qparams, hErr := buildSQLWhere(req.URL.RawQuery, allowedFields)
+	where, qparams, hErr := buildSQLWhere(req.URL.RawQuery, allowedFields, customFieldMap)
 	if hErr != nil {
 		http.Error(w, hErr.message, hErr.code)
 		return
 	}
-
-	// Build the "SELECT ... " part of the statement, including custom fields
-	// Start with the standard fields:
-	temp := make([]string, 0, len(apiHostListStandardFields))
-	for _, f := range apiHostListStandardFields {
-		if f.expression != "" {
-			temp = append(temp, f.expression+" AS "+f.columnName)
-		} else {
-			temp = append(temp, f.columnName)
+	if searchResult != nil {
+		certs := make([]string, 0, len(searchResult))
+		for certfp := range searchResult {
+			certs = append(certs, certfp)
+		}
+		qparams = append(qparams, pq.Array(certs))
+		if len(where) > 0 {
+			where += " AND "
 		}
+		where += fmt.Sprintf("certfp = ANY($%d)", len(qparams))
 	}
-	statement := "SELECT " + strings.Join(temp, ",")
 
-	// Then, append the custom fields
-	for _, name := range customFields {
-		statement = statement +
-			", (SELECT value FROM hostinfo_customfields hc " +
-			"WHERE hc.certfp=h.certfp AND hc.fieldid=" +
-			strconv.Itoa(customFieldIDs[name]) + ") as " + name
-	}
-	statement += " FROM hostinfo h"
+	// Build the "SELECT ... " part of the statement, including custom fields
+	statement := hostFieldsStatement(customFields, customFieldIDs, req.URL.RawQuery)
 
 	// Possibly filter out hosts with undetermined hostnames
 	if config.HideUnknownHosts {
@@ -137,7 +166,8 @@ func (vars *apiMethodHostList) ServeGET(w http.ResponseWriter, req *http.Request
 	}
 
 	// Add an ORDER BY clause
-	var sortBy, desc string
+	var sortBy, orderBy, desc string
+	var sortField, sortType string // the public name and the type of the sort field
 	if sortBy = req.FormValue("sort"); sortBy != "" {
 		if sortBy[0] == '-' {
 			sortBy = sortBy[1:]
@@ -148,21 +178,31 @@ func (vars *apiMethodHostList) ServeGET(w http.ResponseWriter, req *http.Request
 			// order is ASC by default
 		}
 		ok := false
+		sortField = sortBy
 		for _, f := range apiHostListStandardFields {
 			if sortBy == f.publicName {
-				sortBy = f.columnName
+				sortBy, sortType = f.columnName, f.valueType
 				ok = true
 				break
 			}
 		}
 		if !ok {
 			_, ok = customFieldIDs[sortBy]
+			if f := customFieldMap[sortBy]; f != nil {
+				sortType = f.valueType
+			}
 		}
 		if !ok {
 			http.Error(w, "Unsupported sort field", http.StatusUnprocessableEntity)
 			return
 		}
-		statement += fmt.Sprintf(" ORDER BY %s %s", sortBy, desc)
+		// Typed custom fields are sorted by their type, e.g. numerically
+		orderBy = sortBy
+		if f := customFieldMap[sortBy]; !f.isMultiple() {
+			colFormat, _ := f.comparisonFormats()
+			orderBy = fmt.Sprintf(colFormat, sortBy)
+		}
+		statement += fmt.Sprintf(" ORDER BY %s %s", orderBy, desc)
 	} else {
 		// Default to sorting by hostname, ascending
 		statement += fmt.Sprintf(" ORDER BY hostname")
@@ -244,7 +284,7 @@ func (vars *apiMethodHostList) ServeGET(w http.ResponseWriter, req *http.Request
 		}
 		for _, f := range customFields {
 			if fields[f] {
-				res[f] = jsonString(scanvars[i])
+				res[f] = customFieldJSON(customFieldMap[f], scanvars[i])
 			}
 			i++
 		}
@@ -317,11 +357,13 @@ func (vars *apiMethodHostList) ServeGET(w http.ResponseWriter, req *http.Request
 			}
 		}
 		// Step 4: Optionally sort the result
-		if sortBy != "" { // The sort parameter was parsed earlier
-			sort.Slice(result2, func(i, j int) bool {
-				a, _ := result2[i][sortBy].(jsonString)
-				b, _ := result2[j][sortBy].(jsonString)
-				return (a.String < b.String) != (desc == "DESC")
+		if sortField != "" { // The sort parameter was parsed earlier
+			sort.SliceStable(result2, func(i, j int) bool {
+				c := compareHostListValues(sortType, result2[i][sortField], result2[j][sortField])
+				if desc == "DESC" {
+					return c > 0
+				}
+				return c < 0
 			})
 		}
 		result = result2
@@ -330,12 +372,114 @@ func (vars *apiMethodHostList) ServeGET(w http.ResponseWriter, req *http.Request
 	returnJSON(w, req, result)
 }
 
+// compareHostListValues compares two values of a field in the host list, in the same order
+// as ORDER BY does in the statement: numbers numerically, version numbers like version_sortkey,
+// and other values as text. Null values come last. Lists are compared element by element.
+func compareHostListValues(valueType string, a interface{}, b interface{}) int {
+	if listA, ok := a.([]string); ok {
+		listB, _ := b.([]string)
+		for i := 0; i < len(listA) && i < len(listB); i++ {
+			if c := compareTypedValues(valueType, listA[i], listB[i]); c != 0 {
+				return c
+			}
+		}
+		return len(listA) - len(listB)
+	}
+	x, _ := a.(jsonString)
+	y, _ := b.(jsonString)
+	if !x.Valid || !y.Valid {
+		if x.Valid == y.Valid {
+			return 0
+		} else if x.Valid {
+			return -1
+		}
+		return 1
+	}
+	return compareTypedValues(valueType, x.String, y.String)
+}
+
+// compareTypedValues compares two values of the given type, as strings if they can't be parsed
+func compareTypedValues(valueType string, a string, b string) int {
+	switch valueType {
+	case "int", "float":
+		x, errA := strconv.ParseFloat(a, 64)
+		y, errB := strconv.ParseFloat(b, 64)
+		if errA == nil && errB == nil {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	case "bool":
+		if x, y := isTrueish(a), isTrueish(b); x != y {
+			if y {
+				return -1
+			}
+			return 1
+		}
+		return 0
+	case "date":
+		x, errA := parseSortableTime(a)
+		y, errB := parseSortableTime(b)
+		if errA == nil && errB == nil {
+			return x.Compare(y)
+		}
+	case "version":
+		return strings.Compare(versionSortKey(a), versionSortKey(b))
+	}
+	return strings.Compare(a, b)
+}
+
+// parseSortableTime parses a date value of a custom field, or a timestamp from Postgres
+func parseSortableTime(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999Z07:00",
+		"2006-01-02 15:04:05.999999999Z07", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("\"%s\" isn't a date", s)
+}
+
+// hostFieldsStatement returns a statement that selects the standard host fields,
+// followed by the given custom fields, from the hostinfo table (alias h).
+// Fields that are expressions get the column name as an alias.
+// Fields that are subqueries are slow when there are many hosts, so they are only computed
+// if their name appears in the query (as a field, a filter or in sort), and are null otherwise.
+func hostFieldsStatement(customFields []string, customFieldIDs map[string]int, query string) string {
+	query = strings.ToLower(query)
+	// Start with the standard fields:
+	temp := make([]string, 0, len(apiHostListStandardFields)+len(customFields))
+	for _, f := range apiHostListStandardFields {
+		if strings.HasPrefix(f.expression, "(SELECT") && !strings.Contains(query, strings.ToLower(f.publicName)) {
+			temp = append(temp, "NULL AS "+f.columnName)
+		} else if f.expression != "" {
+			temp = append(temp, f.expression+" AS "+f.columnName)
+		} else {
+			temp = append(temp, f.columnName)
+		}
+	}
+	// Then, append the custom fields
+	for _, name := range customFields {
+		temp = append(temp, "(SELECT value FROM hostinfo_customfields hc "+
+			"WHERE hc.certfp=h.certfp AND hc.fieldid="+
+			strconv.Itoa(customFieldIDs[name])+") as "+name)
+	}
+	return "SELECT " + strings.Join(temp, ",") + " FROM hostinfo h"
+}
+
 // Build the WHERE part of the SQL statement based on parameters.
 // - Supports "*" as a wildcard
 // - If a value starts with "!" it means not equal to or not like
 // - If a value starts with "<" or ">" it affects the comparison
 // - Can match one of several values if they are comma-separated
-func buildSQLWhere(queryString string, allowedFields []string) (string, []interface{}, *httpError) {
+// - anyIpAddress matches both the address the host connected from and the addresses on its interfaces
+// - Custom fields with a type are compared as that type, and multi-valued fields match if any value does
+func buildSQLWhere(queryString string, allowedFields []string,
+	customFields map[string]*customField) (string, []interface{}, *httpError) {
 	// This slice will hold multiple clauses that will be ANDed together after
 	where := make([]string, 0)
 	// This slice will hold parameter values for the query
@@ -353,7 +497,8 @@ func buildSQLWhere(queryString string, allowedFields []string) (string, []interf
 
 		name, _ := url.QueryUnescape(m[1])
 		if name == "fields" || name == "sort" ||
-			name == "limit" || name == "offset" || name == "count" {
+			name == "limit" || name == "offset" || name == "count" ||
+			contentSearchParameters.MatchString(name) {
 			continue
 		}
 
@@ -372,6 +517,21 @@ func buildSQLWhere(queryString string, allowedFields []string) (string, []interf
 			}
 		}
 
+		if name == "anyIpAddress" {
+			if operator != "=" {
+				return "", nil, &httpError{
+					message: "anyIpAddress only supports the operator '='",
+					code:    http.StatusBadRequest,
+				}
+			}
+			clause, hErr := anyIPAddressClause(m[3], &qparams)
+			if hErr != nil {
+				return "", nil, hErr
+			}
+			where = append(where, clause)
+			continue
+		}
+
 		if allowedFields != nil && !contains(name, allowedFields) {
 			return "", nil, &httpError{
 				message: "Unsupported field name: " + name,
@@ -387,6 +547,11 @@ func buildSQLWhere(queryString string, allowedFields []string) (string, []interf
 			}
 		}
 
+		// Typed and multi-valued custom fields
+		field := customFields[name]
+		column := field.comparisonColumn(colname)
+		colFormat, paramFormat := field.comparisonFormats()
+
 		// Wildcards?
 		value := m[3]
 		if strings.Index(value, "*") > -1 {
@@ -406,12 +571,12 @@ func buildSQLWhere(queryString string, allowedFields []string) (string, []interf
 			if strings.HasSuffix(value, "*") {
 				joined += "||'%'"
 			}
-			if operator == "!=" {
+			if operator == "!=" && !field.isMultiple() {
 				where = append(where, fmt.Sprintf("%s NOT LIKE %s",
 					colname, joined))
-			} else if operator == "=" {
-				where = append(where, fmt.Sprintf("%s LIKE %s",
-					colname, joined))
+			} else if operator == "=" || operator == "!=" {
+				where = append(where, field.wrapClause(fmt.Sprintf("%s LIKE %s",
+					column, joined), colname, operator == "!="))
 			} else {
 				return "", nil, &httpError{
 					message: "Can't use operator '" + operator + "' with wildcards ('*')",
@@ -457,16 +622,32 @@ func buildSQLWhere(queryString string, allowedFields []string) (string, []interf
 					q := make([]string, 0)
 					for _, s := range strings.Split(value, ",") {
 						s, _ = url.QueryUnescape(s)
+						if field != nil {
+							var hErr *httpError
+							if s, hErr = field.validateParam(s); hErr != nil {
+								return "", nil, hErr
+							}
+						}
 						qparams = append(qparams, s)
-						q = append(q, fmt.Sprintf("$%d", len(qparams)))
+						q = append(q, fmt.Sprintf(paramFormat, len(qparams)))
 					}
-					where = append(where, fmt.Sprintf("%s IN (%s)", colname,
-						strings.Join(q, ",")))
+					where = append(where, field.wrapClause(fmt.Sprintf(colFormat+" IN (%s)", column,
+						strings.Join(q, ",")), colname, false))
 				} else {
 					value, _ = url.QueryUnescape(value)
+					if field != nil {
+						var hErr *httpError
+						if value, hErr = field.validateParam(value); hErr != nil {
+							return "", nil, hErr
+						}
+					}
 					qparams = append(qparams, value)
-					where = append(where, fmt.Sprintf("%s %s $%d", colname,
-						operator, len(qparams)))
+					op := operator
+					if op == "!=" && field.isMultiple() {
+						op = "="
+					}
+					where = append(where, field.wrapClause(fmt.Sprintf(colFormat+" %s "+paramFormat, column,
+						op, len(qparams)), colname, operator == "!="))
 				}
 			}
 		}
@@ -474,3 +655,36 @@ func buildSQLWhere(queryString string, allowedFields []string) (string, []interf
 	sql := strings.Join(where, " AND ")
 	return sql, qparams, nil
 }
+
+// anyIPAddressClause returns a condition for the anyIpAddress parameter.
+// Each of the comma-separated values can be an address, a network in CIDR notation,
+// or contain "*" wildcards. The clause operates on the columns of hostFieldsStatement.
+func anyIPAddressClause(value string, qparams *[]interface{}) (string, *httpError) {
+	clauses := make([]string, 0)
+	for _, v := range strings.Split(value, ",") {
+		v, _ = url.QueryUnescape(v)
+		var cond string
+		switch {
+		case strings.Contains(v, "*"):
+			*qparams = append(*qparams, strings.ReplaceAll(v, "*", "%"))
+			cond = "ipaddr LIKE $%[1]d OR certfp IN " +
+				"(SELECT a.certfp FROM host_addresses a WHERE host(a.ipaddr) LIKE $%[1]d)"
+		case strings.Contains(v, "/"):
+			if _, _, err := net.ParseCIDR(v); err != nil {
+				return "", &httpError{message: "Invalid network: " + v, code: http.StatusBadRequest}
+			}
+			*qparams = append(*qparams, v)
+			cond = "ipaddr::inet <<= $%[1]d::inet OR certfp IN " +
+				"(SELECT a.certfp FROM host_addresses a WHERE a.ipaddr <<= $%[1]d::inet)"
+		default:
+			if net.ParseIP(v) == nil {
+				return "", &httpError{message: "Invalid ip address: " + v, code: http.StatusBadRequest}
+			}
+			*qparams = append(*qparams, v)
+			cond = "ipaddr::inet = $%[1]d::inet OR certfp IN " +
+				"(SELECT a.certfp FROM host_addresses a WHERE a.ipaddr = $%[1]d::inet)"
+		}
+		clauses = append(clauses, fmt.Sprintf(cond, len(*qparams)))
+	}
+	return "(" + strings.Join(clauses, " OR ") + ")", nil
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -89,6 +90,27 @@ func TestBuildSQLWhere(t *testing.T) {
 			sql:    "os = $1",
 			params: []interface{}{"foo,bar,baz"},
 		},
+		whereTest{
+			// Content search parameters are handled elsewhere
+			query:  "q1=nameserver&f1=/etc/resolv.conf&op2=sub&re2=x%2B&query=foo&caseSensitive=1&os=Fedora",
+			sql:    "os = $1",
+			params: []interface{}{"Fedora"},
+		},
+		whereTest{
+			query: "anyIpAddress=10.1.*,192.168.0.0/16&os=Fedora",
+			sql: "(ipaddr LIKE $1 OR certfp IN (SELECT a.certfp FROM host_addresses a WHERE host(a.ipaddr) LIKE $1) OR " +
+				"ipaddr::inet <<= $2::inet OR certfp IN (SELECT a.certfp FROM host_addresses a WHERE a.ipaddr <<= $2::inet)) " +
+				"AND os = $3",
+			params: []interface{}{"10.1.%", "192.168.0.0/16", "Fedora"},
+		},
+		whereTest{
+			query:  "anyIpAddress=10.1.2.300",
+			errmsg: "Invalid ip address: 10.1.2.300",
+		},
+		whereTest{
+			query:  "anyIpAddress!=10.1.2.3",
+			errmsg: "anyIpAddress only supports the operator '='",
+		},
 	}
 
 	allowedFields := make([]string, len(apiHostListStandardFields))
@@ -97,7 +119,7 @@ func TestBuildSQLWhere(t *testing.T) {
 	}
 
 	for _, w := range tests {
-		result, params, err := buildSQLWhere(w.query, allowedFields)
+		result, params, err := buildSQLWhere(w.query, allowedFields, nil)
 		if err != nil && err.message != w.errmsg {
 			if w.errmsg != "" {
 				t.Errorf("Wrong error message.\n     Got: %s\n"+
@@ -122,6 +144,74 @@ func TestBuildSQLWhere(t *testing.T) {
 	}
 }
 
+func TestCompareHostListValues(t *testing.T) {
+	str := func(s string) jsonString { return jsonString{String: s, Valid: true} }
+	null := jsonString{}
+	tests := []struct {
+		valueType string
+		a, b      interface{}
+		expect    int
+	}{
+		{"", str("abc"), str("abd"), -1},
+		{"", str("10"), str("9"), -1},
+		{"int", str("10"), str("9"), 1},
+		{"int", str("-1"), str("0"), -1},
+		{"float", str("1.5"), str("1.50"), 0},
+		{"int", null, str("1"), 1},
+		{"int", str("1"), null, -1},
+		{"", null, null, 0},
+		{"bool", str("false"), str("true"), -1},
+		{"date", str("2024-01-02"), str("2023-12-31T23:00:00Z"), 1},
+		{"date", str("2024-01-02 10:00:00+01"), str("2024-01-02 09:30:00Z"), -1},
+		{"version", str("1.10"), str("1.9"), 1},
+		{"version", str("5.14.0-1"), str("5.14.0"), 1},
+		{"int", []string{"2", "10"}, []string{"2", "9"}, 1},
+		{"int", []string{"2"}, []string{"2", "9"}, -1},
+	}
+	for _, test := range tests {
+		c := compareHostListValues(test.valueType, test.a, test.b)
+		if (c < 0 && test.expect >= 0) || (c > 0 && test.expect <= 0) || (c == 0 && test.expect != 0) {
+			t.Errorf("Comparing %v and %v as %q: got %d, expected %d", test.a, test.b, test.valueType, c, test.expect)
+		}
+	}
+}
+
+func TestHostFieldsStatement(t *testing.T) {
+	tests := []struct {
+		query   string
+		include []string
+		exclude []string
+	}{
+		{
+			query:   "fields=hostname,os&os=RHEL+9",
+			exclude: []string{"host_disks", "host_interfaces", "host_addresses", "host_vulnerabilities"},
+		},
+		{
+			query:   "fields=hostname,diskcount",
+			include: []string{"FROM host_disks d WHERE d.certfp=h.certfp) AS diskcount"},
+			exclude: []string{"host_interfaces", "host_addresses", "host_vulnerabilities"},
+		},
+		{
+			query:   "fields=hostname&vulnCount>0&sort=-interfaceCount",
+			include: []string{"host_vulnerabilities", "host_interfaces"},
+			exclude: []string{"host_disks", "host_addresses"},
+		},
+	}
+	for _, test := range tests {
+		statement := hostFieldsStatement(nil, nil, test.query)
+		for _, s := range test.include {
+			if !strings.Contains(statement, s) {
+				t.Errorf("The statement for %s should contain %q:\n%s", test.query, s, statement)
+			}
+		}
+		for _, s := range test.exclude {
+			if strings.Contains(statement, s) {
+				t.Errorf("The statement for %s shouldn't contain %q:\n%s", test.query, s, statement)
+			}
+		}
+	}
+}
+
 func TestApiMethodHostList(t *testing.T) {
 	if os.Getenv("NOPOSTGRES") != "" {
 		t.Log("No Postgres, skipping test")
@@ -318,3 +408,72 @@ func TestHideUnknownHosts(t *testing.T) {
 	config.HideUnknownHosts = false
 	testAPIcalls(t, mux, testsWhenOptionOff)
 }
+
+func TestHostListWithContentSearch(t *testing.T) {
+	if os.Getenv("NOPOSTGRES") != "" {
+		t.Log("No Postgres, skipping test")
+		return
+	}
+
+	db := getDBconnForTesting(t)
+	defer db.Close()
+
+	// Prepare some data for the tests
+	const filename = "/etc/resolv.conf"
+	hosts := []struct {
+		certfp, hostname, os, ownergroup, resolvconf string
+	}{
+		{"AA", "one.example.com", "RHEL 8", "x", "nameserver 10.0.0.1"},
+		{"BB", "two.example.com", "RHEL 8", "y", "nameserver 10.0.0.1"},
+		{"CC", "three.example.com", "RHEL 9", "x", "nameserver 10.0.0.1"},
+		{"DD", "four.example.com", "RHEL 8", "x", "nameserver 10.0.0.2"},
+	}
+	for i, h := range hosts {
+		_, err := db.Exec("INSERT INTO hostinfo(certfp,hostname,os,ownergroup) VALUES($1,$2,$3,$4)",
+			h.certfp, h.hostname, h.os, h.ownergroup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileID := int64(i + 1)
+		_, err = db.Exec("INSERT INTO files(fileid,filename,certfp,content) VALUES($1,$2,$3,$4)",
+			fileID, filename, h.certfp, h.resolvconf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addFileToFastSearch(fileID, h.certfp, filename, h.resolvconf)
+		defer removeFileFromFastSearch(fileID)
+	}
+	fsReady = 1
+
+	tests := []apiCall{
+		{
+			methodAndPath: "GET /api/v2/hostlist?fields=hostname&os=RHEL+8&ownerGroup=x" +
+				"&q1=nameserver+10.0.0.1&f1=" + filename,
+			expectStatus: http.StatusOK,
+			expectJSON:   `[{"hostname":"one.example.com"}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/hostlist?fields=hostname&os=RHEL*" +
+				"&query=file:" + filename + "+%2210.0.0.1%22",
+			expectStatus: http.StatusOK,
+			expectJSON: `[{"hostname":"one.example.com"},{"hostname":"three.example.com"},` +
+				`{"hostname":"two.example.com"}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/hostlist?fields=os&count=1&q1=10.0.0.1",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"os":"RHEL 8","count":2},{"os":"RHEL 9","count":1}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/hostlist?fields=hostname&q1=nothing+like+this",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/hostlist?fields=hostname&query=(",
+			expectStatus:  http.StatusBadRequest,
+		},
+	}
+	api := createAPImuxer(db, false)
+	testAPIcalls(t, api, tests)
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"fmt"
 	"net/http"
-	"reflect"
 	"regexp"
 )
 
@@ -23,14 +22,11 @@ func runJob(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, "Missing job name in URL path", http.StatusUnprocessableEntity)
 		return
 	}
-	for i, jobitem := range jobs {
-		t := reflect.TypeOf(jobitem.job)
-		if t.Name() == match[1] {
-			// this will make main run the job
-			jobs[i].trigger = true
-			http.Error(w, "OK", http.StatusNoContent)
-			return
-		}
+	if elem := findJob(match[1]); elem != nil {
+		// this will make main run the job
+		elem.triggerNow()
+		http.Error(w, "OK", http.StatusNoContent)
+		return
 	}
 	http.Error(w, "Job not found.", http.StatusNotFound)
 }
@@ -45,6 +41,8 @@ func doNothing(w http.ResponseWriter, req *http.Request) {
 
 // When a machine gets a new certificate to replace the old one,
 // the search cache must be updated.
+// The database also sends a notification about this (see fastSearchNotify.go),
+// so this is only kept for older scripts that still call it.
 func replaceCertificate(w http.ResponseWriter, req *http.Request) {
 	if !isLocal(req) {
 		http.Error(w, "Only local requests are allowed", http.StatusForbidden)
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+//  GET  /api/v2/jobs                 - list the jobs, when they will run next, and recent failures.
+//                                      Only local jobs run on a server instance that isn't the leader.
+//  GET  /api/v2/jobs/<name>          - one job, with the history of runs (?limit=n, default 20)
+//  POST /api/v2/jobs/<name>/trigger  - run the job as soon as possible. If the job only runs on the leader,
+//                                      and this instance isn't the leader, the leader runs it within a few seconds.
+//  PUT  /api/v2/jobs/<name>          - pause or resume the job, with paused=true/false
+
+type apiMethodJobs struct {
+	db *sql.DB
+}
+
+type apiJobRun struct {
+	Started jsonTime   `json:"started"`
+	Seconds float32    `json:"seconds"`
+	Error   jsonString `json:"error"`
+}
+
+type apiJob struct {
+	Name            string      `json:"name"`
+	Interval        float64     `json:"interval"` // seconds
+	Enabled         bool        `json:"enabled"`
+	Paused          bool        `json:"paused"`
+	Running         bool        `json:"running"`
+	Local           bool        `json:"local"` // runs on every server instance, not just the leader
+	LastRun         jsonTime    `json:"lastRun"`
+	LastDuration    float32     `json:"lastDuration"` // seconds
+	NextRun         jsonTime    `json:"nextRun"`
+	LastError       jsonString  `json:"lastError"`
+	FailuresLastDay int         `json:"failuresLastDay"`
+	RecentFailures  []apiJobRun `json:"recentFailures"`
+	History         []apiJobRun `json:"history,omitempty"`
+}
+
+func (vars *apiMethodJobs) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/v2/jobs"), "/"), "/")
+	if path[0] == "" {
+		if req.Method != httpGET {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		vars.list(w, req)
+		return
+	}
+	elem := findJob(path[0])
+	if elem == nil {
+		http.Error(w, "Job not found.", http.StatusNotFound)
+		return
+	}
+	switch {
+	case len(path) == 1 && req.Method == httpGET:
+		vars.get(w, req, elem)
+	case len(path) == 1 && req.Method == httpPUT:
+		vars.update(w, req, elem)
+	case len(path) == 2 && path[1] == "trigger" && req.Method == httpPOST:
+		if elem.disabled {
+			http.Error(w, "The job is disabled in the configuration.", http.StatusConflict)
+			return
+		}
+		// this will make main run the job, here or on the leader
+		if err := triggerJobOnLeader(vars.db, elem); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "", http.StatusNoContent) // 204 OK
+	case len(path) > 2 || (len(path) == 2 && path[1] != "trigger"):
+		http.Error(w, "Not found.", http.StatusNotFound)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (vars *apiMethodJobs) list(w http.ResponseWriter, req *http.Request) {
+	result := make([]apiJob, len(jobs))
+	for i := range jobs {
+		result[i] = makeAPIJob(&jobs[i])
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	failures, err := recentJobFailures(vars.db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range result {
+		if f, ok := failures[result[i].Name]; ok {
+			result[i].FailuresLastDay = f.count
+			result[i].RecentFailures = f.runs
+		}
+	}
+	returnJSON(w, req, result)
+}
+
+func (vars *apiMethodJobs) get(w http.ResponseWriter, req *http.Request, elem *JobListElement) {
+	limit := 20
+	if s := req.FormValue("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 {
+			http.Error(w, "Invalid value for parameter: limit", http.StatusBadRequest)
+			return
+		}
+	}
+	result := makeAPIJob(elem)
+	failures, err := recentJobFailures(vars.db)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if f, ok := failures[result.Name]; ok {
+		result.FailuresLastDay = f.count
+		result.RecentFailures = f.runs
+	}
+	rows, err := vars.db.Query("SELECT started, seconds, error FROM jobruns WHERE job=$1 "+
+		"ORDER BY started DESC LIMIT $2", result.Name, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	result.History = make([]apiJobRun, 0, limit)
+	for rows.Next() {
+		var started pq.NullTime
+		var seconds float32
+		var errorText sql.NullString
+		err = rows.Scan(&started, &seconds, &errorText)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result.History = append(result.History, apiJobRun{
+			Started: jsonTime(started),
+			Seconds: seconds,
+			Error:   jsonString(errorText),
+		})
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	returnJSON(w, req, result)
+}
+
+func (vars *apiMethodJobs) update(w http.ResponseWriter, req *http.Request, elem *JobListElement) {
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	paused, ok := req.Form["paused"]
+	if !ok {
+		http.Error(w, "Missing parameter: paused", http.StatusUnprocessableEntity)
+		return
+	}
+	if err := setJobPaused(vars.db, elem, isTrueish(paused[0])); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Error(w, "", http.StatusNoContent) // 204 OK
+}
+
+func makeAPIJob(elem *JobListElement) apiJob {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	job := apiJob{
+		Name:           jobName(elem.job),
+		Interval:       elem.interval().Seconds(),
+		Enabled:        !elem.disabled,
+		Paused:         elem.paused,
+		Running:        elem.running,
+		Local:          elem.local,
+		LastRun:        jsonTime(pq.NullTime{Time: elem.lastrun, Valid: true}),
+		LastDuration:   float32(elem.lastExecutionTime.Seconds()),
+		RecentFailures: []apiJobRun{},
+	}
+	if next := elem.nextRun(); !next.IsZero() {
+		// A job that is overdue will start within a second
+		if next.Before(time.Now()) {
+			next = time.Now()
+		}
+		job.NextRun = jsonTime(pq.NullTime{Time: next, Valid: true})
+	}
+	if elem.panicObject != nil {
+		job.LastError.String = jobErrorText(elem.panicObject)
+		job.LastError.Valid = true
+	}
+	return job
+}
+
+type jobFailures struct {
+	count int
+	runs  []apiJobRun
+}
+
+// recentJobFailures returns the number of failures during the last day for each job,
+// and details for the last 5 of them
+func recentJobFailures(db *sql.DB) (map[string]*jobFailures, error) {
+	rows, err := db.Query("SELECT job, started, seconds, error, n FROM (" +
+		"SELECT job, started, seconds, error, count(*) OVER (PARTITION BY job) AS n, " +
+		"row_number() OVER (PARTITION BY job ORDER BY started DESC) AS i FROM jobruns " +
+		"WHERE error IS NOT NULL AND started > now() - interval '1 day') AS f WHERE i <= 5 " +
+		"ORDER BY job, started DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string]*jobFailures)
+	for rows.Next() {
+		var name string
+		var started pq.NullTime
+		var seconds float32
+		var errorText sql.NullString
+		var count int
+		err = rows.Scan(&name, &started, &seconds, &errorText, &count)
+		if err != nil {
+			return nil, err
+		}
+		run := apiJobRun{Started: jsonTime(started), Seconds: seconds, Error: jsonString(errorText)}
+		f, ok := result[name]
+		if !ok {
+			f = &jobFailures{count: count}
+			result[name] = f
+		}
+		f.runs = append(f.runs, run)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+)
+
+//  GET /api/v2/packages?name=openssl&fields=hostname,version
+//
+// Lists the hosts that have a package installed, one item per host and package version.
+// The name may contain "*" as a wildcard. Optional parameters:
+//  minVersion, maxVersion  - only include versions in this range (both inclusive)
+//  source                  - only include packages from this package system (dpkg, rpm or windows)
+
+type apiMethodPackages struct {
+	db *sql.DB
+}
+
+func (vars *apiMethodPackages) ServeHTTP(w http.ResponseWriter, req *http.Request, access *AccessProfile) {
+	if req.Method != httpGET {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fields, hErr := unpackFieldParam(req.FormValue("fields"),
+		[]string{"certfp", "hostname", "name", "version", "arch", "source"})
+	if hErr != nil {
+		http.Error(w, hErr.message, hErr.code)
+		return
+	}
+	name := req.FormValue("name")
+	if name == "" {
+		http.Error(w, "Missing parameter: name", http.StatusUnprocessableEntity)
+		return
+	}
+	minVersion := req.FormValue("minVersion")
+	maxVersion := req.FormValue("maxVersion")
+
+	statement := "SELECT p.certfp, h.hostname, p.name, p.version, p.arch, p.source " +
+		"FROM host_packages p JOIN hostinfo h ON h.certfp = p.certfp WHERE p.name LIKE $1"
+	params := []interface{}{strings.Replace(escapeLikePattern(name), "*", "%", -1)}
+	if source := req.FormValue("source"); source != "" {
+		params = append(params, source)
+		statement += " AND p.source = $2"
+	}
+	if !access.HasAccessToAllGroups() {
+		statement += " AND h.ownergroup IN (" + access.GetGroupListForSQLWHERE() + ")"
+	}
+	statement += " ORDER BY h.hostname, p.certfp, p.name, p.version"
+
+	rows, err := vars.db.Query(statement, params...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	result := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		var certfp, pname, version, arch, source string
+		var hostname sql.NullString
+		err = rows.Scan(&certfp, &hostname, &pname, &version, &arch, &source)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// The version range has to be checked here, since the rules for comparing
+		// versions depend on the package system
+		if minVersion != "" && compareVersions(source, version, minVersion) < 0 {
+			continue
+		}
+		if maxVersion != "" && compareVersions(source, version, maxVersion) > 0 {
+			continue
+		}
+		item := make(map[string]interface{})
+		if fields["certfp"] {
+			item["certfp"] = certfp
+		}
+		if fields["hostname"] {
+			item["hostname"] = jsonString(hostname)
+		}
+		if fields["name"] {
+			item["name"] = pname
+		}
+		if fields["version"] {
+			item["version"] = version
+		}
+		if fields["arch"] {
+			item["arch"] = arch
+		}
+		if fields["source"] {
+			item["source"] = source
+		}
+		result = append(result, item)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	returnJSON(w, req, result)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestApiMethodPackages(t *testing.T) {
+	if os.Getenv("NOPOSTGRES") != "" {
+		t.Log("No Postgres, skipping test")
+		return
+	}
+	db := getDBconnForTesting(t)
+	defer db.Close()
+
+	// Two hosts with different versions of openssl
+	hosts := []struct {
+		certfp, hostname, ownergroup, filename, content string
+	}{
+		{"AA", "one.example.com", "x", rpmQaCommand,
+			"openssl-0:1.0.2k-19.el7.x86_64\nbash-0:4.2.46-34.el7.x86_64\n"},
+		{"BB", "two.example.com", "y", "/usr/bin/dpkg-query -l",
+			"||/ Name    Version           Architecture Description\n" +
+				"ii  openssl 1.1.1f-1ubuntu2.1 amd64        Secure Sockets Layer toolkit\n"},
+	}
+	for i, h := range hosts {
+		fileID := i + 1
+		_, err := db.Exec("INSERT INTO files(fileid,certfp,filename,content,received) "+
+			"VALUES($1,$2,$3,$4,now())", fileID, h.certfp, h.filename, h.content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parseFile(db, int64(fileID))
+		_, err = db.Exec("UPDATE hostinfo SET hostname=$1, ownergroup=$2 WHERE certfp=$3",
+			h.hostname, h.ownergroup, h.certfp)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A new version of the package list replaces the old one
+	_, err := db.Exec("INSERT INTO files(fileid,certfp,filename,content,received) "+
+		"VALUES(3,'AA',$1,$2,now())", rpmQaCommand,
+		"openssl-0:1.0.2k-25.el7.x86_64\nbash-0:4.2.46-34.el7.x86_64\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parseFile(db, 3)
+
+	userX := &AccessProfile{isAdmin: false, groups: map[string]bool{"x": true}}
+	api := createAPImuxer(db, false)
+	testAPIcalls(t, api, []apiCall{
+		{
+			methodAndPath: "GET /api/v2/packages?name=openssl&fields=hostname,version,source",
+			expectStatus:  http.StatusOK,
+			expectJSON: `[{"hostname":"one.example.com","version":"1.0.2k-25.el7","source":"rpm"},` +
+				`{"hostname":"two.example.com","version":"1.1.1f-1ubuntu2.1","source":"dpkg"}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/packages?name=openssl&maxVersion=1.1.0&fields=hostname",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"hostname":"one.example.com"}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/packages?name=open*&minVersion=1.1.1a&fields=hostname,arch",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"hostname":"two.example.com","arch":"amd64"}]`,
+		},
+		// Only * is a wildcard
+		{
+			methodAndPath: "GET /api/v2/packages?name=open_sl&fields=hostname",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/packages?name=%25ssl&fields=hostname",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[]`,
+		},
+		// Only hosts in your own groups
+		{
+			methodAndPath: "GET /api/v2/packages?name=openssl&fields=hostname",
+			accessProfile: userX,
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"hostname":"one.example.com"}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/packages?fields=hostname",
+			expectStatus:  http.StatusUnprocessableEntity,
+		},
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sync/atomic"
+)
+
+type apiMethodParsers struct {
+	db *sql.DB
+}
+
+// ServeHTTP lists the registered file parsers and table parsers, and how many files
+// each of them has handled since the server started.
+func (vars *apiMethodParsers) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != httpGET {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	type parserInfo struct {
+		Name            string   `json:"name"`
+		FilenamePattern string   `json:"filenamePattern"`
+		Priority        int      `json:"priority"`
+		Columns         []string `json:"columns,omitempty"`
+		Tables          []string `json:"tables,omitempty"`
+		FilesHandled    uint64   `json:"filesHandled"`
+		Errors          uint64   `json:"errors"`
+	}
+	result := make([]parserInfo, len(fileParsers))
+	for i, p := range fileParsers {
+		result[i] = parserInfo{
+			Name:            p.name,
+			FilenamePattern: p.pattern.String(),
+			Priority:        p.priority,
+			Columns:         p.columns,
+			Tables:          p.tables,
+			FilesHandled:    atomic.LoadUint64(&p.handled),
+			Errors:          atomic.LoadUint64(&p.failed),
+		}
+	}
+	returnJSON(w, req, result)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestApiMethodParsers(t *testing.T) {
+	api := createAPImuxer(nil, false)
+	testAPIcalls(t, api, []apiCall{
+		{
+			methodAndPath: "GET /api/v2/parsers",
+			expectStatus:  http.StatusOK,
+			expectContent: `"name": "redhat-release"`,
+		},
+		// Table parsers are listed too
+		{
+			methodAndPath: "GET /api/v2/parsers",
+			expectStatus:  http.StatusOK,
+			expectContent: `"name": "rpm-packages",
+    "filenamePattern": "^/usr/bin/rpm -qa --queryformat '%\\{NAME\\}-%\\{EPOCHNUM\\}:%\\{VERSION\\}-%\\{RELEASE\\}\\.%\\{ARCH\\}\\\\n'$",
+    "priority": 0,
+    "tables": [
+      "host_packages"
+    ],`,
+		},
+		{
+			methodAndPath: "GET /api/v2/parsers",
+			expectStatus:  http.StatusOK,
+			expectContent: `"name": "lsblk",`,
+		},
+		{
+			methodAndPath: "POST /api/v2/parsers",
+			expectStatus:  http.StatusMethodNotAllowed,
+		},
+	})
+}
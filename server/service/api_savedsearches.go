@@ -0,0 +1,539 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"nivlheim/utility"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+//  GET    /api/v2/savedsearches                - list all you have access to
+//  POST   /api/v2/savedsearches                - create a new
+//  GET    /api/v2/savedsearches/<id>           - show details for one
+//  GET    /api/v2/savedsearches/<id>/hosts     - the hosts that matched the last time
+//  GET    /api/v2/savedsearches/<id>/changes   - hosts that entered or left the result
+//  PUT    /api/v2/savedsearches/<id>           - update one
+//  DELETE /api/v2/savedsearches/<id>           - delete one
+
+type apiMethodSavedSearches struct {
+	db *sql.DB
+}
+
+func (vars *apiMethodSavedSearches) ServeHTTP(w http.ResponseWriter, req *http.Request, access *AccessProfile) {
+	switch req.Method {
+	case httpGET:
+		vars.read(w, req, access)
+	case httpPOST:
+		vars.create(w, req, access)
+	case httpPUT:
+		vars.update(w, req, access)
+	case httpDELETE:
+		vars.delete(w, req, access)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// parseSavedSearchPath returns the search ID and the rest of the path after the ID.
+// The ID is zero if the path doesn't contain one.
+func parseSavedSearchPath(path string) (int, string, *httpError) {
+	i := strings.LastIndex(path, "/savedsearches/")
+	if i == -1 {
+		return 0, "", nil
+	}
+	s := path[i+15:]
+	sub := ""
+	if j := strings.IndexByte(s, '/'); j > -1 {
+		s, sub = s[:j], s[j+1:]
+	}
+	id, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, "", &httpError{message: "Invalid search ID: " + s, code: http.StatusBadRequest}
+	}
+	return id, sub, nil
+}
+
+func (vars *apiMethodSavedSearches) read(w http.ResponseWriter, req *http.Request, access *AccessProfile) {
+	searchID, sub, hErr := parseSavedSearchPath(req.URL.Path)
+	if hErr != nil {
+		http.Error(w, hErr.message, hErr.code)
+		return
+	}
+
+	// See which fields I'm supposed to return
+	fields, hErr := unpackFieldParam(req.FormValue("fields"), []string{
+		"searchID", "name", "ownerGroup", "query", "webhook", "interval",
+		"created", "lastRun", "lastError", "hostCount"})
+	if hErr != nil {
+		http.Error(w, hErr.message, hErr.code)
+		return
+	}
+
+	// The function scanSavedSearch assumes the fields are ordered as in this statement:
+	const selectStatement = "SELECT searchid, name, ownergroup, query, webhook, " +
+		"interval_minutes, created, lastrun, lasterror, " +
+		"(SELECT count(*) FROM savedsearch_hosts h WHERE h.searchid=s.searchid) " +
+		"FROM savedsearches s "
+
+	// Read a saved search with a specific id?
+	if searchID > 0 {
+		row := vars.db.QueryRow(selectStatement+"WHERE searchid=$1", searchID)
+		result, ownergroup, err := scanSavedSearch(row, fields)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Saved search not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !access.IsMemberOf(ownergroup) && !access.IsAdmin() {
+			http.Error(w, "You don't have access to this saved search.", http.StatusForbidden)
+			return
+		}
+		switch sub {
+		case "":
+			returnJSON(w, req, result)
+		case "hosts":
+			vars.readHosts(w, req, searchID)
+		case "changes":
+			vars.readChanges(w, req, searchID)
+		default:
+			http.Error(w, "Not found", http.StatusNotFound)
+		}
+		return
+	}
+
+	// If no ID was given, select a list of all the saved searches you have access to.
+	var rows *sql.Rows
+	var err error
+	if access.IsAdmin() {
+		rows, err = vars.db.Query(selectStatement + "ORDER BY name")
+	} else {
+		rows, err = vars.db.Query(selectStatement +
+			"WHERE ownergroup IN (" + access.GetGroupListForSQLWHERE() + ") ORDER BY name")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	result := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		rowMap, _, err := scanSavedSearch(rows, fields)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result = append(result, rowMap)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	returnJSON(w, req, result)
+}
+
+func scanSavedSearch(row RowScanner, fields map[string]bool) (map[string]interface{}, string, error) {
+	var searchID, interval, hostCount int
+	var name, ownergroup, query, webhook, lastError sql.NullString
+	var created, lastrun pq.NullTime
+	err := row.Scan(&searchID, &name, &ownergroup, &query, &webhook,
+		&interval, &created, &lastrun, &lastError, &hostCount)
+	if err != nil {
+		return nil, "", err
+	}
+	result := make(map[string]interface{}, len(fields))
+	if fields["searchID"] {
+		result["searchID"] = searchID
+	}
+	if fields["name"] {
+		result["name"] = jsonString(name)
+	}
+	if fields["ownerGroup"] {
+		result["ownerGroup"] = jsonString(ownergroup)
+	}
+	if fields["query"] {
+		result["query"] = jsonString(query)
+	}
+	if fields["webhook"] {
+		result["webhook"] = jsonString(webhook)
+	}
+	if fields["interval"] {
+		result["interval"] = interval
+	}
+	if fields["created"] {
+		result["created"] = jsonTime(created)
+	}
+	if fields["lastRun"] {
+		result["lastRun"] = jsonTime(lastrun)
+	}
+	if fields["lastError"] {
+		result["lastError"] = jsonString(lastError)
+	}
+	if fields["hostCount"] {
+		result["hostCount"] = hostCount
+	}
+	return result, ownergroup.String, nil
+}
+
+func (vars *apiMethodSavedSearches) readHosts(w http.ResponseWriter, req *http.Request, searchID int) {
+	rows, err := vars.db.Query("SELECT s.certfp, COALESCE(h.hostname, s.hostname) AS hostname FROM savedsearch_hosts s "+
+		"LEFT JOIN hostinfo h ON h.certfp=s.certfp WHERE s.searchid=$1 "+
+		"ORDER BY hostname", searchID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	result := make([]savedSearchHost, 0)
+	for rows.Next() {
+		var certfp, hostname sql.NullString
+		if err = rows.Scan(&certfp, &hostname); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result = append(result, savedSearchHost{Certfp: certfp.String, Hostname: hostname.String})
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	returnJSON(w, req, result)
+}
+
+// readChanges returns the runs where hosts entered or left the result, newest first.
+// The parameter "since" can be used to only get the changes after a point in time.
+func (vars *apiMethodSavedSearches) readChanges(w http.ResponseWriter, req *http.Request, searchID int) {
+	var since time.Time
+	if s := req.FormValue("since"); s != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			http.Error(w, "Invalid timestamp for parameter since: "+s, http.StatusBadRequest)
+			return
+		}
+	}
+	rows, err := vars.db.Query("SELECT r.runid, r.time, r.hostcount, s.name, "+
+		"c.certfp, c.hostname, c.entered "+
+		"FROM savedsearch_runs r JOIN savedsearches s ON s.searchid=r.searchid "+
+		"JOIN savedsearch_changes c ON c.runid=r.runid "+
+		"WHERE r.searchid=$1 AND r.time > $2 "+
+		"ORDER BY r.time DESC, r.runid DESC, c.hostname", searchID, since)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	result := make([]*savedSearchChanges, 0)
+	var lastRunID int64
+	for rows.Next() {
+		var runID int64
+		var t time.Time
+		var hostCount int
+		var name, certfp, hostname sql.NullString
+		var entered bool
+		err = rows.Scan(&runID, &t, &hostCount, &name, &certfp, &hostname, &entered)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if runID != lastRunID || len(result) == 0 {
+			result = append(result, &savedSearchChanges{
+				SearchID:  searchID,
+				Name:      name.String,
+				Time:      t,
+				HostCount: hostCount,
+				Entered:   make([]savedSearchHost, 0),
+				Left:      make([]savedSearchHost, 0),
+			})
+			lastRunID = runID
+		}
+		c := result[len(result)-1]
+		h := savedSearchHost{Certfp: certfp.String, Hostname: hostname.String}
+		if entered {
+			c.Entered = append(c.Entered, h)
+		} else {
+			c.Left = append(c.Left, h)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	returnJSON(w, req, result)
+}
+
+type apiSavedSearchParams struct {
+	name       string
+	ownerGroup string
+	query      string
+	webhook    sql.NullString
+	interval   int
+}
+
+func (vars *apiMethodSavedSearches) create(w http.ResponseWriter, req *http.Request, access *AccessProfile) {
+	p := vars.parseParameters(w, req)
+	if p == nil {
+		return
+	}
+
+	// All the parameters except webhook and interval are required
+	missingParams := make([]string, 0)
+	for name, value := range map[string]string{
+		"name": p.name, "ownerGroup": p.ownerGroup, "query": p.query} {
+		if value == "" {
+			missingParams = append(missingParams, name)
+		}
+	}
+	if len(missingParams) > 0 {
+		http.Error(w, "Missing parameters: "+strings.Join(missingParams, ","), http.StatusBadRequest)
+		return
+	}
+	if p.interval == 0 {
+		p.interval = 60
+	}
+
+	// ownerGroup must be one of the groups you are a member of
+	if !access.IsMemberOf(p.ownerGroup) && !access.IsAdmin() {
+		http.Error(w, "You can't create a saved search that belongs to a group you aren't a member of: "+
+			p.ownerGroup, http.StatusForbidden)
+		return
+	}
+
+	var newID int
+	err := vars.db.QueryRow("INSERT INTO savedsearches(name,ownergroup,query,webhook,interval_minutes) "+
+		"VALUES($1,$2,$3,$4,$5) RETURNING searchid",
+		p.name, p.ownerGroup, p.query, p.webhook, p.interval).Scan(&newID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Evaluate the new search right away, to have a baseline for the changes
+	triggerJob(savedSearchJob{})
+
+	w.Header().Set("Location", req.URL.RequestURI()+"/"+strconv.Itoa(newID))
+	http.Error(w, "", http.StatusCreated) // 201 Created
+}
+
+func (vars *apiMethodSavedSearches) update(w http.ResponseWriter, req *http.Request, access *AccessProfile) {
+	searchID, sub, hErr := parseSavedSearchPath(req.URL.Path)
+	if hErr != nil {
+		http.Error(w, hErr.message, hErr.code)
+		return
+	}
+	if searchID == 0 || sub != "" {
+		http.Error(w, "Missing search ID in URL path", http.StatusUnprocessableEntity)
+		return
+	}
+	p := vars.parseParameters(w, req)
+	if p == nil {
+		return
+	}
+
+	// Read the existing saved search
+	var old apiSavedSearchParams
+	err := vars.db.QueryRow("SELECT name,ownergroup,query,webhook,interval_minutes "+
+		"FROM savedsearches WHERE searchid=$1", searchID).
+		Scan(&old.name, &old.ownerGroup, &old.query, &old.webhook, &old.interval)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Saved search not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !access.IsMemberOf(old.ownerGroup) && !access.IsAdmin() {
+		http.Error(w, "You don't have access to this saved search.", http.StatusForbidden)
+		return
+	}
+
+	// Parameters that aren't supplied keep their old values
+	resultChanged := false
+	if p.ownerGroup != "" && p.ownerGroup != old.ownerGroup {
+		if !access.IsMemberOf(p.ownerGroup) && !access.IsAdmin() {
+			http.Error(w, "You can't give away a saved search to a group you aren't a member of: "+
+				p.ownerGroup, http.StatusBadRequest)
+			return
+		}
+		old.ownerGroup = p.ownerGroup
+		resultChanged = true
+	}
+	if p.name != "" {
+		old.name = p.name
+	}
+	if p.query != "" && p.query != old.query {
+		old.query = p.query
+		resultChanged = true
+	}
+	if _, ok := ifFormValue(req.PostForm, "webhook"); ok {
+		old.webhook = p.webhook
+	}
+	if p.interval > 0 {
+		old.interval = p.interval
+	}
+
+	var rows int64
+	err = utility.RunInTransaction(vars.db, func(tx *sql.Tx) error {
+		res, err := tx.Exec("UPDATE savedsearches SET name=$1,ownergroup=$2,query=$3,"+
+			"webhook=$4,interval_minutes=$5 WHERE searchid=$6",
+			old.name, old.ownerGroup, old.query, old.webhook, old.interval, searchID)
+		if err != nil {
+			return err
+		}
+		if rows, err = res.RowsAffected(); err != nil || rows == 0 || !resultChanged {
+			return err
+		}
+		// The stored result belongs to the old query, so comparing it with the new result
+		// would report a lot of changes. The next run sets a new baseline instead.
+		_, err = tx.Exec("DELETE FROM savedsearch_hosts WHERE searchid=$1", searchID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE savedsearches SET lastrun=NULL, lasterror=NULL, failures=0, "+
+			"retryafter=NULL WHERE searchid=$1", searchID)
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rows > 0 {
+		if resultChanged {
+			triggerJob(savedSearchJob{})
+		}
+		http.Error(w, "", http.StatusNoContent)
+	} else {
+		http.Error(w, "Saved search not found", http.StatusNotFound)
+	}
+}
+
+func (vars *apiMethodSavedSearches) delete(w http.ResponseWriter, req *http.Request, access *AccessProfile) {
+	searchID, sub, hErr := parseSavedSearchPath(req.URL.Path)
+	if hErr != nil {
+		http.Error(w, hErr.message, hErr.code)
+		return
+	}
+	if searchID == 0 || sub != "" {
+		http.Error(w, "Missing search ID in URL path", http.StatusUnprocessableEntity)
+		return
+	}
+
+	var ownerGroup string
+	err := vars.db.QueryRow("SELECT ownergroup FROM savedsearches WHERE searchid=$1", searchID).
+		Scan(&ownerGroup)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Saved search not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !access.IsMemberOf(ownerGroup) && !access.IsAdmin() {
+		http.Error(w, "You don't have access to this saved search.", http.StatusForbidden)
+		return
+	}
+
+	// The stored hosts, runs and changes are deleted by cascade
+	res, err := vars.db.Exec("DELETE FROM savedsearches WHERE searchid=$1", searchID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rows > 0 {
+		http.Error(w, "", http.StatusNoContent)
+	} else {
+		http.Error(w, "Saved search not found", http.StatusNotFound)
+	}
+}
+
+func (vars *apiMethodSavedSearches) parseParameters(w http.ResponseWriter, req *http.Request) *apiSavedSearchParams {
+	// If one or more parameters have invalid values, will send an http response
+	// with a JSON object with error messages.
+	var params apiSavedSearchParams
+	paramErrors := make(map[string]string, 0)
+	err := req.ParseForm()
+	if err != nil && req.ContentLength > 0 {
+		http.Error(w, fmt.Sprintf("Unable to parse the form data: %s", err.Error()),
+			http.StatusBadRequest)
+		return nil
+	}
+	params.name = strings.TrimSpace(formValue(req.PostForm, "name"))
+	params.ownerGroup = strings.TrimSpace(formValue(req.PostForm, "ownerGroup"))
+	params.query = strings.TrimPrefix(formValue(req.PostForm, "query"), "?")
+	if params.query != "" {
+		if hErr := validateSavedSearchQuery(vars.db, params.query); hErr != nil {
+			paramErrors["query"] = hErr.message
+		}
+	}
+	if webhook := formValue(req.PostForm, "webhook"); webhook != "" {
+		u, err := url.Parse(webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			paramErrors["webhook"] = "Must be a http or https url"
+		} else if !webhookHostAllowed(u.Hostname()) {
+			paramErrors["webhook"] = "Webhooks to internal addresses aren't allowed"
+		}
+		params.webhook = sql.NullString{String: webhook, Valid: true}
+	}
+	if interval := formValue(req.PostForm, "interval"); interval != "" {
+		params.interval, err = strconv.Atoi(interval)
+		if err != nil || params.interval < 1 {
+			paramErrors["interval"] = "Must be a positive number of minutes"
+		}
+	}
+	if len(paramErrors) > 0 {
+		returnJSON(w, req, paramErrors, http.StatusBadRequest)
+		return nil
+	}
+	return &params
+}
+
+// validateSavedSearchQuery checks that a saved search query can be evaluated,
+// so errors are reported when the search is saved instead of every time it runs.
+func validateSavedSearchQuery(db *sql.DB, query string) *httpError {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return &httpError{message: "Unable to parse the query: " + err.Error(), code: http.StatusBadRequest}
+	}
+	customFields, _, err := getListOfCustomFields(db)
+	if err != nil {
+		return &httpError{message: err.Error(), code: http.StatusInternalServerError}
+	}
+	customFieldMap, err := getCustomFieldMap(db)
+	if err != nil {
+		return &httpError{message: err.Error(), code: http.StatusInternalServerError}
+	}
+	allowedFields := make([]string, len(apiHostListStandardFields))
+	for i, f := range apiHostListStandardFields {
+		allowedFields[i] = f.publicName
+	}
+	allowedFields = append(allowedFields, customFields...)
+	if _, _, hErr := buildSQLWhere(query, allowedFields, customFieldMap); hErr != nil {
+		return hErr
+	}
+	if q := values.Get("query"); q != "" {
+		if _, hErr := parseSearchExpression(q, allowedFields); hErr != nil {
+			return hErr
+		}
+	}
+	for name, list := range values {
+		if strings.HasPrefix(name, "re") && name != "regex" && contentSearchParameters.MatchString(name) {
+			for _, re := range list {
+				if _, hErr := newSearchQuery(re, searchOptions{isRegex: true}); hErr != nil {
+					return hErr
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestSavedSearches(t *testing.T) {
+	if os.Getenv("NOPOSTGRES") != "" {
+		t.Log("No Postgres, skipping test")
+		return
+	}
+
+	db := getDBconnForTesting(t)
+	defer db.Close()
+
+	// A web server that receives the webhook calls
+	posted := make(chan savedSearchChanges, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var changes savedSearchChanges
+		body, _ := io.ReadAll(req.Body)
+		if err := json.Unmarshal(body, &changes); err != nil {
+			t.Error(err)
+		}
+		posted <- changes
+	}))
+	defer ts.Close()
+	savedHosts := config.WebhookAllowedHosts
+	defer func() { config.WebhookAllowedHosts = savedHosts }()
+	config.WebhookAllowedHosts = []string{"127.0.0.1"}
+
+	// Prepare some data for the tests
+	const filename = "/etc/ssh/sshd_config"
+	hosts := []struct {
+		certfp, hostname, os, ownergroup, content string
+	}{
+		{"AA", "one.example.com", "RHEL 8", "x", "PermitRootLogin yes"},
+		{"BB", "two.example.com", "RHEL 8", "x", "PermitRootLogin no"},
+		{"CC", "three.example.com", "RHEL 8", "y", "PermitRootLogin yes"},
+	}
+	for i, h := range hosts {
+		_, err := db.Exec("INSERT INTO hostinfo(certfp,hostname,os,ownergroup) VALUES($1,$2,$3,$4)",
+			h.certfp, h.hostname, h.os, h.ownergroup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fileID := int64(i + 1)
+		_, err = db.Exec("INSERT INTO files(fileid,filename,certfp,content) VALUES($1,$2,$3,$4)",
+			fileID, filename, h.certfp, h.content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addFileToFastSearch(fileID, h.certfp, filename, h.content)
+		defer removeFileFromFastSearch(fileID)
+	}
+	fsReady = 1
+
+	query := url.QueryEscape("os=RHEL+8&q1=PermitRootLogin+yes&f1=" + filename)
+	userX := &AccessProfile{isAdmin: false, groups: map[string]bool{"x": true}}
+	userY := &AccessProfile{isAdmin: false, groups: map[string]bool{"y": true}}
+	api := createAPImuxer(db, false)
+	testAPIcalls(t, api, []apiCall{
+		{
+			methodAndPath: "POST /api/v2/savedsearches",
+			body:          "name=root&ownerGroup=x&webhook=" + url.QueryEscape(ts.URL) + "&query=" + query,
+			accessProfile: userX,
+			expectStatus:  http.StatusCreated,
+		},
+		// You can't create a saved search for another group
+		{
+			methodAndPath: "POST /api/v2/savedsearches",
+			body:          "name=root&ownerGroup=x&query=" + query,
+			accessProfile: userY,
+			expectStatus:  http.StatusForbidden,
+		},
+		// Invalid parameters
+		{
+			methodAndPath: "POST /api/v2/savedsearches",
+			body:          "name=bad&ownerGroup=x&webhook=ftp://foo&interval=-1&query=nosuchfield=1",
+			expectStatus:  http.StatusBadRequest,
+			expectJSON: `{"query":"Unsupported field name: nosuchfield",` +
+				`"webhook":"Must be a http or https url",` +
+				`"interval":"Must be a positive number of minutes"}`,
+		},
+		{
+			methodAndPath: "POST /api/v2/savedsearches",
+			body:          "name=bad&ownerGroup=x",
+			expectStatus:  http.StatusBadRequest,
+		},
+		// The server won't call itself or other internal addresses
+		{
+			methodAndPath: "POST /api/v2/savedsearches",
+			body: "name=bad&ownerGroup=x&query=os=RHEL+8&webhook=" +
+				url.QueryEscape("http://localhost/api/internal/triggerJob/x"),
+			expectStatus: http.StatusBadRequest,
+			expectJSON:   `{"webhook":"Webhooks to internal addresses aren't allowed"}`,
+		},
+	})
+
+	// The first run stores the result without reporting any changes
+	savedSearchJob{}.Run(context.Background(), db)
+	testAPIcalls(t, api, []apiCall{
+		{
+			methodAndPath: "GET /api/v2/savedsearches?fields=searchID,name,ownerGroup,hostCount",
+			accessProfile: userX,
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"searchID":1,"name":"root","ownerGroup":"x","hostCount":1}]`,
+		},
+		// Hosts that belong to other groups aren't included
+		{
+			methodAndPath: "GET /api/v2/savedsearches/1/hosts",
+			accessProfile: userX,
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"certfp":"AA","hostname":"one.example.com"}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/savedsearches/1/changes",
+			accessProfile: userX,
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/savedsearches/1",
+			accessProfile: userY,
+			expectStatus:  http.StatusForbidden,
+		},
+		{
+			methodAndPath: "GET /api/v2/savedsearches",
+			accessProfile: userY,
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[]`,
+		},
+	})
+
+	// Change the config on the hosts, and run the search again
+	addFileToFastSearch(1, "AA", filename, "PermitRootLogin no")
+	addFileToFastSearch(2, "BB", filename, "PermitRootLogin yes")
+	if _, err := db.Exec("UPDATE savedsearches SET lastrun = lastrun - interval '2 hours'"); err != nil {
+		t.Fatal(err)
+	}
+	savedSearchJob{}.Run(context.Background(), db)
+
+	select {
+	case changes := <-posted:
+		if changes.SearchID != 1 || changes.HostCount != 1 ||
+			len(changes.Entered) != 1 || changes.Entered[0].Hostname != "two.example.com" ||
+			len(changes.Left) != 1 || changes.Left[0].Hostname != "one.example.com" {
+			t.Errorf("The webhook got %+v", changes)
+		}
+	default:
+		t.Error("The webhook wasn't called")
+	}
+
+	list, err := QueryList(db, "SELECT certfp, entered FROM savedsearch_changes ORDER BY certfp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(list, []map[string]interface{}{
+		{"certfp": "AA", "entered": false}, {"certfp": "BB", "entered": true}}) {
+		t.Errorf("Recorded changes: %v", list)
+	}
+
+	// A search that isn't due yet isn't evaluated
+	savedSearchJob{}.Run(context.Background(), db)
+	if len(posted) > 0 {
+		t.Error("The search was evaluated before it was due")
+	}
+
+	testAPIcalls(t, api, []apiCall{
+		{
+			methodAndPath: "GET /api/v2/savedsearches/1/changes",
+			accessProfile: userX,
+			expectStatus:  http.StatusOK,
+			expectContent: `"hostname": "two.example.com"`,
+		},
+		{
+			methodAndPath: "GET /api/v2/savedsearches/1/changes?since=2999-01-01T00:00:00Z",
+			accessProfile: userX,
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[]`,
+		},
+		{
+			methodAndPath: "PUT /api/v2/savedsearches/1",
+			body:          "interval=5&webhook=",
+			accessProfile: userX,
+			expectStatus:  http.StatusNoContent,
+		},
+		{
+			methodAndPath: "GET /api/v2/savedsearches/1?fields=name,interval,webhook",
+			accessProfile: userX,
+			expectStatus:  http.StatusOK,
+			expectJSON:    `{"name":"root","interval":5,"webhook":null}`,
+		},
+		// A new query throws away the old result, and the next run sets a new baseline
+		{
+			methodAndPath: "PUT /api/v2/savedsearches/1",
+			body:          "webhook=" + url.QueryEscape(ts.URL) + "&query=os=RHEL+8",
+			accessProfile: userX,
+			expectStatus:  http.StatusNoContent,
+		},
+		{
+			methodAndPath: "GET /api/v2/savedsearches/1?fields=lastRun,hostCount",
+			accessProfile: userX,
+			expectStatus:  http.StatusOK,
+			expectJSON:    `{"lastRun":null,"hostCount":0}`,
+		},
+	})
+	savedSearchJob{}.Run(context.Background(), db)
+	if len(posted) > 0 {
+		t.Errorf("The webhook was called after the query was changed: %+v", <-posted)
+	}
+	testAPIcalls(t, api, []apiCall{
+		{
+			methodAndPath: "GET /api/v2/savedsearches/1?fields=hostCount",
+			accessProfile: userX,
+			expectStatus:  http.StatusOK,
+			expectJSON:    `{"hostCount":2}`,
+		},
+	})
+
+	// A host that is deleted has left the result
+	if _, err := db.Exec("DELETE FROM hostinfo WHERE certfp='BB'"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE savedsearches SET lastrun = lastrun - interval '2 hours'"); err != nil {
+		t.Fatal(err)
+	}
+	savedSearchJob{}.Run(context.Background(), db)
+	select {
+	case changes := <-posted:
+		if changes.HostCount != 1 || len(changes.Entered) != 0 || len(changes.Left) != 1 ||
+			changes.Left[0].Certfp != "BB" || changes.Left[0].Hostname != "two.example.com" {
+			t.Errorf("The webhook got %+v", changes)
+		}
+	default:
+		t.Error("The webhook wasn't called when a host was deleted")
+	}
+
+	testAPIcalls(t, api, []apiCall{
+		{
+			methodAndPath: "DELETE /api/v2/savedsearches/1",
+			accessProfile: userY,
+			expectStatus:  http.StatusForbidden,
+		},
+		{
+			methodAndPath: "DELETE /api/v2/savedsearches/1",
+			accessProfile: userX,
+			expectStatus:  http.StatusNoContent,
+		},
+		{
+			methodAndPath: "GET /api/v2/savedsearches/1",
+			expectStatus:  http.StatusNotFound,
+		},
+	})
+}
+
+func TestSavedSearchWithoutFilters(t *testing.T) {
+	if os.Getenv("NOPOSTGRES") != "" {
+		t.Log("No Postgres, skipping test")
+		return
+	}
+	db := getDBconnForTesting(t)
+	defer db.Close()
+
+	_, err := db.Exec("INSERT INTO hostinfo(certfp,hostname,ownergroup) VALUES" +
+		"('AA','one.example.com','x'),('BB',null,'y')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedGroup, savedHide := config.LDAPAdminGroup, config.HideUnknownHosts
+	defer func() { config.LDAPAdminGroup, config.HideUnknownHosts = savedGroup, savedHide }()
+	config.LDAPAdminGroup = "admins"
+
+	// A search owned by the admin group has no filters at all
+	hosts, hErr := findHostsForSavedSearch(db, "", "admins")
+	if hErr != nil {
+		t.Fatal(hErr.message)
+	}
+	if len(hosts) != 2 {
+		t.Errorf("Expected 2 hosts, got %v", hosts)
+	}
+
+	// Hosts without a hostname are left out, like in the hostlist
+	config.HideUnknownHosts = true
+	hosts, hErr = findHostsForSavedSearch(db, "", "admins")
+	if hErr != nil {
+		t.Fatal(hErr.message)
+	}
+	if !reflect.DeepEqual(hosts, map[string]string{"AA": "one.example.com"}) {
+		t.Errorf("Expected only AA, got %v", hosts)
+	}
+}
+
+func TestWebhookAddresses(t *testing.T) {
+	savedHosts := config.WebhookAllowedHosts
+	defer func() { config.WebhookAllowedHosts = savedHosts }()
+	config.WebhookAllowedHosts = []string{"hooks.example.local"}
+
+	tests := []struct {
+		host   string
+		expect bool
+	}{
+		{"www.example.com", true},
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::", true},
+		{"hooks.example.local", true},
+		{"localhost", false},
+		{"LocalHost", false},
+		{"foo.localhost", false},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"192.168.0.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+	}
+	for _, test := range tests {
+		if webhookHostAllowed(test.host) != test.expect {
+			t.Errorf("webhookHostAllowed(%q) should be %v", test.host, test.expect)
+		}
+	}
+
+	// A name that resolves to an internal address is stopped when connecting
+	called := make(chan bool, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		called <- true
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	resp, err := webhookClient("localhost").Get("http://localhost:" + u.Port() + "/")
+	if err == nil {
+		resp.Body.Close()
+		t.Error("Expected an error")
+	}
+	if len(called) > 0 {
+		t.Error("The webhook client connected to an internal address")
+	}
+	// unless the host is in the list of allowed hosts
+	config.WebhookAllowedHosts = []string{"127.0.0.1"}
+	resp, err = webhookClient("127.0.0.1").Get(ts.URL)
+	if err != nil {
+		t.Error(err)
+	} else {
+		resp.Body.Close()
+	}
+	if len(called) == 0 {
+		t.Error("The webhook client didn't connect to an allowed host")
+	}
+}
+
+func TestSavedSearchFailureAndPruning(t *testing.T) {
+	if os.Getenv("NOPOSTGRES") != "" {
+		t.Log("No Postgres, skipping test")
+		return
+	}
+	db := getDBconnForTesting(t)
+	defer db.Close()
+	fsReady = 1
+
+	// A search that fails is retried later, not every minute
+	_, err := db.Exec("INSERT INTO savedsearches(searchid,name,ownergroup,query) " +
+		"VALUES(1,'bad','x','nosuchfield=1')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		savedSearchJob{}.Run(context.Background(), db)
+	}
+	var failures int
+	var lastError sql.NullString
+	var waiting bool
+	err = db.QueryRow("SELECT failures, lasterror, retryafter > now() + interval '50 minutes' "+
+		"FROM savedsearches WHERE searchid=1").Scan(&failures, &lastError, &waiting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures != 1 || !lastError.Valid || !waiting {
+		t.Errorf("failures=%d, lasterror=%v, waiting=%v", failures, lastError, waiting)
+	}
+
+	// Old runs are removed, with their changes
+	_, err = db.Exec("INSERT INTO savedsearch_runs(runid,searchid,time,hostcount,entered_count,left_count) " +
+		"VALUES(1,1,now() - interval '1 year',1,1,0),(2,1,now(),1,1,0)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO savedsearch_changes(runid,certfp,entered) VALUES(1,'AA',true),(2,'AA',true)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pruneSavedSearchHistoryJob{}.Run(context.Background(), db)
+	list, err := QueryColumn(db, "SELECT runid FROM savedsearch_changes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(list, []interface{}{int64(2)}) {
+		t.Errorf("Expected only the changes from run 2, got %v", list)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"log"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -18,11 +19,16 @@ func (vars *apiMethodSearch) ServeHTTP(w http.ResponseWriter, req *http.Request,
 		return
 	}
 
-	query := req.FormValue("q")
+	query, opts := searchStringFromRequest(req, "q", "re")
 	if query == "" {
 		http.Error(w, "Missing or empty parameter: q", http.StatusBadRequest)
 		return
 	}
+	sq, hErr := newSearchQuery(query, opts)
+	if hErr != nil {
+		http.Error(w, hErr.message, hErr.code)
+		return
+	}
 
 	// Get a list of names and IDs of all defined custom fields
 	customFields, customFieldIDs, err := getListOfCustomFields(vars.db)
@@ -50,22 +56,25 @@ func (vars *apiMethodSearch) ServeHTTP(w http.ResponseWriter, req *http.Request,
 		return
 	}
 
+	// The parameters "history" and "asOf" are used to search in old versions of files
+	history, hErr := historicalSearchFromRequest(req)
+	if hErr != nil {
+		http.Error(w, hErr.message, hErr.code)
+		return
+	}
+
 	// When the system service starts up, it can take a few seconds before the cache is loaded.
 	// If we allowed search during this period, it would yield incomplete results.
-	if !isReadyForSearch() {
+	if history == nil && !isReadyForSearch() {
 		w.Header().Set("Retry-After", "60")
 		http.Error(w, "Not ready yet, still loading data", http.StatusServiceUnavailable)
 		return
 	}
 
-	// Perform the search
-	filename := req.FormValue("filename")
-	var hitIDs []int64
-	if access.HasAccessToAllGroups() {
-		hitIDs, _ = searchFiles(query, filename)
-	} else {
-		// Compute a list of which certificates the user has access to,
-		// based on current hosts in hostinfo owned by one of the groups the user has access to.
+	// Compute a list of which certificates the user has access to,
+	// based on current hosts in hostinfo owned by one of the groups the user has access to.
+	var validCerts map[string]bool
+	if !access.HasAccessToAllGroups() {
 		list, err := QueryColumn(vars.db, "SELECT certfp FROM hostinfo WHERE ownergroup IN ("+
 			access.GetGroupListForSQLWHERE()+")")
 		if err != nil {
@@ -74,15 +83,36 @@ func (vars *apiMethodSearch) ServeHTTP(w http.ResponseWriter, req *http.Request,
 			return
 		}
 		// List is a slice of interface{}, so I must convert that to a map[string]bool
-		validCerts := make(map[string]bool, 100)
+		validCerts = make(map[string]bool, 100)
 		for _, s := range list {
 			str, ok := s.(string)
 			if ok {
 				validCerts[str] = true
 			}
 		}
-		// Finally, we can perform the search
-		hitIDs, _ = searchFilesWithFilter(query, filename, validCerts)
+	}
+
+	// Perform the search
+	filename := req.FormValue("filename")
+	var hitIDs []int64
+	if history != nil {
+		var hits map[int64]string
+		hits, hErr = history.search(vars.db, sq, filename, validCerts)
+		list := make(hitList, 0, len(hits))
+		for fileID := range hits {
+			list = append(list, fileID)
+		}
+		// Same order as the other search functions
+		sort.Sort(list)
+		hitIDs = list
+	} else if validCerts == nil {
+		hitIDs, _, hErr = searchFiles(sq, filename)
+	} else {
+		hitIDs, _, hErr = searchFilesWithFilter(sq, filename, validCerts)
+	}
+	if hErr != nil {
+		http.Error(w, hErr.message, hErr.code)
+		return
 	}
 
 	// We probably need to read additional information from the database,
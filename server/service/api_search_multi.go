@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -42,76 +43,18 @@ func (vars *apiMethodMultiStageSearch) ServeHTTP(w http.ResponseWriter, req *htt
 		return
 	}
 
-	// When the system service starts up, it can take a few seconds before the cache is loaded.
-	// If we allowed search during this period, it would yield incomplete results.
-	if !isReadyForSearch() {
+	// Perform the search
+	resultingCerts, hErr := hostsMatchingContentSearch(vars.db, req, allowedFields, customFieldIDs)
+	if hErr == errNotReadyForSearch {
 		w.Header().Set("Retry-After", "60")
-		http.Error(w, "Not ready yet, still loading data", http.StatusServiceUnavailable)
+	}
+	if hErr != nil {
+		http.Error(w, hErr.message, hErr.code)
 		return
 	}
-
-	// The user can specify a search that goes over several stages.
-	// For more information, see https://github.com/unioslo/nivlheim/issues/121
-	var resultingCerts = make(map[string]bool, 0)
-	for stage := 1; ; stage++ {
-
-		// Parse the "q" and "f" parameters for this stage.
-		// Filename can be empty.
-		var query, filename, operation string
-		query = req.FormValue(fmt.Sprintf("q%d", stage))
-		filename = req.FormValue(fmt.Sprintf("f%d", stage))
-		operation = req.FormValue(fmt.Sprintf("op%d", stage))
-
-		if query == "" {
-			if stage == 1 {
-				http.Error(w, "Missing or empty parameter: q1",
-					http.StatusBadRequest)
-				return
-			}
-			// Otherwise, I guess we're done
-			break
-		}
-
-		// All stages after the first requires an operation
-		if stage > 1 && operation == "" {
-			http.Error(w, fmt.Sprintf("Missing or empty parameter: op%d", stage), http.StatusBadRequest)
-			return
-		}
-
-		// Perform the search
-		var hitIDs map[string]bool
-		hitIDs = searchForHosts(query, filename) // If filename is empty, it searches all the files.
-
-		if stage > 1 {
-			// Perform the operation
-			switch strings.ToUpper(operation) {
-			case "AND": // intersection
-				// remove entries from before that weren't in this stage's results:
-				for id := range resultingCerts {
-					if !hitIDs[id] {
-						delete(resultingCerts, id)
-					}
-				}
-			case "OR": // union
-				for id := range hitIDs {
-					resultingCerts[id] = true
-				}
-			case "SUB": // difference
-				// Subtract this stage's results from the previous list
-				for id := range hitIDs {
-					delete(resultingCerts, id)
-				}
-			default:
-				http.Error(w, fmt.Sprintf("Unsupported operation: %s", operation), http.StatusBadRequest)
-				return
-			}
-		} else {
-			// This is the first (and perhaps only) stage.
-			// Copy the hitIDs list into the resultingFileIDs map.
-			for id := range hitIDs {
-				resultingCerts[id] = true
-			}
-		}
+	if resultingCerts == nil {
+		http.Error(w, "Missing or empty parameter: q1", http.StatusBadRequest)
+		return
 	}
 
 	// Access control
@@ -170,7 +113,7 @@ func (vars *apiMethodMultiStageSearch) ServeHTTP(w http.ResponseWriter, req *htt
 		}
 
 		// Prepare SQL statement
-		statement := "SELECT " + strings.Join(temp, ",") + " FROM hostinfo " +
+		statement := "SELECT " + strings.Join(temp, ",") + " FROM hostinfo h " +
 					"WHERE certfp=$1"
 		// Possibly filter out hosts with undetermined hostnames
 		if config.HideUnknownHosts {
@@ -249,3 +192,138 @@ func (vars *apiMethodMultiStageSearch) ServeHTTP(w http.ResponseWriter, req *htt
 	// Return everything as JSON
 	returnJSON(w, req, result)
 }
+
+// contentSearchParameters matches the names of the request parameters
+// that are used by hostsMatchingContentSearch
+var contentSearchParameters = regexp.MustCompile(
+	`^(query|(q|re|f|op)\d+|regex|caseSensitive|wholeWord|history|asOf)$`)
+
+// errNotReadyForSearch is returned while the search cache is being loaded
+var errNotReadyForSearch = &httpError{
+	message: "Not ready yet, still loading data",
+	code:    http.StatusServiceUnavailable,
+}
+
+// hostsMatchingContentSearch performs the search given by the request
+// parameters, and returns the certificate fingerprints of the hosts that matched.
+// The search can be given as an expression in the "query" parameter,
+// or as several stages with numbered parameters (q1, f1, q2, f2, op2, etc).
+// Returns nil if the request doesn't have any search parameters.
+func hostsMatchingContentSearch(db *sql.DB, req *http.Request, allowedFields []string,
+	customFieldIDs map[string]int) (map[string]bool, *httpError) {
+	if req.FormValue("query") == "" && req.FormValue("q1") == "" && req.FormValue("re1") == "" {
+		// There's no search in this request
+		return nil, nil
+	}
+
+	// The parameters "history" and "asOf" are used to search in old versions of files
+	history, hErr := historicalSearchFromRequest(req)
+	if hErr != nil {
+		return nil, hErr
+	}
+
+	// When the system service starts up, it can take a few seconds before the cache is loaded.
+	// If we allowed search during this period, it would yield incomplete results.
+	if history == nil && !isReadyForSearch() {
+		return nil, errNotReadyForSearch
+	}
+
+	// The search can be given as an expression in the "query" parameter,
+	// or as several stages with numbered parameters.
+	if query := req.FormValue("query"); query != "" {
+		expr, hErr := parseSearchExpression(query, allowedFields)
+		if hErr != nil {
+			return nil, hErr
+		}
+		evaluator := &searchExpressionEvaluator{
+			db:             db,
+			opts:           searchOptionsFromRequest(req),
+			history:        history,
+			customFieldIDs: customFieldIDs,
+		}
+		return evaluator.eval(expr)
+	}
+
+	// The user can specify a search that goes over several stages.
+	// For more information, see https://github.com/unioslo/nivlheim/issues/121
+	var resultingCerts = make(map[string]bool, 0)
+	for stage := 1; ; stage++ {
+
+		// Parse the "q" (or "re") and "f" parameters for this stage.
+		// Filename can be empty.
+		var query, filename, operation string
+		var opts searchOptions
+		query, opts = searchStringFromRequest(req,
+			fmt.Sprintf("q%d", stage), fmt.Sprintf("re%d", stage))
+		filename = req.FormValue(fmt.Sprintf("f%d", stage))
+		operation = req.FormValue(fmt.Sprintf("op%d", stage))
+
+		if query == "" {
+			// I guess we're done
+			break
+		}
+
+		// All stages after the first requires an operation
+		if stage > 1 && operation == "" {
+			return nil, &httpError{
+				message: fmt.Sprintf("Missing or empty parameter: op%d", stage),
+				code:    http.StatusBadRequest,
+			}
+		}
+
+		// Perform the search
+		sq, hErr := newSearchQuery(query, opts)
+		if hErr != nil {
+			return nil, hErr
+		}
+		var hitIDs map[string]bool
+		if history != nil {
+			// Access control is left to the caller
+			var hits map[int64]string
+			hits, hErr = history.search(db, sq, filename, nil)
+			hitIDs = make(map[string]bool, len(hits))
+			for _, certfp := range hits {
+				hitIDs[certfp] = true
+			}
+		} else {
+			hitIDs, hErr = searchForHosts(sq, filename) // If filename is empty, it searches all the files.
+		}
+		if hErr != nil {
+			return nil, hErr
+		}
+
+		if stage > 1 {
+			// Perform the operation
+			switch strings.ToUpper(operation) {
+			case "AND": // intersection
+				// remove entries from before that weren't in this stage's results:
+				for id := range resultingCerts {
+					if !hitIDs[id] {
+						delete(resultingCerts, id)
+					}
+				}
+			case "OR": // union
+				for id := range hitIDs {
+					resultingCerts[id] = true
+				}
+			case "SUB": // difference
+				// Subtract this stage's results from the previous list
+				for id := range hitIDs {
+					delete(resultingCerts, id)
+				}
+			default:
+				return nil, &httpError{
+					message: fmt.Sprintf("Unsupported operation: %s", operation),
+					code:    http.StatusBadRequest,
+				}
+			}
+		} else {
+			// This is the first (and perhaps only) stage.
+			// Copy the hitIDs list into the resultingFileIDs map.
+			for id := range hitIDs {
+				resultingCerts[id] = true
+			}
+		}
+	}
+	return resultingCerts, nil
+}
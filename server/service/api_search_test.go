@@ -2,6 +2,7 @@ package main
 
 import (
 	"net/http"
+	"net/url"
 	"os"
 	"testing"
 )
@@ -161,3 +162,329 @@ func TestSearchCaseSensitivity(t *testing.T) {
 	testAPIcalls(t, api, tests)
 	config.HideUnknownHosts = false
 }
+
+func TestRegexSearch(t *testing.T) {
+	if os.Getenv("NOPOSTGRES") != "" {
+		t.Log("No Postgres, skipping test")
+		return
+	}
+
+	db := getDBconnForTesting(t)
+	defer db.Close()
+
+	// Prepare some data for the tests
+	const fileID int64 = 1
+	const certfp = "ABFF"
+	const filename = "/etc/ssh/sshd_config"
+	const content = "#PermitRootLogin yes\nPermitRootLogin no\nX11Forwarding yes"
+	const hostname = "acme.example.com"
+	_, err := db.Exec("INSERT INTO files(fileid,filename,certfp,content) "+
+		"VALUES($1,$2,$3,$4)", fileID, filename, certfp, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO hostinfo(certfp,hostname) VALUES($1,$2)",
+		certfp, hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addFileToFastSearch(fileID, certfp, filename, content)
+	defer removeFileFromFastSearch(fileID)
+	fsReady = 1
+
+	api := createAPImuxer(db, false)
+	tests := []apiCall{
+		{
+			methodAndPath: "GET /api/v2/search?re=%5Epermitrootlogin%5Cs%2Bno&fields=hostname",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"hostname":"` + hostname + `"}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/search?q=%5Epermitrootlogin%5Cs%2Bmaybe&regex=true&fields=hostname",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/search?re=permit(root&fields=hostname",
+			expectStatus:  http.StatusBadRequest,
+		},
+		{
+			methodAndPath: "GET /api/v2/grep?re=%5Epermit.*no%24",
+			expectStatus:  http.StatusOK,
+			expectContent: hostname + ":" + filename + ":PermitRootLogin no\n",
+		},
+		{
+			methodAndPath: "GET /api/v2/searchpage?re=x11%5Cw%2B",
+			expectStatus:  http.StatusOK,
+			expectContent: "<em>X11Forwarding</em>",
+		},
+		{
+			methodAndPath: "GET /api/v2/msearch?re1=%5Epermitrootlogin&op2=sub&q2=x11&fields=certfp",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/msearch?re1=%5Epermitrootlogin&op2=and&re2=(&fields=certfp",
+			expectStatus:  http.StatusBadRequest,
+		},
+	}
+	testAPIcalls(t, api, tests)
+}
+
+func TestCaseSensitiveAndWholeWordSearch(t *testing.T) {
+	if os.Getenv("NOPOSTGRES") != "" {
+		t.Log("No Postgres, skipping test")
+		return
+	}
+
+	db := getDBconnForTesting(t)
+	defer db.Close()
+
+	// Prepare some data for the tests
+	const fileID int64 = 1
+	const certfp = "ABFF"
+	const filename = "/etc/ssh/sshd_config"
+	const content = "Port 2222\nPermitRootLogin no\n# permitrootlogin yes"
+	const hostname = "acme.example.com"
+	_, err := db.Exec("INSERT INTO files(fileid,filename,certfp,content) "+
+		"VALUES($1,$2,$3,$4)", fileID, filename, certfp, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO hostinfo(certfp,hostname) VALUES($1,$2)",
+		certfp, hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addFileToFastSearch(fileID, certfp, filename, content)
+	defer removeFileFromFastSearch(fileID)
+	fsReady = 1
+
+	api := createAPImuxer(db, false)
+	tests := []apiCall{
+		{
+			methodAndPath: "GET /api/v2/search?q=PERMITROOTLOGIN&fields=hostname",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"hostname":"` + hostname + `"}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/search?q=PERMITROOTLOGIN&caseSensitive=true&fields=hostname",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/search?re=%5Epermit&caseSensitive=true&fields=hostname",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/search?q=222&wholeWord=true&fields=hostname",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/search?q=2222&wholeWord=true&fields=hostname",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"hostname":"` + hostname + `"}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/grep?q=permit&caseSensitive=true",
+			expectStatus:  http.StatusOK,
+			expectContent: hostname + ":" + filename + ":# permitrootlogin yes\n",
+		},
+		{
+			methodAndPath: "GET /api/v2/searchpage?q=Root&caseSensitive=true",
+			expectStatus:  http.StatusOK,
+			expectContent: "Permit<em>Root</em>Login",
+		},
+		{
+			methodAndPath: "GET /api/v2/msearch?q1=port&wholeWord=true&op2=sub&q2=permit&fields=certfp",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[]`,
+		},
+	}
+	testAPIcalls(t, api, tests)
+}
+
+func TestHistoricalSearch(t *testing.T) {
+	if os.Getenv("NOPOSTGRES") != "" {
+		t.Log("No Postgres, skipping test")
+		return
+	}
+
+	db := getDBconnForTesting(t)
+	defer db.Close()
+
+	// Two hosts with three versions of the same file.
+	// Only the current versions are in the search cache.
+	const filename = "dpkg-query -W"
+	const hostname1, hostname2 = "one.example.com", "two.example.com"
+	files := []struct {
+		fileID   int64
+		certfp   string
+		received string
+		content  string
+		current  bool
+	}{
+		{1, "AA", "2020-01-01T12:00:00Z", "openssl 1.1.1a", false},
+		{2, "AA", "2020-02-01T12:00:00Z", "openssl 1.1.1b", false},
+		{3, "AA", "2020-03-01T12:00:00Z", "openssl 1.1.1c", true},
+		{4, "BB", "2020-01-15T12:00:00Z", "openssl 1.1.1a", false},
+		{5, "BB", "2020-03-15T12:00:00Z", "openssl 1.1.1c", true},
+	}
+	for _, f := range files {
+		_, err := db.Exec("INSERT INTO files(fileid,filename,certfp,received,content,current) "+
+			"VALUES($1,$2,$3,$4,$5,$6)", f.fileID, filename, f.certfp, f.received, f.content, f.current)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.current {
+			addFileToFastSearch(f.fileID, f.certfp, filename, f.content)
+			defer removeFileFromFastSearch(f.fileID)
+		}
+	}
+	_, err := db.Exec("INSERT INTO hostinfo(certfp,hostname,ownergroup) VALUES('AA',$1,'one'),('BB',$2,'two')",
+		hostname1, hostname2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsReady = 1
+
+	api := createAPImuxer(db, false)
+	tests := []apiCall{
+		{
+			methodAndPath: "GET /api/v2/search?q=1.1.1a&fields=fileID",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/search?q=1.1.1a&history=true&fields=fileID,hostname",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"fileID":4,"hostname":"two.example.com"},{"fileID":1,"hostname":"one.example.com"}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/search?q=1.1.1a&asOf=2020-01-20&fields=fileID",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"fileID":4},{"fileID":1}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/search?q=1.1.1a&asOf=2020-02-15T00:00:00Z&fields=fileID",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"fileID":4}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/search?re=1%5C.1%5C.1%5Bab%5D&asOf=2020-02-15T00:00:00Z&fields=fileID",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"fileID":4},{"fileID":2}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/search?q=1.1.1a&asOf=2020-01-20&fields=fileID",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"fileID":1}]`,
+			accessProfile: &AccessProfile{groups: map[string]bool{"one": true}},
+		},
+		{
+			methodAndPath: "GET /api/v2/search?q=1.1.1a&asOf=last+tuesday",
+			expectStatus:  http.StatusBadRequest,
+		},
+		{
+			methodAndPath: "GET /api/v2/msearch?q1=1.1.1b&op2=or&q2=1.1.1a&asOf=2020-02-15&fields=hostname",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"hostname":"one.example.com"},{"hostname":"two.example.com"}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/msearch?q1=1.1.1a&asOf=2020-02-15&fields=hostname",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"hostname":"two.example.com"}]`,
+			accessProfile: &AccessProfile{groups: map[string]bool{"two": true}},
+		},
+	}
+	testAPIcalls(t, api, tests)
+}
+
+func TestMultiStageSearchExpression(t *testing.T) {
+	if os.Getenv("NOPOSTGRES") != "" {
+		t.Log("No Postgres, skipping test")
+		return
+	}
+
+	db := getDBconnForTesting(t)
+	defer db.Close()
+
+	// Prepare some data for the tests
+	const sshdConfig = "/etc/ssh/sshd_config"
+	hosts := []struct {
+		certfp, hostname, os, sshd, motd string
+	}{
+		{"AA", "one.example.com", "RHEL 9", "PermitRootLogin yes", "Welcome"},
+		{"BB", "two.example.com", "RHEL 9", "PermitRootLogin no", "PermitRootLogin yes"},
+		{"CC", "three.example.com", "Fedora 40", "PermitRootLogin yes", ""},
+	}
+	var fileID int64
+	for _, h := range hosts {
+		_, err := db.Exec("INSERT INTO hostinfo(certfp,hostname,os) VALUES($1,$2,$3)",
+			h.certfp, h.hostname, h.os)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for filename, content := range map[string]string{sshdConfig: h.sshd, "/etc/motd": h.motd} {
+			if content == "" {
+				continue
+			}
+			fileID++
+			_, err = db.Exec("INSERT INTO files(fileid,filename,certfp,content) VALUES($1,$2,$3,$4)",
+				fileID, filename, h.certfp, content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addFileToFastSearch(fileID, h.certfp, filename, content)
+			defer removeFileFromFastSearch(fileID)
+		}
+	}
+	fsReady = 1
+
+	api := createAPImuxer(db, false)
+	tests := []apiCall{
+		{
+			methodAndPath: "GET /api/v2/msearch?fields=hostname&query=" + url.QueryEscape(
+				`os:"RHEL 9" AND file:/etc/ssh/sshd_config "PermitRootLogin yes"`),
+			expectStatus: http.StatusOK,
+			expectJSON:   `[{"hostname":"one.example.com"}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/msearch?fields=hostname&query=" + url.QueryEscape(
+				`"PermitRootLogin yes" NOT os:RHEL*`),
+			expectStatus: http.StatusOK,
+			expectJSON:   `[{"hostname":"three.example.com"}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/msearch?fields=hostname&query=" + url.QueryEscape(
+				`NOT file:/etc/motd OR (welcome AND re:"root\\w+ yes")`),
+			expectStatus: http.StatusOK,
+			expectJSON:   `[{"hostname":"one.example.com"},{"hostname":"three.example.com"}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/msearch?fields=hostname&caseSensitive=true&query=" +
+				url.QueryEscape(`welcome`),
+			expectStatus: http.StatusOK,
+			expectJSON:   `[]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/msearch?fields=hostname&regex=true&query=" +
+				url.QueryEscape(`"root\\w+ no"`),
+			expectStatus: http.StatusOK,
+			expectJSON:   `[{"hostname":"two.example.com"}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/msearch?fields=hostname&query=" + url.QueryEscape(`(yes`),
+			expectStatus:  http.StatusBadRequest,
+		},
+		// The numbered parameters still work
+		{
+			methodAndPath: "GET /api/v2/msearch?fields=hostname&q1=yes&f1=/etc/motd",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"hostname":"two.example.com"}]`,
+		},
+	}
+	testAPIcalls(t, api, tests)
+}
@@ -51,13 +51,15 @@ func (vars *apiMethodSearchPage) ServeHTTP(w http.ResponseWriter, req *http.Requ
 
 	// Want to distinguish between q being empty and q missing
 	_, ok := req.Form["q"]
-	if !ok {
+	_, ok2 := req.Form["re"]
+	if !ok && !ok2 {
 		http.Error(w, "Missing parameter: q", http.StatusUnprocessableEntity)
 		return
 	}
 
 	result := new(apiSearchPageResult)
-	result.Query = req.FormValue("q")
+	var opts searchOptions
+	result.Query, opts = searchStringFromRequest(req, "q", "re")
 	if result.Query == "" {
 		// Search for an empty string yields a search result with no hits
 		result.Page = 1
@@ -66,6 +68,12 @@ func (vars *apiMethodSearchPage) ServeHTTP(w http.ResponseWriter, req *http.Requ
 		return
 	}
 
+	sq, hErr := newSearchQuery(result.Query, opts)
+	if hErr != nil {
+		http.Error(w, hErr.message, hErr.code)
+		return
+	}
+
 	result.Page, err = strconv.Atoi(req.FormValue("page"))
 	if err != nil {
 		result.Page = 1
@@ -133,7 +141,11 @@ func (vars *apiMethodSearchPage) ServeHTTP(w http.ResponseWriter, req *http.Requ
 	}
 
 	// Finally, we can perform the search
-	hitIDs, distinctFilenames = searchFilesWithFilter(result.Query, filename, validCerts)
+	hitIDs, distinctFilenames, hErr = searchFilesWithFilter(sq, filename, validCerts)
+	if hErr != nil {
+		http.Error(w, hErr.message, hErr.code)
+		return
+	}
 
 	// Put together a data structure with the results
 	result.NumHits = len(hitIDs)
@@ -174,7 +186,7 @@ func (vars *apiMethodSearchPage) ServeHTTP(w http.ResponseWriter, req *http.Requ
 		hit.CertFP = jsonString(certfp)
 		hit.IsCommand = isCommand.Bool
 		hit.DisplayNumber = i + 1
-		hit.Excerpt = createExcerpt(fileID, content.String, result.Query)
+		hit.Excerpt = createExcerpt(fileID, content.String, sq)
 		result.Hits = append(result.Hits, hit)
 	}
 
@@ -206,27 +218,32 @@ func Min(x, y int) int {
 	return y
 }
 
-func createExcerpt(fileID int64, content string, query string) string {
+func createExcerpt(fileID int64, content string, q *searchQuery) string {
 	var buffer bytes.Buffer
-	// use a fast function to find locations where the query string matched
-	for _, i := range findMatchesInFile(fileID, query, 3) {
+	// use a fast function to find locations where the query matched
+	for _, match := range findMatchesInFile(fileID, q, 3) {
+		i, j := match[0], match[1]
+		if j > len(content) {
+			// The lowercase version of the content may differ in length
+			break
+		}
 		// include some context, try to cut off at word boundaries
 		start := Max(i-30, 0)
 		cutoff := strings.IndexAny(content[start:i], " \n\t")
 		if cutoff != -1 {
 			start = start + cutoff + 1
 		}
-		end := Min(i+len(query)+30, len(content))
-		cutoff = strings.LastIndexAny(content[i+len(query):end], " \n\t")
+		end := Min(j+30, len(content))
+		cutoff = strings.LastIndexAny(content[j:end], " \n\t")
 		if cutoff != -1 {
-			end = i + len(query) + cutoff
+			end = j + cutoff
 		}
 		// html-escape and add <em>-tags
 		buffer.WriteString(html.EscapeString(content[start:i]))
 		buffer.WriteString("<em>")
-		buffer.WriteString(html.EscapeString(content[i : i+len(query)]))
+		buffer.WriteString(html.EscapeString(content[i:j]))
 		buffer.WriteString("</em>")
-		buffer.WriteString(html.EscapeString(content[i+len(query) : end]))
+		buffer.WriteString(html.EscapeString(content[j:end]))
 		buffer.WriteString("<br>")
 	}
 	return buffer.String()
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"os"
 	"reflect"
+	"runtime"
 )
 
 type apiMethodStatus struct {
@@ -26,11 +27,15 @@ func (vars *apiMethodStatus) ServeHTTP(w http.ResponseWriter, req *http.Request)
 		ParseQueueSize              int                `json:"parseQueueSize"`
 		TaskQueueSize               int                `json:"taskQueueSize"`
 		FailingTasks                int                `json:"failingTasks"`
+		DeadTasks                   int                `json:"deadTasks"`
 		AgeOfNewestFile             float32            `json:"ageOfNewestFile"`
 		ThroughputPerSecond         float32            `json:"throughputPerSecond"`
+		SearchCacheMemory           int64              `json:"searchCacheMemory"`
+		MemoryInUse                 uint64             `json:"memoryInUse"`
 		LastExecutionTime           map[string]float32 `json:"lastExecutionTime"`
 		Errors                      map[string]string  `json:"errors"`
 		Version                     jsonString         `json:"version"`
+		Leader                      bool               `json:"leader"`
 	}
 	status := Status{}
 
@@ -63,6 +68,7 @@ func (vars *apiMethodStatus) ServeHTTP(w http.ResponseWriter, req *http.Request)
 	// LastExecutionTime
 	status.LastExecutionTime = make(map[string]float32, len(jobs))
 	status.Errors = make(map[string]string)
+	jobsMutex.Lock()
 	for _, job := range jobs {
 		t := reflect.TypeOf(job.job)
 		status.LastExecutionTime[t.Name()] = float32(job.lastExecutionTime.Seconds())
@@ -70,6 +76,7 @@ func (vars *apiMethodStatus) ServeHTTP(w http.ResponseWriter, req *http.Request)
 			status.Errors[t.Name()] = fmt.Sprintf("%v", job.panicObject)
 		}
 	}
+	jobsMutex.Unlock()
 
 	// IncomingQueueSize
 	// TODO optimize for large directories
@@ -88,12 +95,17 @@ func (vars *apiMethodStatus) ServeHTTP(w http.ResponseWriter, req *http.Request)
 		Scan(&status.ParseQueueSize)
 
 	// TaskQueueSize
-	vars.db.QueryRow("SELECT count(*) FROM tasks").Scan(&status.TaskQueueSize)
+	vars.db.QueryRow("SELECT count(*) FROM tasks WHERE status<$1", taskStatusDead).
+		Scan(&status.TaskQueueSize)
 
 	// FailingTasks
-	vars.db.QueryRow("SELECT count(*) FROM tasks WHERE status>0").
+	vars.db.QueryRow("SELECT count(*) FROM tasks WHERE status=$1", taskStatusFailing).
 		Scan(&status.FailingTasks)
 
+	// DeadTasks
+	vars.db.QueryRow("SELECT count(*) FROM tasks WHERE status=$1", taskStatusDead).
+		Scan(&status.DeadTasks)
+
 	// AgeOfNewestFile
 	var t sql.NullFloat64
 	status.AgeOfNewestFile = -1
@@ -106,11 +118,25 @@ func (vars *apiMethodStatus) ServeHTTP(w http.ResponseWriter, req *http.Request)
 	// ThroughputPerSecond
 	status.ThroughputPerSecond = float32(pfib.Sum() / 60.0)
 
+	// SearchCacheMemory (an estimate, in bytes)
+	status.SearchCacheMemory = -1
+	if isReadyForSearch() {
+		status.SearchCacheMemory = searchCacheMemoryUsage()
+	}
+
+	// MemoryInUse (bytes of heap memory used by the server)
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	status.MemoryInUse = mem.HeapInuse
+
 	// Version
 	if version != "" {
 		status.Version.String = version
 		status.Version.Valid = true
 	}
 
+	// Leader (whether this server instance runs the jobs that aren't local)
+	status.Leader = isLeader()
+
 	returnJSON(w, req, status)
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+//  GET    /api/v2/tasks[?status=new|failing|dead][&type=...][&limit=n] - list tasks, oldest first
+//  GET    /api/v2/tasks/<id>        - one task
+//  POST   /api/v2/tasks/<id>/retry  - run the task again as soon as possible, even if it is dead
+//  DELETE /api/v2/tasks/<id>        - discard the task
+
+type apiMethodTasks struct {
+	db *sql.DB
+}
+
+type apiTask struct {
+	TaskID    int64      `json:"taskId"`
+	Type      string     `json:"type"`
+	URL       jsonString `json:"url"`
+	Status    string     `json:"status"`
+	Attempts  int        `json:"attempts"`
+	Created   jsonTime   `json:"created"`
+	LastTry   jsonTime   `json:"lastTry"`
+	NextTry   jsonTime   `json:"nextTry"`
+	LastError jsonString `json:"lastError"`
+	// ClaimedUntil is set while a server instance runs the task
+	ClaimedUntil jsonTime `json:"claimedUntil"`
+}
+
+var taskStatusNames = map[int]string{
+	taskStatusNew:     "new",
+	taskStatusFailing: "failing",
+	taskStatusDead:    "dead",
+}
+
+const taskSelectStatement = "SELECT taskid, type, url, status, attempts, created, lasttry, delay, lasterror, claimed_until FROM tasks"
+
+func (vars *apiMethodTasks) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/v2/tasks"), "/"), "/")
+	if path[0] == "" {
+		if req.Method != httpGET {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		vars.list(w, req)
+		return
+	}
+	taskID, err := strconv.ParseInt(path[0], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid task ID", http.StatusBadRequest)
+		return
+	}
+	switch {
+	case len(path) == 1 && req.Method == httpGET:
+		vars.get(w, req, taskID)
+	case len(path) == 1 && req.Method == httpDELETE:
+		vars.discard(w, req, taskID)
+	case len(path) == 2 && path[1] == "retry" && req.Method == httpPOST:
+		vars.retry(w, req, taskID)
+	case len(path) > 2 || (len(path) == 2 && path[1] != "retry"):
+		http.Error(w, "Not found.", http.StatusNotFound)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (vars *apiMethodTasks) list(w http.ResponseWriter, req *http.Request) {
+	statement := taskSelectStatement + " WHERE true"
+	args := make([]interface{}, 0)
+	if s := req.FormValue("status"); s != "" {
+		status := -1
+		for k, v := range taskStatusNames {
+			if v == s {
+				status = k
+			}
+		}
+		if status < 0 {
+			http.Error(w, "Invalid value for parameter: status", http.StatusBadRequest)
+			return
+		}
+		args = append(args, status)
+		statement += fmt.Sprintf(" AND status=$%d", len(args))
+	}
+	if s := req.FormValue("type"); s != "" {
+		args = append(args, s)
+		statement += fmt.Sprintf(" AND type=$%d", len(args))
+	}
+	limit := 100
+	if s := req.FormValue("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 {
+			http.Error(w, "Invalid value for parameter: limit", http.StatusBadRequest)
+			return
+		}
+	}
+	args = append(args, limit)
+	statement += fmt.Sprintf(" ORDER BY taskid LIMIT $%d", len(args))
+	rows, err := vars.db.Query(statement, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	result := make([]apiTask, 0)
+	for rows.Next() {
+		task, err := scanAPITask(rows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result = append(result, task)
+	}
+	if err = rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	returnJSON(w, req, result)
+}
+
+func (vars *apiMethodTasks) get(w http.ResponseWriter, req *http.Request, taskID int64) {
+	task, err := scanAPITask(vars.db.QueryRow(taskSelectStatement+" WHERE taskid=$1", taskID))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Task not found.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	returnJSON(w, req, task)
+}
+
+func (vars *apiMethodTasks) retry(w http.ResponseWriter, req *http.Request, taskID int64) {
+	// The error from the last attempt is kept, for reference
+	res, err := vars.db.Exec("UPDATE tasks SET status=$1, attempts=0, delay=0, delay2=0, lasttry=null "+
+		"WHERE taskid=$2", taskStatusNew, taskID)
+	vars.respondToChange(w, res, err)
+}
+
+func (vars *apiMethodTasks) discard(w http.ResponseWriter, req *http.Request, taskID int64) {
+	res, err := vars.db.Exec("DELETE FROM tasks WHERE taskid=$1", taskID)
+	vars.respondToChange(w, res, err)
+}
+
+func (vars *apiMethodTasks) respondToChange(w http.ResponseWriter, res sql.Result, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Task not found.", http.StatusNotFound)
+		return
+	}
+	http.Error(w, "", http.StatusNoContent) // 204 OK
+}
+
+func scanAPITask(row RowScanner) (apiTask, error) {
+	var task apiTask
+	var status, delay int
+	var created, lasttry, claimedUntil pq.NullTime
+	var url, lasterror sql.NullString
+	err := row.Scan(&task.TaskID, &task.Type, &url, &status, &task.Attempts,
+		&created, &lasttry, &delay, &lasterror, &claimedUntil)
+	if err != nil {
+		return task, err
+	}
+	task.Status = taskStatusNames[status]
+	task.URL = jsonString(url)
+	task.Created = jsonTime(created)
+	task.LastTry = jsonTime(lasttry)
+	task.LastError = jsonString(lasterror)
+	if claimedUntil.Valid && claimedUntil.Time.After(time.Now()) {
+		task.ClaimedUntil = jsonTime(claimedUntil)
+	}
+	// Dead tasks aren't retried. New tasks are run as soon as possible.
+	if status != taskStatusDead {
+		next := time.Now()
+		if lasttry.Valid && lasttry.Time.Add(time.Duration(delay)*time.Second).After(next) {
+			next = lasttry.Time.Add(time.Duration(delay) * time.Second)
+		}
+		task.NextTry = jsonTime(pq.NullTime{Time: next, Valid: true})
+	}
+	return task, nil
+}
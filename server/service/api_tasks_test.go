@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestExecuteTask(t *testing.T) {
+	if os.Getenv("NOPOSTGRES") != "" {
+		t.Log("No Postgres, skipping test")
+		return
+	}
+	db := getDBconnForTesting(t)
+	defer db.Close()
+
+	RegisterTaskType("testfail", func(arg string, db *sql.DB) error {
+		// The claim is committed before the handler runs, and the backoff is left alone
+		var claimed bool
+		err := db.QueryRow("SELECT claimed_until > now() FROM tasks WHERE url=$1", arg).Scan(&claimed)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			t.Error("The task wasn't claimed")
+		}
+		return errors.New("failed " + arg)
+	})
+	defer delete(taskHandlers, "testfail")
+	savedMax := config.TaskMaxAttempts
+	defer func() { config.TaskMaxAttempts = savedMax }()
+	config.TaskMaxAttempts = 2
+
+	if err := enqueueTask(db, "nosuchtype", "x"); err == nil {
+		t.Error("Expected an error when enqueueing a task of an unknown type")
+	}
+	if err := enqueueTask(db, "testfail", "abc"); err != nil {
+		t.Fatal(err)
+	}
+	// A duplicate is ignored
+	if err := enqueueTask(db, "testfail", "abc"); err != nil {
+		t.Fatal(err)
+	}
+	// Tasks of unknown types can only come from elsewhere, e.g. an older or newer server version
+	_, err := db.Exec("INSERT INTO tasks(type,url) VALUES('nosuchtype','x')")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readTask := func(taskType string) Task {
+		var task Task
+		var lasttry pq.NullTime
+		err := db.QueryRow("SELECT taskid,url,lasttry,status,delay,delay2,attempts FROM tasks WHERE type=$1",
+			taskType).Scan(&task.taskid, &task.url, &lasttry, &task.status, &task.delay,
+			&task.delay2, &task.attempts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		task.taskType = taskType
+		task.lasttry = lasttry.Time
+		return task
+	}
+	checkTask := func(taskType string, status int, attempts int, lasterror string) {
+		t.Helper()
+		var s, a int
+		var e sql.NullString
+		err := db.QueryRow("SELECT status,attempts,lasterror FROM tasks WHERE type=$1", taskType).
+			Scan(&s, &a, &e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != status || a != attempts || e.String != lasterror {
+			t.Errorf("Task %s: expected status %d, attempts %d, error \"%s\", got %d, %d, \"%s\"",
+				taskType, status, attempts, lasterror, s, a, e.String)
+		}
+	}
+
+	executeTask(db, readTask("nosuchtype"))
+	checkTask("nosuchtype", taskStatusDead, 1, "unknown task type: nosuchtype")
+
+	executeTask(db, readTask("testfail"))
+	checkTask("testfail", taskStatusFailing, 1, "failed abc")
+
+	// A task that has been tried by someone else since it was read is skipped
+	task := readTask("testfail")
+	db.Exec("UPDATE tasks SET lasttry=$1 WHERE taskid=$2", time.Now(), task.taskid)
+	executeTask(db, task)
+	checkTask("testfail", taskStatusFailing, 1, "failed abc")
+
+	executeTask(db, readTask("testfail"))
+	checkTask("testfail", taskStatusDead, 2, "failed abc")
+
+	// Dead tasks aren't run
+	executeTask(db, readTask("testfail"))
+	checkTask("testfail", taskStatusDead, 2, "failed abc")
+}
+
+func TestApiMethodTasks(t *testing.T) {
+	if os.Getenv("NOPOSTGRES") != "" {
+		t.Log("No Postgres, skipping test")
+		return
+	}
+	db := getDBconnForTesting(t)
+	defer db.Close()
+
+	_, err := db.Exec("INSERT INTO tasks(taskid,type,url,status,attempts,lasttry,delay,lasterror) VALUES" +
+		"(1,'archive','a.tgz',0,0,null,0,null)," +
+		"(2,'archive','b.tgz',1,3,now(),3,'disk full')," +
+		"(3,'other','c',2,25,now(),86400,'no such thing')," +
+		"(5,'other',null,1,1,now(),1,'no url')")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := createAPImuxer(db, false)
+	testAPIcalls(t, api, []apiCall{
+		{
+			methodAndPath: "GET /api/v2/tasks?status=dead",
+			expectStatus:  http.StatusOK,
+			expectContent: `"taskId": 3,
+    "type": "other",
+    "url": "c",
+    "status": "dead",
+    "attempts": 25,`,
+		},
+		{
+			methodAndPath: "GET /api/v2/tasks?status=dead",
+			expectStatus:  http.StatusOK,
+			expectContent: `"nextTry": null,
+    "lastError": "no such thing"`,
+		},
+		{
+			methodAndPath: "GET /api/v2/tasks?type=archive&limit=1",
+			expectStatus:  http.StatusOK,
+			expectContent: `"url": "a.tgz"`,
+		},
+		{
+			methodAndPath: "GET /api/v2/tasks?status=sleepy",
+			expectStatus:  http.StatusBadRequest,
+		},
+		{
+			methodAndPath: "GET /api/v2/tasks?limit=0",
+			expectStatus:  http.StatusBadRequest,
+		},
+		{
+			methodAndPath: "GET /api/v2/tasks/2",
+			expectStatus:  http.StatusOK,
+			expectContent: `"status": "failing"`,
+		},
+		{
+			methodAndPath: "GET /api/v2/tasks/4",
+			expectStatus:  http.StatusNotFound,
+		},
+		// The url column can be null
+		{
+			methodAndPath: "GET /api/v2/tasks/5",
+			expectStatus:  http.StatusOK,
+			expectContent: `"url": null,`,
+		},
+		{
+			methodAndPath: "GET /api/v2/tasks/abc",
+			expectStatus:  http.StatusBadRequest,
+		},
+		{
+			methodAndPath: "POST /api/v2/tasks",
+			expectStatus:  http.StatusMethodNotAllowed,
+		},
+		// Retry the dead task
+		{
+			methodAndPath: "POST /api/v2/tasks/3/retry",
+			expectStatus:  http.StatusNoContent,
+		},
+		{
+			methodAndPath: "GET /api/v2/tasks/3",
+			expectStatus:  http.StatusOK,
+			expectContent: `"status": "new",
+  "attempts": 0,`,
+		},
+		{
+			methodAndPath: "POST /api/v2/tasks/4/retry",
+			expectStatus:  http.StatusNotFound,
+		},
+		// Discard a task
+		{
+			methodAndPath: "DELETE /api/v2/tasks/2",
+			expectStatus:  http.StatusNoContent,
+		},
+		{
+			methodAndPath: "DELETE /api/v2/tasks/2",
+			expectStatus:  http.StatusNotFound,
+		},
+		{
+			methodAndPath: "GET /api/v2/tasks",
+			expectStatus:  http.StatusOK,
+			expectContent: `"url": "c"`,
+		},
+	})
+}
+
+func TestRenewTaskClaim(t *testing.T) {
+	if os.Getenv("NOPOSTGRES") != "" {
+		t.Log("No Postgres, skipping test")
+		return
+	}
+	db := getDBconnForTesting(t)
+	defer db.Close()
+
+	savedInterval := taskClaimRenewInterval
+	defer func() { taskClaimRenewInterval = savedInterval }()
+	taskClaimRenewInterval = 10 * time.Millisecond
+
+	var taskid int64
+	err := db.QueryRow("INSERT INTO tasks(type,url,lasttry,delay) " +
+		"VALUES('archive','x',now() - interval '1 hour',600) RETURNING taskid").Scan(&taskid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A task that runs longer than the claim is still claimed when it finishes
+	stop := renewTaskClaim(db, taskid)
+	time.Sleep(50 * time.Millisecond)
+	stop()
+	var claimed bool
+	var delay int
+	var lasttry time.Time
+	err = db.QueryRow("SELECT claimed_until > now() + interval '5 minutes', delay, lasttry "+
+		"FROM tasks WHERE taskid=$1", taskid).Scan(&claimed, &delay, &lasttry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claimed {
+		t.Error("The claim wasn't renewed")
+	}
+	if delay != 600 {
+		t.Errorf("The claim changed the delay to %d", delay)
+	}
+	// Another instance can't claim it
+	ok, err := claimTask(db, Task{taskid: taskid, taskType: "archive", url: "x", lasttry: lasttry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("Claimed a task that was already claimed")
+	}
+	// When the claim has expired, e.g. because the server instance stopped, it can be claimed again
+	if _, err = db.Exec("UPDATE tasks SET claimed_until = now() - interval '1 second' WHERE taskid=$1", taskid); err != nil {
+		t.Fatal(err)
+	}
+	ok, err = claimTask(db, Task{taskid: taskid, taskType: "archive", url: "x", lasttry: lasttry})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("Couldn't claim a task when the claim had expired")
+	}
+}
@@ -376,6 +376,13 @@ func (vars *apiMethodRenewCert) ServeHTTP(w http.ResponseWriter, req *http.Reque
 			log.Println("Failed to update files table " + err.Error())
 			return err
 		}
+
+		// Saved searches would report the new certificate as a host that entered, and the old as one that left
+		_, err = tx.Exec("UPDATE savedsearch_hosts SET certfp = $1 WHERE certfp = $2", clientFP, fingerprint)
+		if err != nil {
+			log.Println("Failed to update savedsearch_hosts table " + err.Error())
+			return err
+		}
 		// everything ok
 		return nil
 	})
@@ -386,8 +393,7 @@ func (vars *apiMethodRenewCert) ServeHTTP(w http.ResponseWriter, req *http.Reque
 		return
 	}
 
-	requestURL := fmt.Sprintf("http://nivlheimapi:4040/api/internal/replaceCertificate?old=%s&new=%s", fingerprint, clientFP)
-	_, _ = http.Get(requestURL)
+	// The search cache is updated by a notification from the database (see fastSearchNotify.go)
 
 	fmt.Fprint(w, clientCRTText)
 	fmt.Fprint(w, keyString)
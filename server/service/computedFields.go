@@ -0,0 +1,333 @@
+package main
+
+// A computed custom field has a value that is computed from other fields of the host,
+// using an expression (see fieldExpression.go), instead of being extracted from a file.
+// The values are stored in hostinfo_customfields like the other custom fields,
+// so they can be used in searches, sorting and counting the same way.
+// They are computed again every time parseFile has updated a host,
+// and by computedFieldsJob for all hosts when a field is created or changed.
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+type computedFieldsJob struct{}
+
+func init() {
+	RegisterJob(computedFieldsJob{})
+}
+
+// HowOften is only a fallback, since most changes are caught by parseFile.
+// Hostnames are set by handleDNSchangesJob, for example.
+func (job computedFieldsJob) HowOften() time.Duration {
+	return time.Hour
+}
+
+func (job computedFieldsJob) Run(ctx context.Context, db *sql.DB) {
+	fields, err := loadCustomFields(db, "expression IS NOT NULL")
+	if err != nil {
+		log.Panic(err)
+	}
+	if len(fields) == 0 {
+		return
+	}
+	list, err := QueryColumn(db, "SELECT certfp FROM hostinfo")
+	if err != nil {
+		log.Panic(err)
+	}
+	for _, c := range list {
+		if ctx.Err() != nil {
+			return
+		}
+		certfp, ok := c.(string)
+		if !ok {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			log.Panic(err)
+		}
+		if err = computeFieldsForHost(tx, certfp, fields); err != nil {
+			tx.Rollback()
+			log.Panic(err)
+		}
+		if err = tx.Commit(); err != nil {
+			log.Panic(err)
+		}
+	}
+}
+
+// updateComputedFields computes the values of all the computed fields for a host
+func updateComputedFields(tx *sql.Tx, certfp string) error {
+	fields, err := loadCustomFields(tx, "expression IS NOT NULL")
+	if err != nil || len(fields) == 0 {
+		return err
+	}
+	return computeFieldsForHost(tx, certfp, fields)
+}
+
+// computeFieldsForHost computes the values of the given fields for a host, and stores the ones that changed.
+// Errors in the expressions are logged, database errors are returned.
+func computeFieldsForHost(tx *sql.Tx, certfp string, fields []*customField) error {
+	names := make(map[string]bool)
+	for _, f := range fields {
+		_, fieldNames, err := parseFieldExpression(f.expression)
+		if err != nil {
+			continue
+		}
+		for _, name := range fieldNames {
+			names[name] = true
+		}
+	}
+	env, current, err := loadHostFieldValues(tx, certfp, names)
+	if err != nil || env == nil {
+		return err
+	}
+	for _, f := range fields {
+		value, err := f.compute(env)
+		if err != nil {
+			if err != errNoMatch {
+				log.Printf("Computed field %s for %s: %s", f.name, certfp, err)
+			}
+			if _, ok := current[f.fieldID]; ok {
+				_, err = tx.Exec("DELETE FROM hostinfo_customfields WHERE certfp=$1 AND fieldid=$2",
+					certfp, f.fieldID)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		old, ok := current[f.fieldID]
+		switch {
+		case !ok:
+			_, err = tx.Exec("INSERT INTO hostinfo_customfields(certfp,fieldid,value) VALUES($1,$2,$3)",
+				certfp, f.fieldID, value)
+		case !old.Valid || old.String != value:
+			_, err = tx.Exec("UPDATE hostinfo_customfields SET value=$1 WHERE certfp=$2 AND fieldid=$3",
+				value, certfp, f.fieldID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadHostFieldValues returns the values of the named fields for a host, in the form that
+// the expressions use, with lowercase names as keys. It also returns the current values
+// of the computed fields, with field IDs as keys. If the host doesn't exist, env is nil.
+func loadHostFieldValues(tx *sql.Tx, certfp string, names map[string]bool) (env map[string]interface{},
+	current map[int]sql.NullString, err error) {
+	env = make(map[string]interface{}, len(names))
+	columns := make([]string, 0)
+	publicNames := make([]string, 0)
+	for _, f := range apiHostListStandardFields {
+		name := strings.ToLower(f.publicName)
+		if !names[name] {
+			continue
+		}
+		if f.expression != "" {
+			columns = append(columns, f.expression)
+		} else {
+			columns = append(columns, f.columnName)
+		}
+		publicNames = append(publicNames, name)
+	}
+	if len(columns) == 0 {
+		columns = append(columns, "certfp")
+	}
+	values := make([]sql.NullString, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	err = tx.QueryRow("SELECT "+strings.Join(columns, ",")+" FROM hostinfo h WHERE certfp=$1",
+		certfp).Scan(pointers...)
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, name := range publicNames {
+		if values[i].Valid {
+			env[name] = values[i].String
+		}
+	}
+
+	rows, err := tx.Query("SELECT c.fieldid, c.name, c.type, c.multiple, c.expression IS NOT NULL, v.value "+
+		"FROM hostinfo_customfields v JOIN customfields c ON c.fieldid=v.fieldid WHERE v.certfp=$1", certfp)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	current = make(map[int]sql.NullString)
+	for rows.Next() {
+		var f customField
+		var computed bool
+		var value sql.NullString
+		if err = rows.Scan(&f.fieldID, &f.name, &f.valueType, &f.multiple, &computed, &value); err != nil {
+			return nil, nil, err
+		}
+		if computed {
+			current[f.fieldID] = value
+		} else if names[f.name] && value.Valid {
+			env[f.name] = f.exprValue(value.String)
+		}
+	}
+	return env, current, rows.Err()
+}
+
+// exprValue converts a stored value of the field to the form that the expressions use
+func (f *customField) exprValue(value string) interface{} {
+	if f.multiple {
+		list := make([]string, 0)
+		if json.Unmarshal([]byte(value), &list) != nil {
+			return nil
+		}
+		result := make([]interface{}, len(list))
+		for i, s := range list {
+			result[i] = (&customField{valueType: f.valueType}).exprValue(s)
+		}
+		return result
+	}
+	switch f.valueType {
+	case "int", "float":
+		if n, ok := exprNumber(value); ok {
+			return n
+		}
+	case "bool":
+		return value == "true"
+	}
+	return value
+}
+
+// compileExpression parses the expression of a computed field, once
+func (f *customField) compileExpression() (exprNode, error) {
+	if f.program != nil {
+		return f.program, nil
+	}
+	program, _, err := parseFieldExpression(f.expression)
+	if err != nil {
+		return nil, err
+	}
+	f.program = program
+	return program, nil
+}
+
+// compute evaluates the expression of a computed field, and returns the value
+// in the same form as extract does. A null result gives errNoMatch.
+func (f *customField) compute(env map[string]interface{}) (string, error) {
+	program, err := f.compileExpression()
+	if err != nil {
+		return "", err
+	}
+	result, err := program.eval(env)
+	if err != nil {
+		return "", err
+	}
+	if result == nil {
+		return "", errNoMatch
+	}
+	list, isList := result.([]interface{})
+	if isList && !f.multiple {
+		return "", fmt.Errorf("the result is a list, but the field only has one value")
+	}
+	if !isList {
+		list = []interface{}{result}
+	}
+	values := make([]string, 0, len(list))
+	for _, v := range list {
+		if v == nil {
+			continue
+		}
+		s, err := normalizeCustomFieldValue(f.valueType, exprString(v))
+		if err != nil {
+			return "", err
+		}
+		values = append(values, s)
+	}
+	if len(values) == 0 {
+		return "", errNoMatch
+	}
+	if !f.multiple {
+		return values[0], nil
+	}
+	b, err := json.Marshal(values)
+	return string(b), err
+}
+
+// validateFieldExpression checks the syntax of an expression, and that it only refers to
+// fields that exist and aren't computed themselves.
+func validateFieldExpression(q queryer, expression string) error {
+	_, names, err := parseFieldExpression(expression)
+	if err != nil {
+		return err
+	}
+	known := make(map[string]bool)
+	for _, f := range apiHostListStandardFields {
+		known[strings.ToLower(f.publicName)] = true
+	}
+	customFields, err := getCustomFieldMap(q)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if f, ok := customFields[name]; ok {
+			if f.expression != "" {
+				return fmt.Errorf("%s is a computed field, and can't be used in an expression", name)
+			}
+			continue
+		}
+		if !known[name] {
+			return fmt.Errorf("unknown field %s", name)
+		}
+	}
+	return nil
+}
+
+// fieldDependants returns the names of the computed fields with expressions that refer to the named field.
+// Such a field can't be renamed, deleted or become computed itself, since the expressions would stop working.
+func fieldDependants(q queryer, name string) ([]string, error) {
+	customFields, err := getCustomFieldMap(q)
+	if err != nil {
+		return nil, err
+	}
+	name = strings.ToLower(name)
+	result := make([]string, 0)
+	for _, f := range customFields {
+		if f.expression == "" || strings.ToLower(f.name) == name {
+			continue
+		}
+		if _, names, err := parseFieldExpression(f.expression); err == nil && contains(name, names) {
+			result = append(result, f.name)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// checkFieldDependants writes a 409 Conflict response and returns false
+// if any computed fields refer to the named field
+func checkFieldDependants(w http.ResponseWriter, q queryer, name string) bool {
+	dependants, err := fieldDependants(q, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if len(dependants) > 0 {
+		http.Error(w, "The field is used in the expressions of these computed fields: "+
+			strings.Join(dependants, ","), http.StatusConflict)
+		return false
+	}
+	return true
+}
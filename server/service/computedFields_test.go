@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestComputedFields(t *testing.T) {
+	if os.Getenv("NOPOSTGRES") != "" {
+		t.Log("No Postgres, skipping test")
+		return
+	}
+	db := getDBconnForTesting(t)
+	defer db.Close()
+
+	api := createAPImuxer(db, false)
+	testAPIcalls(t, api, []apiCall{
+		{
+			methodAndPath: "POST /api/v2/settings/customfields",
+			body:          "name=cores&filename=/etc/hwinfo&regexp=cores%3D(.*)&type=int",
+			expectStatus:  http.StatusCreated,
+		},
+		{
+			methodAndPath: "POST /api/v2/settings/customfields",
+			body:          "name=eol&expression=" + url.QueryEscape(`os in ("RHEL 7", "CentOS 7")`) + "&type=bool",
+			expectStatus:  http.StatusCreated,
+		},
+		{
+			methodAndPath: "POST /api/v2/settings/customfields",
+			body:          "name=kernelmajor&expression=" + url.QueryEscape(`split(kernel, ".")[0]`) + "&type=int",
+			expectStatus:  http.StatusCreated,
+		},
+		{
+			methodAndPath: "POST /api/v2/settings/customfields",
+			body:          "name=big&expression=" + url.QueryEscape(`cores >= 16`),
+			expectStatus:  http.StatusCreated,
+		},
+		// Invalid expressions and combinations
+		{
+			methodAndPath: "POST /api/v2/settings/customfields",
+			body:          "name=bad&expression=" + url.QueryEscape(`os in`),
+			expectStatus:  http.StatusBadRequest,
+		},
+		{
+			methodAndPath: "POST /api/v2/settings/customfields",
+			body:          "name=bad&expression=" + url.QueryEscape(`nosuchfield = 1`),
+			expectStatus:  http.StatusBadRequest,
+			expectContent: "Invalid expression: unknown field nosuchfield",
+		},
+		{
+			methodAndPath: "POST /api/v2/settings/customfields",
+			body:          "name=bad&expression=" + url.QueryEscape(`not eol`),
+			expectStatus:  http.StatusBadRequest,
+			expectContent: "eol is a computed field",
+		},
+		{
+			methodAndPath: "POST /api/v2/settings/customfields",
+			body:          "name=bad&expression=os&filename=/etc/redhat-release",
+			expectStatus:  http.StatusBadRequest,
+		},
+		{
+			methodAndPath: "GET /api/v2/settings/customfields/eol?fields=filename,type,expression",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `{"filename":null,"type":"bool","expression":"os in (\"RHEL 7\", \"CentOS 7\")"}`,
+		},
+	})
+
+	hosts := []struct {
+		certfp, hostname, os, kernel, cores string
+	}{
+		{"AA", "one.example.com", "RHEL 7", "3.10.0-1160.el7.x86_64", "cores=8"},
+		{"BB", "two.example.com", "RHEL 9", "5.14.0-70.el9.x86_64", "cores=32"},
+		{"CC", "three.example.com", "CentOS 7", "3.10.0-957.el7.x86_64", "cores=16"},
+	}
+	for i, h := range hosts {
+		_, err := db.Exec("INSERT INTO hostinfo(certfp,hostname,os,kernel) VALUES($1,$2,$3,$4)",
+			h.certfp, h.hostname, h.os, h.kernel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec("INSERT INTO files(fileid,certfp,filename,content,received,current) "+
+			"VALUES($1,$2,'/etc/hwinfo',$3,now(),true)", i+1, h.certfp, h.cores)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parseFile(db, int64(i+1))
+	}
+
+	testAPIcalls(t, api, []apiCall{
+		{
+			methodAndPath: "GET /api/v2/hostlist?fields=hostname,eol,kernelmajor,big&sort=hostname",
+			expectStatus:  http.StatusOK,
+			expectJSON: `[{"hostname":"one.example.com","eol":"true","kernelmajor":"3","big":"false"},` +
+				`{"hostname":"three.example.com","eol":"true","kernelmajor":"3","big":"true"},` +
+				`{"hostname":"two.example.com","eol":"false","kernelmajor":"5","big":"true"}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/hostlist?fields=hostname&eol=true&kernelmajor<4&big=true",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"hostname":"three.example.com"}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/hostlist?fields=eol&count=1&sort=eol",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"eol":"false","count":1},{"eol":"true","count":2}]`,
+		},
+	})
+
+	// A change that doesn't come from a file is picked up by the job
+	_, err := db.Exec("UPDATE hostinfo SET os='RHEL 8', kernel='4.18.0-80.el8.x86_64' WHERE certfp='AA'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	computedFieldsJob{}.Run(context.Background(), db)
+	testAPIcalls(t, api, []apiCall{
+		{
+			methodAndPath: "GET /api/v2/hostlist?fields=hostname,eol,kernelmajor&hostname=one.example.com",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"hostname":"one.example.com","eol":"false","kernelmajor":"4"}]`,
+		},
+		// Changing the expression
+		{
+			methodAndPath: "PUT /api/v2/settings/customfields/eol",
+			body:          "expression=" + url.QueryEscape(`os in ("RHEL 8")`),
+			expectStatus:  http.StatusNoContent,
+		},
+	})
+	computedFieldsJob{}.Run(context.Background(), db)
+	testAPIcalls(t, api, []apiCall{
+		{
+			methodAndPath: "GET /api/v2/hostlist?fields=hostname&eol=true",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"hostname":"one.example.com"}]`,
+		},
+		// A field that is used in an expression can't be renamed, deleted or computed
+		{
+			methodAndPath: "DELETE /api/v2/settings/customfields/cores",
+			expectStatus:  http.StatusConflict,
+			expectContent: "computed fields: big",
+		},
+		{
+			methodAndPath: "PUT /api/v2/settings/customfields/cores",
+			body:          "name=cpucores",
+			expectStatus:  http.StatusConflict,
+		},
+		{
+			methodAndPath: "PUT /api/v2/settings/customfields/cores",
+			body:          "expression=" + url.QueryEscape(`16`),
+			expectStatus:  http.StatusConflict,
+		},
+		{
+			methodAndPath: "PUT /api/v2/settings/customfields/cores",
+			body:          "filename=/etc/hwinfo&regexp=cpus%3D(.*)",
+			expectStatus:  http.StatusNoContent,
+		},
+		{
+			methodAndPath: "DELETE /api/v2/settings/customfields/big",
+			expectStatus:  http.StatusNoContent,
+		},
+		{
+			methodAndPath: "DELETE /api/v2/settings/customfields/cores",
+			expectStatus:  http.StatusNoContent,
+		},
+	})
+}
@@ -21,6 +21,11 @@ type Config struct {
 	ArchiveDayLimit             int
 	DeleteDayLimit              int
 	HideUnknownHosts            bool
+	RegexSearchTimeLimit        int
+	SearchCacheSnapshotFile     string
+	SearchCacheSnapshotInterval int
+	AdvisoryDir                 string
+	WebhookAllowedHosts         []string
 	LDAPServer                  string
 	LDAPUserTree                string
 	LDAPMemberAttr              string
@@ -38,6 +43,9 @@ type Config struct {
 	PGpassword, PGsslmode       string
 	PGport                      int
 	HTTPListenAddress           string
+	JobIntervals                []string // like "parseFilesJob:10s,pruneOldFilesJob:6h"
+	DisabledJobs                []string
+	TaskMaxAttempts             int
 }
 
 func updateConfig(config *Config, key string, value string) {
@@ -83,8 +91,16 @@ func UpdateConfigFromFile(config *Config, configFileName string) error {
 	// Read the config file
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
+		// Skip blank lines and comments
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
 		// Parse the name=value pair
-		keyAndValue := strings.SplitN(scanner.Text(), "=", 2)
+		keyAndValue := strings.SplitN(line, "=", 2)
+		if len(keyAndValue) < 2 {
+			continue
+		}
 		key := strings.ToLower(strings.TrimSpace(keyAndValue[0]))
 		value := strings.TrimSpace(keyAndValue[1])
 
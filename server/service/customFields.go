@@ -0,0 +1,515 @@
+package main
+
+// Custom fields are defined by the users. The value is extracted from a file
+// with a regular expression, and/or from a JSON document with a path,
+// or computed from other fields with an expression (see computedFields.go).
+// The value can have a type, which decides how it is validated and compared.
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type customField struct {
+	fieldID   int
+	name      string
+	filename  string
+	regexp    string
+	valueType string
+	multiple  bool
+	jsonPath  string
+	// expression is set for computed fields, which don't have a filename
+	expression string
+	re         *regexp.Regexp // compiled by compile()
+	program    exprNode       // compiled by compileExpression()
+}
+
+// The types a custom field can have. The first one is the default.
+var customFieldTypes = []string{"string", "int", "float", "bool", "date", "version"}
+
+var errNoMatch = errors.New("no match")
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// loadCustomFields returns the custom fields that satisfy the where clause.
+// It works with both *sql.DB and *sql.Tx.
+func loadCustomFields(q queryer, where string, args ...interface{}) ([]*customField, error) {
+	statement := "SELECT fieldid, name, filename, regexp, type, multiple, jsonpath, expression FROM customfields"
+	if where != "" {
+		statement += " WHERE " + where
+	}
+	rows, err := q.Query(statement+" ORDER BY name", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := make([]*customField, 0)
+	for rows.Next() {
+		var f customField
+		var filename, re, jsonPath, expression sql.NullString
+		err = rows.Scan(&f.fieldID, &f.name, &filename, &re, &f.valueType, &f.multiple, &jsonPath, &expression)
+		if err != nil {
+			return nil, err
+		}
+		f.filename, f.regexp, f.jsonPath = filename.String, re.String, jsonPath.String
+		f.expression = expression.String
+		list = append(list, &f)
+	}
+	return list, rows.Err()
+}
+
+// getCustomFieldMap returns all the custom fields, with the name as key
+func getCustomFieldMap(q queryer) (map[string]*customField, error) {
+	list, err := loadCustomFields(q, "")
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]*customField, len(list))
+	for _, f := range list {
+		m[f.name] = f
+	}
+	return m, nil
+}
+
+// extract finds the value of the custom field in the file content.
+// If the field is multi-valued, the result is a JSON array with all the values.
+// The error says why there isn't a value.
+func (f *customField) extract(content string) (string, error) {
+	candidates := []string{content}
+	if f.jsonPath != "" {
+		var doc interface{}
+		if err := json.Unmarshal([]byte(content), &doc); err != nil {
+			return "", fmt.Errorf("the content isn't valid JSON: %s", err)
+		}
+		var err error
+		if candidates, err = jsonPathValues(doc, f.jsonPath); err != nil {
+			return "", err
+		}
+	}
+	re, err := f.compile()
+	if err != nil {
+		return "", err
+	}
+	values := make([]string, 0)
+	for _, c := range candidates {
+		if re == nil {
+			values = append(values, c)
+		} else if f.multiple {
+			for _, match := range re.FindAllStringSubmatch(c, -1) {
+				if len(match) >= 2 {
+					values = append(values, match[1])
+				}
+			}
+		} else if match := re.FindStringSubmatch(c); len(match) >= 2 {
+			values = append(values, match[1])
+		}
+		if !f.multiple && len(values) > 0 {
+			break
+		}
+	}
+	if len(values) == 0 {
+		return "", errNoMatch
+	}
+	for i := range values {
+		v, err := normalizeCustomFieldValue(f.valueType, values[i])
+		if err != nil {
+			return "", err
+		}
+		values[i] = v
+	}
+	if !f.multiple {
+		return values[0], nil
+	}
+	b, err := json.Marshal(values)
+	return string(b), err
+}
+
+// compile returns the regular expression the way extract uses it, or nil if there isn't one.
+// The error message refers to the expression as the user wrote it.
+func (f *customField) compile() (*regexp.Regexp, error) {
+	if f.regexp == "" || f.re != nil {
+		return f.re, nil
+	}
+	if _, err := regexp.Compile(f.regexp); err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile("(?m)" + f.regexp)
+	if err != nil {
+		return nil, err
+	}
+	f.re = re
+	return re, nil
+}
+
+var customFieldDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	time.ANSIC,
+	time.UnixDate,
+	time.RFC1123,
+	time.RFC1123Z,
+}
+
+// normalizeCustomFieldValue validates a value and returns it in a canonical form
+// that Postgres can cast to the corresponding SQL type.
+func normalizeCustomFieldValue(valueType string, s string) (string, error) {
+	if valueType == "" || valueType == "string" {
+		return s, nil
+	}
+	s = strings.TrimSpace(s)
+	switch valueType {
+	case "int":
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("\"%s\" isn't an integer", s)
+		}
+		return strconv.FormatInt(i, 10), nil
+	case "float":
+		f, err := strconv.ParseFloat(s, 64)
+		// NaN and infinity can't be sorted or compared with other values
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return "", fmt.Errorf("\"%s\" isn't a number", s)
+		}
+		return strconv.FormatFloat(f, 'f', -1, 64), nil
+	case "bool":
+		if isTrueish(s) {
+			return "true", nil
+		}
+		switch strings.ToLower(s) {
+		case "0", "f", "false", "n", "no", "off":
+			return "false", nil
+		}
+		return "", fmt.Errorf("\"%s\" isn't a boolean value", s)
+	case "date":
+		if t, err := time.Parse("2006-01-02", s); err == nil {
+			return t.Format("2006-01-02"), nil
+		}
+		for _, layout := range customFieldDateLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t.Format(time.RFC3339), nil
+			}
+		}
+		return "", fmt.Errorf("\"%s\" isn't a date", s)
+	case "version":
+		if s == "" || strings.ContainsAny(s, " \t\n") || !strings.ContainsAny(s, "0123456789") {
+			return "", fmt.Errorf("\"%s\" isn't a version number", s)
+		}
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown type %s", valueType)
+}
+
+// validateParam checks a value that is compared with the field in a query
+func (f *customField) validateParam(value string) (string, *httpError) {
+	v, err := normalizeCustomFieldValue(f.valueType, value)
+	if err != nil {
+		return "", &httpError{
+			message: fmt.Sprintf("Invalid value for %s: %s", f.name, err.Error()),
+			code:    http.StatusBadRequest,
+		}
+	}
+	return v, nil
+}
+
+// customFieldJSON returns a value of the field for the API output.
+// Multi-valued fields are returned as a list.
+func customFieldJSON(f *customField, value sql.NullString) interface{} {
+	if f.isMultiple() && value.Valid {
+		list := make([]string, 0)
+		if json.Unmarshal([]byte(value.String), &list) == nil {
+			return list
+		}
+	}
+	return jsonString(value)
+}
+
+func (f *customField) isMultiple() bool {
+	return f != nil && f.multiple
+}
+
+// comparisonFormats returns format strings for the column and the parameter
+// when comparing values of the field with = < > in SQL.
+func (f *customField) comparisonFormats() (string, string) {
+	if f == nil {
+		return "%s", "$%d"
+	}
+	switch f.valueType {
+	case "int", "float":
+		return "(%s)::numeric", "$%d::numeric"
+	case "bool":
+		return "(%s)::boolean", "$%d::boolean"
+	case "date":
+		return "(%s)::timestamptz", "$%d::timestamptz"
+	case "version":
+		return "version_sortkey(%s)", "version_sortkey($%d)"
+	}
+	return "%s", "$%d"
+}
+
+// versionSortKey does the same as the SQL function version_sortkey (see patch016.sql),
+// so version numbers can be sorted in Go in the same order as in the database.
+// The numbers are padded with zeros to 20 digits, so the keys can be compared as text.
+func versionSortKey(version string) string {
+	var sb strings.Builder
+	for len(version) > 0 {
+		i, digits := 0, isDigit(version[0])
+		for i < len(version) && isDigit(version[i]) == digits {
+			i++
+		}
+		part := version[:i]
+		if digits {
+			if len(part) < 20 {
+				sb.WriteString(strings.Repeat("0", 20-len(part)))
+			} else {
+				// lpad truncates longer strings
+				part = part[:20]
+			}
+		}
+		sb.WriteString(part)
+		version = version[i:]
+	}
+	return sb.String()
+}
+
+// comparisonColumn is the column to use in the clause. For multi-valued fields,
+// it is each of the elements in the JSON array, see wrapClause.
+func (f *customField) comparisonColumn(colname string) string {
+	if f.isMultiple() {
+		return "e.v"
+	}
+	return colname
+}
+
+// wrapClause makes a clause for a multi-valued field match if any of the values match.
+// A negated clause must be given in the positive form, and then matches if none of the values match.
+func (f *customField) wrapClause(clause string, colname string, negated bool) string {
+	if !f.isMultiple() {
+		return clause
+	}
+	exists := "EXISTS"
+	if negated {
+		exists = "NOT EXISTS"
+	}
+	return fmt.Sprintf("%s (SELECT 1 FROM json_array_elements_text(%s::json) AS e(v) WHERE %s)",
+		exists, colname, clause)
+}
+
+// customFieldPreview is the result of trying a custom field on the files in the search cache
+type customFieldPreview struct {
+	Files    int                 `json:"files"`    // files with a matching name
+	Hits     int                 `json:"hits"`     // files where a value was found
+	NotFound int                 `json:"notFound"` // files where no value was found
+	Invalid  int                 `json:"invalid"`  // files where the value wasn't valid for the type
+	Samples  []customFieldSample `json:"samples"`
+}
+
+type customFieldSample struct {
+	certfp   string
+	Hostname string      `json:"hostname"`
+	Filename string      `json:"filename"`
+	Value    interface{} `json:"value"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// errPreviewTimeLimit means that the preview took too long, like errSearchTimeLimit for searches
+var errPreviewTimeLimit = errors.New("the preview took too long and was aborted. Try a more specific regular expression")
+
+// previewCustomField extracts the field from all the current files in the search cache,
+// without storing anything. The samples are the first hits and invalid values that were found,
+// at most maxSamples of them, unsorted. It gives up with errPreviewTimeLimit after the deadline.
+func previewCustomField(f *customField, maxSamples int, deadline time.Time) (*customFieldPreview, error) {
+	if _, err := f.compile(); err != nil {
+		return nil, err
+	}
+	filenameRE, err := likePatternToRegexp(f.filename)
+	if err != nil {
+		return nil, err
+	}
+	result := &customFieldPreview{Samples: make([]customFieldSample, 0)}
+	expired := false
+	// The value is only extracted once for files with the same content
+	forEachContentInCache(filenameRE.MatchString, func(content string, files []cachedFile) bool {
+		if time.Now().After(deadline) {
+			expired = true
+			return false
+		}
+		result.Files += len(files)
+		value, err := f.extract(content)
+		for _, file := range files {
+			switch {
+			case err == errNoMatch:
+				result.NotFound++
+			case err != nil:
+				result.Invalid++
+				if len(result.Samples) < maxSamples {
+					result.Samples = append(result.Samples, customFieldSample{
+						certfp: file.certfp, Filename: file.filename, Error: err.Error()})
+				}
+			default:
+				result.Hits++
+				if len(result.Samples) < maxSamples {
+					result.Samples = append(result.Samples, customFieldSample{
+						certfp: file.certfp, Filename: file.filename,
+						Value: customFieldJSON(f, sql.NullString{String: value, Valid: true})})
+				}
+			}
+		}
+		return true
+	})
+	if expired {
+		return nil, errPreviewTimeLimit
+	}
+	return result, nil
+}
+
+// likePatternToRegexp converts a pattern for the SQL LIKE operator to a regular expression.
+// Like in Postgres, a backslash makes the next character lose its special meaning.
+func likePatternToRegexp(pattern string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '%':
+			sb.WriteString(".*")
+		case r == '_':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
+
+type jsonPathStep struct {
+	key   string
+	index int // -1 means all elements
+	isKey bool
+}
+
+var reJSONPathSegment = regexp.MustCompile(`^([^.\[\]]*)((?:\[(?:\d+|\*)\])*)$`)
+var reJSONPathIndex = regexp.MustCompile(`\[(\d+|\*)\]`)
+
+// parseJSONPath parses a path like "a.b[0].c" or "[*].Name". A leading "$." is optional.
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return []jsonPathStep{}, nil
+	}
+	steps := make([]jsonPathStep, 0)
+	for _, segment := range strings.Split(path, ".") {
+		m := reJSONPathSegment.FindStringSubmatch(segment)
+		if m == nil || (m[1] == "" && m[2] == "") {
+			return nil, fmt.Errorf("invalid JSON path: %s", path)
+		}
+		if m[1] != "" {
+			steps = append(steps, jsonPathStep{key: m[1], isKey: true})
+		}
+		for _, idx := range reJSONPathIndex.FindAllStringSubmatch(m[2], -1) {
+			step := jsonPathStep{index: -1}
+			if idx[1] != "*" {
+				step.index, _ = strconv.Atoi(idx[1])
+			}
+			steps = append(steps, step)
+		}
+	}
+	return steps, nil
+}
+
+// jsonPathValues returns the values in the document that the path leads to, as strings.
+// Keys are case-insensitive, and a key applied to a list is applied to each element,
+// since ConvertTo-Json in PowerShell gives an object if there's one item and a list otherwise.
+// For the same reason, [0] applied to an object returns the object itself.
+func jsonPathValues(doc interface{}, path string) ([]string, error) {
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	current := []interface{}{doc}
+	for _, step := range steps {
+		next := make([]interface{}, 0, len(current))
+		for _, v := range current {
+			next = append(next, step.apply(v)...)
+		}
+		current = next
+	}
+	result := make([]string, 0, len(current))
+	for _, v := range current {
+		result = appendJSONStrings(result, v)
+	}
+	return result, nil
+}
+
+func (step jsonPathStep) apply(v interface{}) []interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if !step.isKey {
+			if step.index <= 0 {
+				return []interface{}{t}
+			}
+			return nil
+		}
+		if value, ok := t[step.key]; ok {
+			return []interface{}{value}
+		}
+		for k, value := range t {
+			if strings.EqualFold(k, step.key) {
+				return []interface{}{value}
+			}
+		}
+	case []interface{}:
+		if step.isKey {
+			result := make([]interface{}, 0, len(t))
+			for _, elem := range t {
+				result = append(result, step.apply(elem)...)
+			}
+			return result
+		}
+		if step.index == -1 {
+			return t
+		}
+		if step.index < len(t) {
+			return []interface{}{t[step.index]}
+		}
+	}
+	return nil
+}
+
+// appendJSONStrings converts a JSON value to strings. Lists are flattened, and null is skipped.
+func appendJSONStrings(list []string, v interface{}) []string {
+	switch t := v.(type) {
+	case nil:
+		return list
+	case string:
+		return append(list, t)
+	case float64:
+		return append(list, strconv.FormatFloat(t, 'f', -1, 64))
+	case bool:
+		return append(list, strconv.FormatBool(t))
+	case []interface{}:
+		for _, elem := range t {
+			list = appendJSONStrings(list, elem)
+		}
+		return list
+	}
+	b, _ := json.Marshal(v)
+	return append(list, string(b))
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestCustomFieldExtract(t *testing.T) {
+	const windowsDisks = `[
+		{"DeviceID": "\\\\.\\PHYSICALDRIVE0", "Model": "KXG50ZNV512G", "Size": 512105932800},
+		{"DeviceID": "\\\\.\\PHYSICALDRIVE1", "Model": "USB Stick", "Size": 15000000000}
+	]`
+	tests := []struct {
+		field   customField
+		content string
+		expect  string
+		err     bool
+	}{
+		// Plain string, like before
+		{
+			field:   customField{regexp: `^owner=(.*)$`},
+			content: "x=1\nowner=bob \n",
+			expect:  "bob ",
+		},
+		{
+			field:   customField{regexp: `^owner=(.*)$`},
+			content: "x=1\n",
+			err:     true,
+		},
+		// Typed values are validated and normalized
+		{
+			field:   customField{regexp: `cores: (.*)`, valueType: "int"},
+			content: "cores: 08",
+			expect:  "8",
+		},
+		{
+			field:   customField{regexp: `cores: (.*)`, valueType: "int"},
+			content: "cores: many",
+			err:     true,
+		},
+		{
+			field:   customField{regexp: `load: (.*)`, valueType: "float"},
+			content: "load: 1.50",
+			expect:  "1.5",
+		},
+		{
+			field:   customField{regexp: `load: (.*)`, valueType: "float"},
+			content: "load: inf",
+			err:     true,
+		},
+		{
+			field:   customField{regexp: `load: (.*)`, valueType: "float"},
+			content: "load: +Inf",
+			err:     true,
+		},
+		{
+			field:   customField{regexp: `load: (.*)`, valueType: "float"},
+			content: "load: 1e999",
+			err:     true,
+		},
+		{
+			field:   customField{regexp: `load: (.*)`, valueType: "float"},
+			content: "load: NaN",
+			err:     true,
+		},
+		{
+			field:   customField{regexp: `enabled: (.*)`, valueType: "bool"},
+			content: "enabled: Yes",
+			expect:  "true",
+		},
+		{
+			field:   customField{regexp: `installed: (.*)`, valueType: "date"},
+			content: "installed: 2021-03-04",
+			expect:  "2021-03-04",
+		},
+		{
+			field:   customField{regexp: `installed: (.*)`, valueType: "date"},
+			content: "installed: 2021-03-04 10:11:12",
+			expect:  "2021-03-04T10:11:12Z",
+		},
+		{
+			field:   customField{regexp: `version (\S+)`, valueType: "version"},
+			content: "version 1.10.2-3",
+			expect:  "1.10.2-3",
+		},
+		// All the matches
+		{
+			field:   customField{regexp: `^nameserver (.*)$`, multiple: true},
+			content: "search example.com\nnameserver 10.0.0.1\nnameserver 10.0.0.2\n",
+			expect:  `["10.0.0.1","10.0.0.2"]`,
+		},
+		// JSON paths, with and without a regexp
+		{
+			field:   customField{jsonPath: "Model"},
+			content: windowsDisks,
+			expect:  "KXG50ZNV512G",
+		},
+		{
+			field:   customField{jsonPath: "[*].size", valueType: "int", multiple: true},
+			content: windowsDisks,
+			expect:  `["512105932800","15000000000"]`,
+		},
+		{
+			field:   customField{jsonPath: "$[1].DeviceID", regexp: `DRIVE(\d+)`},
+			content: windowsDisks,
+			expect:  "1",
+		},
+		{
+			field:   customField{jsonPath: "[0].Model"},
+			content: `{"Model": "Only one"}`,
+			expect:  "Only one",
+		},
+		{
+			field:   customField{jsonPath: "Model"},
+			content: "not json",
+			err:     true,
+		},
+	}
+	for i, test := range tests {
+		got, err := test.field.extract(test.content)
+		if test.err {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, got %q", i, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: %v", i, err)
+			continue
+		}
+		if got != test.expect {
+			t.Errorf("Test %d: Got %q, expected %q", i, got, test.expect)
+		}
+	}
+}
+
+func TestParseJSONPath(t *testing.T) {
+	steps, err := parseJSONPath("$.a.b[2][*].c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []jsonPathStep{
+		{key: "a", isKey: true},
+		{key: "b", isKey: true},
+		{index: 2},
+		{index: -1},
+		{key: "c", isKey: true},
+	}
+	if !reflect.DeepEqual(steps, expect) {
+		t.Errorf("Got %v, expected %v", steps, expect)
+	}
+	for _, invalid := range []string{"a..b", "a[x]", "a]"} {
+		if _, err := parseJSONPath(invalid); err == nil {
+			t.Errorf("Expected %s to be invalid", invalid)
+		}
+	}
+}
+
+func TestBuildSQLWhereTypedFields(t *testing.T) {
+	fields := map[string]*customField{
+		"cores":   {name: "cores", valueType: "int"},
+		"kernel2": {name: "kernel2", valueType: "version"},
+		"dns":     {name: "dns", multiple: true},
+	}
+	tests := []struct {
+		query  string
+		sql    string
+		params []interface{}
+		errmsg string
+	}{
+		{
+			query:  "cores>8",
+			sql:    "(cores)::numeric > $1::numeric",
+			params: []interface{}{"8"},
+		},
+		{
+			query:  "cores=2,4",
+			sql:    "(cores)::numeric IN ($1::numeric,$2::numeric)",
+			params: []interface{}{"2", "4"},
+		},
+		{
+			query:  "cores<many",
+			errmsg: `Invalid value for cores: "many" isn't an integer`,
+		},
+		{
+			query:  "kernel2<4.18",
+			sql:    "version_sortkey(kernel2) < version_sortkey($1)",
+			params: []interface{}{"4.18"},
+		},
+		{
+			query: "dns=10.0.0.1&dns!=10.9.*",
+			sql: "EXISTS (SELECT 1 FROM json_array_elements_text(dns::json) AS e(v) WHERE e.v = $1) AND " +
+				"NOT EXISTS (SELECT 1 FROM json_array_elements_text(dns::json) AS e(v) WHERE e.v LIKE $2||'%')",
+			params: []interface{}{"10.0.0.1", "10.9."},
+		},
+		{
+			query:  "dns=null",
+			sql:    "dns IS NULL",
+			params: []interface{}{},
+		},
+	}
+	allowedFields := []string{"cores", "kernel2", "dns"}
+	for _, test := range tests {
+		result, params, err := buildSQLWhere(test.query, allowedFields, fields)
+		if err != nil {
+			if err.message != test.errmsg {
+				t.Errorf("%s: Got error %q, expected %q", test.query, err.message, test.errmsg)
+			}
+			continue
+		}
+		if test.errmsg != "" {
+			t.Errorf("%s: Expected error %q", test.query, test.errmsg)
+			continue
+		}
+		if result != test.sql {
+			t.Errorf("%s:\n     Got: %s\nExpected: %s", test.query, result, test.sql)
+		}
+		if !reflect.DeepEqual(params, test.params) {
+			t.Errorf("%s: Got params %v, expected %v", test.query, params, test.params)
+		}
+	}
+}
+
+func TestTypedCustomFields(t *testing.T) {
+	if os.Getenv("NOPOSTGRES") != "" {
+		t.Log("No Postgres, skipping test")
+		return
+	}
+	db := getDBconnForTesting(t)
+	defer db.Close()
+
+	api := createAPImuxer(db, false)
+	testAPIcalls(t, api, []apiCall{
+		{
+			methodAndPath: "POST /api/v2/settings/customfields",
+			body:          "name=cores&filename=/etc/hwinfo&regexp=cores%3D(.*)&type=int",
+			expectStatus:  http.StatusCreated,
+		},
+		{
+			methodAndPath: "POST /api/v2/settings/customfields",
+			body:          "name=dns&filename=/etc/resolv.conf&regexp=nameserver%20(.*)&multiple=1",
+			expectStatus:  http.StatusCreated,
+		},
+		{
+			methodAndPath: "POST /api/v2/settings/customfields",
+			body:          "name=bad&filename=/etc/x&regexp=x&type=complex",
+			expectStatus:  http.StatusBadRequest,
+		},
+		{
+			methodAndPath: "GET /api/v2/settings/customfields/dns?fields=type,multiple,jsonPath",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `{"type":"string","multiple":true,"jsonPath":null}`,
+		},
+	})
+
+	hosts := []struct {
+		certfp, hostname, cores, dns string
+	}{
+		{"AA", "one.example.com", "cores=8", "nameserver 10.0.0.1\nnameserver 10.0.0.2\n"},
+		{"BB", "two.example.com", "cores=16", "nameserver 10.0.0.2\n"},
+		{"CC", "three.example.com", "cores=4", "nameserver 10.0.0.3\n"},
+	}
+	fileID := 0
+	for _, h := range hosts {
+		for filename, content := range map[string]string{"/etc/hwinfo": h.cores, "/etc/resolv.conf": h.dns} {
+			fileID++
+			_, err := db.Exec("INSERT INTO files(fileid,certfp,filename,content,received) "+
+				"VALUES($1,$2,$3,$4,now())", fileID, h.certfp, filename, content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parseFile(db, int64(fileID))
+		}
+		_, err := db.Exec("UPDATE hostinfo SET hostname=$1 WHERE certfp=$2", h.hostname, h.certfp)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testAPIcalls(t, api, []apiCall{
+		// A lexical comparison would say "16" < "8"
+		{
+			methodAndPath: "GET /api/v2/hostlist?fields=hostname,cores&cores>6&sort=cores",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"hostname":"one.example.com","cores":"8"},{"hostname":"two.example.com","cores":"16"}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/hostlist?fields=hostname&dns=10.0.0.2",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"hostname":"one.example.com"},{"hostname":"two.example.com"}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/host/one.example.com?fields=dns,cores",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `{"dns":["10.0.0.1","10.0.0.2"],"cores":"8"}`,
+		},
+	})
+}
+
+func TestVersionCustomField(t *testing.T) {
+	if os.Getenv("NOPOSTGRES") != "" {
+		t.Log("No Postgres, skipping test")
+		return
+	}
+	db := getDBconnForTesting(t)
+	defer db.Close()
+
+	// The database function and versionSortKey must agree, since both are used for sorting
+	for _, version := range []string{"1.10", "1.9", "5.14.0-70.el9", "2:1.0", "abc", "123456789012345678901234"} {
+		var key string
+		if err := db.QueryRow("SELECT version_sortkey($1)", version).Scan(&key); err != nil {
+			t.Fatal(err)
+		}
+		if key != versionSortKey(version) {
+			t.Errorf("version_sortkey(%q) = %q, but versionSortKey gives %q", version, key, versionSortKey(version))
+		}
+	}
+
+	api := createAPImuxer(db, false)
+	testAPIcalls(t, api, []apiCall{
+		{
+			methodAndPath: "POST /api/v2/settings/customfields",
+			body:          "name=appversion&filename=/etc/app-release&regexp=version%20(.*)&type=version",
+			expectStatus:  http.StatusCreated,
+		},
+	})
+
+	hosts := []struct {
+		certfp, hostname, version string
+	}{
+		{"AA", "one.example.com", "1.10.2"},
+		{"BB", "two.example.com", "1.9.0"},
+		{"CC", "three.example.com", "1.2.15"},
+		{"DD", "four.example.com", "2.0"},
+	}
+	for i, h := range hosts {
+		_, err := db.Exec("INSERT INTO files(fileid,certfp,filename,content,received) "+
+			"VALUES($1,$2,'/etc/app-release',$3,now())", i+1, h.certfp, "version "+h.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parseFile(db, int64(i+1))
+		_, err = db.Exec("UPDATE hostinfo SET hostname=$1 WHERE certfp=$2", h.hostname, h.certfp)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testAPIcalls(t, api, []apiCall{
+		// A lexical comparison would say "1.10.2" < "1.9" and "1.2.15" > "1.10"
+		{
+			methodAndPath: "GET /api/v2/hostlist?fields=hostname,appversion&appversion>1.9&sort=appversion",
+			expectStatus:  http.StatusOK,
+			expectJSON: `[{"hostname":"two.example.com","appversion":"1.9.0"},` +
+				`{"hostname":"one.example.com","appversion":"1.10.2"},` +
+				`{"hostname":"four.example.com","appversion":"2.0"}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/hostlist?fields=hostname&appversion<1.10&sort=-appversion",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"hostname":"two.example.com"},{"hostname":"three.example.com"}]`,
+		},
+	})
+}
+
+func TestPreviewCustomField(t *testing.T) {
+	const certfp = "EEEE5555"
+	const certfp2 = "FFFF6666"
+	defer removeHostFromFastSearch(certfp)
+	defer removeHostFromFastSearch(certfp2)
+	addFileToFastSearch(8001, certfp, "/etc/hwinfo", "Cores=8")
+	addFileToFastSearch(8002, certfp2, "/etc/hwinfo", "Cores=many")
+	addFileToFastSearch(8003, certfp, "/etc/hwinfo.d/x", "Cores=4")
+	addFileToFastSearch(8004, certfp2, "/etc/hw_info", "nothing here")
+	future := time.Now().Add(time.Minute)
+
+	preview, err := previewCustomField(&customField{filename: "/etc/hw%nfo", regexp: `Cores=(.*)`, valueType: "int"}, 10, future)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(preview.Samples, func(i, j int) bool { return preview.Samples[i].certfp < preview.Samples[j].certfp })
+	expect := &customFieldPreview{
+		Files:    3,
+		Hits:     1,
+		NotFound: 1,
+		Invalid:  1,
+		Samples: []customFieldSample{
+			{certfp: certfp, Filename: "/etc/hwinfo", Value: jsonString(sql.NullString{String: "8", Valid: true})},
+			{certfp: certfp2, Filename: "/etc/hwinfo", Error: `"many" isn't an integer`},
+		},
+	}
+	if !reflect.DeepEqual(preview, expect) {
+		t.Errorf("Got %+v\nexpected %+v", preview, expect)
+	}
+
+	if _, err = previewCustomField(&customField{filename: "%", regexp: `Cores=(.*`}, 10, future); err == nil {
+		t.Error("Expected an error from an invalid regexp")
+	}
+
+	// The counts include all the files, but there are only as many samples as asked for
+	preview, err = previewCustomField(&customField{filename: "/etc/hw%nfo", regexp: `Cores=(.*)`, valueType: "int"}, 1, future)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.Hits != 1 || preview.Invalid != 1 || len(preview.Samples) != 1 {
+		t.Errorf("Got %+v", preview)
+	}
+
+	// The preview has a time limit, like a regex search
+	past := time.Now().Add(-time.Second)
+	if _, err = previewCustomField(&customField{filename: "/etc/hw%nfo", regexp: `Cores=(.*)`}, 10, past); err != errPreviewTimeLimit {
+		t.Errorf("Expected a time limit error, got %v", err)
+	}
+
+	// Files with the same content are all counted, and all get samples
+	const certfp3 = "GGGG7777"
+	defer removeHostFromFastSearch(certfp3)
+	addFileToFastSearch(8005, certfp3, "/etc/hwinfo", "Cores=8")
+	preview, err = previewCustomField(&customField{filename: "/etc/hwinfo", regexp: `Cores=(.*)`, valueType: "int"}, 10, future)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(preview.Samples, func(i, j int) bool { return preview.Samples[i].certfp < preview.Samples[j].certfp })
+	if preview.Files != 3 || preview.Hits != 2 || len(preview.Samples) != 3 ||
+		preview.Samples[0].certfp != certfp || preview.Samples[2].certfp != certfp3 {
+		t.Errorf("Got %+v", preview)
+	}
+}
+
+func TestLikePatternToRegexp(t *testing.T) {
+	tests := []struct {
+		pattern, filename string
+		expect            bool
+	}{
+		{"/etc/hosts", "/etc/hosts", true},
+		{"/etc/hosts", "/etc/hosts.allow", false},
+		{"/etc/%", "/etc/hosts", true},
+		{"/etc/host_", "/etc/hosts", true},
+		{`/etc/host\_`, "/etc/hosts", false},
+		{`/etc/host\_`, "/etc/host_", true},
+		{"Get-Item (x)", "Get-Item (x)", true},
+	}
+	for _, test := range tests {
+		re, err := likePatternToRegexp(test.pattern)
+		if err != nil {
+			t.Errorf("%s: %v", test.pattern, err)
+			continue
+		}
+		if re.MatchString(test.filename) != test.expect {
+			t.Errorf("%s matching %s: expected %v", test.pattern, test.filename, test.expect)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+SET client_min_messages TO WARNING;
+
+-- For a trigram index on the file content, to speed up searches in old versions of files
+-- (the fast search cache in memory only has the current versions).
+-- The index itself is built with CREATE INDEX CONCURRENTLY after the patches have been applied,
+-- since that can't run in a transaction; see createContentIndex in historicalSearch.go.
+-- Creating the extension requires the CREATE privilege on the database (it is a trusted extension
+-- since PostgreSQL 13), or a superuser on older versions. The searches work without it, only slower,
+-- so a failure doesn't stop the migration. A superuser can create it later with: CREATE EXTENSION pg_trgm;
+DO $$
+BEGIN
+	CREATE EXTENSION IF NOT EXISTS pg_trgm;
+EXCEPTION WHEN OTHERS THEN
+	RAISE WARNING 'Unable to create the extension pg_trgm: %. Searches in old versions of files will be slower.', SQLERRM;
+END
+$$;
+
+-- To find the version of a file that was current at a given time
+CREATE INDEX files_certfp_fname_received ON files(certfp,filename,received);
+
+UPDATE db SET patchlevel = 9;
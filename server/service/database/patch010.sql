@@ -0,0 +1,55 @@
+SET client_min_messages TO WARNING;
+
+-- Saved searches are evaluated regularly, and the changes in the results are recorded.
+-- The query is a url query string with the same parameters as the hostlist API,
+-- e.g. "os=RHEL+8&q1=nameserver+10.0.0.1&f1=/etc/resolv.conf"
+CREATE TABLE savedsearches(
+	searchid serial PRIMARY KEY NOT NULL,
+	name text not null,
+	ownergroup text not null,
+	query text not null,
+	webhook text,
+	interval_minutes int not null default 60,
+	created timestamp with time zone not null default now(),
+	lastrun timestamp with time zone,
+	-- After a failed run, the search isn't tried again until retryafter,
+	-- which is pushed further out for every failure in a row.
+	lasterror text,
+	failures int not null default 0,
+	retryafter timestamp with time zone
+);
+
+-- The hosts that matched the last time the search was evaluated.
+-- This doesn't refer to hostinfo, since a host that has been deleted must still be here
+-- to be reported as having left. The hostname is kept for the same reason.
+-- certfp is changed along with hostinfo when a certificate is renewed (see cert.go),
+-- so that isn't reported as a change.
+CREATE TABLE savedsearch_hosts(
+	searchid int not null REFERENCES savedsearches(searchid) ON UPDATE CASCADE ON DELETE CASCADE,
+	certfp text not null,
+	hostname text,
+	PRIMARY KEY(searchid, certfp)
+);
+CREATE INDEX savedsearch_hosts_certfp ON savedsearch_hosts(certfp);
+
+-- Each time a saved search is evaluated
+CREATE TABLE savedsearch_runs(
+	runid bigserial PRIMARY KEY NOT NULL,
+	searchid int not null REFERENCES savedsearches(searchid) ON UPDATE CASCADE ON DELETE CASCADE,
+	time timestamp with time zone not null default now(),
+	hostcount int not null,
+	entered_count int not null,
+	left_count int not null
+);
+
+-- Hosts that entered or left the result of a saved search
+CREATE TABLE savedsearch_changes(
+	runid bigint not null REFERENCES savedsearch_runs(runid) ON UPDATE CASCADE ON DELETE CASCADE,
+	certfp text not null,
+	hostname text,
+	entered boolean not null
+);
+CREATE INDEX savedsearch_changes_runid ON savedsearch_changes(runid);
+CREATE INDEX savedsearch_runs_searchid ON savedsearch_runs(searchid,time);
+
+UPDATE db SET patchlevel = 10;
@@ -0,0 +1,12 @@
+SET client_min_messages TO WARNING;
+
+-- Which file parser set each of the columns in hostinfo.
+-- A parser isn't allowed to overwrite a value that was set by a parser with a higher priority.
+CREATE TABLE hostinfo_parsedby(
+	certfp text not null REFERENCES hostinfo(certfp) ON UPDATE CASCADE ON DELETE CASCADE,
+	colname text not null,
+	parser text not null,
+	PRIMARY KEY(certfp, colname)
+);
+
+UPDATE db SET patchlevel = 11;
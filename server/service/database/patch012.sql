@@ -0,0 +1,15 @@
+SET client_min_messages TO WARNING;
+
+-- Installed packages, from the output of dpkg-query, rpm, and the list of programs on Windows.
+-- The source tells which package system it is, which decides how versions are compared.
+CREATE TABLE host_packages(
+	certfp text not null REFERENCES hostinfo(certfp) ON UPDATE CASCADE ON DELETE CASCADE,
+	source text not null,
+	name text not null,
+	version text not null,
+	arch text not null default '',
+	PRIMARY KEY(certfp, source, name, version, arch)
+);
+CREATE INDEX host_packages_name ON host_packages(name);
+
+UPDATE db SET patchlevel = 12;
@@ -0,0 +1,42 @@
+SET client_min_messages TO WARNING;
+
+-- Security advisories in OSV format (https://ossf.github.io/osv-schema/)
+CREATE TABLE advisories(
+	advisoryid text PRIMARY KEY NOT NULL,
+	summary text,
+	aliases text,
+	modified timestamp with time zone,
+	imported timestamp with time zone not null default now()
+);
+
+-- The versions of packages that are affected by an advisory.
+-- Each row is a range from "introduced" (inclusive, "0" means the beginning)
+-- until "fixed" (exclusive) or "last_affected" (inclusive). If both are null,
+-- all later versions are affected.
+-- osrelease is e.g. "Debian 11" if the advisory only applies to that release.
+-- distribution is e.g. "SLES". It is needed when osrelease is empty,
+-- since several distributions use the same package system.
+CREATE TABLE advisory_ranges(
+	advisoryid text not null REFERENCES advisories(advisoryid) ON UPDATE CASCADE ON DELETE CASCADE,
+	source text not null,
+	distribution text not null default '',
+	osrelease text not null default '',
+	package text not null,
+	introduced text not null default '0',
+	fixed text,
+	last_affected text
+);
+CREATE INDEX advisory_ranges_advisoryid ON advisory_ranges(advisoryid);
+
+-- Installed packages that are affected by an advisory
+CREATE TABLE host_vulnerabilities(
+	certfp text not null REFERENCES hostinfo(certfp) ON UPDATE CASCADE ON DELETE CASCADE,
+	advisoryid text not null REFERENCES advisories(advisoryid) ON UPDATE CASCADE ON DELETE CASCADE,
+	package text not null,
+	version text not null,
+	found timestamp with time zone not null default now(),
+	PRIMARY KEY(certfp, advisoryid, package, version)
+);
+CREATE INDEX host_vulnerabilities_advisoryid ON host_vulnerabilities(advisoryid);
+
+UPDATE db SET patchlevel = 13;
@@ -0,0 +1,27 @@
+SET client_min_messages TO WARNING;
+
+-- Processor and memory, from dmidecode, system_profiler and WMI
+ALTER TABLE hostinfo ADD COLUMN cpu_model text,
+	ADD COLUMN cpu_sockets int,
+	ADD COLUMN cpu_cores int,
+	ADD COLUMN memory_mb bigint;
+
+-- A machine can have any number of disks and network interfaces
+CREATE TABLE host_disks(
+	certfp text not null REFERENCES hostinfo(certfp) ON UPDATE CASCADE ON DELETE CASCADE,
+	name text not null,
+	model text,
+	size bigint,
+	PRIMARY KEY(certfp, name)
+);
+CREATE TABLE host_interfaces(
+	certfp text not null REFERENCES hostinfo(certfp) ON UPDATE CASCADE ON DELETE CASCADE,
+	name text not null,
+	mac text,
+	mtu int,
+	state text,
+	PRIMARY KEY(certfp, name)
+);
+CREATE INDEX host_interfaces_mac ON host_interfaces(mac);
+
+UPDATE db SET patchlevel = 14;
@@ -0,0 +1,13 @@
+SET client_min_messages TO WARNING;
+
+-- All the addresses a host has on its network interfaces, from "ip addr" and ipconfig.
+-- hostinfo.ipaddr is only the address the host connected from, which may be behind NAT.
+CREATE TABLE host_addresses(
+	certfp text not null REFERENCES hostinfo(certfp) ON UPDATE CASCADE ON DELETE CASCADE,
+	ipaddr inet not null,
+	ifname text,
+	PRIMARY KEY(certfp, ipaddr)
+);
+CREATE INDEX host_addresses_ipaddr ON host_addresses(ipaddr);
+
+UPDATE db SET patchlevel = 15;
@@ -0,0 +1,17 @@
+SET client_min_messages TO WARNING;
+
+-- The type decides how values are validated, and how they are compared with < and >.
+-- If multiple is true, all the matches are kept, as a JSON array in hostinfo_customfields.value.
+-- jsonpath picks values out of a JSON document, before the regexp (which is now optional) is applied.
+ALTER TABLE customfields ADD COLUMN type text not null default 'string',
+	ADD COLUMN multiple boolean not null default false,
+	ADD COLUMN jsonpath text;
+
+-- Makes version numbers comparable as text, by padding all the numbers with zeros,
+-- so "1.10" comes after "1.9".
+CREATE FUNCTION version_sortkey(text) RETURNS text AS $$
+	SELECT string_agg(CASE WHEN t.m[1] ~ '^[0-9]+$' THEN lpad(t.m[1], 20, '0') ELSE t.m[1] END, '' ORDER BY t.i)
+	FROM regexp_matches($1, '([0-9]+|[^0-9]+)', 'g') WITH ORDINALITY AS t(m, i)
+$$ LANGUAGE SQL IMMUTABLE;
+
+UPDATE db SET patchlevel = 16;
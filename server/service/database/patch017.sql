@@ -0,0 +1,7 @@
+SET client_min_messages TO WARNING;
+
+-- A computed custom field has an expression instead of a filename and regexp.
+-- The value is computed from other fields of the host, see fieldExpression.go.
+ALTER TABLE customfields ADD COLUMN expression text;
+
+UPDATE db SET patchlevel = 17;
@@ -0,0 +1,6 @@
+SET client_min_messages TO WARNING;
+
+-- For the feed of recently changed files
+CREATE INDEX files_received ON files(received);
+
+UPDATE db SET patchlevel = 18;
@@ -0,0 +1,23 @@
+SET client_min_messages TO WARNING;
+
+-- The history of job runs. error is the panic text if the job failed.
+CREATE TABLE jobruns(
+	runid bigserial PRIMARY KEY,
+	job text not null,
+	started timestamp with time zone not null,
+	seconds real not null,
+	error text
+);
+CREATE INDEX jobruns_job_started ON jobruns(job, started);
+
+-- Jobs that have been paused through the API. Paused jobs don't run on schedule,
+-- but they can still be triggered.
+-- triggered is set when a job is triggered through the API on a server instance that isn't
+-- the leader. The leader runs the job if it hasn't run since then.
+CREATE TABLE jobsettings(
+	job text PRIMARY KEY,
+	paused boolean not null default false,
+	triggered timestamp with time zone
+);
+
+UPDATE db SET patchlevel = 19;
@@ -0,0 +1,41 @@
+SET client_min_messages TO WARNING;
+
+-- Changes that affect the in-memory search cache are announced on the channel "searchcache",
+-- so all the server instances that share the database can update their caches.
+-- The payload is one of:
+--   add <fileid>           a current file has been parsed, or has become current again
+--   remove <fileid>        a file is no longer current, or has been deleted
+--   host <certfp>          a host has been removed
+--   cert <old> <new>       a host has a new certificate
+--start_of_procedures
+CREATE FUNCTION notify_searchcache_files() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP <> 'DELETE' AND NEW.current AND NEW.parsed
+		AND (TG_OP = 'INSERT' OR NOT OLD.current OR NOT OLD.parsed) THEN
+		PERFORM pg_notify('searchcache', 'add ' || NEW.fileid);
+	ELSIF TG_OP <> 'INSERT' AND OLD.current AND (TG_OP = 'DELETE' OR NOT NEW.current) THEN
+		PERFORM pg_notify('searchcache', 'remove ' || OLD.fileid);
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER files_searchcache AFTER INSERT OR DELETE OR UPDATE OF current, parsed ON files
+	FOR EACH ROW EXECUTE PROCEDURE notify_searchcache_files();
+
+CREATE FUNCTION notify_searchcache_hostinfo() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP = 'DELETE' THEN
+		PERFORM pg_notify('searchcache', 'host ' || OLD.certfp);
+	ELSIF OLD.certfp IS DISTINCT FROM NEW.certfp THEN
+		PERFORM pg_notify('searchcache', 'cert ' || OLD.certfp || ' ' || NEW.certfp);
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER hostinfo_searchcache AFTER DELETE OR UPDATE OF certfp ON hostinfo
+	FOR EACH ROW EXECUTE PROCEDURE notify_searchcache_hostinfo();
+--end_of_procedures
+
+UPDATE db SET patchlevel = 20;
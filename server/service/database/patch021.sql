@@ -0,0 +1,17 @@
+SET client_min_messages TO WARNING;
+
+-- The type decides which handler runs a task, and url is the argument for it.
+-- For "archive" tasks, url is the name of a file in the queue directory.
+-- status is 0 for new tasks, 1 for tasks that have failed and will be retried,
+-- and 2 for tasks that failed too many times and won't be retried unless someone asks for it.
+-- A server instance that runs a task claims it until claimed_until, and renews the claim while it runs.
+-- delay is only the waiting time before the next attempt after a failure.
+ALTER TABLE tasks ADD COLUMN type text not null default 'archive',
+	ADD COLUMN attempts int not null default 0,
+	ADD COLUMN lasterror text,
+	ADD COLUMN created timestamp with time zone default now(),
+	ADD COLUMN claimed_until timestamp with time zone;
+ALTER TABLE tasks DROP CONSTRAINT tasks_url_key;
+ALTER TABLE tasks ADD CONSTRAINT tasks_type_url_key UNIQUE (type, url);
+
+UPDATE db SET patchlevel = 21;
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"log"
 	"nivlheim/utility"
@@ -17,7 +18,7 @@ func (p deleteOldCertificatesJob) HowOften() time.Duration {
 	return time.Hour * 24
 }
 
-func (p deleteOldCertificatesJob) Run(db *sql.DB) {
+func (p deleteOldCertificatesJob) Run(ctx context.Context, db *sql.DB) {
 	// Delete old certificates from the database table
 	// Criteria:
 	// - expired (past the "not after" date)
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"nivlheim/utility"
 	"os"
 	"testing"
@@ -37,7 +38,7 @@ func TestDeleteOldCertificates(t *testing.T) {
 
 	// Run the function
 	job := deleteOldCertificatesJob{}
-	job.Run(db)
+	job.Run(context.Background(), db)
 
 	// Look at the result
 	list, err := QueryColumn(db, "SELECT certid FROM certificates ORDER BY certid")
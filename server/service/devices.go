@@ -0,0 +1,303 @@
+package main
+
+// A machine can have any number of disks, network interfaces and ip addresses, so they are
+// kept in the host_disks, host_interfaces and host_addresses tables instead of in hostinfo.
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net"
+	"regexp"
+	"strings"
+)
+
+type hostDisk struct {
+	name, model string
+	size        int64
+}
+
+type hostInterface struct {
+	name, mac, state string
+	mtu              int64
+}
+
+type hostAddress struct {
+	ipaddr, ifname string
+}
+
+// hostDevices is the result from a DeviceParser. A nil list means that the file
+// doesn't say anything about that kind of device, so the existing rows are kept.
+type hostDevices struct {
+	disks      []hostDisk
+	interfaces []hostInterface
+	addresses  []hostAddress
+}
+
+// A DeviceParser returns the devices that are listed in a file
+type DeviceParser func(content string) (*hostDevices, error)
+
+// RegisterDeviceParser adds a table parser for files whose name matches the pattern
+func RegisterDeviceParser(name string, filenamePattern string, parser DeviceParser) {
+	RegisterTableParser(name, filenamePattern, []string{"host_disks", "host_interfaces", "host_addresses"},
+		func(content string) (func(tx *sql.Tx, certfp string) error, error) {
+			devices, err := parser(content)
+			if err != nil {
+				return nil, err
+			}
+			return func(tx *sql.Tx, certfp string) error {
+				return updateHostDevices(tx, certfp, devices)
+			}, nil
+		})
+}
+
+func init() {
+	RegisterDeviceParser("lsblk", exactFilename("/usr/bin/lsblk -J -b -d -o NAME,TYPE,SIZE,MODEL"), parseLsblk)
+	RegisterDeviceParser("ip-addr", `^(/usr)?/sbin/ip -j addr$`, parseIPAddr)
+	RegisterDeviceParser("windows-diskdrive",
+		exactFilenameFold("Get-WmiObject Win32_diskdrive|select partitions,deviceid,model,size,caption|ConvertTo-Json"),
+		parseWindowsDiskDrive)
+	RegisterDeviceParser("windows-ipconfig", exactFilenameFold("ipconfig"), parseIpconfig)
+}
+
+// updateHostDevices replaces the disks, network interfaces and/or ip addresses of a host
+// with the ones found in a file
+func updateHostDevices(tx *sql.Tx, certfp string, devices *hostDevices) error {
+	if devices.disks != nil {
+		if err := replaceHostDisks(tx, certfp, devices.disks); err != nil {
+			return err
+		}
+	}
+	if devices.interfaces != nil {
+		if err := replaceHostInterfaces(tx, certfp, devices.interfaces); err != nil {
+			return err
+		}
+	}
+	if devices.addresses != nil {
+		if err := replaceHostAddresses(tx, certfp, devices.addresses); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The lists are short, so it's simpler to replace all the rows than to find the differences
+func replaceHostDisks(tx *sql.Tx, certfp string, disks []hostDisk) error {
+	_, err := tx.Exec("DELETE FROM host_disks WHERE certfp=$1", certfp)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(disks))
+	for _, d := range disks {
+		if seen[d.name] {
+			continue
+		}
+		seen[d.name] = true
+		_, err = tx.Exec("INSERT INTO host_disks(certfp,name,model,size) VALUES($1,$2,$3,$4)",
+			certfp, d.name, nullIfEmpty(d.model), nullIfZero(d.size))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func replaceHostInterfaces(tx *sql.Tx, certfp string, interfaces []hostInterface) error {
+	_, err := tx.Exec("DELETE FROM host_interfaces WHERE certfp=$1", certfp)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(interfaces))
+	for _, n := range interfaces {
+		if seen[n.name] {
+			continue
+		}
+		seen[n.name] = true
+		_, err = tx.Exec("INSERT INTO host_interfaces(certfp,name,mac,mtu,state) VALUES($1,$2,$3,$4,$5)",
+			certfp, n.name, nullIfEmpty(n.mac), nullIfZero(n.mtu), nullIfEmpty(n.state))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceHostAddresses only writes the differences, because if the addresses have changed,
+// the host must be renamed (dnsttl=null makes handleDNSchangesJob look at it again).
+func replaceHostAddresses(tx *sql.Tx, certfp string, addresses []hostAddress) error {
+	rows, err := tx.Query("SELECT host(ipaddr), COALESCE(ifname,'') FROM host_addresses "+
+		"WHERE certfp=$1", certfp)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	existing := make(map[string]string)
+	for rows.Next() {
+		var ip, ifname string
+		if err = rows.Scan(&ip, &ifname); err != nil {
+			return err
+		}
+		existing[ip] = ifname
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	changed := false
+	seen := make(map[string]bool, len(addresses))
+	for _, a := range addresses {
+		if seen[a.ipaddr] {
+			continue
+		}
+		seen[a.ipaddr] = true
+		if ifname, ok := existing[a.ipaddr]; ok {
+			delete(existing, a.ipaddr)
+			if ifname == a.ifname {
+				continue
+			}
+			_, err = tx.Exec("UPDATE host_addresses SET ifname=$1 WHERE certfp=$2 AND ipaddr=$3",
+				nullIfEmpty(a.ifname), certfp, a.ipaddr)
+		} else {
+			_, err = tx.Exec("INSERT INTO host_addresses(certfp,ipaddr,ifname) VALUES($1,$2,$3)",
+				certfp, a.ipaddr, nullIfEmpty(a.ifname))
+			changed = true
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Whatever is left wasn't in the new list
+	for ip := range existing {
+		_, err = tx.Exec("DELETE FROM host_addresses WHERE certfp=$1 AND ipaddr=$2", certfp, ip)
+		if err != nil {
+			return err
+		}
+		changed = true
+	}
+	if changed {
+		_, err = tx.Exec("UPDATE hostinfo SET dnsttl=null WHERE certfp=$1", certfp)
+	}
+	return err
+}
+
+// parseLsblk parses the JSON output from lsblk. Only whole disks are included, not cd-roms etc.
+// Old versions of lsblk put the size in a string.
+func parseLsblk(content string) (*hostDevices, error) {
+	var doc struct {
+		BlockDevices []struct {
+			Name  string      `json:"name"`
+			Type  string      `json:"type"`
+			Size  interface{} `json:"size"`
+			Model *string     `json:"model"`
+		} `json:"blockdevices"`
+	}
+	if err := json.Unmarshal([]byte(content), &doc); err != nil {
+		return nil, err
+	}
+	disks := make([]hostDisk, 0, len(doc.BlockDevices))
+	for _, d := range doc.BlockDevices {
+		if d.Type != "disk" {
+			continue
+		}
+		disk := hostDisk{name: d.Name, size: jsonNumberToInt64(d.Size)}
+		if d.Model != nil {
+			disk.model = strings.TrimSpace(*d.Model)
+		}
+		disks = append(disks, disk)
+	}
+	return &hostDevices{disks: disks}, nil
+}
+
+// parseIPAddr parses the JSON output from "ip -j addr". The loopback interface is skipped,
+// and so are link-local addresses, since they're the same on every network.
+func parseIPAddr(content string) (*hostDevices, error) {
+	var list []struct {
+		IfName    string `json:"ifname"`
+		MTU       int64  `json:"mtu"`
+		OperState string `json:"operstate"`
+		LinkType  string `json:"link_type"`
+		Address   string `json:"address"`
+		AddrInfo  []struct {
+			Local string `json:"local"`
+			Scope string `json:"scope"`
+		} `json:"addr_info"`
+	}
+	if err := json.Unmarshal([]byte(content), &list); err != nil {
+		return nil, err
+	}
+	devices := &hostDevices{
+		interfaces: make([]hostInterface, 0, len(list)),
+		addresses:  make([]hostAddress, 0, len(list)),
+	}
+	for _, n := range list {
+		if n.LinkType == "loopback" || n.IfName == "" {
+			continue
+		}
+		i := hostInterface{name: n.IfName, mtu: n.MTU, state: n.OperState}
+		if n.LinkType == "ether" {
+			i.mac = n.Address
+		}
+		devices.interfaces = append(devices.interfaces, i)
+		for _, a := range n.AddrInfo {
+			if a.Scope == "link" || a.Scope == "host" {
+				continue
+			}
+			if ip := net.ParseIP(a.Local); ip != nil {
+				devices.addresses = append(devices.addresses, hostAddress{ipaddr: ip.String(), ifname: n.IfName})
+			}
+		}
+	}
+	return devices, nil
+}
+
+var reIpconfigAdapter = regexp.MustCompile(`^\S.* adapter (.+):\s*$`)
+var reIpconfigAddress = regexp.MustCompile(`^\s+(?:IPv4 |IPv6 |Temporary IPv6 |IP )?Address[ .]*: ([0-9a-fA-F.:]+)`)
+
+// parseIpconfig parses the output from ipconfig on Windows.
+// Link-local addresses aren't included, like with "ip addr".
+func parseIpconfig(content string) (*hostDevices, error) {
+	devices := &hostDevices{addresses: make([]hostAddress, 0)}
+	adapter := ""
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if m := reIpconfigAdapter.FindStringSubmatch(line); m != nil {
+			adapter = m[1]
+			continue
+		}
+		m := reIpconfigAddress.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		ip := net.ParseIP(m[1])
+		if ip == nil || ip.IsLinkLocalUnicast() || ip.IsLoopback() {
+			continue
+		}
+		devices.addresses = append(devices.addresses, hostAddress{ipaddr: ip.String(), ifname: adapter})
+	}
+	return devices, nil
+}
+
+func parseWindowsDiskDrive(content string) (*hostDevices, error) {
+	list, err := unmarshalWmiList(content)
+	if err != nil {
+		return nil, err
+	}
+	disks := make([]hostDisk, 0, len(list))
+	for _, m := range list {
+		var d hostDisk
+		for k, v := range m {
+			switch strings.ToLower(k) {
+			case "deviceid":
+				d.name, _ = v.(string)
+			case "model":
+				d.model, _ = v.(string)
+			case "size":
+				d.size = jsonNumberToInt64(v)
+			}
+		}
+		if d.name != "" {
+			disks = append(disks, d)
+		}
+	}
+	return &hostDevices{disks: disks}, nil
+}
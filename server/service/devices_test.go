@@ -0,0 +1,206 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+)
+
+const lsblkOutput = `{
+   "blockdevices": [
+      {"name": "sda", "type": "disk", "size": 500107862016, "model": "Samsung SSD 860 "},
+      {"name": "sr0", "type": "rom", "size": 1073741312, "model": "DVD-RW"},
+      {"name": "nvme0n1", "type": "disk", "size": "1024209543168", "model": null}
+   ]
+}`
+
+const ipAddrOutput = `[
+	{"ifindex": 1, "ifname": "lo", "mtu": 65536, "operstate": "UNKNOWN", "link_type": "loopback",
+	 "address": "00:00:00:00:00:00", "addr_info": [{"family": "inet", "local": "127.0.0.1", "prefixlen": 8}]},
+	{"ifindex": 2, "ifname": "eth0", "mtu": 1500, "operstate": "UP", "link_type": "ether",
+	 "address": "52:54:00:12:34:56", "addr_info": [
+		{"family": "inet", "local": "10.1.2.3", "prefixlen": 24, "scope": "global"},
+		{"family": "inet6", "local": "2001:db8::1", "prefixlen": 64, "scope": "global"},
+		{"family": "inet6", "local": "fe80::5054:ff:fe12:3456", "prefixlen": 64, "scope": "link"}]},
+	{"ifindex": 3, "ifname": "wg0", "mtu": 1420, "operstate": "UNKNOWN", "link_type": "none"}
+]`
+
+const ipconfigOutput = "\r\nWindows IP Configuration\r\n\r\n\r\n" +
+	"Ethernet adapter Ethernet:\r\n\r\n" +
+	"   Connection-specific DNS Suffix  . : example.com\r\n" +
+	"   IPv6 Address. . . . . . . . . . . : 2001:db8:1::15\r\n" +
+	"   Link-local IPv6 Address . . . . . : fe80::1c2d:3e4f:5a6b:7c8d%12\r\n" +
+	"   IPv4 Address. . . . . . . . . . . : 10.0.0.15\r\n" +
+	"   Subnet Mask . . . . . . . . . . . : 255.255.255.0\r\n" +
+	"   Default Gateway . . . . . . . . . : 10.0.0.1\r\n\r\n" +
+	"Ethernet adapter VirtualBox Host-Only Network:\r\n\r\n" +
+	"   IPv4 Address. . . . . . . . . . . : 192.168.56.1(Preferred)\r\n\r\n" +
+	"Wireless LAN adapter Wi-Fi:\r\n\r\n" +
+	"   Media State . . . . . . . . . . . : Media disconnected\r\n"
+
+func TestDeviceParsers(t *testing.T) {
+	tests := []struct {
+		parser  DeviceParser
+		content string
+		expect  *hostDevices
+	}{
+		{
+			parser:  parseLsblk,
+			content: lsblkOutput,
+			expect: &hostDevices{disks: []hostDisk{
+				{name: "sda", model: "Samsung SSD 860", size: 500107862016},
+				{name: "nvme0n1", size: 1024209543168},
+			}},
+		},
+		{
+			parser:  parseIPAddr,
+			content: ipAddrOutput,
+			expect: &hostDevices{
+				interfaces: []hostInterface{
+					{name: "eth0", mac: "52:54:00:12:34:56", state: "UP", mtu: 1500},
+					{name: "wg0", state: "UNKNOWN", mtu: 1420},
+				},
+				addresses: []hostAddress{
+					{ipaddr: "10.1.2.3", ifname: "eth0"},
+					{ipaddr: "2001:db8::1", ifname: "eth0"},
+				},
+			},
+		},
+		{
+			parser:  parseIpconfig,
+			content: ipconfigOutput,
+			expect: &hostDevices{addresses: []hostAddress{
+				{ipaddr: "2001:db8:1::15", ifname: "Ethernet"},
+				{ipaddr: "10.0.0.15", ifname: "Ethernet"},
+				{ipaddr: "192.168.56.1", ifname: "VirtualBox Host-Only Network"},
+			}},
+		},
+		{
+			parser:  parseWindowsDiskDrive,
+			content: `{"DeviceID": "\\\\.\\PHYSICALDRIVE0", "Model": "KXG50ZNV512G", "Size": 512105932800}`,
+			expect: &hostDevices{disks: []hostDisk{
+				{name: `\\.\PHYSICALDRIVE0`, model: "KXG50ZNV512G", size: 512105932800},
+			}},
+		},
+		{
+			parser:  parseLsblk,
+			content: "lsblk: unknown column: MODEL",
+		},
+	}
+	for i, test := range tests {
+		got, err := test.parser(test.content)
+		if test.expect == nil {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("Test %d:\n got %v\nexpected %v", i, got, test.expect)
+		}
+	}
+}
+
+func TestHostDevices(t *testing.T) {
+	if os.Getenv("NOPOSTGRES") != "" {
+		t.Log("No Postgres, skipping test")
+		return
+	}
+	db := getDBconnForTesting(t)
+	defer db.Close()
+
+	files := []struct {
+		filename, content string
+	}{
+		{"/usr/bin/lsblk -J -b -d -o NAME,TYPE,SIZE,MODEL", lsblkOutput},
+		{"/sbin/ip -j addr", ipAddrOutput},
+		{"/usr/sbin/dmidecode -t processor", dmiDecodeProcessorOutput},
+		{"/usr/sbin/dmidecode -t memory", dmiDecodeMemoryOutput},
+	}
+	for i, f := range files {
+		fileID := i + 1
+		_, err := db.Exec("INSERT INTO files(fileid,certfp,filename,content,received) "+
+			"VALUES($1,'AA',$2,$3,now())", fileID, f.filename, f.content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parseFile(db, int64(fileID))
+	}
+	_, err := db.Exec("UPDATE hostinfo SET hostname='one.example.com', ipaddr='192.0.2.1' WHERE certfp='AA'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := createAPImuxer(db, false)
+	testAPIcalls(t, api, []apiCall{
+		{
+			methodAndPath: "GET /api/v2/hostlist?fields=hostname,cpuSockets,cpuCores,memoryMB," +
+				"diskCount,diskSizeGB,interfaceCount",
+			expectStatus: http.StatusOK,
+			expectJSON: `[{"hostname":"one.example.com","cpuSockets":"2","cpuCores":"32",` +
+				`"memoryMB":"24576","diskCount":"2","diskSizeGB":"1524","interfaceCount":"2"}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/hostlist?fields=hostname&cpuCores=16",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/host/one.example.com?fields=cpuModel,memoryMB,disks,interfaces",
+			expectStatus:  http.StatusOK,
+			expectJSON: `{"cpuModel":"Intel(R) Xeon(R) Gold 6130 CPU @ 2.10GHz","memoryMB":24576,` +
+				`"disks":[{"name":"nvme0n1","model":null,"size":1024209543168},` +
+				`{"name":"sda","model":"Samsung SSD 860","size":500107862016}],` +
+				`"interfaces":[{"name":"eth0","mac":"52:54:00:12:34:56","mtu":1500,"state":"UP"},` +
+				`{"name":"wg0","mac":null,"mtu":1420,"state":"UNKNOWN"}]}`,
+		},
+		{
+			methodAndPath: "GET /api/v2/hostlist?fields=hostname,ipAddress,ipAddresses&anyIpAddress=10.1.*",
+			expectStatus:  http.StatusOK,
+			expectJSON: `[{"hostname":"one.example.com","ipAddress":"192.0.2.1",` +
+				`"ipAddresses":"10.1.2.3 2001:db8::1"}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/hostlist?fields=hostname&anyIpAddress=2001:db8::/32",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"hostname":"one.example.com"}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/hostlist?fields=hostname&anyIpAddress=192.0.2.1",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"hostname":"one.example.com"}]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/hostlist?fields=hostname&anyIpAddress=10.2.*",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[]`,
+		},
+		{
+			methodAndPath: "GET /api/v2/host/one.example.com?fields=ipAddresses",
+			expectStatus:  http.StatusOK,
+			expectJSON: `{"ipAddresses":[{"ipAddress":"10.1.2.3","interface":"eth0"},` +
+				`{"ipAddress":"2001:db8::1","interface":"eth0"}]}`,
+		},
+	})
+
+	// A new list replaces the old one
+	_, err = db.Exec("INSERT INTO files(fileid,certfp,filename,content,received) "+
+		"VALUES(5,'AA','/usr/bin/lsblk -J -b -d -o NAME,TYPE,SIZE,MODEL',$1,now())",
+		`{"blockdevices":[{"name":"sdb","type":"disk","size":1000000000,"model":"X"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parseFile(db, 5)
+	testAPIcalls(t, api, []apiCall{
+		{
+			methodAndPath: "GET /api/v2/hostlist?fields=hostname,diskCount,diskSizeGB",
+			expectStatus:  http.StatusOK,
+			expectJSON:    `[{"hostname":"one.example.com","diskCount":"1","diskSizeGB":"1"}]`,
+		},
+	})
+}
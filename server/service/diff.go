@@ -0,0 +1,227 @@
+package main
+
+// Line-based diff of file versions, with output in the unified format.
+// It uses the algorithm from "An O(ND) Difference Algorithm and Its Variations" by Eugene W. Myers.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffMaxEdits limits the work for files that are very different.
+// If the shortest edit script is longer, the rest of the files is treated as replaced.
+const diffMaxEdits = 1000
+
+type diffEdit struct {
+	op   byte // ' ' for unchanged, '-' for removed, '+' for added
+	a, b int  // line numbers (counting from 0) in the old and new version
+}
+
+// diffLines returns an edit script that turns a into b
+func diffLines(a, b []string) []diffEdit {
+	edits := make([]diffEdit, 0, len(a)+len(b))
+	// Lines that are the same at the start and end don't need the expensive part
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		edits = append(edits, diffEdit{op: ' ', a: prefix, b: prefix})
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix &&
+		a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	edits = append(edits, myersDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix], prefix, prefix)...)
+	for i := suffix; i > 0; i-- {
+		edits = append(edits, diffEdit{op: ' ', a: len(a) - i, b: len(b) - i})
+	}
+	return edits
+}
+
+// myersDiff finds the shortest edit script. offsetA and offsetB are added to the line numbers.
+func myersDiff(a, b []string, offsetA, offsetB int) []diffEdit {
+	n, m := len(a), len(b)
+	max := n + m
+	if max == 0 {
+		return nil
+	}
+	if max > diffMaxEdits {
+		max = diffMaxEdits
+	}
+	// v[k+max] is the furthest x on diagonal k. trace[d] has a copy of the diagonals -d..d after step d.
+	v := make([]int, 2*max+2)
+	trace := make([][]int, 0)
+	found := -1
+	for d := 0; d <= max && found < 0; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[k-1+max] < v[k+1+max]) {
+				x = v[k+1+max] // down, an added line
+			} else {
+				x = v[k-1+max] + 1 // right, a removed line
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[k+max] = x
+			if x >= n && y >= m {
+				found = d
+				break
+			}
+		}
+		trace = append(trace, append([]int(nil), v[max-d:max+d+1]...))
+	}
+	if found < 0 {
+		// Too different. Everything is replaced.
+		edits := make([]diffEdit, 0, n+m)
+		for i := 0; i < n; i++ {
+			edits = append(edits, diffEdit{op: '-', a: offsetA + i, b: offsetB})
+		}
+		for j := 0; j < m; j++ {
+			edits = append(edits, diffEdit{op: '+', a: offsetA + n, b: offsetB + j})
+		}
+		return edits
+	}
+
+	// Backtrack through the trace to find the path, from the end
+	reversed := make([]diffEdit, 0, n+m)
+	x, y := n, m
+	for d := found; d > 0; d-- {
+		prev := trace[d-1] // prev[k+d-1] is diagonal k
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && prev[k-1+d-1] < prev[k+1+d-1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := prev[prevK+d-1]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			reversed = append(reversed, diffEdit{op: ' ', a: offsetA + x, b: offsetB + y})
+		}
+		if x == prevX {
+			y--
+			reversed = append(reversed, diffEdit{op: '+', a: offsetA + x, b: offsetB + y})
+		} else {
+			x--
+			reversed = append(reversed, diffEdit{op: '-', a: offsetA + x, b: offsetB + y})
+		}
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		reversed = append(reversed, diffEdit{op: ' ', a: offsetA + x, b: offsetB + y})
+	}
+	edits := make([]diffEdit, len(reversed))
+	for i, e := range reversed {
+		edits[len(reversed)-1-i] = e
+	}
+	return edits
+}
+
+// diffStats returns the number of added and removed lines
+func diffStats(edits []diffEdit) (added, removed int) {
+	for _, e := range edits {
+		switch e.op {
+		case '+':
+			added++
+		case '-':
+			removed++
+		}
+	}
+	return
+}
+
+// unifiedDiff formats the edits from diffLines like "diff -u" does, with the given number of context lines.
+// The result is empty if there are no differences.
+func unifiedDiff(edits []diffEdit, a, b []string, nameA, nameB string, context int) string {
+	var sb strings.Builder
+	for i := 0; i < len(edits); {
+		// Find the next change
+		for i < len(edits) && edits[i].op == ' ' {
+			i++
+		}
+		if i == len(edits) {
+			break
+		}
+		// The hunk starts with context before the change, and ends when
+		// there are more than 2*context unchanged lines in a row
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for end < len(edits) {
+			if edits[end].op != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(edits) && edits[run].op == ' ' {
+				run++
+			}
+			if run == len(edits) || run-end > 2*context {
+				end = Min(end+context, len(edits))
+				break
+			}
+			end = run
+		}
+		if sb.Len() == 0 {
+			fmt.Fprintf(&sb, "--- %s\n+++ %s\n", nameA, nameB)
+		}
+		writeHunk(&sb, edits[start:end], a, b)
+		i = end
+	}
+	return sb.String()
+}
+
+func writeHunk(sb *strings.Builder, hunk []diffEdit, a, b []string) {
+	countA, countB := 0, 0
+	for _, e := range hunk {
+		if e.op != '+' {
+			countA++
+		}
+		if e.op != '-' {
+			countB++
+		}
+	}
+	// Like diff, an empty range starts at the line before
+	startA, startB := hunk[0].a+1, hunk[0].b+1
+	if countA == 0 {
+		startA--
+	}
+	if countB == 0 {
+		startB--
+	}
+	fmt.Fprintf(sb, "@@ -%s +%s @@\n", hunkRange(startA, countA), hunkRange(startB, countB))
+	for _, e := range hunk {
+		switch e.op {
+		case '-':
+			sb.WriteString("-" + a[e.a] + "\n")
+		case '+':
+			sb.WriteString("+" + b[e.b] + "\n")
+		default:
+			sb.WriteString(" " + a[e.a] + "\n")
+		}
+	}
+}
+
+func hunkRange(start, count int) string {
+	if count == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// contentLines splits file content into lines for diffing. Empty content has no lines.
+func contentLines(content string) []string {
+	if content == "" {
+		return []string{}
+	}
+	return splitLines(content)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		a, b   string
+		expect string
+	}{
+		{
+			a:      "same\n",
+			b:      "same\n",
+			expect: "",
+		},
+		{
+			a: "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n",
+			b: "1\n2\n3\nfour\n5\n6\n7\n8\n9\n10\n11\n12\n13\n",
+			expect: "--- a\n+++ b\n" +
+				"@@ -1,7 +1,7 @@\n 1\n 2\n 3\n-4\n+four\n 5\n 6\n 7\n" +
+				"@@ -10,3 +10,4 @@\n 10\n 11\n 12\n+13\n",
+		},
+		{
+			// Changes close to each other end up in the same hunk
+			a: "a\nb\nc\nd\ne\nf\n",
+			b: "a\nB\nc\nd\ne\nF\n",
+			expect: "--- a\n+++ b\n" +
+				"@@ -1,6 +1,6 @@\n a\n-b\n+B\n c\n d\n e\n-f\n+F\n",
+		},
+		{
+			a:      "",
+			b:      "new\nfile\n",
+			expect: "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+new\n+file\n",
+		},
+		{
+			a:      "old\n",
+			b:      "",
+			expect: "--- a\n+++ b\n@@ -1 +0,0 @@\n-old\n",
+		},
+	}
+	for i, test := range tests {
+		a, b := contentLines(test.a), contentLines(test.b)
+		got := unifiedDiff(diffLines(a, b), a, b, "a", "b", 3)
+		if got != test.expect {
+			t.Errorf("Test %d: got\n%s\nexpected\n%s", i, got, test.expect)
+		}
+	}
+}
+
+func TestDiffLinesRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	randomLines := func(n int) []string {
+		lines := make([]string, n)
+		for i := range lines {
+			lines[i] = strconv.Itoa(r.Intn(5))
+		}
+		return lines
+	}
+	for i := 0; i < 500; i++ {
+		a := randomLines(r.Intn(30))
+		b := randomLines(r.Intn(30))
+		edits := diffLines(a, b)
+		// Applying the edits to a must give b, and the unchanged lines must be the same
+		result := make([]string, 0)
+		removed := 0
+		for _, e := range edits {
+			switch e.op {
+			case ' ':
+				if a[e.a] != b[e.b] {
+					t.Fatalf("Unchanged lines differ: %v %v %v", a, b, edits)
+				}
+				result = append(result, a[e.a])
+			case '+':
+				result = append(result, b[e.b])
+			case '-':
+				removed++
+			}
+		}
+		if !reflect.DeepEqual(result, b) && !(len(result) == 0 && len(b) == 0) {
+			t.Fatalf("Got %v, expected %v", result, b)
+		}
+		if len(edits)-len(b) != removed {
+			t.Fatalf("Wrong number of removed lines")
+		}
+	}
+}
+
+func TestDiffLinesTooDifferent(t *testing.T) {
+	a := make([]string, diffMaxEdits)
+	b := make([]string, diffMaxEdits)
+	for i := range a {
+		a[i] = "a" + strconv.Itoa(i)
+		b[i] = "b" + strconv.Itoa(i)
+	}
+	added, removed := diffStats(diffLines(a, b))
+	if added != len(b) || removed != len(a) {
+		t.Errorf("Got %d added and %d removed", added, removed)
+	}
+}
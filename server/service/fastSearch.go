@@ -1,25 +1,48 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"log"
+	"os"
 	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 var fsMutex sync.RWMutex
-var fsContent map[int64]string
-var fsID map[string]int64  // maps a key string to file id. The key is <certfp>:<filename>
-var fsKey map[int64]string // the reverse of fsID
+var fsContent map[int64]*fsBlob // maps a file id to the blob with its content
+var fsID map[string]int64       // maps a key string to file id. The key is <certfp>:<filename>
+var fsKey map[int64]string      // the reverse of fsID
 var fsReady uint32
 
+// fsTrigrams is an inverted index over the content in fsBlobs.
+// It maps each trigram (3 consecutive bytes of the lowercase content,
+// packed into an uint32) to the list of blob IDs that contain it.
+// A file can only contain the search string if it contains all the trigrams
+// of the search string, so the index is used to narrow down the list of
+// candidates before doing the actual substring check.
+var fsTrigrams map[uint32]*fsPostings
+
+// fsPostings is the sorted list of blob IDs that contain a trigram.
+// A list of numbers takes much less memory than a set, which matters since
+// there's one entry per distinct trigram per blob.
+// Removing an ID from the middle of a long list is slow, so removed blobs
+// are only counted as stale, and the list is compacted when a quarter of it is stale.
+type fsPostings struct {
+	ids   []int64
+	stale int
+}
+
 func init() {
-	fsContent = make(map[int64]string)
+	fsContent = make(map[int64]*fsBlob)
 	fsID = make(map[string]int64)
 	fsKey = make(map[int64]string)
+	fsTrigrams = make(map[uint32]*fsPostings)
 }
 
 func isReadyForSearch() bool {
@@ -28,6 +51,21 @@ func isReadyForSearch() bool {
 }
 
 func loadContentForFastSearch(db *sql.DB) {
+	// Loading a snapshot from disk is much faster than reading everything from the database.
+	// The snapshot may be out of date, so the search cache is compared to the database afterwards.
+	if config.SearchCacheSnapshotFile != "" {
+		t, err := loadSearchCacheSnapshot(config.SearchCacheSnapshotFile)
+		if err == nil {
+			log.Printf("Loaded the search cache from a snapshot made %s ago",
+				time.Since(t).Round(time.Second))
+			markSearchCacheReady(db)
+			triggerJob(compareSearchCacheJob{})
+			return
+		}
+		if !os.IsNotExist(err) {
+			log.Printf("Unable to load a snapshot of the search cache: %s", err)
+		}
+	}
 	log.Printf("Starting to load file content for fast search")
 	rows, err := db.Query("SELECT fileid,filename,certfp,content FROM files " +
 		"WHERE current AND certfp IN (SELECT certfp FROM hostinfo)")
@@ -48,7 +86,7 @@ func loadContentForFastSearch(db *sql.DB) {
 		addFileToFastSearch(fileID, certfp.String, filename.String, content.String)
 	}
 	log.Printf("Finished loading file content for fast search")
-	atomic.StoreUint32(&fsReady, 1)
+	markSearchCacheReady(db)
 	// trigger the job
 	triggerJob(compareSearchCacheJob{})
 }
@@ -57,14 +95,22 @@ func loadContentForFastSearch(db *sql.DB) {
 func addFileToFastSearch(fileID int64, certfp string, filename string, content string) {
 	fsMutex.Lock()
 	defer fsMutex.Unlock()
+	atomic.AddUint64(&fsChanges, 1)
 	key := certfp + ":" + filename
 	// If a previous version of the file is in the cache, it should be removed
 	oldID, ok := fsID[key]
 	if ok {
+		releaseFile(oldID)
 		delete(fsKey, oldID)
-		delete(fsContent, oldID)
 	}
-	fsContent[fileID] = strings.ToLower(content)
+	// The same file ID could also be re-added with a different key
+	if _, ok := fsContent[fileID]; ok {
+		releaseFile(fileID)
+		delete(fsID, fsKey[fileID])
+	}
+	b := internContent(content)
+	b.files[fileID] = struct{}{}
+	fsContent[fileID] = b
 	fsID[key] = fileID
 	fsKey[fileID] = key
 }
@@ -72,7 +118,8 @@ func addFileToFastSearch(fileID int64, certfp string, filename string, content s
 func removeFileFromFastSearch(fileID int64) {
 	fsMutex.Lock()
 	defer fsMutex.Unlock()
-	delete(fsContent, fileID)
+	atomic.AddUint64(&fsChanges, 1)
+	releaseFile(fileID)
 	key, ok := fsKey[fileID]
 	if ok {
 		delete(fsID, key)
@@ -83,10 +130,11 @@ func removeFileFromFastSearch(fileID int64) {
 func removeHostFromFastSearch(certFingerprint string) {
 	fsMutex.Lock()
 	defer fsMutex.Unlock()
+	atomic.AddUint64(&fsChanges, 1)
 	for key, fileID := range fsID {
 		ar := strings.SplitN(key, ":", 2)
 		if ar[0] == certFingerprint {
-			delete(fsContent, fileID)
+			releaseFile(fileID)
 			delete(fsKey, fileID)
 			delete(fsID, key)
 		}
@@ -96,6 +144,7 @@ func removeHostFromFastSearch(certFingerprint string) {
 func replaceCertificateInCache(oldCertFingerprint, newCertFingerprint string) {
 	fsMutex.Lock()
 	defer fsMutex.Unlock()
+	atomic.AddUint64(&fsChanges, 1)
 	for key, fileID := range fsID {
 		ar := strings.SplitN(key, ":", 2)
 		if ar[0] == oldCertFingerprint {
@@ -107,6 +156,36 @@ func replaceCertificateInCache(oldCertFingerprint, newCertFingerprint string) {
 	}
 }
 
+// rekeyFileInFastSearch changes the key of a file in the cache, without touching the content.
+// If another file had the same key, it is removed, since there can only be one current version.
+// Returns false if the file isn't in the cache.
+func rekeyFileInFastSearch(fileID int64, key string) bool {
+	fsMutex.Lock()
+	defer fsMutex.Unlock()
+	oldKey, ok := fsKey[fileID]
+	if !ok {
+		return false
+	}
+	atomic.AddUint64(&fsChanges, 1)
+	if otherID, ok := fsID[key]; ok && otherID != fileID {
+		releaseFile(otherID)
+		delete(fsKey, otherID)
+	}
+	if fsID[oldKey] == fileID {
+		delete(fsID, oldKey)
+	}
+	fsID[key] = fileID
+	fsKey[fileID] = key
+	return true
+}
+
+func isFileInFastSearch(fileID int64) bool {
+	fsMutex.RLock()
+	defer fsMutex.RUnlock()
+	_, ok := fsKey[fileID]
+	return ok
+}
+
 func numberOfFilesInFastSearch() int {
 	// Don't want to return a count if the cache isn't fully loaded yet, it would be misleading
 	if !isReadyForSearch() {
@@ -132,22 +211,25 @@ func compareSearchCacheToDB(db *sql.DB) {
 	const passes = 2
 	obsolete := make([]map[int64]bool, passes)
 	missing := make([]map[int64]bool, passes)
+	wrongKey := make([]map[int64]string, passes)
 	for pass := 0; pass < passes; pass++ {
 
-		// Read a list of the IDs of "current" and parsed files from the database
-		source := make(map[int64]bool, 10000)
-		rows, err := db.Query("SELECT fileid FROM files WHERE current AND certfp IN (SELECT certfp FROM hostinfo)")
+		// Read a list of the IDs and keys of "current" and parsed files from the database
+		source := make(map[int64]string, 10000)
+		rows, err := db.Query("SELECT fileid,certfp,filename FROM files " +
+			"WHERE current AND certfp IN (SELECT certfp FROM hostinfo)")
 		if err != nil {
 			log.Panic(err)
 		}
 		defer rows.Close()
 		for rows.Next() {
 			var fileID int64
-			err = rows.Scan(&fileID)
+			var certfp, filename sql.NullString
+			err = rows.Scan(&fileID, &certfp, &filename)
 			if err != nil {
 				log.Panic(err)
 			}
-			source[fileID] = true
+			source[fileID] = certfp.String + ":" + filename.String
 		}
 		if rows.Err() != nil {
 			log.Panic(rows.Err())
@@ -156,12 +238,17 @@ func compareSearchCacheToDB(db *sql.DB) {
 		// Allocate maps
 		obsolete[pass] = make(map[int64]bool)
 		missing[pass] = make(map[int64]bool)
+		wrongKey[pass] = make(map[int64]string)
 
-		// Find entries in the cache that should have been removed
+		// Find entries in the cache that should have been removed,
+		// and entries with the wrong key, e.g. because the certificate was renewed
 		fsMutex.RLock()
-		for fileID := range fsKey {
-			if _, ok := source[fileID]; !ok {
+		for fileID, cachedKey := range fsKey {
+			key, ok := source[fileID]
+			if !ok {
 				obsolete[pass][fileID] = true
+			} else if key != cachedKey {
+				wrongKey[pass][fileID] = key
 			}
 		}
 
@@ -192,17 +279,38 @@ func compareSearchCacheToDB(db *sql.DB) {
 		log.Printf("The search cache had %d files that were obsolete", rem)
 	}
 
-	// Load the missing files
-	mis := 0
+	// Fix the keys
+	rekeyed := 0
+	for fileID, key := range wrongKey[0] {
+		if wrongKey[1][fileID] == key && rekeyFileInFastSearch(fileID, key) {
+			rekeyed++
+		}
+	}
+	if rekeyed > 0 {
+		log.Printf("The search cache had %d files with an outdated certificate or filename", rekeyed)
+	}
+
+	// Load the missing files.
+	// After loading a snapshot there can be many of them, so they are read in batches.
+	list := make([]int64, 0, len(missing[0]))
 	for fileID, b := range missing[0] {
 		if b && missing[1][fileID] {
+			list = append(list, fileID)
+		}
+	}
+	mis := 0
+	const batchSize = 1000
+	for start := 0; start < len(list); start += batchSize {
+		batch := list[start:Min(start+batchSize, len(list))]
+		rows, err := db.Query("SELECT fileid,filename,certfp,content FROM files "+
+			"WHERE fileid = ANY($1) AND current", pq.Array(batch))
+		if err != nil {
+			log.Panic(err)
+		}
+		for rows.Next() {
+			var fileID int64
 			var filename, certfp, content sql.NullString
-			err := db.QueryRow("SELECT filename,certfp,content FROM files "+
-				"WHERE fileid=$1 AND current", fileID).
-				Scan(&filename, &certfp, &content)
-			if err == sql.ErrNoRows {
-				continue
-			} else if err != nil {
+			if err = rows.Scan(&fileID, &filename, &certfp, &content); err != nil {
 				log.Panic(err)
 			}
 			if !certfp.Valid || !filename.Valid || !content.Valid {
@@ -211,6 +319,10 @@ func compareSearchCacheToDB(db *sql.DB) {
 			addFileToFastSearch(fileID, certfp.String, filename.String, content.String)
 			mis++
 		}
+		if err = rows.Err(); err != nil {
+			log.Panic(err)
+		}
+		rows.Close()
 	}
 	if mis > 0 {
 		log.Printf("The search cache was missing %d files", mis)
@@ -223,97 +335,323 @@ func (a hitList) Len() int           { return len(a) }
 func (a hitList) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a hitList) Less(i, j int) bool { return a[i] > a[j] } // reverse sort
 
-func searchFiles(searchString string, filename string) ([]int64, map[string]int) {
-	fsMutex.RLock()
-	searchString = strings.ToLower(searchString)
-	hits := make(hitList, 0)
-	distinctFilenames := make(map[string]int, 0)
-	for id, content := range fsContent {
-		if strings.Contains(content, searchString) {
-			key := fsKey[id]
-			ar := strings.SplitN(key, ":", 2)
-			if filename != "" {
-				if filename != ar[1] {
-					continue
-				}
+// trigram packs 3 bytes from s, starting at position i, into an uint32
+func trigram(s string, i int) uint32 {
+	return uint32(s[i])<<16 | uint32(s[i+1])<<8 | uint32(s[i+2])
+}
+
+// addToTrigramIndex adds all the trigrams in the (lowercase) content of a blob to the index,
+// which is fsTrigrams or one that is being built.
+// The caller must hold the write lock on fsMutex if it is fsTrigrams.
+func addToTrigramIndex(index map[uint32]*fsPostings, blobID int64, content string) {
+	for i := 0; i+3 <= len(content); i++ {
+		t := trigram(content, i)
+		p, ok := index[t]
+		if !ok {
+			p = &fsPostings{}
+			index[t] = p
+		}
+		p.add(blobID)
+	}
+}
+
+// add inserts the ID in the list, unless it is there already.
+// New blobs get higher IDs than all the others, so the ID is usually appended.
+func (p *fsPostings) add(blobID int64) {
+	n := len(p.ids)
+	if n == 0 || p.ids[n-1] < blobID {
+		p.ids = append(p.ids, blobID)
+		return
+	}
+	i := sort.Search(n, func(i int) bool { return p.ids[i] >= blobID })
+	if p.ids[i] == blobID {
+		// The trigram occurs more than once in the content
+		return
+	}
+	p.ids = append(p.ids, 0)
+	copy(p.ids[i+1:], p.ids[i:])
+	p.ids[i] = blobID
+}
+
+// compact removes the IDs of blobs that aren't in the cache anymore.
+// The caller must hold the write lock on fsMutex.
+func (p *fsPostings) compact() {
+	ids := make([]int64, 0, len(p.ids)-p.stale)
+	for _, id := range p.ids {
+		if _, ok := fsBlobs[id]; ok {
+			ids = append(ids, id)
+		}
+	}
+	p.ids = ids
+	p.stale = 0
+}
+
+// removeFromTrigramIndex removes the blob from the index, which must already have been removed from fsBlobs.
+// The content must be the same as what was given to addToTrigramIndex.
+// The caller must hold the write lock on fsMutex.
+func removeFromTrigramIndex(blobID int64, content string) {
+	seen := make(map[uint32]struct{})
+	for i := 0; i+3 <= len(content); i++ {
+		t := trigram(content, i)
+		if _, ok := seen[t]; ok {
+			continue
+		}
+		seen[t] = struct{}{}
+		p, ok := fsTrigrams[t]
+		if !ok {
+			continue
+		}
+		p.stale++
+		if p.stale >= len(p.ids) {
+			delete(fsTrigrams, t)
+		} else if p.stale*4 >= len(p.ids) {
+			p.compact()
+		}
+	}
+}
+
+// candidateBlobs uses the trigram index to find which blobs may contain
+// all the given (lowercase) strings. The second return value is false if the
+// strings are too short to use the index, in which case the caller
+// must consider every blob in the cache.
+// The list may contain IDs of blobs that have been removed, which the caller must skip.
+// The caller must hold the read lock on fsMutex.
+func candidateBlobs(required []string) ([]int64, bool) {
+	trigrams := make(map[uint32]struct{})
+	for _, str := range required {
+		for i := 0; i+3 <= len(str); i++ {
+			trigrams[trigram(str, i)] = struct{}{}
+		}
+	}
+	if len(trigrams) == 0 {
+		return nil, false
+	}
+	lists := make([][]int64, 0, len(trigrams))
+	for t := range trigrams {
+		p, ok := fsTrigrams[t]
+		if !ok {
+			// No blob contains this trigram, so no file can match
+			return []int64{}, true
+		}
+		lists = append(lists, p.ids)
+	}
+	// The candidates are the blobs that contain every trigram.
+	// Starting with the shortest list keeps the intermediate results small.
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+	candidates := append([]int64{}, lists[0]...)
+	for _, list := range lists[1:] {
+		if len(candidates) == 0 {
+			break
+		}
+		candidates = intersectSorted(candidates, list)
+	}
+	return candidates, true
+}
+
+// intersectSorted returns the numbers that are in both sorted lists.
+// The result is written over a, which should be the shorter list.
+func intersectSorted(a []int64, b []int64) []int64 {
+	result := a[:0]
+	for _, id := range a {
+		i := sort.Search(len(b), func(i int) bool { return b[i] >= id })
+		if i == len(b) {
+			break
+		}
+		if b[i] == id {
+			result = append(result, id)
+		}
+		b = b[i:]
+	}
+	return result
+}
+
+// forEachMatch calls f for every file that matches the query, with the
+// file ID and the certificate fingerprint and filename of the file.
+// The function accept is called first, so the content only has to be
+// matched if at least one of the files that share it is of interest.
+// If the query runs out of time, it stops and returns errSearchTimeLimit.
+// The caller must hold the read lock on fsMutex.
+func forEachMatch(q *searchQuery, accept func(certfp, filename string) bool,
+	f func(id int64, certfp, filename string)) *httpError {
+	now := time.Now().Unix()
+	type acceptedFile struct {
+		id               int64
+		certfp, filename string
+	}
+	accepted := make([]acceptedFile, 0)
+	check := func(b *fsBlob) {
+		accepted = accepted[0:0]
+		for id := range b.files {
+			ar := strings.SplitN(fsKey[id], ":", 2)
+			if len(ar) == 2 && accept(ar[0], ar[1]) {
+				accepted = append(accepted, acceptedFile{id, ar[0], ar[1]})
+			}
+		}
+		if len(accepted) == 0 || !blobMatches(q, b, now) {
+			return
+		}
+		for _, a := range accepted {
+			f(a.id, a.certfp, a.filename)
+		}
+	}
+	// A blob that was being matched when the time ran out may have been ruled out wrongly,
+	// so the deadline is checked after each blob, including the last one
+	candidates, ok := candidateBlobs(q.literals)
+	if !ok {
+		for _, b := range fsBlobs {
+			check(b)
+			if q.hasExpired() {
+				return errSearchTimeLimit
 			}
-			hits = append(hits, id)
-			distinctFilenames[ar[1]]++
+		}
+		return nil
+	}
+	for _, id := range candidates {
+		if b, ok := fsBlobs[id]; ok {
+			check(b)
+		}
+		if q.hasExpired() {
+			return errSearchTimeLimit
 		}
 	}
+	return nil
+}
+
+// blobMatches returns true if the content of the blob matches the query.
+// Case-sensitive queries are matched against the original content.
+// The caller must hold the read lock on fsMutex.
+func blobMatches(q *searchQuery, b *fsBlob, now int64) bool {
+	atomic.StoreInt64(&b.lastUsed, now)
+	lowercase := b.text()
+	if !q.caseSensitive {
+		return q.matches(lowercase)
+	}
+	// Restoring the original content costs more than ruling it out first
+	if !q.mayMatch(lowercase) {
+		return false
+	}
+	return q.matches(b.originalContent(lowercase))
+}
+
+func searchFiles(q *searchQuery, filename string) ([]int64, map[string]int, *httpError) {
+	fsMutex.RLock()
+	hits := make(hitList, 0)
+	distinctFilenames := make(map[string]int, 0)
+	hErr := forEachMatch(q, func(certfp, fname string) bool {
+		return filename == "" || filename == fname
+	}, func(id int64, certfp, fname string) {
+		hits = append(hits, id)
+		distinctFilenames[fname]++
+	})
 	fsMutex.RUnlock()
+	if hErr != nil {
+		return nil, nil, hErr
+	}
 	// The result list must be in the same order every time for pagination to work.
 	// The hits are reverse sorted so the newest files will show first.
 	sort.Sort(hits)
-	return hits, distinctFilenames
+	return hits, distinctFilenames, nil
 }
 
-func searchFilesWithFilter(searchString string, filename string, validCerts map[string]bool) ([]int64, map[string]int) {
+func searchFilesWithFilter(q *searchQuery, filename string, validCerts map[string]bool) ([]int64, map[string]int, *httpError) {
 	fsMutex.RLock()
-	searchString = strings.ToLower(searchString)
 	hits := make(hitList, 0)
 	distinctFilenames := make(map[string]int, 0)
-	for key, id := range fsID {
-		// extract certfp and filename from key
-		ar := strings.SplitN(key, ":", 2)
-		if filename != "" && filename != ar[1] {
-			continue
-		}
-		certfp := ar[0]
-		if validCerts[certfp] {
-			content := fsContent[id]
-			if strings.Contains(content, searchString) {
-				hits = append(hits, id)
-				distinctFilenames[ar[1]]++
-			}
-		}
-	}
+	hErr := forEachMatch(q, func(certfp, fname string) bool {
+		return (filename == "" || filename == fname) && validCerts[certfp]
+	}, func(id int64, certfp, fname string) {
+		hits = append(hits, id)
+		distinctFilenames[fname]++
+	})
 	fsMutex.RUnlock()
+	if hErr != nil {
+		return nil, nil, hErr
+	}
 	// The result list must be in the same order every time for pagination to work.
 	// The hits are reverse sorted so the newest files will show first.
 	sort.Sort(hits)
-	return hits, distinctFilenames
+	return hits, distinctFilenames, nil
 }
 
-func searchForHosts(searchString string, filename string) map[string]bool {
+func searchForHosts(q *searchQuery, filename string) (map[string]bool, *httpError) {
 	fsMutex.RLock()
 	defer fsMutex.RUnlock()
-	searchString = strings.ToLower(searchString)
 	resultMap := make(map[string]bool, 0)
-	for key, id := range fsID {
-		// extract certfp and filename from key
-		ar := strings.SplitN(key, ":", 2)
-		if filename != "" && filename != ar[1] {
-			continue
-		}
-		// match strings
-		if strings.Contains(fsContent[id], searchString) {
-			resultMap[ar[0]] = true
-		}
+	hErr := forEachMatch(q, func(certfp, fname string) bool {
+		// No need to match the content again for hosts that are already in the result
+		return (filename == "" || filename == fname) && !resultMap[certfp]
+	}, func(id int64, certfp, fname string) {
+		resultMap[certfp] = true
+	})
+	if hErr != nil {
+		return nil, hErr
 	}
-	return resultMap
+	return resultMap, nil
 }
 
-func findMatchesInFile(fileID int64, query string, maxMatches int) []int {
+// findMatchesInFile returns the start and end positions of up to maxMatches
+// places in the file where the query matched.
+func findMatchesInFile(fileID int64, q *searchQuery, maxMatches int) [][]int {
 	fsMutex.RLock()
-	content, ok := fsContent[fileID]
+	var content string
+	b, ok := fsContent[fileID]
+	if ok {
+		content = b.text()
+		if q.caseSensitive {
+			content = b.originalContent(content)
+		}
+	}
 	fsMutex.RUnlock()
 	if !ok {
 		return nil
 	}
-	result := make([]int, 0, Min(maxMatches, 10))
-	query = strings.ToLower(query)
-	offset := 0
-	for n := 0; n < maxMatches; n++ {
-		i := strings.Index(content, query)
-		if i == -1 {
-			break
+	return q.findAll(content, maxMatches)
+}
+
+// cachedFile is a file in the search cache, identified by the host and the filename
+type cachedFile struct {
+	certfp, filename string
+}
+
+// forEachContentInCache calls f once for each distinct content among the files in the cache
+// with a name that is accepted, with the original content and the files that have it,
+// until f returns false. The files are collected under the read lock on fsMutex,
+// but f runs without it, so a slow f doesn't hold up updates to the cache, or searches.
+func forEachContentInCache(accept func(filename string) bool, f func(content string, files []cachedFile) bool) {
+	type candidate struct {
+		blob  fsBlob // a copy of the fields that are needed to restore the content
+		files []cachedFile
+	}
+	candidates := make(map[int64]*candidate)
+	list := make([]*candidate, 0)
+	fsMutex.RLock()
+	for id, key := range fsKey {
+		ar := strings.SplitN(key, ":", 2)
+		if len(ar) < 2 || !accept(ar[1]) {
+			continue
+		}
+		b, ok := fsContent[id]
+		if !ok {
+			continue
+		}
+		c, ok := candidates[b.id]
+		if !ok {
+			// The strings and slices are never modified in place (see compressSearchCache),
+			// so the copy can be used without the lock
+			c = &candidate{blob: fsBlob{id: b.id, content: b.content, compressed: b.compressed,
+				upper: b.upper, original: b.original}}
+			candidates[b.id] = c
+			list = append(list, c)
+		}
+		c.files = append(c.files, cachedFile{certfp: ar[0], filename: ar[1]})
+	}
+	fsMutex.RUnlock()
+
+	for _, c := range list {
+		if !f(c.blob.originalContent(c.blob.text()), c.files) {
+			return
 		}
-		result = append(result, i+offset)
-		content = content[i+len(query):]
-		offset = offset + i + len(query)
 	}
-	return result
 }
 
 // getCertAndFilenameFromFileID returns 2 strings: certificate fingerprint and filename
@@ -332,13 +670,13 @@ func getCertAndFilenameFromFileID(fileID int64) (string, string) {
 type compareSearchCacheJob struct{}
 
 func init() {
-	RegisterJob(compareSearchCacheJob{})
+	RegisterLocalJob(compareSearchCacheJob{})
 }
 
 func (job compareSearchCacheJob) HowOften() time.Duration {
 	return time.Minute * 15
 }
 
-func (job compareSearchCacheJob) Run(db *sql.DB) {
+func (job compareSearchCacheJob) Run(ctx context.Context, db *sql.DB) {
 	compareSearchCacheToDB(db)
 }
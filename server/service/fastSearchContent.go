@@ -0,0 +1,258 @@
+package main
+
+// Many files are identical on lots of hosts (e.g. /etc/nsswitch.conf),
+// so the search cache only keeps one copy of each distinct content.
+// A copy is called a blob, and each file in the cache refers to a blob.
+// The trigram index refers to blobs too, and a search only has to match
+// the content of each blob once, no matter how many files share it.
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"database/sql"
+	"hash/crc32"
+	"io"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type fsBlob struct {
+	id int64
+	// crc is the checksum of the original content, used to find duplicates
+	crc uint32
+	// size is the length of the original content
+	size int
+	// content is the lowercase content. It is empty if the blob is compressed.
+	content string
+	// compressed is the lowercase content, compressed with flate.
+	// Large blobs that haven't been searched in a while are compressed.
+	compressed []byte
+	// upper is a bitmap with one bit per byte of content. A set bit means
+	// that the byte was an uppercase ASCII letter in the original content.
+	// It is nil if the content had no uppercase letters.
+	upper []byte
+	// original is the original content, only kept when lowercasing changed
+	// more than just ASCII letters, which is rare.
+	original string
+	// files are the IDs of the files that have this content.
+	// The blob is removed when no files refer to it anymore.
+	files map[int64]struct{}
+	// lastUsed is when the content was last matched against a query (unix time)
+	lastUsed int64
+}
+
+// fsBlobs maps blob IDs to blobs
+var fsBlobs map[int64]*fsBlob
+
+// fsBlobsByCRC is used to find an existing blob with the same content
+var fsBlobsByCRC map[uint32][]*fsBlob
+
+var fsNextBlobID int64
+
+// Blobs larger than this can be compressed, if they aren't used for a while
+const fsCompressMinSize = 64 * 1024
+const fsCompressAfter = time.Hour
+
+func init() {
+	fsBlobs = make(map[int64]*fsBlob)
+	fsBlobsByCRC = make(map[uint32][]*fsBlob)
+}
+
+// internContent returns the blob with the given content, creating it if necessary.
+// New blobs are added to the trigram index.
+// The caller must hold the write lock on fsMutex.
+func internContent(content string) *fsBlob {
+	crc := crc32.ChecksumIEEE([]byte(content))
+	for _, b := range fsBlobsByCRC[crc] {
+		if b.size == len(content) && b.originalContent(b.text()) == content {
+			return b
+		}
+	}
+	lowercase := strings.ToLower(content)
+	fsNextBlobID++
+	b := &fsBlob{
+		id:       fsNextBlobID,
+		crc:      crc,
+		size:     len(content),
+		content:  lowercase,
+		files:    make(map[int64]struct{}, 1),
+		lastUsed: time.Now().Unix(),
+	}
+	b.upper, b.original = caseInfo(content, lowercase)
+	fsBlobs[b.id] = b
+	fsBlobsByCRC[crc] = append(fsBlobsByCRC[crc], b)
+	addToTrigramIndex(fsTrigrams, b.id, lowercase)
+	return b
+}
+
+// releaseFile removes the file's reference to its blob, and removes the blob
+// if no other files refer to it.
+// The caller must hold the write lock on fsMutex.
+func releaseFile(fileID int64) {
+	b, ok := fsContent[fileID]
+	if !ok {
+		return
+	}
+	delete(fsContent, fileID)
+	delete(b.files, fileID)
+	if len(b.files) > 0 {
+		return
+	}
+	delete(fsBlobs, b.id)
+	removeFromTrigramIndex(b.id, b.text())
+	list := fsBlobsByCRC[b.crc]
+	for i, other := range list {
+		if other == b {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(fsBlobsByCRC, b.crc)
+	} else {
+		fsBlobsByCRC[b.crc] = list
+	}
+}
+
+// text returns the lowercase content of the blob, decompressing it if needed.
+// The caller must hold the read lock on fsMutex.
+func (b *fsBlob) text() string {
+	if b.compressed == nil {
+		return b.content
+	}
+	data, err := io.ReadAll(flate.NewReader(bytes.NewReader(b.compressed)))
+	if err != nil {
+		// Should not happen, since the data was compressed by compressSearchCache
+		log.Printf("Unable to decompress blob %d in the search cache: %s", b.id, err)
+		return ""
+	}
+	return string(data)
+}
+
+// originalContent restores the original content of the blob, given the lowercase content.
+// The caller must hold the read lock on fsMutex.
+func (b *fsBlob) originalContent(lowercase string) string {
+	if b.original != "" {
+		return b.original
+	}
+	if b.upper == nil {
+		return lowercase
+	}
+	buf := []byte(lowercase)
+	for i := range buf {
+		if b.upper[i/8]&(1<<(i%8)) != 0 {
+			buf[i] -= 'a' - 'A'
+		}
+	}
+	return string(buf)
+}
+
+// caseInfo returns what is needed to restore the original content
+// from the lowercase version: either a bitmap of the uppercase ASCII letters,
+// or the original content if lowercasing changed anything else.
+func caseInfo(original string, lowercase string) ([]byte, string) {
+	if original == lowercase {
+		return nil, ""
+	}
+	// Lowercasing non-ASCII text may change the length of the string,
+	// and then a bitmap won't do.
+	if len(original) != len(lowercase) {
+		return nil, original
+	}
+	bitmap := make([]byte, (len(original)+7)/8)
+	for i := 0; i < len(original); i++ {
+		c := original[i]
+		if c == lowercase[i] {
+			continue
+		}
+		if c < 'A' || c > 'Z' {
+			return nil, original
+		}
+		bitmap[i/8] |= 1 << (i % 8)
+	}
+	return bitmap, ""
+}
+
+// compressSearchCache compresses large blobs that haven't been searched in a while.
+// They are decompressed on the fly if they become candidates in a search.
+// Returns the number of blobs that were compressed.
+func compressSearchCache() int {
+	// Find the blobs to compress
+	limit := time.Now().Add(-fsCompressAfter).Unix()
+	list := make([]*fsBlob, 0)
+	fsMutex.RLock()
+	for _, b := range fsBlobs {
+		if b.compressed == nil && b.size >= fsCompressMinSize &&
+			atomic.LoadInt64(&b.lastUsed) < limit {
+			list = append(list, b)
+		}
+	}
+	fsMutex.RUnlock()
+
+	// The content of a blob never changes, so it can be compressed without holding the lock
+	count := 0
+	for _, b := range list {
+		var buf bytes.Buffer
+		zw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+		zw.Write([]byte(b.content))
+		zw.Close()
+		// Not worth it if it doesn't save at least a quarter
+		if buf.Len() > len(b.content)*3/4 {
+			continue
+		}
+		fsMutex.Lock()
+		if fsBlobs[b.id] == b && b.compressed == nil {
+			b.compressed = buf.Bytes()
+			b.content = ""
+			atomic.AddUint64(&fsChanges, 1)
+			count++
+		}
+		fsMutex.Unlock()
+	}
+	return count
+}
+
+// searchCacheMemoryUsage returns an estimate of how many bytes the search cache uses.
+// It counts the content, the maps with a rough estimate of the overhead per map entry,
+// and the lists in the trigram index.
+func searchCacheMemoryUsage() int64 {
+	const mapEntryOverhead = 48
+	const postingsOverhead = 8 + 24 + 8 // pointer, slice header, stale counter
+	fsMutex.RLock()
+	defer fsMutex.RUnlock()
+	var total int64
+	for _, b := range fsBlobs {
+		total += int64(len(b.content) + len(b.compressed) + len(b.upper) + len(b.original))
+		total += int64(len(b.files)+1) * mapEntryOverhead
+	}
+	for key := range fsID {
+		total += int64(len(key)) + 3*mapEntryOverhead
+	}
+	for _, p := range fsTrigrams {
+		total += mapEntryOverhead/2 + postingsOverhead + int64(cap(p.ids))*8
+	}
+	return total
+}
+
+// Job
+type compressSearchCacheJob struct{}
+
+func init() {
+	RegisterLocalJob(compressSearchCacheJob{})
+}
+
+func (job compressSearchCacheJob) HowOften() time.Duration {
+	return time.Minute * 10
+}
+
+func (job compressSearchCacheJob) Run(ctx context.Context, db *sql.DB) {
+	if !isReadyForSearch() {
+		return
+	}
+	if n := compressSearchCache(); n > 0 {
+		log.Printf("Compressed %d files in the search cache", n)
+	}
+}
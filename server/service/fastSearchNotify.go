@@ -0,0 +1,144 @@
+package main
+
+// Each server instance has its own search cache. Changes in the database that affect
+// the cache are announced with NOTIFY by triggers (see database/patch020.sql),
+// so every instance can apply them, no matter which instance or script made the change.
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const searchCacheChannel = "searchcache"
+
+// Notifications that arrive while the cache is loading are kept here,
+// and applied when the cache is ready. If there are too many, the rest are dropped,
+// and compareSearchCacheJob must fix the cache afterwards.
+var pendingNotifications []string
+var pendingNotificationsMutex sync.Mutex
+
+const maxPendingNotifications = 100000
+
+// listenForSearchCacheChanges is intended to be run as a goroutine.
+// It returns when ctx is cancelled.
+func listenForSearchCacheChanges(ctx context.Context, db *sql.DB, connectionString string) {
+	listener := pq.NewListener(connectionString, time.Second, time.Minute,
+		func(event pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Printf("Search cache listener: %v", err)
+			}
+		})
+	defer listener.Close()
+	if err := listener.Listen(searchCacheChannel); err != nil {
+		log.Printf("Unable to listen for search cache changes: %v", err)
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-listener.Notify:
+			if n == nil {
+				// The connection was lost and re-established, and notifications may have been missed
+				if isReadyForSearch() {
+					triggerJob(compareSearchCacheJob{})
+				}
+				continue
+			}
+			if err := applySearchCacheNotification(db, n.Extra); err != nil {
+				log.Printf("Search cache notification \"%s\": %v", n.Extra, err)
+			}
+		case <-time.After(90 * time.Second):
+			// Make sure the connection is still alive, so a lost connection is noticed
+			go listener.Ping()
+		}
+	}
+}
+
+// markSearchCacheReady makes the search cache available, and applies the notifications
+// that arrived while it was loading
+func markSearchCacheReady(db *sql.DB) {
+	pendingNotificationsMutex.Lock()
+	list := pendingNotifications
+	pendingNotifications = nil
+	atomic.StoreUint32(&fsReady, 1)
+	pendingNotificationsMutex.Unlock()
+	for _, payload := range list {
+		if err := applySearchCacheNotification(db, payload); err != nil {
+			log.Printf("Search cache notification \"%s\": %v", payload, err)
+		}
+	}
+}
+
+// queueSearchCacheNotification keeps the notification until the cache is ready.
+// Returns false if the cache has become ready, so the notification can be applied right away.
+func queueSearchCacheNotification(payload string) bool {
+	pendingNotificationsMutex.Lock()
+	defer pendingNotificationsMutex.Unlock()
+	if isReadyForSearch() {
+		return false
+	}
+	if len(pendingNotifications) < maxPendingNotifications {
+		pendingNotifications = append(pendingNotifications, payload)
+	}
+	return true
+}
+
+// applySearchCacheNotification updates the search cache according to the payload of a notification
+func applySearchCacheNotification(db *sql.DB, payload string) error {
+	if !isReadyForSearch() && queueSearchCacheNotification(payload) {
+		return nil
+	}
+	fields := strings.Fields(payload)
+	if len(fields) == 0 {
+		return fmt.Errorf("empty payload")
+	}
+	switch {
+	case fields[0] == "add" && len(fields) == 2:
+		fileID, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		if isFileInFastSearch(fileID) {
+			// The content of a file version never changes, so there's nothing to do
+			return nil
+		}
+		// If the host has been deleted, the notification may have arrived after the "host" notification,
+		// and the file must not be put back in the cache
+		var filename, certfp, content sql.NullString
+		err = db.QueryRow("SELECT filename,certfp,content FROM files WHERE fileid=$1 AND current "+
+			"AND certfp IN (SELECT certfp FROM hostinfo)", fileID).Scan(&filename, &certfp, &content)
+		if err == sql.ErrNoRows {
+			// It has been replaced or removed since, or the host has been deleted
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if certfp.Valid && filename.Valid && content.Valid {
+			addFileToFastSearch(fileID, certfp.String, filename.String, content.String)
+		}
+	case fields[0] == "remove" && len(fields) == 2:
+		fileID, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		removeFileFromFastSearch(fileID)
+	case fields[0] == "host" && len(fields) == 2:
+		removeHostFromFastSearch(fields[1])
+	case fields[0] == "cert" && len(fields) == 3:
+		replaceCertificateInCache(fields[1], fields[2])
+	default:
+		return fmt.Errorf("unknown notification")
+	}
+	return nil
+}
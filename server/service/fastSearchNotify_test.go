@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestApplySearchCacheNotification(t *testing.T) {
+	const certfp = "NOTIFY11"
+	const certfp2 = "NOTIFY22"
+	defer removeHostFromFastSearch(certfp)
+	defer removeHostFromFastSearch(certfp2)
+	fsReady = 1
+
+	addFileToFastSearch(9001, certfp, "/etc/hosts", "127.0.0.1 localhost")
+	addFileToFastSearch(9002, certfp, "/etc/motd", "Hello")
+	addFileToFastSearch(9003, certfp2, "/etc/motd", "Hi")
+
+	// "add" for a file that is already in the cache doesn't need the database
+	for _, payload := range []string{"add 9001", "remove 9002", "cert NOTIFY22 NOTIFY33"} {
+		if err := applySearchCacheNotification(nil, payload); err != nil {
+			t.Errorf("%s: %v", payload, err)
+		}
+	}
+	if !isFileInFastSearch(9001) || isFileInFastSearch(9002) {
+		t.Errorf("Wrong files in the cache after remove")
+	}
+	if c, _ := getCertAndFilenameFromFileID(9003); c != "NOTIFY33" {
+		t.Errorf("The certificate wasn't replaced, file 9003 belongs to %s", c)
+	}
+	if err := applySearchCacheNotification(nil, "host "+certfp); err != nil {
+		t.Error(err)
+	}
+	if isFileInFastSearch(9001) {
+		t.Errorf("The host wasn't removed")
+	}
+	removeHostFromFastSearch("NOTIFY33")
+
+	for _, payload := range []string{"", "remove", "remove x", "cert AA", "something 1"} {
+		if err := applySearchCacheNotification(nil, payload); err == nil {
+			t.Errorf("Expected an error for \"%s\"", payload)
+		}
+	}
+}
+
+func TestApplySearchCacheNotificationAdd(t *testing.T) {
+	if os.Getenv("NOPOSTGRES") != "" {
+		t.Log("No Postgres, skipping test")
+		return
+	}
+	db := getDBconnForTesting(t)
+	defer db.Close()
+	const certfp = "NOTIFY44"
+	defer removeHostFromFastSearch(certfp)
+	fsReady = 1
+
+	_, err := db.Exec("INSERT INTO hostinfo(certfp) VALUES('NOTIFY44')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// File 9014 belongs to a host that has been deleted
+	_, err = db.Exec("INSERT INTO files(fileid,certfp,filename,content,received,current) VALUES " +
+		"(9011,'NOTIFY44','/etc/issue','Welcome',now(),true)," +
+		"(9012,'NOTIFY44','/etc/issue.net','Welcome',now(),false)," +
+		"(9014,'NOTIFY45','/etc/issue','Welcome',now(),true)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, payload := range []string{"add 9011", "add 9012", "add 9013", "add 9014"} {
+		if err = applySearchCacheNotification(db, payload); err != nil {
+			t.Errorf("%s: %v", payload, err)
+		}
+	}
+	// Only current files of existing hosts are added
+	if !isFileInFastSearch(9011) || isFileInFastSearch(9012) || isFileInFastSearch(9013) ||
+		isFileInFastSearch(9014) {
+		t.Errorf("Wrong files in the cache")
+	}
+}
+
+func TestSearchCacheNotificationsWhileLoading(t *testing.T) {
+	const certfp = "NOTIFY55"
+	defer removeHostFromFastSearch(certfp)
+	defer removeHostFromFastSearch("NOTIFY66")
+	addFileToFastSearch(9021, certfp, "/etc/hosts", "127.0.0.1 localhost")
+	addFileToFastSearch(9022, certfp, "/etc/motd", "Hello")
+
+	fsReady = 0
+	for _, payload := range []string{"cert NOTIFY55 NOTIFY66", "remove 9022"} {
+		if err := applySearchCacheNotification(nil, payload); err != nil {
+			t.Errorf("%s: %v", payload, err)
+		}
+	}
+	if c, _ := getCertAndFilenameFromFileID(9021); c != certfp || !isFileInFastSearch(9022) {
+		t.Errorf("The notifications should wait until the cache is ready")
+	}
+
+	markSearchCacheReady(nil)
+	if c, _ := getCertAndFilenameFromFileID(9021); c != "NOTIFY66" {
+		t.Errorf("The certificate wasn't replaced, file 9021 belongs to %s", c)
+	}
+	if isFileInFastSearch(9022) {
+		t.Errorf("File 9022 wasn't removed")
+	}
+	if len(pendingNotifications) > 0 {
+		t.Errorf("There are still %d pending notifications", len(pendingNotifications))
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+// The search cache is saved to a file regularly, and when the server shuts down.
+// At startup, the cache is loaded from the file instead of from the database,
+// which is a lot faster. Then compareSearchCacheToDB brings it up to date.
+// The trigram index isn't saved, since it is larger than the content and can be rebuilt from it.
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// The version must be increased if the format of the snapshot changes,
+// so old snapshots won't be loaded.
+const searchCacheSnapshotVersion = 3
+
+const defaultSearchCacheSnapshotInterval = 30 // minutes
+
+// fsChanges is incremented every time the cache is modified,
+// so the snapshot job can tell if there's anything new to save.
+var fsChanges uint64
+
+// fsSavedChanges is the value of fsChanges at the time of the last snapshot
+var fsSavedChanges uint64
+
+// snapshotChunkSize is how many files are copied each time the lock is taken while saving a snapshot.
+// Writers wait for the copying, and searches wait for the writers, so the lock is held briefly.
+const snapshotChunkSize = 1000
+
+// The snapshot file is a gzipped stream of gob-encoded values: first a header,
+// then one snapshotBlob per blob, and one snapshotFile per file.
+type snapshotHeader struct {
+	Version   int
+	Time      time.Time
+	Blobs     int
+	Files     int
+	ChangeSeq uint64
+}
+
+type snapshotBlob struct {
+	ID         int64
+	CRC        uint32
+	Size       int
+	Content    string
+	Compressed []byte
+	Upper      []byte
+	Original   string
+}
+
+type snapshotFile struct {
+	ID     int64
+	Key    string
+	BlobID int64
+}
+
+// saveSearchCacheSnapshot writes the search cache to a file.
+// The file is written under a temporary name and renamed when it is complete,
+// so a crash while writing won't leave a broken snapshot behind.
+func saveSearchCacheSnapshot(filename string) error {
+	if !isReadyForSearch() {
+		return errors.New("the search cache isn't loaded yet")
+	}
+
+	// Copy the cache a chunk of files at a time, releasing the lock in between,
+	// and encode the copy afterwards. Strings aren't copied, so this is cheaper than it looks.
+	// Files that are added while copying are left out, and files that are removed are skipped.
+	// compareSearchCacheToDB fixes that after the snapshot is loaded, like any other changes since then.
+	// The change counter is read first, so any changes made while copying are saved next time.
+	changeSeq := atomic.LoadUint64(&fsChanges)
+	fsMutex.RLock()
+	fileIDs := make([]int64, 0, len(fsContent))
+	for fileID := range fsContent {
+		fileIDs = append(fileIDs, fileID)
+	}
+	fsMutex.RUnlock()
+	blobs := make([]snapshotBlob, 0)
+	files := make([]snapshotFile, 0, len(fileIDs))
+	copied := make(map[int64]bool)
+	for start := 0; start < len(fileIDs); start += snapshotChunkSize {
+		fsMutex.RLock()
+		for _, fileID := range fileIDs[start:Min(start+snapshotChunkSize, len(fileIDs))] {
+			b, ok := fsContent[fileID]
+			if !ok {
+				continue
+			}
+			files = append(files, snapshotFile{ID: fileID, Key: fsKey[fileID], BlobID: b.id})
+			if copied[b.id] {
+				continue
+			}
+			copied[b.id] = true
+			blobs = append(blobs, snapshotBlob{
+				ID:         b.id,
+				CRC:        b.crc,
+				Size:       b.size,
+				Content:    b.content,
+				Compressed: b.compressed,
+				Upper:      b.upper,
+				Original:   b.original,
+			})
+		}
+		fsMutex.RUnlock()
+	}
+	header := snapshotHeader{
+		Version:   searchCacheSnapshotVersion,
+		Time:      time.Now(),
+		Blobs:     len(blobs),
+		Files:     len(files),
+		ChangeSeq: changeSeq,
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	// The snapshot contains file content from the hosts, so only the owner may read it
+	if err = tmp.Chmod(0600); err != nil {
+		return err
+	}
+	buf := bufio.NewWriter(tmp)
+	zw, err := gzip.NewWriterLevel(buf, gzip.BestSpeed)
+	if err != nil {
+		return err
+	}
+	enc := gob.NewEncoder(zw)
+	if err = enc.Encode(header); err != nil {
+		return err
+	}
+	for i := range blobs {
+		if err = enc.Encode(&blobs[i]); err != nil {
+			return err
+		}
+	}
+	for i := range files {
+		if err = enc.Encode(&files[i]); err != nil {
+			return err
+		}
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	if err = buf.Flush(); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+	atomic.StoreUint64(&fsSavedChanges, header.ChangeSeq)
+	return nil
+}
+
+// loadSearchCacheSnapshot replaces the content of the search cache with a snapshot
+// that was written by saveSearchCacheSnapshot. If the file can't be read,
+// an error is returned and the search cache is left as it was.
+// Returns the time the snapshot was made.
+func loadSearchCacheSnapshot(filename string) (time.Time, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return time.Time{}, err
+	}
+	dec := gob.NewDecoder(zr)
+	var header snapshotHeader
+	if err = dec.Decode(&header); err != nil {
+		return time.Time{}, err
+	}
+	if header.Version != searchCacheSnapshotVersion {
+		return time.Time{}, fmt.Errorf("the snapshot has version %d, expected %d",
+			header.Version, searchCacheSnapshotVersion)
+	}
+
+	// Build new maps, and only replace the cache if the whole file could be read
+	now := time.Now().Unix()
+	blobs := make(map[int64]*fsBlob, header.Blobs)
+	blobsByCRC := make(map[uint32][]*fsBlob, header.Blobs)
+	var maxBlobID int64
+	content := make(map[int64]*fsBlob, header.Files)
+	ids := make(map[string]int64, header.Files)
+	keys := make(map[int64]string, header.Files)
+	list := make([]*fsBlob, 0, header.Blobs)
+	for i := 0; i < header.Blobs; i++ {
+		var sb snapshotBlob
+		if err = dec.Decode(&sb); err != nil {
+			return time.Time{}, err
+		}
+		b := &fsBlob{
+			id:         sb.ID,
+			crc:        sb.CRC,
+			size:       sb.Size,
+			content:    sb.Content,
+			compressed: sb.Compressed,
+			upper:      sb.Upper,
+			original:   sb.Original,
+			files:      make(map[int64]struct{}, 1),
+			lastUsed:   now,
+		}
+		blobs[b.id] = b
+		blobsByCRC[b.crc] = append(blobsByCRC[b.crc], b)
+		list = append(list, b)
+		if b.id > maxBlobID {
+			maxBlobID = b.id
+		}
+	}
+	for i := 0; i < header.Files; i++ {
+		var file snapshotFile
+		if err = dec.Decode(&file); err != nil {
+			return time.Time{}, err
+		}
+		b, ok := blobs[file.BlobID]
+		if !ok {
+			return time.Time{}, fmt.Errorf("file %d refers to an unknown blob ID %d", file.ID, file.BlobID)
+		}
+		b.files[file.ID] = struct{}{}
+		content[file.ID] = b
+		ids[file.Key] = file.ID
+		keys[file.ID] = file.Key
+	}
+
+	// Rebuild the trigram index. Adding the blobs in order keeps the lists sorted without moving anything.
+	sort.Slice(list, func(i, j int) bool { return list[i].id < list[j].id })
+	trigrams := make(map[uint32]*fsPostings)
+	for _, b := range list {
+		addToTrigramIndex(trigrams, b.id, b.text())
+	}
+
+	fsMutex.Lock()
+	fsBlobs = blobs
+	fsBlobsByCRC = blobsByCRC
+	fsNextBlobID = maxBlobID
+	fsContent = content
+	fsID = ids
+	fsKey = keys
+	fsTrigrams = trigrams
+	// The cache is now the same as the snapshot on disk
+	atomic.StoreUint64(&fsSavedChanges, atomic.AddUint64(&fsChanges, 1))
+	fsMutex.Unlock()
+	return header.Time, nil
+}
+
+// Job
+type searchCacheSnapshotJob struct{}
+
+func init() {
+	RegisterLocalJob(searchCacheSnapshotJob{})
+}
+
+func (job searchCacheSnapshotJob) HowOften() time.Duration {
+	minutes := config.SearchCacheSnapshotInterval
+	if minutes <= 0 {
+		minutes = defaultSearchCacheSnapshotInterval
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+func (job searchCacheSnapshotJob) Run(ctx context.Context, db *sql.DB) {
+	writeSearchCacheSnapshot()
+}
+
+// writeSearchCacheSnapshot saves the search cache to the configured file,
+// unless the cache hasn't changed since the last time.
+func writeSearchCacheSnapshot() {
+	if config.SearchCacheSnapshotFile == "" || !isReadyForSearch() ||
+		atomic.LoadUint64(&fsChanges) == atomic.LoadUint64(&fsSavedChanges) {
+		return
+	}
+	start := time.Now()
+	if err := saveSearchCacheSnapshot(config.SearchCacheSnapshotFile); err != nil {
+		log.Printf("Unable to save a snapshot of the search cache: %s", err)
+		return
+	}
+	log.Printf("Saved a snapshot of the search cache in %s", time.Since(start).Round(time.Millisecond))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSearchCacheSnapshot(t *testing.T) {
+	const certfp = "ABAB1212"
+	defer removeHostFromFastSearch(certfp)
+	addFileToFastSearch(6001, certfp, "/etc/hosts", "127.0.0.1 localhost")
+	addFileToFastSearch(6002, certfp, "/etc/motd", "Welcome to HOST 1")
+	addFileToFastSearch(6003, certfp, "/etc/issue", "Ærlig Østlandsk")
+	addFileToFastSearch(6004, certfp, "/etc/issue.net", "Ærlig Østlandsk")
+	atomic.StoreUint32(&fsReady, 1)
+
+	filename := filepath.Join(t.TempDir(), "searchcache")
+	if err := saveSearchCacheSnapshot(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep the current content of the cache, and clear it
+	type fileState struct {
+		key, content string
+		blobID       int64
+	}
+	state := func() map[int64]fileState {
+		m := make(map[int64]fileState, len(fsContent))
+		for fileID, b := range fsContent {
+			m[fileID] = fileState{fsKey[fileID], b.originalContent(b.text()), b.id}
+		}
+		return m
+	}
+	fsMutex.Lock()
+	before, trigrams, numBlobs := state(), liveTrigramIndex(), len(fsBlobs)
+	fsContent, fsKey, fsID = make(map[int64]*fsBlob), make(map[int64]string), make(map[string]int64)
+	fsBlobs, fsTrigrams = make(map[int64]*fsBlob), make(map[uint32]*fsPostings)
+	fsMutex.Unlock()
+
+	// Loading the snapshot must restore the cache exactly
+	if _, err := loadSearchCacheSnapshot(filename); err != nil {
+		t.Fatal(err)
+	}
+	fsMutex.RLock()
+	if !reflect.DeepEqual(state(), before) || !reflect.DeepEqual(liveTrigramIndex(), trigrams) ||
+		len(fsBlobs) != numBlobs {
+		t.Error("The search cache is different after loading the snapshot")
+	}
+	fsMutex.RUnlock()
+	q, _ := newSearchQuery("HOST", searchOptions{caseSensitive: true})
+	if hits, _, _ := searchFiles(q, ""); !reflect.DeepEqual(hits, []int64{6002}) {
+		t.Errorf("Search after loading the snapshot returned %v", hits)
+	}
+
+	// Nothing has changed, so the job doesn't need to save anything
+	if atomic.LoadUint64(&fsChanges) != atomic.LoadUint64(&fsSavedChanges) {
+		t.Error("The cache should be marked as saved after loading a snapshot")
+	}
+
+	// A broken snapshot is rejected, and the cache is left as it was
+	if err := os.WriteFile(filename, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadSearchCacheSnapshot(filename); err == nil {
+		t.Error("Expected an error when loading a broken snapshot")
+	}
+	if numberOfFilesInFastSearch() != len(before) {
+		t.Error("The cache was modified by loading a broken snapshot")
+	}
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrigramIndex(t *testing.T) {
+	const certfp = "AAAA1111"
+	const certfp2 = "BBBB2222"
+	defer removeHostFromFastSearch(certfp)
+	defer removeHostFromFastSearch(certfp2)
+
+	addFileToFastSearch(1001, certfp, "/etc/passwd", "root:x:0:0:root:/root:/bin/bash")
+	addFileToFastSearch(1002, certfp, "/etc/hosts", "127.0.0.1 localhost")
+	addFileToFastSearch(1003, certfp2, "/etc/passwd", "ROOT:x:0:0:Root:/root:/bin/zsh")
+	addFileToFastSearch(1004, certfp2, "/etc/hosts", "::1 LocalHost")
+
+	// Replace a file with a new version. The old content must not be found anymore.
+	addFileToFastSearch(1005, certfp2, "/etc/hosts", "10.0.0.1 gateway")
+
+	tests := []struct {
+		query, filename string
+		expect          []int64
+	}{
+		{query: "root", expect: []int64{1003, 1001}},
+		{query: "/BIN/", expect: []int64{1003, 1001}},
+		{query: "bash", expect: []int64{1001}},
+		{query: "localhost", expect: []int64{1002}},
+		{query: "gateway", filename: "/etc/hosts", expect: []int64{1005}},
+		{query: "gateway", filename: "/etc/passwd", expect: []int64{}},
+		{query: "no such thing", expect: []int64{}},
+		// Short search strings can't use the index
+		{query: "sh", expect: []int64{1003, 1001}},
+	}
+	for _, test := range tests {
+		q, _ := newSearchQuery(test.query, searchOptions{})
+		hits, _, _ := searchFiles(q, test.filename)
+		if !reflect.DeepEqual(hits, test.expect) {
+			t.Errorf("searchFiles(%q,%q) = %v, expected %v",
+				test.query, test.filename, hits, test.expect)
+		}
+		hits, _, _ = searchFilesWithFilter(q, test.filename,
+			map[string]bool{certfp: true, certfp2: true})
+		if !reflect.DeepEqual(hits, test.expect) {
+			t.Errorf("searchFilesWithFilter(%q,%q) = %v, expected %v",
+				test.query, test.filename, hits, test.expect)
+		}
+	}
+
+	q, _ := newSearchQuery("localhost", searchOptions{})
+	hosts, _ := searchForHosts(q, "")
+	if !reflect.DeepEqual(hosts, map[string]bool{certfp: true}) {
+		t.Errorf("searchForHosts returned %v", hosts)
+	}
+
+	// After removing files, the index shouldn't contain them anymore
+	removeFileFromFastSearch(1001)
+	removeHostFromFastSearch(certfp2)
+	for _, b := range fsBlobs {
+		for _, id := range []int64{1001, 1003, 1004, 1005} {
+			if _, ok := b.files[id]; ok {
+				t.Fatalf("File %d still refers to a blob", id)
+			}
+		}
+	}
+	checkTrigramIndex(t)
+	q, _ = newSearchQuery("root", searchOptions{})
+	hits, _, _ := searchFiles(q, "")
+	if len(hits) != 0 {
+		t.Errorf("Found removed files: %v", hits)
+	}
+}
+
+func TestCandidateFilesMatchBruteForce(t *testing.T) {
+	const certfp = "CCCC3333"
+	defer removeHostFromFastSearch(certfp)
+	words := []string{"alpha", "beta", "gamma", "delta", "epsilon", "zeta"}
+	var id int64 = 2000
+	for i := range words {
+		for j := range words {
+			id++
+			addFileToFastSearch(id, certfp, "/file"+words[j],
+				words[i]+" "+words[j]+"\n"+strings.ToUpper(words[(i+j)%len(words)]))
+		}
+	}
+	type query struct {
+		str     string
+		isRegex bool
+	}
+	for _, test := range []query{
+		{"alpha beta", false}, {"a\nz", false}, {"ta\nep", false},
+		{"GAMMA", false}, {"mm", false}, {"a", false},
+		{"^alpha (beta|gamma)$", true}, {"EPS+ilon\\s+ze", true},
+		{"[a-z]+ta\\nDELTA", true}, {"(?-i)GAMMA", true}, {"k", true},
+	} {
+		q, hErr := newSearchQuery(test.str, searchOptions{isRegex: test.isRegex})
+		if hErr != nil {
+			t.Fatal(hErr)
+		}
+		hits, _, _ := searchFiles(q, "")
+		// brute force
+		re := regexp.MustCompile("(?i)" + regexp.QuoteMeta(test.str))
+		if test.isRegex {
+			re = regexp.MustCompile("(?im)" + test.str)
+		}
+		expect := make(hitList, 0)
+		fsMutex.RLock()
+		for fileID, b := range fsContent {
+			if re.MatchString(b.text()) {
+				expect = append(expect, fileID)
+			}
+		}
+		fsMutex.RUnlock()
+		sort.Sort(expect)
+		if !reflect.DeepEqual(hits, []int64(expect)) {
+			t.Errorf("Search for %q returned %v, expected %v", test.str, hits, expect)
+		}
+	}
+}
+
+func TestRequiredLiterals(t *testing.T) {
+	tests := []struct {
+		re     string
+		expect []string
+	}{
+		{re: "PermitRootLogin\\s+yes", expect: []string{"permitrootlogin", "ye"}},
+		{re: "foo(bar)+baz?", expect: []string{"foo", "bar", "ba"}},
+		{re: "(foo|bar)", expect: []string{}},
+		{re: "a.*b", expect: []string{"a", "b"}},
+		{re: "x{2,}", expect: []string{"x"}},
+		{re: "(x)*y", expect: []string{"y"}},
+		// s and k have more than two case variants (ſ and the Kelvin sign)
+		{re: "disk", expect: []string{"di"}},
+		{re: "musk ox", expect: []string{"mu", " ox"}},
+	}
+	for _, test := range tests {
+		parsed, err := syntax.Parse("(?i)"+test.re, syntax.Perl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := requiredLiterals(parsed)
+		if !reflect.DeepEqual(result, test.expect) {
+			t.Errorf("requiredLiterals(%q) = %q, expected %q", test.re, result, test.expect)
+		}
+	}
+}
+
+func TestRegexSearchQuery(t *testing.T) {
+	if _, hErr := newSearchQuery("foo(bar", searchOptions{isRegex: true}); hErr == nil || hErr.code != 400 {
+		t.Errorf("Expected a 400 error for an invalid regular expression, got %v", hErr)
+	}
+	q, hErr := newSearchQuery("b.r", searchOptions{isRegex: true})
+	if hErr != nil {
+		t.Fatal(hErr)
+	}
+	matches := q.findAll("foo bar bor baz", 10)
+	if !reflect.DeepEqual(matches, [][]int{{4, 7}, {8, 11}}) {
+		t.Errorf("findAll returned %v", matches)
+	}
+	// A query that has run out of time is aborted
+	addFileToFastSearch(3001, "DDDD4444", "/etc/foo", "foo bar")
+	defer removeFileFromFastSearch(3001)
+	q.deadline = time.Now().Add(-time.Second)
+	if _, _, hErr = searchFiles(q, ""); hErr != errSearchTimeLimit {
+		t.Errorf("Expected the search to be aborted, got %v", hErr)
+	}
+	// Matching large content stops in the middle when the time is up
+	large := strings.Repeat("foo\n", regexReaderMinSize) + "bar"
+	if q.matches(large) {
+		t.Error("The match wasn't stopped when the query had expired")
+	}
+	q.deadline = time.Now().Add(time.Minute)
+	if !q.matches(large) {
+		t.Error("Large content didn't match")
+	}
+}
+
+func TestOriginalCase(t *testing.T) {
+	const certfp = "EEEE5555"
+	defer removeHostFromFastSearch(certfp)
+	tests := []string{
+		"all lowercase",
+		"Some UPPERCASE letters",
+		"Non-ASCII: Ærlig Østlandsk Ålesund",
+		"Invalid UTF-8: \xff\xfe",
+		"",
+	}
+	for i, content := range tests {
+		fileID := int64(4001 + i)
+		addFileToFastSearch(fileID, certfp, "/file"+strconv.Itoa(i), content)
+		fsMutex.RLock()
+		b := fsContent[fileID]
+		restored := b.originalContent(b.text())
+		fsMutex.RUnlock()
+		if restored != content {
+			t.Errorf("Restored %q, expected %q", restored, content)
+		}
+	}
+	// Only files with uppercase letters need a bitmap
+	fsMutex.RLock()
+	bitmap := fsContent[4001].upper
+	fsMutex.RUnlock()
+	if bitmap != nil {
+		t.Errorf("Lowercase content shouldn't need a bitmap")
+	}
+}
+
+func TestCaseSensitiveAndWholeWord(t *testing.T) {
+	const certfp = "FFFF6666"
+	defer removeHostFromFastSearch(certfp)
+	addFileToFastSearch(5001, certfp, "/etc/ssh/sshd_config", "PermitRootLogin no\nPort 2222")
+	addFileToFastSearch(5002, certfp, "/etc/passwd", "root:x:0:0:root:/root:/bin/bash")
+	addFileToFastSearch(5003, certfp, "/etc/motd", "Welcome, ROOT user! Reports are in /srv/report_2222")
+
+	tests := []struct {
+		query  string
+		opts   searchOptions
+		expect []int64
+	}{
+		{"root", searchOptions{}, []int64{5003, 5002, 5001}},
+		{"root", searchOptions{caseSensitive: true}, []int64{5002}},
+		{"ROOT", searchOptions{caseSensitive: true}, []int64{5003}},
+		{"Root", searchOptions{caseSensitive: true}, []int64{5001}},
+		{"root", searchOptions{wholeWord: true}, []int64{5003, 5002}},
+		{"ROOT", searchOptions{wholeWord: true, caseSensitive: true}, []int64{5003}},
+		{"2222", searchOptions{wholeWord: true}, []int64{5001}},
+		{"report", searchOptions{wholeWord: true}, []int64{}},
+		{"^Port \\d+$", searchOptions{isRegex: true, caseSensitive: true}, []int64{5001}},
+		{"^port \\d+$", searchOptions{isRegex: true, caseSensitive: true}, []int64{}},
+		{"r[eo]+t", searchOptions{isRegex: true, wholeWord: true}, []int64{5003, 5002}},
+	}
+	for _, test := range tests {
+		q, hErr := newSearchQuery(test.query, test.opts)
+		if hErr != nil {
+			t.Fatal(hErr)
+		}
+		hits, _, _ := searchFiles(q, "")
+		if !reflect.DeepEqual(hits, test.expect) {
+			t.Errorf("Search for %q with %+v returned %v, expected %v",
+				test.query, test.opts, hits, test.expect)
+		}
+	}
+
+	// The match positions must refer to the original content
+	q, _ := newSearchQuery("root", searchOptions{wholeWord: true})
+	matches := findMatchesInFile(5002, q, 10)
+	if !reflect.DeepEqual(matches, [][]int{{0, 4}, {11, 15}, {17, 21}}) {
+		t.Errorf("findMatchesInFile returned %v", matches)
+	}
+}
+
+func TestContentDeduplication(t *testing.T) {
+	const certfp, certfp2 = "ACAC1313", "BDBD2424"
+	defer removeHostFromFastSearch(certfp)
+	defer removeHostFromFastSearch(certfp2)
+	const nsswitch = "passwd: files sss\nGroup: files sss"
+	addFileToFastSearch(7001, certfp, "/etc/nsswitch.conf", nsswitch)
+	addFileToFastSearch(7002, certfp2, "/etc/nsswitch.conf", nsswitch)
+	// Same lowercase content, but different case
+	addFileToFastSearch(7003, certfp, "/etc/nsswitch.bak", strings.ToLower(nsswitch))
+
+	fsMutex.RLock()
+	b1, b2, b3 := fsContent[7001], fsContent[7002], fsContent[7003]
+	fsMutex.RUnlock()
+	if b1 != b2 || len(b1.files) != 2 {
+		t.Errorf("Identical files should share a blob")
+	}
+	if b1 == b3 {
+		t.Errorf("Files that only differ in case must not share a blob")
+	}
+
+	q, _ := newSearchQuery("Group", searchOptions{caseSensitive: true})
+	if hits, _, _ := searchFiles(q, ""); !reflect.DeepEqual(hits, []int64{7002, 7001}) {
+		t.Errorf("Search returned %v", hits)
+	}
+	hosts, _ := searchForHosts(q, "/etc/nsswitch.conf")
+	if !reflect.DeepEqual(hosts, map[string]bool{certfp: true, certfp2: true}) {
+		t.Errorf("searchForHosts returned %v", hosts)
+	}
+	hits, _, _ := searchFilesWithFilter(q, "", map[string]bool{certfp2: true})
+	if !reflect.DeepEqual(hits, []int64{7002}) {
+		t.Errorf("searchFilesWithFilter returned %v", hits)
+	}
+
+	// The blob is removed when the last file that refers to it is removed
+	removeFileFromFastSearch(7001)
+	if len(b1.files) != 1 {
+		t.Errorf("Expected 1 reference, got %d", len(b1.files))
+	}
+	addFileToFastSearch(7004, certfp2, "/etc/nsswitch.conf", "passwd: files")
+	fsMutex.RLock()
+	_, ok := fsBlobs[b1.id]
+	fsMutex.RUnlock()
+	if ok {
+		t.Errorf("The blob should have been removed")
+	}
+}
+
+func TestSearchCacheCompression(t *testing.T) {
+	const certfp = "CECE3535"
+	defer removeHostFromFastSearch(certfp)
+	content := strings.Repeat("Lorem ipsum dolor sit amet\n", fsCompressMinSize/20) + "The End"
+	addFileToFastSearch(8001, certfp, "/var/log/big", content)
+
+	// Pretend the file hasn't been searched for a while
+	fsMutex.RLock()
+	b := fsContent[8001]
+	b.lastUsed = time.Now().Add(-2 * fsCompressAfter).Unix()
+	fsMutex.RUnlock()
+	compressSearchCache()
+	if b.compressed == nil || b.content != "" {
+		t.Fatal("The blob wasn't compressed")
+	}
+
+	// Compressed content can still be searched
+	q, _ := newSearchQuery("The End", searchOptions{caseSensitive: true})
+	if hits, _, _ := searchFiles(q, ""); !reflect.DeepEqual(hits, []int64{8001}) {
+		t.Errorf("Search returned %v", hits)
+	}
+	if matches := findMatchesInFile(8001, q, 10); !reflect.DeepEqual(matches,
+		[][]int{{len(content) - 7, len(content)}}) {
+		t.Errorf("findMatchesInFile returned %v", matches)
+	}
+	// Removing the file must remove the compressed blob from the index too
+	removeFileFromFastSearch(8001)
+	checkTrigramIndex(t)
+}
+
+func TestRekeyFileInFastSearch(t *testing.T) {
+	defer removeHostFromFastSearch("REKEY1")
+	defer removeHostFromFastSearch("REKEY2")
+	addFileToFastSearch(7101, "REKEY1", "/etc/hosts", "127.0.0.1 localhost")
+	addFileToFastSearch(7102, "REKEY2", "/etc/hosts", "127.0.0.1 old")
+	if !rekeyFileInFastSearch(7101, "REKEY2:/etc/hosts") {
+		t.Fatal("The file wasn't found")
+	}
+	if c, f := getCertAndFilenameFromFileID(7101); c != "REKEY2" || f != "/etc/hosts" {
+		t.Errorf("The file has the key %s:%s", c, f)
+	}
+	// The file that had the key before is gone
+	if isFileInFastSearch(7102) {
+		t.Error("File 7102 should have been removed")
+	}
+	if rekeyFileInFastSearch(7103, "REKEY2:/etc/motd") {
+		t.Error("Rekeyed a file that isn't in the cache")
+	}
+}
+
+func TestCompareSearchCacheKeys(t *testing.T) {
+	if os.Getenv("NOPOSTGRES") != "" {
+		t.Log("No Postgres, skipping test")
+		return
+	}
+	db := getDBconnForTesting(t)
+	defer db.Close()
+	defer removeHostFromFastSearch("RENEWED1")
+	defer removeHostFromFastSearch("EXPIRED1")
+	fsReady = 1
+
+	// The certificate was renewed after the cache was loaded, e.g. from a snapshot
+	_, err := db.Exec("INSERT INTO hostinfo(certfp,hostname) VALUES('RENEWED1','renewed.example.com')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO files(fileid,certfp,filename,content,received,current) VALUES " +
+		"(7201,'RENEWED1','/etc/hosts','127.0.0.1 localhost',now(),true)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addFileToFastSearch(7201, "EXPIRED1", "/etc/hosts", "127.0.0.1 localhost")
+
+	compareSearchCacheToDB(db)
+	if c, _ := getCertAndFilenameFromFileID(7201); c != "RENEWED1" {
+		t.Errorf("File 7201 belongs to %s in the cache", c)
+	}
+	q, _ := newSearchQuery("localhost", searchOptions{})
+	hosts, _ := searchForHosts(q, "/etc/hosts")
+	if !hosts["RENEWED1"] {
+		t.Errorf("searchForHosts returned %v", hosts)
+	}
+}
+
+// checkTrigramIndex verifies that the IDs in each list of the trigram index are sorted,
+// and that the blobs that have been removed are counted as stale
+func checkTrigramIndex(t *testing.T) {
+	t.Helper()
+	for tri, p := range fsTrigrams {
+		stale := 0
+		for i, blobID := range p.ids {
+			if i > 0 && p.ids[i-1] >= blobID {
+				t.Fatalf("The list for trigram %x isn't sorted: %v", tri, p.ids)
+			}
+			if _, ok := fsBlobs[blobID]; !ok {
+				stale++
+			}
+		}
+		if stale != p.stale || stale >= len(p.ids) {
+			t.Fatalf("The list for trigram %x has %d removed blobs of %d, but stale is %d",
+				tri, stale, len(p.ids), p.stale)
+		}
+	}
+}
+
+// liveTrigramIndex returns the trigram index without the removed blobs
+func liveTrigramIndex() map[uint32][]int64 {
+	m := make(map[uint32][]int64, len(fsTrigrams))
+	for tri, p := range fsTrigrams {
+		for _, blobID := range p.ids {
+			if _, ok := fsBlobs[blobID]; ok {
+				m[tri] = append(m[tri], blobID)
+			}
+		}
+	}
+	return m
+}
+
+func TestTrigramPostings(t *testing.T) {
+	const certfp = "POST1234"
+	defer removeHostFromFastSearch(certfp)
+	for i := 0; i < 8; i++ {
+		addFileToFastSearch(int64(9101+i), certfp, fmt.Sprintf("/etc/zqxj%d", i), fmt.Sprintf("zqxj %d zqxj", i))
+	}
+	tri := trigram("zqx", 0)
+	if n := len(fsTrigrams[tri].ids); n != 8 {
+		t.Fatalf("Expected 8 blobs for the trigram, got %d", n)
+	}
+	// The list is compacted when a quarter of it is stale
+	removeFileFromFastSearch(9101)
+	checkTrigramIndex(t)
+	if p := fsTrigrams[tri]; len(p.ids) != 8 || p.stale != 1 {
+		t.Errorf("Expected 1 stale ID of 8, got %d of %d", p.stale, len(p.ids))
+	}
+	removeFileFromFastSearch(9102)
+	checkTrigramIndex(t)
+	if p := fsTrigrams[tri]; len(p.ids) != 6 || p.stale != 0 {
+		t.Errorf("Expected 6 IDs after compacting, got %d with %d stale", len(p.ids), p.stale)
+	}
+	q, _ := newSearchQuery("zqxj 2 zqxj", searchOptions{})
+	if hits, _, _ := searchFiles(q, ""); !reflect.DeepEqual(hits, []int64{9103}) {
+		t.Errorf("Search returned %v", hits)
+	}
+	// The list is removed with the last blob
+	removeHostFromFastSearch(certfp)
+	checkTrigramIndex(t)
+	if _, ok := fsTrigrams[tri]; ok {
+		t.Error("The trigram is still in the index")
+	}
+
+	if got := intersectSorted([]int64{1, 3, 5, 7}, []int64{2, 3, 4, 7, 9}); !reflect.DeepEqual(got, []int64{3, 7}) {
+		t.Errorf("intersectSorted returned %v", got)
+	}
+}
@@ -0,0 +1,759 @@
+package main
+
+// This file implements the expression language for computed custom fields.
+// Examples of expressions:
+//
+//	os in ("RHEL 7", "CentOS 7")
+//	split(kernel, ".")[0]
+//	memoryMB / 1024 >= 64 and not (osFamily = "windows")
+//	if(startsWith(hostname, "test"), "test", coalesce(environment, "prod"))
+//
+// - Field names refer to the standard host fields and the custom fields that aren't computed.
+//   A field without a value is null.
+// - Literals are numbers, strings in single or double quotes, true, false and null.
+// - The operators are = (or ==), !=, <, <=, >, >=, in, not in, and, or, not, + - * /
+//   and [n] to pick an element from a list (negative numbers count from the end).
+// - Values that look like numbers are compared as numbers. + adds numbers and joins other strings.
+// - There are no loops or assignments, and a string value can't be longer than
+//   maxFieldExpressionValueLength, so the time an expression takes is limited.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const maxFieldExpressionLength = 2000
+
+// maxFieldExpressionValueLength is the longest string an expression can produce along the way.
+// Without it, nested calls like replace(replace(x, "", x), "", x) would grow the value geometrically.
+const maxFieldExpressionValueLength = 64 * 1024
+
+var errExprValueTooLong = fmt.Errorf("the value would be longer than %d bytes", maxFieldExpressionValueLength)
+
+// exprCheckLength returns errExprValueTooLong if the string would be too long
+func exprCheckLength(length int) error {
+	if length > maxFieldExpressionValueLength {
+		return errExprValueTooLong
+	}
+	return nil
+}
+
+// exprNode is a node in the syntax tree of a parsed expression
+type exprNode interface {
+	eval(env map[string]interface{}) (interface{}, error)
+}
+
+type exprLiteral struct{ value interface{} }
+
+// exprField is a reference to a field. The name is lowercase, like the keys in the environment.
+type exprField struct{ name string }
+
+type exprUnary struct {
+	op string
+	x  exprNode
+}
+
+type exprBinary struct {
+	op   string
+	x, y exprNode
+}
+
+type exprIn struct {
+	x       exprNode
+	list    []exprNode
+	negated bool
+}
+
+type exprIndex struct{ x, index exprNode }
+
+type exprCall struct {
+	fn   *exprFunction
+	args []exprNode
+	// re is the compiled regexp for matches(), if the pattern is a literal
+	re *regexp.Regexp
+}
+
+type exprFunction struct {
+	name             string
+	minArgs, maxArgs int // maxArgs -1 means no limit
+	// nullable means that the function is called even if the first argument is null.
+	// Otherwise the result is null.
+	nullable bool
+	call     func(args []interface{}) (interface{}, error)
+}
+
+var exprFunctions = map[string]*exprFunction{}
+
+func init() {
+	for _, f := range []*exprFunction{
+		{name: "lower", minArgs: 1, maxArgs: 1, call: func(a []interface{}) (interface{}, error) {
+			return strings.ToLower(exprString(a[0])), nil
+		}},
+		{name: "upper", minArgs: 1, maxArgs: 1, call: func(a []interface{}) (interface{}, error) {
+			return strings.ToUpper(exprString(a[0])), nil
+		}},
+		{name: "trim", minArgs: 1, maxArgs: 1, call: func(a []interface{}) (interface{}, error) {
+			return strings.TrimSpace(exprString(a[0])), nil
+		}},
+		{name: "split", minArgs: 2, maxArgs: 2, call: func(a []interface{}) (interface{}, error) {
+			parts := strings.Split(exprString(a[0]), exprString(a[1]))
+			list := make([]interface{}, len(parts))
+			for i, s := range parts {
+				list[i] = s
+			}
+			return list, nil
+		}},
+		{name: "join", minArgs: 2, maxArgs: 2, call: func(a []interface{}) (interface{}, error) {
+			list, ok := a[0].([]interface{})
+			if !ok {
+				return exprString(a[0]), nil
+			}
+			parts := make([]string, len(list))
+			sep := exprString(a[1])
+			length := len(sep) * (len(list) - 1)
+			for i, v := range list {
+				parts[i] = exprString(v)
+				length += len(parts[i])
+			}
+			if err := exprCheckLength(length); err != nil {
+				return nil, err
+			}
+			return strings.Join(parts, sep), nil
+		}},
+		{name: "contains", minArgs: 2, maxArgs: 2, call: func(a []interface{}) (interface{}, error) {
+			if list, ok := a[0].([]interface{}); ok {
+				for _, v := range list {
+					if exprEqual(v, a[1]) {
+						return true, nil
+					}
+				}
+				return false, nil
+			}
+			return strings.Contains(exprString(a[0]), exprString(a[1])), nil
+		}},
+		{name: "startsWith", minArgs: 2, maxArgs: 2, call: func(a []interface{}) (interface{}, error) {
+			return strings.HasPrefix(exprString(a[0]), exprString(a[1])), nil
+		}},
+		{name: "endsWith", minArgs: 2, maxArgs: 2, call: func(a []interface{}) (interface{}, error) {
+			return strings.HasSuffix(exprString(a[0]), exprString(a[1])), nil
+		}},
+		{name: "matches", minArgs: 2, maxArgs: 2, call: func(a []interface{}) (interface{}, error) {
+			re, err := regexp.Compile(exprString(a[1]))
+			if err != nil {
+				return nil, err
+			}
+			return re.MatchString(exprString(a[0])), nil
+		}},
+		{name: "replace", minArgs: 3, maxArgs: 3, call: func(a []interface{}) (interface{}, error) {
+			s, old, new := exprString(a[0]), exprString(a[1]), exprString(a[2])
+			// An empty string matches at the start and after each character
+			if err := exprCheckLength(len(s) + strings.Count(s, old)*(len(new)-len(old))); err != nil {
+				return nil, err
+			}
+			return strings.Replace(s, old, new, -1), nil
+		}},
+		{name: "len", minArgs: 1, maxArgs: 1, nullable: true, call: func(a []interface{}) (interface{}, error) {
+			switch t := a[0].(type) {
+			case nil:
+				return float64(0), nil
+			case []interface{}:
+				return float64(len(t)), nil
+			}
+			return float64(utf8.RuneCountInString(exprString(a[0]))), nil
+		}},
+		{name: "coalesce", minArgs: 1, maxArgs: -1, nullable: true, call: func(a []interface{}) (interface{}, error) {
+			for _, v := range a {
+				if v != nil && v != "" {
+					return v, nil
+				}
+			}
+			return nil, nil
+		}},
+		{name: "if", minArgs: 2, maxArgs: 3, nullable: true, call: func(a []interface{}) (interface{}, error) {
+			if exprTruthy(a[0]) {
+				return a[1], nil
+			}
+			if len(a) == 3 {
+				return a[2], nil
+			}
+			return nil, nil
+		}},
+		{name: "number", minArgs: 1, maxArgs: 1, call: func(a []interface{}) (interface{}, error) {
+			if n, ok := exprNumber(a[0]); ok {
+				return n, nil
+			}
+			return nil, nil
+		}},
+		{name: "int", minArgs: 1, maxArgs: 1, call: func(a []interface{}) (interface{}, error) {
+			if n, ok := exprNumber(a[0]); ok {
+				return math.Trunc(n), nil
+			}
+			return nil, nil
+		}},
+	} {
+		exprFunctions[strings.ToLower(f.name)] = f
+	}
+}
+
+type exprToken struct {
+	kind byte // 'n' number, 's' string, 'i' identifier, 'o' operator, 0 end of input
+	text string
+	num  float64
+	pos  int
+}
+
+var exprOperators = []string{"==", "!=", "<=", ">=", "=", "<", ">", "+", "-", "*", "/", "(", ")", "[", "]", ","}
+
+func tokenizeFieldExpression(src string) ([]exprToken, error) {
+	tokens := make([]exprToken, 0)
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '"' || c == '\'':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(src) && src[j] != c; j++ {
+				if src[j] == '\\' && j+1 < len(src) {
+					j++
+				}
+				sb.WriteByte(src[j])
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string at position %d", i+1)
+			}
+			tokens = append(tokens, exprToken{kind: 's', text: sb.String(), pos: i})
+			i = j + 1
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+			j := i
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.') {
+				j++
+			}
+			n, err := strconv.ParseFloat(src[i:j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %s at position %d", src[i:j], i+1)
+			}
+			tokens = append(tokens, exprToken{kind: 'n', text: src[i:j], num: n, pos: i})
+			i = j
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i
+			for j < len(src) && (src[j] == '_' || src[j] >= 'a' && src[j] <= 'z' ||
+				src[j] >= 'A' && src[j] <= 'Z' || src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			tokens = append(tokens, exprToken{kind: 'i', text: src[i:j], pos: i})
+			i = j
+		default:
+			found := false
+			for _, op := range exprOperators {
+				if strings.HasPrefix(src[i:], op) {
+					tokens = append(tokens, exprToken{kind: 'o', text: op, pos: i})
+					i += len(op)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i+1)
+			}
+		}
+	}
+	return append(tokens, exprToken{pos: len(src)}), nil
+}
+
+type exprParser struct {
+	tokens []exprToken
+	i      int
+	fields map[string]bool
+}
+
+// parseFieldExpression parses an expression and returns the syntax tree
+// and the (lowercase) names of the fields it refers to.
+func parseFieldExpression(src string) (exprNode, []string, error) {
+	if len(src) > maxFieldExpressionLength {
+		return nil, nil, fmt.Errorf("the expression is longer than %d characters", maxFieldExpressionLength)
+	}
+	tokens, err := tokenizeFieldExpression(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	p := &exprParser{tokens: tokens, fields: make(map[string]bool)}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, nil, err
+	}
+	if t := p.peek(); t.kind != 0 {
+		return nil, nil, p.unexpected(t)
+	}
+	fields := make([]string, 0, len(p.fields))
+	for name := range p.fields {
+		fields = append(fields, name)
+	}
+	return node, fields, nil
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.i]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.tokens[p.i]
+	if t.kind != 0 {
+		p.i++
+	}
+	return t
+}
+
+// isKeyword returns true if the next token is the given keyword (case-insensitive)
+func (p *exprParser) isKeyword(word string) bool {
+	t := p.peek()
+	return t.kind == 'i' && strings.EqualFold(t.text, word)
+}
+
+func (p *exprParser) isOperator(ops ...string) bool {
+	t := p.peek()
+	return t.kind == 'o' && contains(t.text, ops)
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.isOperator(op) {
+		return fmt.Errorf("expected %s at position %d", op, p.peek().pos+1)
+	}
+	p.next()
+	return nil
+}
+
+func (p *exprParser) unexpected(t exprToken) error {
+	if t.kind == 0 {
+		return errors.New("unexpected end of expression")
+	}
+	return fmt.Errorf("unexpected %s at position %d", t.text, t.pos+1)
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	x, err := p.parseAnd()
+	for err == nil && p.isKeyword("or") {
+		p.next()
+		var y exprNode
+		if y, err = p.parseAnd(); err == nil {
+			x = &exprBinary{op: "or", x: x, y: y}
+		}
+	}
+	return x, err
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	x, err := p.parseNot()
+	for err == nil && p.isKeyword("and") {
+		p.next()
+		var y exprNode
+		if y, err = p.parseNot(); err == nil {
+			x = &exprBinary{op: "and", x: x, y: y}
+		}
+	}
+	return x, err
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	if p.isKeyword("not") {
+		p.next()
+		x, err := p.parseNot()
+		return &exprUnary{op: "not", x: x}, err
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	x, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if p.isOperator("=", "==", "!=", "<", "<=", ">", ">=") {
+		op := p.next().text
+		if op == "==" {
+			op = "="
+		}
+		y, err := p.parseSum()
+		return &exprBinary{op: op, x: x, y: y}, err
+	}
+	negated := false
+	if p.isKeyword("not") && p.tokens[p.i+1].kind == 'i' && strings.EqualFold(p.tokens[p.i+1].text, "in") {
+		p.next()
+		negated = true
+	}
+	if !p.isKeyword("in") {
+		return x, nil
+	}
+	p.next()
+	if err = p.expect("("); err != nil {
+		return nil, err
+	}
+	in := &exprIn{x: x, negated: negated}
+	for {
+		elem, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		in.list = append(in.list, elem)
+		if !p.isOperator(",") {
+			break
+		}
+		p.next()
+	}
+	return in, p.expect(")")
+}
+
+func (p *exprParser) parseSum() (exprNode, error) {
+	x, err := p.parseProduct()
+	for err == nil && p.isOperator("+", "-") {
+		op := p.next().text
+		var y exprNode
+		if y, err = p.parseProduct(); err == nil {
+			x = &exprBinary{op: op, x: x, y: y}
+		}
+	}
+	return x, err
+}
+
+func (p *exprParser) parseProduct() (exprNode, error) {
+	x, err := p.parseUnary()
+	for err == nil && p.isOperator("*", "/") {
+		op := p.next().text
+		var y exprNode
+		if y, err = p.parseUnary(); err == nil {
+			x = &exprBinary{op: op, x: x, y: y}
+		}
+	}
+	return x, err
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.isOperator("-") {
+		p.next()
+		x, err := p.parseUnary()
+		return &exprUnary{op: "-", x: x}, err
+	}
+	x, err := p.parsePrimary()
+	for err == nil && p.isOperator("[") {
+		p.next()
+		var index exprNode
+		if index, err = p.parseOr(); err == nil {
+			x = &exprIndex{x: x, index: index}
+			err = p.expect("]")
+		}
+	}
+	return x, err
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case 'n':
+		return &exprLiteral{value: t.num}, nil
+	case 's':
+		return &exprLiteral{value: t.text}, nil
+	case 'o':
+		if t.text != "(" {
+			return nil, p.unexpected(t)
+		}
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(")")
+	case 'i':
+		switch strings.ToLower(t.text) {
+		case "true":
+			return &exprLiteral{value: true}, nil
+		case "false":
+			return &exprLiteral{value: false}, nil
+		case "null":
+			return &exprLiteral{value: nil}, nil
+		case "and", "or", "not", "in":
+			return nil, p.unexpected(t)
+		}
+		if !p.isOperator("(") {
+			name := strings.ToLower(t.text)
+			p.fields[name] = true
+			return &exprField{name: name}, nil
+		}
+		// A function call
+		fn, ok := exprFunctions[strings.ToLower(t.text)]
+		if !ok {
+			return nil, fmt.Errorf("unknown function %s at position %d", t.text, t.pos+1)
+		}
+		p.next()
+		call := &exprCall{fn: fn, args: make([]exprNode, 0)}
+		for !p.isOperator(")") {
+			if len(call.args) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+		}
+		p.next()
+		if len(call.args) < fn.minArgs || (fn.maxArgs >= 0 && len(call.args) > fn.maxArgs) {
+			return nil, fmt.Errorf("wrong number of arguments for %s at position %d", fn.name, t.pos+1)
+		}
+		// Compile the regexp once, instead of every time the expression is evaluated
+		if lit, ok := call.args[len(call.args)-1].(*exprLiteral); ok && fn.name == "matches" && lit.value != nil {
+			re, err := regexp.Compile(exprString(lit.value))
+			if err != nil {
+				return nil, fmt.Errorf("invalid regular expression for %s at position %d: %v", fn.name, t.pos+1, err)
+			}
+			call.re = re
+		}
+		return call, nil
+	}
+	return nil, p.unexpected(t)
+}
+
+func (n *exprLiteral) eval(env map[string]interface{}) (interface{}, error) {
+	return n.value, nil
+}
+
+func (n *exprField) eval(env map[string]interface{}) (interface{}, error) {
+	return env[n.name], nil
+}
+
+func (n *exprUnary) eval(env map[string]interface{}) (interface{}, error) {
+	x, err := n.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "not" {
+		return !exprTruthy(x), nil
+	}
+	if x == nil {
+		return nil, nil
+	}
+	num, ok := exprNumber(x)
+	if !ok {
+		return nil, fmt.Errorf("can't negate %s", exprString(x))
+	}
+	return -num, nil
+}
+
+func (n *exprBinary) eval(env map[string]interface{}) (interface{}, error) {
+	x, err := n.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	// and/or only evaluate the right side when needed
+	switch n.op {
+	case "and":
+		if !exprTruthy(x) {
+			return false, nil
+		}
+	case "or":
+		if exprTruthy(x) {
+			return true, nil
+		}
+	}
+	y, err := n.y.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "and", "or":
+		return exprTruthy(y), nil
+	case "=":
+		return exprEqual(x, y), nil
+	case "!=":
+		return !exprEqual(x, y), nil
+	case "<", "<=", ">", ">=":
+		c, ok := exprCompare(x, y)
+		if !ok {
+			return false, nil
+		}
+		switch n.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		}
+		return c >= 0, nil
+	}
+	// Arithmetic
+	if x == nil || y == nil {
+		return nil, nil
+	}
+	a, okA := exprNumber(x)
+	b, okB := exprNumber(y)
+	if !okA || !okB {
+		if n.op == "+" {
+			s, t := exprString(x), exprString(y)
+			if err := exprCheckLength(len(s) + len(t)); err != nil {
+				return nil, err
+			}
+			return s + t, nil
+		}
+		return nil, fmt.Errorf("can't use %s on %s and %s", n.op, exprString(x), exprString(y))
+	}
+	switch n.op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	}
+	if b == 0 {
+		return nil, nil
+	}
+	return a / b, nil
+}
+
+func (n *exprIn) eval(env map[string]interface{}) (interface{}, error) {
+	x, err := n.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	for _, elem := range n.list {
+		v, err := elem.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		if exprEqual(x, v) {
+			return !n.negated, nil
+		}
+	}
+	return n.negated, nil
+}
+
+func (n *exprIndex) eval(env map[string]interface{}) (interface{}, error) {
+	x, err := n.x.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	index, err := n.index.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := x.([]interface{})
+	i, isNum := exprNumber(index)
+	if !ok || !isNum {
+		return nil, nil
+	}
+	if i < 0 {
+		i += float64(len(list))
+	}
+	// Compare before converting, since huge values don't fit in an int
+	if i < 0 || i >= float64(len(list)) || i != math.Trunc(i) {
+		return nil, nil
+	}
+	return list[int(i)], nil
+}
+
+func (n *exprCall) eval(env map[string]interface{}) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for i, a := range n.args {
+		v, err := a.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	if args[0] == nil && !n.fn.nullable {
+		return nil, nil
+	}
+	if n.re != nil {
+		return n.re.MatchString(exprString(args[0])), nil
+	}
+	return n.fn.call(args)
+}
+
+// exprNumber converts a value to a number, if it is one or is a string that looks like one
+func exprNumber(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case float64:
+		return t, true
+	case string:
+		n, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+		return n, err == nil && !math.IsNaN(n) && !math.IsInf(n, 0)
+	}
+	return 0, false
+}
+
+// exprString converts a value to a string. Lists are converted to JSON.
+func exprString(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(t)
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func exprTruthy(v interface{}) bool {
+	switch t := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return t
+	case string:
+		return t != ""
+	case float64:
+		return t != 0
+	case []interface{}:
+		return len(t) > 0
+	}
+	return true
+}
+
+func exprEqual(x, y interface{}) bool {
+	if x == nil || y == nil {
+		return x == nil && y == nil
+	}
+	if a, ok := exprNumber(x); ok {
+		if b, ok := exprNumber(y); ok {
+			return a == b
+		}
+	}
+	_, xIsList := x.([]interface{})
+	_, yIsList := y.([]interface{})
+	if xIsList || yIsList {
+		return reflect.DeepEqual(x, y)
+	}
+	return exprString(x) == exprString(y)
+}
+
+// exprCompare returns -1, 0 or 1, and false if the values can't be ordered
+func exprCompare(x, y interface{}) (int, bool) {
+	if x == nil || y == nil {
+		return 0, false
+	}
+	if a, ok := exprNumber(x); ok {
+		if b, ok := exprNumber(y); ok {
+			switch {
+			case a < b:
+				return -1, true
+			case a > b:
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+	return strings.Compare(exprString(x), exprString(y)), true
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestFieldExpressions(t *testing.T) {
+	env := map[string]interface{}{
+		"os":       "RHEL 7",
+		"kernel":   "3.10.0-1160.el7.x86_64",
+		"memorymb": "65536",
+		"cores":    float64(16),
+		"dns":      []interface{}{"10.0.0.1", "10.0.0.2"},
+		"hostname": "test01.example.com",
+		"virtual":  false,
+	}
+	tests := []struct {
+		expression string
+		expect     interface{}
+	}{
+		{`os in ("RHEL 7", "CentOS 7")`, true},
+		{`os not in ("RHEL 7", "CentOS 7")`, false},
+		{`NOT os IN ('RHEL 8')`, true},
+		{`split(kernel, ".")[0]`, "3"},
+		{`split(kernel, ".")[-1]`, "x86_64"},
+		{`split(kernel, ".")[10]`, nil},
+		{`split(kernel, ".")[100000000000000000000]`, nil},
+		{`split(kernel, ".")[-100000000000000000000]`, nil},
+		{`split(kernel, ".")[0.5]`, nil},
+		{`memoryMB / 1024`, float64(64)},
+		{`memoryMB / 1024 >= 64 and cores > 8`, true},
+		{`memoryMB > 100000 or cores = 16`, true},
+		{`cores == "16"`, true},
+		{`-cores + 2 * 3`, float64(-10)},
+		{`(1 + 2) * 3`, float64(9)},
+		{`"kernel " + kernel`, "kernel 3.10.0-1160.el7.x86_64"},
+		{`missing`, nil},
+		{`missing = null`, true},
+		{`missing > 1`, false},
+		{`lower(missing)`, nil},
+		{`coalesce(missing, "none")`, "none"},
+		{`if(startsWith(hostname, "test"), "test", "prod")`, "test"},
+		{`if(virtual, "vm")`, nil},
+		{`contains(dns, "10.0.0.2")`, true},
+		{`len(dns)`, float64(2)},
+		{`join(dns, " ")`, "10.0.0.1 10.0.0.2"},
+		{`dns`, []interface{}{"10.0.0.1", "10.0.0.2"}},
+		{`matches(kernel, "el[0-9]+")`, true},
+		{`upper(replace(os, " ", "_"))`, "RHEL_7"},
+		{`int(memoryMB / 1000)`, float64(65)},
+		{`number("x")`, nil},
+		{`1 / 0`, nil},
+		{`"abc" < "abd"`, true},
+		{`"10" < "9"`, false},
+	}
+	for _, test := range tests {
+		node, _, err := parseFieldExpression(test.expression)
+		if err != nil {
+			t.Errorf("%s: %v", test.expression, err)
+			continue
+		}
+		got, err := node.eval(env)
+		if err != nil {
+			t.Errorf("%s: %v", test.expression, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("%s: got %#v, expected %#v", test.expression, got, test.expect)
+		}
+	}
+}
+
+func TestFieldExpressionErrors(t *testing.T) {
+	for _, expression := range []string{
+		``,
+		`os in "RHEL 7"`,
+		`os = `,
+		`(os`,
+		`"unterminated`,
+		`os # 2`,
+		`nosuchfunction(os)`,
+		`lower(os, kernel)`,
+		`split(kernel)`,
+		`os and`,
+		`1 2`,
+		`matches(os, "(")`,
+	} {
+		if _, _, err := parseFieldExpression(expression); err == nil {
+			t.Errorf("Expected an error for: %s", expression)
+		}
+	}
+	// Runtime errors
+	node, _, err := parseFieldExpression(`os - 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = node.eval(map[string]interface{}{"os": "RHEL"}); err == nil {
+		t.Error("Expected an error when subtracting from a string")
+	}
+	// Values that grow too large
+	for _, expression := range []string{
+		`replace(replace(replace(replace(os, "", os), "", os), "", os), "", os)`,
+		`join(split(replace(replace(replace(os, "", os), "", os), "", os), ""), os)`,
+	} {
+		node, _, err = parseFieldExpression(expression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = node.eval(map[string]interface{}{"os": "RHEL 7 Server"}); err != errExprValueTooLong {
+			t.Errorf("%s: expected errExprValueTooLong, got %v", expression, err)
+		}
+	}
+	node, _, err = parseFieldExpression(`a + a`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = node.eval(map[string]interface{}{"a": strings.Repeat("x", maxFieldExpressionValueLength)}); err != errExprValueTooLong {
+		t.Errorf("Expected errExprValueTooLong when concatenating, got %v", err)
+	}
+}
+
+func TestFieldExpressionNames(t *testing.T) {
+	_, names, err := parseFieldExpression(`if(osFamily = "linux", split(Kernel, ".")[0], osEdition) + kernel`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	expect := []string{"kernel", "osedition", "osfamily"}
+	if !reflect.DeepEqual(names, expect) {
+		t.Errorf("Got %v, expected %v", names, expect)
+	}
+}
+
+func TestComputeCustomField(t *testing.T) {
+	env := map[string]interface{}{
+		"kernel": "5.14.0-70.el9.x86_64",
+		"dns":    []interface{}{"10.0.0.1", "10.0.0.2"},
+	}
+	tests := []struct {
+		field  customField
+		expect string
+		err    bool
+	}{
+		{field: customField{expression: `split(kernel, ".")[0]`, valueType: "int"}, expect: "5"},
+		{field: customField{expression: `split(kernel, "-")[0]`, valueType: "version"}, expect: "5.14.0"},
+		{field: customField{expression: `kernel = "x"`}, expect: "false"},
+		{field: customField{expression: `kernel = "x"`, valueType: "bool"}, expect: "false"},
+		{field: customField{expression: `dns`, multiple: true}, expect: `["10.0.0.1","10.0.0.2"]`},
+		{field: customField{expression: `dns[0]`, multiple: true}, expect: `["10.0.0.1"]`},
+		// A list for a field with one value
+		{field: customField{expression: `dns`}, err: true},
+		// Not an integer
+		{field: customField{expression: `kernel`, valueType: "int"}, err: true},
+		// No value
+		{field: customField{expression: `missing`}, err: true},
+	}
+	for _, test := range tests {
+		got, err := test.field.compute(env)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", test.field.expression, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.field.expression, err)
+			continue
+		}
+		if got != test.expect {
+			t.Errorf("%s: got %s, expected %s", test.field.expression, got, test.expect)
+		}
+	}
+}
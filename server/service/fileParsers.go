@@ -0,0 +1,266 @@
+package main
+
+// Files from the clients are parsed to fill in columns in the hostinfo table,
+// like the operating system, the kernel version, or the serial number.
+// Each parser is registered with a pattern that decides which files it parses,
+// and the list of hostinfo columns it is allowed to set.
+// Table parsers are registered the same way, but fill in other tables,
+// like the list of installed packages (see packages.go and devices.go).
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// A FileParser looks at the content of a file and returns values for hostinfo columns.
+// A nil value sets the column to null, and columns that aren't in the map are left alone.
+// An error means that the content couldn't be parsed. The same content will give
+// the same error, so the file isn't retried.
+type FileParser interface {
+	Parse(filename string, content string) (map[string]interface{}, error)
+}
+
+// FileParserFunc lets an ordinary function be used as a FileParser
+type FileParserFunc func(filename string, content string) (map[string]interface{}, error)
+
+func (f FileParserFunc) Parse(filename string, content string) (map[string]interface{}, error) {
+	return f(filename, content)
+}
+
+// A TableParser looks at the content of a file and returns a function that writes
+// the result to the tables it is registered for. An error means that the content couldn't be parsed.
+type TableParser func(content string) (func(tx *sql.Tx, certfp string) error, error)
+
+type fileParserEntry struct {
+	name     string
+	pattern  *regexp.Regexp
+	priority int
+	columns  []string
+	parser   FileParser
+	// Table parsers have these instead of columns and parser
+	tables      []string
+	tableParser TableParser
+	// Counters since the server started
+	handled uint64
+	failed  uint64
+}
+
+// fileParsers is sorted by descending priority
+var fileParsers []*fileParserEntry
+
+var reColumnName = regexp.MustCompile(`^[a-z_]+$`)
+
+// RegisterFileParser adds a parser for files whose name matches the pattern (a regular expression).
+// If more than one parser sets the same column for a file, the one with the highest priority wins.
+// Columns lists the hostinfo columns that the parser may set.
+func RegisterFileParser(name string, filenamePattern string, priority int, columns []string,
+	parser FileParser) {
+	for _, col := range columns {
+		if !reColumnName.MatchString(col) {
+			panic(fmt.Sprintf("file parser %s: invalid column name %q", name, col))
+		}
+	}
+	fileParsers = append(fileParsers, &fileParserEntry{
+		name:     name,
+		pattern:  regexp.MustCompile(filenamePattern),
+		priority: priority,
+		columns:  columns,
+		parser:   parser,
+	})
+	sort.SliceStable(fileParsers, func(i, j int) bool {
+		return fileParsers[i].priority > fileParsers[j].priority
+	})
+}
+
+// RegisterTableParser adds a parser for files whose name matches the pattern (a regular expression),
+// that writes to other tables than hostinfo. Tables lists them, for information.
+func RegisterTableParser(name string, filenamePattern string, tables []string, parser TableParser) {
+	fileParsers = append(fileParsers, &fileParserEntry{
+		name:        name,
+		pattern:     regexp.MustCompile(filenamePattern),
+		tables:      tables,
+		tableParser: parser,
+	})
+}
+
+// exactFilename returns a pattern that only matches the given filename
+func exactFilename(filename string) string {
+	return "^" + regexp.QuoteMeta(filename) + "$"
+}
+
+// exactFilenameFold is like exactFilename, but ignores case.
+// The Windows client isn't consistent about the case of the commands.
+func exactFilenameFold(filename string) string {
+	return "(?i)" + exactFilename(filename)
+}
+
+// runFileParsers runs the parsers that match the filename,
+// and updates the hostinfo row with the result.
+// A column isn't changed if it was set by a parser with a higher priority,
+// even if that was for another file. This way, the best source of
+// information wins no matter which order the files arrive in.
+// Parsing errors are logged, database errors are returned.
+func runFileParsers(tx *sql.Tx, certfp string, filename string, content string) error {
+	values, sources := parseFileContent(certfp, filename, content)
+	if len(values) == 0 {
+		return nil
+	}
+
+	// Find out which parsers set the columns the last time
+	rows, err := tx.Query("SELECT colname, parser FROM hostinfo_parsedby WHERE certfp=$1", certfp)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	previous := make(map[string]string)
+	for rows.Next() {
+		var colname, parser string
+		if err = rows.Scan(&colname, &parser); err != nil {
+			return err
+		}
+		previous[colname] = parser
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	for col, p := range sources {
+		if prev, ok := previous[col]; ok && prev != p.name && fileParserPriority(prev) > p.priority {
+			delete(values, col)
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+
+	columns := make([]string, 0, len(values))
+	for col := range values {
+		columns = append(columns, col)
+	}
+	sort.Strings(columns)
+	set := make([]string, len(columns))
+	params := make([]interface{}, len(columns), len(columns)+1)
+	for i, col := range columns {
+		set[i] = fmt.Sprintf("%s=$%d", col, i+1)
+		params[i] = values[col]
+	}
+	params = append(params, certfp)
+	_, err = tx.Exec("UPDATE hostinfo SET "+strings.Join(set, ",")+
+		fmt.Sprintf(" WHERE certfp=$%d", len(params)), params...)
+	if err != nil {
+		return err
+	}
+
+	// Remember which parser set each column
+	for _, col := range columns {
+		name := sources[col].name
+		if prev, ok := previous[col]; ok && prev == name {
+			continue
+		}
+		if _, ok := previous[col]; ok {
+			_, err = tx.Exec("UPDATE hostinfo_parsedby SET parser=$1 WHERE certfp=$2 AND colname=$3",
+				name, certfp, col)
+		} else {
+			_, err = tx.Exec("INSERT INTO hostinfo_parsedby(certfp,colname,parser) VALUES($1,$2,$3)",
+				certfp, col, name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseFileContent runs the parsers that match the filename,
+// and returns the combined result and which parser each value came from
+func parseFileContent(certfp string, filename string, content string) (
+	map[string]interface{}, map[string]*fileParserEntry) {
+	values := make(map[string]interface{})
+	sources := make(map[string]*fileParserEntry)
+	for _, p := range fileParsers {
+		if p.parser == nil || !p.pattern.MatchString(filename) {
+			continue
+		}
+		atomic.AddUint64(&p.handled, 1)
+		result, err := p.parser.Parse(filename, content)
+		if err == nil {
+			err = p.checkColumns(result)
+		}
+		if err != nil {
+			atomic.AddUint64(&p.failed, 1)
+			log.Printf("Parser %s failed on %s from %s: %s", p.name, filename, certfp, err)
+			continue
+		}
+		for col, value := range result {
+			// The parsers are sorted by priority, so the first value wins
+			if _, ok := values[col]; !ok {
+				values[col] = value
+				sources[col] = p
+			}
+		}
+	}
+	return values, sources
+}
+
+// runTableParsers runs the table parsers that match the filename.
+// Parsing errors are logged, database errors are returned.
+func runTableParsers(tx *sql.Tx, certfp string, filename string, content string) error {
+	for _, p := range fileParsers {
+		if p.tableParser == nil || !p.pattern.MatchString(filename) {
+			continue
+		}
+		atomic.AddUint64(&p.handled, 1)
+		store, err := p.tableParser(content)
+		if err != nil {
+			atomic.AddUint64(&p.failed, 1)
+			log.Printf("Parser %s failed on %s from %s: %s", p.name, filename, certfp, err)
+			continue
+		}
+		if err = store(tx, certfp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileParserPriority returns the priority of the named parser.
+// Parsers that no longer exist have the lowest possible priority.
+func fileParserPriority(name string) int {
+	for _, p := range fileParsers {
+		if p.name == name {
+			return p.priority
+		}
+	}
+	return math.MinInt32
+}
+
+func (p *fileParserEntry) checkColumns(result map[string]interface{}) error {
+	for col := range result {
+		if !contains(col, p.columns) {
+			return fmt.Errorf("the parser isn't registered for the column %s", col)
+		}
+	}
+	return nil
+}
+
+// nullIfEmpty is a helper for parsers, to set a column to null instead of an empty string
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// nullIfZero does the same for numeric columns, where 0 means the value wasn't found
+func nullIfZero(n int64) interface{} {
+	if n == 0 {
+		return nil
+	}
+	return n
+}
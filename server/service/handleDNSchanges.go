@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"log"
 	"net"
@@ -24,7 +25,7 @@ func (j handleDNSchangesJob) HowOften() time.Duration {
 // Look for hostinfo rows where dnsttl is null or expired,
 // or where hostname is null.
 // Perform the naming algorithm, and update hostname (and ttl) in the table.
-func (j handleDNSchangesJob) Run(db *sql.DB) {
+func (j handleDNSchangesJob) Run(ctx context.Context, db *sql.DB) {
 	// This function is structured so it uses only 1 database connection,
 	// to facilitate unit testing with a temp schema.
 	rows, err := db.Query("SELECT certfp,ipaddr,os_hostname,lastseen " +
@@ -54,6 +55,10 @@ func (j handleDNSchangesJob) Run(db *sql.DB) {
 	}
 	rows.Close()
 	for _, m := range list {
+		if ctx.Err() != nil {
+			// The server is shutting down. The rest will be handled at the next run.
+			return
+		}
 		err = utility.RunInTransaction(db, func(tx *sql.Tx) error {
 			var hostname string
 			hostname, err = nameMachine(tx, m.ipaddr.String, m.osHostname.String,
@@ -114,15 +119,21 @@ func nameMachine(tx *sql.Tx, ipAddress string, osHostname string, certfp string,
 		return "", nil
 	}
 	// See if the ip address is within one of the ip ranges where DNS should be used.
-	var count int
-	err = tx.QueryRow("SELECT count(*) FROM ipranges WHERE $1 <<= iprange "+
-		"AND use_dns", ipAddress).Scan(&count)
+	// If the host is behind NAT, one of the addresses on its interfaces may be.
+	dnsAddresses, err := addressesForDNS(tx, ipAddress, certfp)
 	if err != nil {
 		return "", err
 	}
-	if count > 0 {
+	var count int
+	if len(dnsAddresses) > 0 {
 		// Yes, use DNS.
-		hostname := forwardConfirmReverseDNS(ipAddress)
+		hostname, dnsAddress := "", ""
+		for _, a := range dnsAddresses {
+			if hostname = forwardConfirmReverseDNS(a); hostname != "" {
+				dnsAddress = a
+				break
+			}
+		}
 		if hostname == "" {
 			// If DNS lookup wasn't conclusive, consider using the
 			// name given by the operating system (osHostname).
@@ -141,8 +152,9 @@ func nameMachine(tx *sql.Tx, ipAddress string, osHostname string, certfp string,
 		}
 		// Ok, we have a hostname. Is it in use by another row that has the same ip address
 		// (which means same claim to it by DNS) and is more recent?
-		err = tx.QueryRow("SELECT count(*) FROM hostinfo WHERE hostname=$1 AND ipaddr=$2 "+
-			"AND certfp!=$3 AND lastseen>$4", hostname, ipAddress, certfp, lastseen).Scan(&count)
+		err = tx.QueryRow("SELECT count(*) FROM hostinfo WHERE hostname=$1 AND (ipaddr=$2 OR "+
+			"certfp IN (SELECT certfp FROM host_addresses WHERE ipaddr=$2)) "+
+			"AND certfp!=$3 AND lastseen>$4", hostname, dnsAddress, certfp, lastseen).Scan(&count)
 		if err != nil {
 			return "", err
 		}
@@ -247,6 +259,33 @@ func nameMachine(tx *sql.Tx, ipAddress string, osHostname string, certfp string,
 	return hostname.String, nil
 }
 
+// addressesForDNS returns the addresses of the host that are within ip ranges where DNS
+// should be used. The address the host connected from comes first, then the addresses
+// on its network interfaces (from the host_addresses table).
+func addressesForDNS(tx *sql.Tx, ipAddress string, certfp string) ([]string, error) {
+	rows, err := tx.Query("SELECT host(a.ip) FROM "+
+		"(SELECT $1::inet AS ip, 0 AS n UNION SELECT ipaddr, 1 FROM host_addresses WHERE certfp=$2) AS a "+
+		"WHERE EXISTS(SELECT 1 FROM ipranges WHERE a.ip <<= iprange AND use_dns) "+
+		"ORDER BY a.n, a.ip", ipAddress, certfp)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := make([]string, 0)
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var ip string
+		if err = rows.Scan(&ip); err != nil {
+			return nil, err
+		}
+		if !seen[ip] {
+			seen[ip] = true
+			list = append(list, ip)
+		}
+	}
+	return list, rows.Err()
+}
+
 // returns hostname or empty string
 func forwardConfirmReverseDNS(ipAddress string) string {
 	// First, look up the ip address and get a list of hostnames
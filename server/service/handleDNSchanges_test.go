@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"os"
 	"testing"
@@ -76,6 +77,7 @@ func TestHandleDNSchanges(t *testing.T) {
 		expected         string
 		overrideHostname sql.NullString
 		lastseen         time.Time
+		addresses        []string
 	}
 	tests := []testname{
 		// this host will be renamed based on DNS PTR record for the ip address
@@ -206,6 +208,15 @@ func TestHandleDNSchanges(t *testing.T) {
 			osHostname: "trustworthy.example.com",
 			expected:   "trustworthy.example.com",
 		},
+		// This host connects through NAT from an address outside the ip ranges,
+		// but one of the addresses on its interfaces is in a range where DNS is used
+		testname{
+			certfp:     "q",
+			ipAddress:  "80.90.100.200",
+			osHostname: "ns2.uio.no",
+			addresses:  []string{"192.168.1.10", "129.240.2.42"},
+			expected:   "ns2.uio.no",
+		},
 	}
 	for _, test := range tests {
 		ipAddr := sql.NullString{String: test.ipAddress, Valid: test.ipAddress != ""}
@@ -216,10 +227,16 @@ func TestHandleDNSchanges(t *testing.T) {
 			t.Logf("hostname: %s", test.hostname.String)
 			t.Fatal(err)
 		}
+		for _, a := range test.addresses {
+			_, err = db.Exec("INSERT INTO host_addresses(certfp,ipaddr) VALUES($1,$2)", test.certfp, a)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
 	}
 	// Run the function
 	job := handleDNSchangesJob{}
-	job.Run(db)
+	job.Run(context.Background(), db)
 	// Check the results
 	for _, test := range tests {
 		var hostname sql.NullString
@@ -235,7 +252,7 @@ func TestHandleDNSchanges(t *testing.T) {
 	}
 	// Run again
 	db.Exec("UPDATE hostinfo SET dnsttl=null")
-	job.Run(db)
+	job.Run(context.Background(), db)
 	// Check the results again, to check for flip-flopping
 	for _, test := range tests {
 		var hostname sql.NullString
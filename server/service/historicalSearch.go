@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// historicalSearch describes a search in old versions of files.
+// The fast search cache only has the current version of each file,
+// so these searches go to the database instead.
+type historicalSearch struct {
+	// asOf is the point in time to search. For each file, the version
+	// that was current at that time is searched.
+	// If it is zero, all the versions of every file are searched.
+	asOf time.Time
+}
+
+// historicalSearchFromRequest reads the parameters "history" and "asOf".
+// asOf can be a timestamp in RFC3339 format, or just a date (YYYY-MM-DD).
+// Returns nil if the request is for a regular search in the current files.
+func historicalSearchFromRequest(req *http.Request) (*historicalSearch, *httpError) {
+	if str := req.FormValue("asOf"); str != "" {
+		t, hErr := parseTimeParam("asOf", str)
+		if hErr != nil {
+			return nil, hErr
+		}
+		return &historicalSearch{asOf: t}, nil
+	}
+	if isTrueish(req.FormValue("history")) {
+		return &historicalSearch{}, nil
+	}
+	return nil, nil
+}
+
+// parseTimeParam parses a timestamp in RFC3339 format, or just a date (YYYY-MM-DD).
+// A date means the end of that day.
+func parseTimeParam(name string, str string) (time.Time, *httpError) {
+	t, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		t, err = time.ParseInLocation("2006-01-02", str, time.Local)
+		if err != nil {
+			return time.Time{}, &httpError{
+				message: "Invalid timestamp for parameter " + name + ": " + str,
+				code:    http.StatusBadRequest,
+			}
+		}
+		t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	}
+	return t, nil
+}
+
+// search looks for the query in old versions of files in the database.
+// Only files from hosts in validCerts are searched, or from all hosts if
+// validCerts is nil. If filename is non-empty, only files with that name are searched.
+// Returns a map from the ID of each matching file version to the certificate fingerprint.
+//
+// The database can narrow down the list of files by looking for
+// the strings that must be present in matching content, and then
+// the content is matched with the same code as the fast search.
+// The whole search, including the database query, has the same time limit as a regular expression.
+func (h *historicalSearch) search(db *sql.DB, q *searchQuery, filename string,
+	validCerts map[string]bool) (map[int64]string, *httpError) {
+	statement := "SELECT f.fileid, f.certfp, f.content FROM files f " +
+		"WHERE f.certfp IN (SELECT certfp FROM hostinfo) AND f.content IS NOT NULL"
+	args := make([]interface{}, 0)
+	param := func(value interface{}) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+	for _, s := range q.literals {
+		statement += " AND f.content ILIKE " + param("%"+escapeLikePattern(s)+"%")
+	}
+	if filename != "" {
+		statement += " AND f.filename=" + param(filename)
+	}
+	if !h.asOf.IsZero() {
+		// The version that was current at the given time is
+		// the last version that was received before that time.
+		asOf := param(h.asOf)
+		statement += " AND f.received <= " + asOf +
+			" AND NOT EXISTS (SELECT 1 FROM files f2 WHERE f2.certfp=f.certfp " +
+			"AND f2.filename=f.filename AND f2.received > f.received " +
+			"AND f2.received <= " + asOf + ")"
+	}
+	deadline := q.deadline
+	if deadline.IsZero() {
+		deadline = time.Now().Add(regexTimeLimit())
+	}
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, statement, args...)
+	if ctx.Err() != nil {
+		return nil, errSearchTimeLimit
+	}
+	if err != nil {
+		return nil, &httpError{message: err.Error(), code: http.StatusInternalServerError}
+	}
+	defer rows.Close()
+	result := make(map[int64]string)
+	for rows.Next() {
+		var fileID int64
+		var certfp, content string
+		if err = rows.Scan(&fileID, &certfp, &content); err != nil {
+			return nil, &httpError{message: err.Error(), code: http.StatusInternalServerError}
+		}
+		if validCerts != nil && !validCerts[certfp] {
+			continue
+		}
+		if !q.caseSensitive {
+			content = strings.ToLower(content)
+		}
+		if q.matches(content) {
+			result[fileID] = certfp
+		}
+		if ctx.Err() != nil {
+			return nil, errSearchTimeLimit
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, errSearchTimeLimit
+	}
+	if err = rows.Err(); err != nil {
+		return nil, &httpError{message: err.Error(), code: http.StatusInternalServerError}
+	}
+	return result, nil
+}
+
+// escapeLikePattern escapes the characters that have a special meaning
+// in patterns for LIKE and ILIKE
+func escapeLikePattern(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// contentIndexLockID identifies the advisory lock that makes sure only one instance builds the trigram index
+const contentIndexLockID = leaderLockID + 1
+
+// createContentIndex builds the trigram index on the file content, which speeds up searches in old versions.
+// A regular CREATE INDEX would block new files for as long as it takes to build the index, which can be
+// a long time with many files. CREATE INDEX CONCURRENTLY doesn't, but it can't run in a transaction,
+// so it isn't part of the database patches. If a build was interrupted, it leaves an invalid index behind,
+// which is dropped and built again.
+func createContentIndex(ctx context.Context, db *sql.DB) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		log.Printf("Unable to create the content index: %v", err)
+		return
+	}
+	defer conn.Close()
+	var gotLock bool
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", contentIndexLockID).Scan(&gotLock)
+	if err != nil || !gotLock {
+		// another instance is building it
+		return
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", contentIndexLockID)
+
+	// The patch that creates the extension carries on without it if it isn't allowed (see patch009.sql)
+	var haveExtension bool
+	err = conn.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM pg_extension WHERE extname='pg_trgm')").
+		Scan(&haveExtension)
+	if err != nil {
+		log.Printf("Unable to create the content index: %v", err)
+		return
+	}
+	if !haveExtension {
+		log.Println("The content index can't be created, since the PostgreSQL extension pg_trgm isn't installed. " +
+			"Searches in old versions of files will be slower. A superuser can install it with: CREATE EXTENSION pg_trgm;")
+		return
+	}
+
+	var valid sql.NullBool
+	err = conn.QueryRowContext(ctx, "SELECT i.indisvalid FROM pg_index i "+
+		"JOIN pg_class c ON c.oid=i.indexrelid WHERE c.relname='files_content_trgm'").Scan(&valid)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Unable to create the content index: %v", err)
+		return
+	}
+	if valid.Valid && valid.Bool {
+		return
+	}
+	if valid.Valid {
+		if _, err = conn.ExecContext(ctx, "DROP INDEX CONCURRENTLY files_content_trgm"); err != nil {
+			log.Printf("Unable to drop the invalid content index: %v", err)
+			return
+		}
+	}
+	log.Println("Creating the content index.")
+	start := time.Now()
+	_, err = conn.ExecContext(ctx, "CREATE INDEX CONCURRENTLY files_content_trgm ON files USING gin(content gin_trgm_ops)")
+	if err != nil {
+		log.Printf("Unable to create the content index: %v", err)
+		return
+	}
+	log.Printf("Created the content index in %s.", time.Since(start).Round(time.Second))
+}
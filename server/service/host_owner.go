@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"io/ioutil"
 	"log"
@@ -20,7 +21,7 @@ func init() {
 	RegisterJob(determineHostOwnershipJob{})
 }
 
-func (job determineHostOwnershipJob) Run(db *sql.DB) {
+func (job determineHostOwnershipJob) Run(ctx context.Context, db *sql.DB) {
 	// If no plugin has been configured, there's nothing to do here
 	if config.HostOwnerPluginURL == "" {
 		return
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// jobHistoryDays is how long the history of job runs is kept
+const jobHistoryDays = 7
+
+// jobName is the name used for a job in config, in the database and in the API
+func jobName(job Job) string {
+	return reflect.TypeOf(job).Name()
+}
+
+func findJob(name string) *JobListElement {
+	for i := range jobs {
+		if strings.EqualFold(jobName(jobs[i].job), name) {
+			return &jobs[i]
+		}
+	}
+	return nil
+}
+
+// interval is how often the job runs, which can be overridden in config
+func (elem *JobListElement) interval() time.Duration {
+	if elem.intervalOverride > 0 {
+		return elem.intervalOverride
+	}
+	return elem.job.HowOften()
+}
+
+// isDue returns true if the job should be started now
+func (elem *JobListElement) isDue() bool {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	if elem.disabled || elem.running || (!elem.local && !isLeader()) {
+		return false
+	}
+	if elem.trigger {
+		return true
+	}
+	return !elem.paused && time.Since(elem.lastrun) > elem.interval()
+}
+
+// nextRun returns when the job will be started, or a zero time if it won't.
+// The caller must hold jobsMutex.
+func (elem *JobListElement) nextRun() time.Time {
+	if elem.disabled || (elem.paused && !elem.trigger) || (!elem.local && !isLeader()) {
+		return time.Time{}
+	}
+	if elem.trigger {
+		return time.Now()
+	}
+	return elem.lastrun.Add(elem.interval())
+}
+
+// startJob runs the job in a goroutine. jobSlots limits how many jobs can run at the same time.
+// Each run is recorded in the jobruns table. The job should return early when ctx is cancelled.
+func startJob(ctx context.Context, db *sql.DB, elem *JobListElement, jobSlots chan bool) {
+	jobSlots <- true
+	started := time.Now()
+	jobsMutex.Lock()
+	elem.running = true
+	elem.lastrun = started
+	elem.trigger = false
+	jobsMutex.Unlock()
+	go func() {
+		defer func() {
+			// if panicking, we want to recover, and keep the object in elem.panicObject.
+			// if NOT panicking, we want elem.panicObject to be nil.
+			r := recover()
+			duration := time.Since(started)
+			jobsMutex.Lock()
+			elem.panicObject = r
+			elem.lastExecutionTime = duration
+			elem.lastrun = time.Now()
+			jobsMutex.Unlock()
+			recordJobRun(db, jobName(elem.job), started, duration, r)
+			jobsMutex.Lock()
+			elem.running = false
+			jobsMutex.Unlock()
+			<-jobSlots
+		}()
+		elem.job.Run(ctx, db)
+	}()
+}
+
+// triggerNow makes the main loop start the job as soon as possible
+func (elem *JobListElement) triggerNow() {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	elem.trigger = true
+}
+
+func recordJobRun(db *sql.DB, name string, started time.Time, duration time.Duration, panicObject interface{}) {
+	var errorText sql.NullString
+	if panicObject != nil {
+		errorText.String = jobErrorText(panicObject)
+		errorText.Valid = true
+	}
+	_, err := db.Exec("INSERT INTO jobruns(job,started,seconds,error) VALUES($1,$2,$3,$4)",
+		name, started, duration.Seconds(), errorText)
+	if err != nil {
+		log.Printf("Unable to record the run of %s: %v", name, err)
+	}
+}
+
+// jobErrorText is the text for a panic in a job
+func jobErrorText(panicObject interface{}) string {
+	return fmt.Sprintf("%v", panicObject)
+}
+
+// applyJobConfig sets interval overrides and disables jobs according to the config options
+// JobIntervals and DisabledJobs
+func applyJobConfig(config *Config) {
+	for _, s := range config.JobIntervals {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		nameAndInterval := strings.SplitN(s, ":", 2)
+		if len(nameAndInterval) != 2 {
+			log.Printf("Invalid JobIntervals entry (expected name:interval): %s", s)
+			continue
+		}
+		elem := findJob(strings.TrimSpace(nameAndInterval[0]))
+		if elem == nil {
+			log.Printf("JobIntervals: Unknown job %s", nameAndInterval[0])
+			continue
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(nameAndInterval[1]))
+		if err != nil || d <= 0 {
+			log.Printf("JobIntervals: Invalid interval for %s: %s", nameAndInterval[0], nameAndInterval[1])
+			continue
+		}
+		elem.intervalOverride = d
+	}
+	for _, name := range config.DisabledJobs {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		elem := findJob(name)
+		if elem == nil {
+			log.Printf("DisabledJobs: Unknown job %s", name)
+			continue
+		}
+		elem.disabled = true
+	}
+}
+
+// loadJobState restores which jobs are paused, and when each job last ran,
+// so the schedule continues where it left off when the server is restarted.
+// It is also called regularly, to pick up changes from other server instances.
+// Local jobs keep their own schedule on each instance.
+func loadJobState(db *sql.DB) error {
+	rows, err := db.Query("SELECT job, max(started + seconds * interval '1 second') FROM jobruns GROUP BY job")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var lastrun time.Time
+		if err = rows.Scan(&name, &lastrun); err != nil {
+			return err
+		}
+		if elem := findJob(name); elem != nil && !elem.local {
+			jobsMutex.Lock()
+			if lastrun.After(elem.lastrun) {
+				elem.lastrun = lastrun
+			}
+			jobsMutex.Unlock()
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	rows, err = db.Query("SELECT job, paused, triggered FROM jobsettings")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	leader := isLeader()
+	for rows.Next() {
+		var name string
+		var paused bool
+		var triggered pq.NullTime
+		if err = rows.Scan(&name, &paused, &triggered); err != nil {
+			return err
+		}
+		if elem := findJob(name); elem != nil {
+			jobsMutex.Lock()
+			elem.paused = paused
+			// Run the jobs that were triggered on other instances, see triggerJobOnLeader
+			if leader && !elem.local && triggered.Valid && triggered.Time.After(elem.lastrun) {
+				elem.trigger = true
+			}
+			jobsMutex.Unlock()
+		}
+	}
+	return rows.Err()
+}
+
+// triggerJobOnLeader makes the job run as soon as possible on the instance that runs it.
+// If that isn't this instance, the trigger is saved in the database, and the leader
+// picks it up the next time it loads the job state.
+func triggerJobOnLeader(db *sql.DB, elem *JobListElement) error {
+	if elem.local || isLeader() {
+		elem.triggerNow()
+		return nil
+	}
+	name := jobName(elem.job)
+	res, err := db.Exec("UPDATE jobsettings SET triggered=now() WHERE job=$1", name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		_, err = db.Exec("INSERT INTO jobsettings(job,triggered) VALUES($1,now())", name)
+	}
+	return err
+}
+
+// setJobPaused pauses or resumes a job, and saves the setting
+func setJobPaused(db *sql.DB, elem *JobListElement, paused bool) error {
+	name := jobName(elem.job)
+	res, err := db.Exec("UPDATE jobsettings SET paused=$2 WHERE job=$1", name, paused)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		_, err = db.Exec("INSERT INTO jobsettings(job,paused) VALUES($1,$2)", name, paused)
+		if err != nil {
+			return err
+		}
+	}
+	jobsMutex.Lock()
+	elem.paused = paused
+	jobsMutex.Unlock()
+	return nil
+}
+
+// pruneJobHistoryJob removes old entries from the history of job runs
+type pruneJobHistoryJob struct{}
+
+func init() {
+	RegisterJob(pruneJobHistoryJob{})
+}
+
+func (job pruneJobHistoryJob) HowOften() time.Duration {
+	return time.Hour * 6
+}
+
+func (job pruneJobHistoryJob) Run(ctx context.Context, db *sql.DB) {
+	_, err := db.Exec("DELETE FROM jobruns WHERE started < now() - $1 * interval '1 day'", jobHistoryDays)
+	if err != nil {
+		log.Panic(err)
+	}
+}
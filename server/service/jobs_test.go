@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+type testJobA struct{}
+
+func (job testJobA) HowOften() time.Duration {
+	return time.Hour
+}
+
+func (job testJobA) Run(ctx context.Context, db *sql.DB) {}
+
+type testJobB struct{}
+
+func (job testJobB) HowOften() time.Duration {
+	return time.Minute
+}
+
+func (job testJobB) Run(ctx context.Context, db *sql.DB) {
+	panic("something went wrong")
+}
+
+func TestApplyJobConfig(t *testing.T) {
+	saved := jobs
+	defer func() { jobs = saved }()
+	jobs = []JobListElement{{job: testJobA{}}, {job: testJobB{}}}
+
+	applyJobConfig(&Config{
+		JobIntervals: []string{"testJobA:10m", " testjobb : 30s", "testJobB", "noSuchJob:1h", "testJobA:soon"},
+		DisabledJobs: []string{"testJobB", "", "noSuchJob"},
+	})
+	if jobs[0].interval() != 10*time.Minute || jobs[0].disabled {
+		t.Errorf("testJobA: interval %v, disabled %v", jobs[0].interval(), jobs[0].disabled)
+	}
+	if jobs[1].interval() != 30*time.Second || !jobs[1].disabled {
+		t.Errorf("testJobB: interval %v, disabled %v", jobs[1].interval(), jobs[1].disabled)
+	}
+}
+
+func TestJobIsDue(t *testing.T) {
+	tests := []struct {
+		elem   JobListElement
+		isDue  bool
+		hasRun bool // whether nextRun returns a time
+	}{
+		{JobListElement{lastrun: time.Now()}, false, true},
+		{JobListElement{lastrun: time.Now().Add(-2 * time.Hour)}, true, true},
+		{JobListElement{lastrun: time.Now(), intervalOverride: time.Millisecond}, true, true},
+		{JobListElement{lastrun: time.Now(), trigger: true}, true, true},
+		{JobListElement{lastrun: time.Now().Add(-2 * time.Hour), running: true}, false, true},
+		{JobListElement{lastrun: time.Now().Add(-2 * time.Hour), paused: true}, false, false},
+		{JobListElement{lastrun: time.Now(), paused: true, trigger: true}, true, true},
+		{JobListElement{trigger: true, disabled: true}, false, false},
+	}
+	setLeader(true)
+	defer setLeader(false)
+	time.Sleep(time.Millisecond)
+	for i, test := range tests {
+		test.elem.job = testJobA{}
+		if test.elem.isDue() != test.isDue {
+			t.Errorf("Test %d: isDue returned %v", i, !test.isDue)
+		}
+		if test.elem.nextRun().IsZero() == test.hasRun {
+			t.Errorf("Test %d: nextRun returned %v", i, test.elem.nextRun())
+		}
+	}
+
+	// Only local jobs run when this instance isn't the leader
+	setLeader(false)
+	elem := JobListElement{job: testJobA{}, trigger: true}
+	if elem.isDue() || !elem.nextRun().IsZero() {
+		t.Errorf("A job is due, but this instance isn't the leader")
+	}
+	elem.local = true
+	if !elem.isDue() {
+		t.Errorf("A local job isn't due")
+	}
+}
+
+func TestApiMethodJobs(t *testing.T) {
+	if os.Getenv("NOPOSTGRES") != "" {
+		t.Log("No Postgres, skipping test")
+		return
+	}
+	db := getDBconnForTesting(t)
+	defer db.Close()
+
+	saved := jobs
+	defer func() { jobs = saved }()
+	jobs = []JobListElement{{job: testJobA{}}, {job: testJobB{}}}
+
+	// Run both jobs and wait for them to finish
+	jobSlots := make(chan bool, 2)
+	for i := range jobs {
+		startJob(context.Background(), db, &jobs[i], jobSlots)
+	}
+	for len(jobSlots) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	api := createAPImuxer(db, false)
+	testAPIcalls(t, api, []apiCall{
+		{
+			methodAndPath: "GET /api/v2/jobs",
+			expectStatus:  http.StatusOK,
+			expectContent: `"failuresLastDay": 1`,
+		},
+		{
+			methodAndPath: "GET /api/v2/jobs/testJobB",
+			expectStatus:  http.StatusOK,
+			expectContent: `"lastError": "something went wrong"`,
+		},
+		{
+			methodAndPath: "GET /api/v2/jobs/testJobA?limit=5",
+			expectStatus:  http.StatusOK,
+			expectContent: `"error": null`,
+		},
+		{
+			methodAndPath: "GET /api/v2/jobs/noSuchJob",
+			expectStatus:  http.StatusNotFound,
+		},
+		{
+			methodAndPath: "PUT /api/v2/jobs/testJobA",
+			body:          "paused=true",
+			expectStatus:  http.StatusNoContent,
+		},
+		{
+			methodAndPath: "PUT /api/v2/jobs/testJobA",
+			expectStatus:  http.StatusUnprocessableEntity,
+		},
+		{
+			methodAndPath: "GET /api/v2/jobs/testJobA",
+			expectStatus:  http.StatusOK,
+			expectContent: `"nextRun": null`,
+		},
+		{
+			methodAndPath: "POST /api/v2/jobs/testJobA/trigger",
+			expectStatus:  http.StatusNoContent,
+		},
+		{
+			methodAndPath: "POST /api/v2/jobs/testJobA/other",
+			expectStatus:  http.StatusNotFound,
+		},
+		{
+			methodAndPath: "DELETE /api/v2/jobs/testJobA",
+			expectStatus:  http.StatusMethodNotAllowed,
+		},
+	})
+	// This instance isn't the leader, so the trigger is left for the leader
+	if !jobs[0].paused || jobs[0].trigger {
+		t.Errorf("Expected testJobA to be paused, and not triggered here")
+	}
+	setLeader(true)
+	defer setLeader(false)
+	if err := loadJobState(db); err != nil {
+		t.Fatal(err)
+	}
+	if !jobs[0].trigger {
+		t.Errorf("The leader didn't pick up the trigger")
+	}
+
+	// The pause setting and the last run are restored at startup
+	jobs = []JobListElement{{job: testJobA{}}, {job: testJobB{}}}
+	if err := loadJobState(db); err != nil {
+		t.Fatal(err)
+	}
+	if !jobs[0].paused || jobs[1].paused {
+		t.Errorf("Wrong pause state after reload")
+	}
+	if time.Since(jobs[1].lastrun) > time.Minute {
+		t.Errorf("The last run wasn't restored: %v", jobs[1].lastrun)
+	}
+}
+
+type testJobC struct{}
+
+func (job testJobC) HowOften() time.Duration {
+	return time.Hour
+}
+
+func (job testJobC) Run(ctx context.Context, db *sql.DB) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Minute):
+		panic("the job wasn't cancelled")
+	}
+}
+
+func TestJobCancellation(t *testing.T) {
+	if os.Getenv("NOPOSTGRES") != "" {
+		t.Log("No Postgres, skipping test")
+		return
+	}
+	db := getDBconnForTesting(t)
+	defer db.Close()
+
+	saved := jobs
+	defer func() { jobs = saved }()
+	jobs = []JobListElement{{job: testJobC{}}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	jobSlots := make(chan bool, 1)
+	startJob(ctx, db, &jobs[0], jobSlots)
+
+	// The task runner should stop too
+	stopped := make(chan bool)
+	go func() {
+		taskRunner(ctx, db, false)
+		stopped <- true
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case jobSlots <- true:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The job didn't stop")
+	}
+	if jobs[0].panicObject != nil {
+		t.Errorf("The job failed: %v", jobs[0].panicObject)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The task runner didn't stop")
+	}
+}
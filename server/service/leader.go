@@ -0,0 +1,109 @@
+package main
+
+// Several server instances can share one database, for example behind a load balancer.
+// All of them serve the API and receive files, but most jobs work on the database and
+// should only run in one place. That is the leader, which is the instance that holds
+// a PostgreSQL advisory lock. If the leader stops, or loses its database connection,
+// the lock is released and another instance takes over.
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// leaderLockID identifies the advisory lock. The value is arbitrary, but must be the same for all instances.
+const leaderLockID = 0x6e69766c
+
+// leaderCheckInterval is how often a non-leader tries to take over,
+// and how often the leader checks that it still has the connection.
+const leaderCheckInterval = 10 * time.Second
+
+var leader int32 // 1 if this instance is the leader
+
+func isLeader() bool {
+	return atomic.LoadInt32(&leader) == 1
+}
+
+func setLeader(b bool) {
+	var i int32
+	if b {
+		i = 1
+	}
+	if atomic.SwapInt32(&leader, i) != i {
+		if b {
+			log.Println("This server instance is now the leader.")
+		} else {
+			log.Println("This server instance is no longer the leader.")
+		}
+	}
+}
+
+// leaderElection is intended to be run as a goroutine. It tries to become the leader,
+// and keeps trying until ctx is cancelled. The advisory lock belongs to a database session,
+// so a dedicated connection is kept open while this instance is the leader.
+func leaderElection(ctx context.Context, db *sql.DB) {
+	var conn *sql.Conn
+	defer func() {
+		setLeader(false)
+		if conn != nil {
+			releaseLeaderLock(conn)
+		}
+	}()
+	hasLock := false
+	for {
+		var err error
+		hasLock, err = tryLeadership(ctx, db, &conn, hasLock)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Leader election: %v", err)
+			if conn != nil {
+				releaseLeaderLock(conn)
+				conn = nil
+			}
+			hasLock = false
+		}
+		// Pick up changes to the job schedule made by other instances.
+		// A new leader continues the schedule from where the previous one left off.
+		if err = loadJobState(db); err != nil && ctx.Err() == nil {
+			log.Printf("Unable to load the job state: %v", err)
+		}
+		setLeader(hasLock)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(leaderCheckInterval):
+		}
+	}
+}
+
+// tryLeadership takes the lock if it is free. If held is true, the lock was taken earlier,
+// so it only checks that the connection is still working. conn is the dedicated connection.
+// Returns true if this instance has the lock.
+func tryLeadership(ctx context.Context, db *sql.DB, conn **sql.Conn, held bool) (bool, error) {
+	if *conn == nil {
+		c, err := db.Conn(ctx)
+		if err != nil {
+			return false, err
+		}
+		*conn = c
+	}
+	if held {
+		var one int
+		err := (*conn).QueryRowContext(ctx, "SELECT 1").Scan(&one)
+		return err == nil, err
+	}
+	var gotLock bool
+	err := (*conn).QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", leaderLockID).Scan(&gotLock)
+	return gotLock, err
+}
+
+// releaseLeaderLock gives up the lock and returns the connection to the pool.
+// If the connection is broken, the database has already released the lock.
+func releaseLeaderLock(conn *sql.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn.ExecContext(ctx, "SELECT pg_advisory_unlock_all()")
+	conn.Close()
+}
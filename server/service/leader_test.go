@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"testing"
+)
+
+func TestLeaderElection(t *testing.T) {
+	if os.Getenv("NOPOSTGRES") != "" {
+		t.Log("No Postgres, skipping test")
+		return
+	}
+	// Two database handles act as two server instances. Advisory locks are
+	// shared by the whole database, even if each handle has its own temporary schema.
+	db1 := getDBconnForTesting(t)
+	defer db1.Close()
+	db2 := getDBconnForTesting(t)
+	defer db2.Close()
+
+	ctx := context.Background()
+	var conn1, conn2 *sql.Conn
+	hasLock, err := tryLeadership(ctx, db1, &conn1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasLock {
+		t.Fatal("The first instance didn't become the leader")
+	}
+	hasLock, err = tryLeadership(ctx, db2, &conn2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasLock {
+		t.Fatal("The second instance became the leader while the first one has the lock")
+	}
+	// The leader checks that it still has the connection
+	hasLock, err = tryLeadership(ctx, db1, &conn1, true)
+	if err != nil || !hasLock {
+		t.Fatalf("The first instance lost the lock: %v", err)
+	}
+
+	// When the first instance lets go, the second one takes over
+	releaseLeaderLock(conn1)
+	hasLock, err = tryLeadership(ctx, db2, &conn2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasLock {
+		t.Fatal("The second instance didn't take over")
+	}
+	releaseLeaderLock(conn2)
+}
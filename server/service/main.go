@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"embed"
 	"errors"
@@ -14,31 +15,47 @@ import (
 	"reflect"
 	"regexp"
 	"runtime"
+	"sync"
 	"syscall"
 	"time"
 )
 
 // A Job is an internal piece of code that gets run periodically by this program
 type Job interface {
-	Run(db *sql.DB)
+	// Run should return early if ctx is cancelled, which happens when the server shuts down
+	Run(ctx context.Context, db *sql.DB)
 	HowOften() time.Duration
 	//TODO change the HowOften func to a parameter for RegisterJob,
 	//     and call it minimumTimeBetweenRuns or something similar.
 }
 
+// JobListElement is the state of a registered job. The fields that change while the server runs
+// are read and written by the main loop, the job goroutines, the API handlers and the leader election,
+// so jobsMutex must be held when accessing them.
 type JobListElement struct {
 	job               Job
 	lastrun           time.Time
 	lastExecutionTime time.Duration
 	running, trigger  bool
 	panicObject       interface{}
+	intervalOverride  time.Duration // from config, 0 means HowOften() is used
+	disabled          bool          // by config
+	paused            bool          // through the API
+	local             bool          // runs on every server instance, not just the leader
 }
 
 func RegisterJob(newjob Job) {
 	jobs = append(jobs, JobListElement{job: newjob})
 }
 
+// RegisterLocalJob registers a job that runs on every server instance, because
+// it works on the memory or files of the instance. Other jobs only run on the leader.
+func RegisterLocalJob(newjob Job) {
+	jobs = append(jobs, JobListElement{job: newjob, local: true})
+}
+
 var jobs []JobListElement
+var jobsMutex sync.Mutex
 var postgresSupportsOnConflict bool
 var version string // should be set with -ldflags "-X main.version=1.2.3" during build
 var config = &Config{}
@@ -86,13 +103,12 @@ func main() {
 	// in Go, the default random generator produces a deterministic sequence of values unless seeded
 	rand.Seed(time.Now().UnixNano())
 
-	// handle ctrl-c (SIGINT) and SIGTERM
-	var quit bool
+	// handle ctrl-c (SIGINT) and SIGTERM by cancelling the context,
+	// which stops the API server, the task runner and the jobs
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	go func() {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-		<-c
-		quit = true
+		<-ctx.Done()
 		log.Println("\rShutting down...")
 	}()
 	defer log.Println("Stopped.")
@@ -169,7 +185,7 @@ func main() {
 
 	// Verify the schema patch level
 	var patchLevel int
-	const requirePatchLevel = 8
+	const requirePatchLevel = 21
 	err = db.QueryRow("SELECT patchlevel FROM db").Scan(&patchLevel)
 	if err != nil {
 		patchLevel = 0
@@ -183,42 +199,47 @@ func main() {
 		}
 	}
 
-	go runAPI(db, config.HTTPListenAddress, devmode)
-	go taskRunner(db, devmode)
+	// Apply the job settings from config, and continue the schedule from the last run
+	applyJobConfig(config)
+	if err = loadJobState(db); err != nil {
+		log.Printf("Unable to load the job state: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		leaderElection(ctx, db)
+	}()
+	go func() {
+		defer wg.Done()
+		runAPI(ctx, db, config.HTTPListenAddress, devmode)
+	}()
+	go func() {
+		defer wg.Done()
+		taskRunner(ctx, db, devmode)
+	}()
+	go func() {
+		defer wg.Done()
+		listenForSearchCacheChanges(ctx, db, dbConnectionString)
+	}()
 	go loadContentForFastSearch(db)
+	go createContentIndex(ctx, db)
 
 	jobSlots := make(chan bool, 10) // max concurrent running jobs
-	for !quit {
+	for ctx.Err() == nil {
 		// Run jobs
-		for i, j := range jobs {
-			if (time.Since(j.lastrun) > j.job.HowOften() || j.trigger) && !j.running {
-				jobSlots <- true
-				elem := &jobs[i]
-				elem.running = true
-				elem.lastrun = time.Now()
-				elem.trigger = false
-				go func() {
-					defer func() {
-						if r := recover(); r != nil {
-							// if panicking, we want to recover, and keep the
-							// object in elem.panicObject.
-							elem.panicObject = r
-						} else {
-							// if NOT panicking, we want elem.panicObject to be nil.
-							elem.panicObject = nil
-						}
-						elem.lastExecutionTime = time.Since(elem.lastrun)
-						elem.lastrun = time.Now()
-						elem.running = false
-						<-jobSlots
-					}()
-					elem.job.Run(db)
-				}()
+		for i := range jobs {
+			if jobs[i].isDue() {
+				startJob(ctx, db, &jobs[i], jobSlots)
 			}
 		}
 
 		// Sleep
-		time.Sleep(time.Second)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
 	}
 	// wait for jobs to finish
 	log.Println("Waiting for running jobs to finish...")
@@ -229,20 +250,33 @@ func main() {
 		case jobSlots <- true:
 			left--
 		default:
-			time.Sleep(time.Second)
+			time.Sleep(100 * time.Millisecond)
 		}
 	}
 	if left > 0 {
-		log.Printf("Terminating %d running jobs.", left)
+		log.Printf("%d jobs didn't stop in time.", left)
 	} else {
 		log.Println("All jobs are finished.")
 	}
+	// wait for the API server, the task runner, the leader election and the search cache listener
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 10):
+		log.Println("Some of the background work didn't stop in time.")
+	}
+	// Save the search cache, so it can be loaded quickly at the next startup
+	writeSearchCacheSnapshot()
 }
 
 func triggerJob(job Job) {
 	for i, jobitem := range jobs {
 		if reflect.TypeOf(jobitem.job) == reflect.TypeOf(job) {
-			jobs[i].trigger = true
+			jobs[i].triggerNow()
 			return
 		}
 	}
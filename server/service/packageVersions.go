@@ -0,0 +1,224 @@
+package main
+
+// Version numbers are compared the same way the package managers do it,
+// so that e.g. "1.10" is newer than "1.9", and "1.0~rc1" is older than "1.0" in dpkg.
+
+import (
+	"strconv"
+	"strings"
+)
+
+// compareVersions returns -1, 0 or 1 if version a is older than, the same as, or newer than b.
+// Source is the package system the versions come from.
+func compareVersions(source string, a string, b string) int {
+	var c int
+	if source == "dpkg" {
+		c = compareDpkgVersions(a, b)
+	} else {
+		// Windows programs have no particular rules, but rpm's algorithm does the right thing
+		// for the usual dotted numbers
+		c = compareRpmVersions(a, b)
+	}
+	if c < 0 {
+		return -1
+	} else if c > 0 {
+		return 1
+	}
+	return 0
+}
+
+// splitEpoch splits "epoch:version" into the epoch and the rest. The epoch is 0 if missing.
+func splitEpoch(v string) (int, string) {
+	if i := strings.IndexByte(v, ':'); i > 0 {
+		if epoch, err := strconv.Atoi(v[:i]); err == nil {
+			return epoch, v[i+1:]
+		}
+	}
+	return 0, v
+}
+
+// splitRevision splits "version-revision" at the last dash
+func splitRevision(v string) (string, string) {
+	if i := strings.LastIndexByte(v, '-'); i > -1 {
+		return v[:i], v[i+1:]
+	}
+	return v, ""
+}
+
+// compareRpmVersions compares [epoch:]version[-release] like rpm does
+func compareRpmVersions(a string, b string) int {
+	epochA, a := splitEpoch(a)
+	epochB, b := splitEpoch(b)
+	if epochA != epochB {
+		return epochA - epochB
+	}
+	versionA, releaseA := splitRevision(a)
+	versionB, releaseB := splitRevision(b)
+	if c := rpmvercmp(versionA, versionB); c != 0 {
+		return c
+	}
+	return rpmvercmp(releaseA, releaseB)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isAlpha(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// rpmvercmp is a port of the function with the same name in rpm.
+// The strings are split into segments of digits and letters, which are compared one by one.
+// Numbers are newer than letters, and a tilde sorts before anything, even the end of the string.
+func rpmvercmp(a string, b string) int {
+	if a == b {
+		return 0
+	}
+	for len(a) > 0 || len(b) > 0 {
+		for len(a) > 0 && !isDigit(a[0]) && !isAlpha(a[0]) && a[0] != '~' && a[0] != '^' {
+			a = a[1:]
+		}
+		for len(b) > 0 && !isDigit(b[0]) && !isAlpha(b[0]) && b[0] != '~' && b[0] != '^' {
+			b = b[1:]
+		}
+		// Tilde sorts before everything else
+		if (len(a) > 0 && a[0] == '~') || (len(b) > 0 && b[0] == '~') {
+			if len(a) == 0 || a[0] != '~' {
+				return 1
+			}
+			if len(b) == 0 || b[0] != '~' {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+		// Caret sorts after the end of the string, but before anything else
+		if (len(a) > 0 && a[0] == '^') || (len(b) > 0 && b[0] == '^') {
+			if len(a) == 0 {
+				return -1
+			}
+			if len(b) == 0 {
+				return 1
+			}
+			if a[0] != '^' {
+				return 1
+			}
+			if b[0] != '^' {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+		if len(a) == 0 || len(b) == 0 {
+			break
+		}
+		// Take a segment of the same type from both strings
+		numeric := isDigit(a[0])
+		segment := func(s string) (string, string) {
+			i := 0
+			for i < len(s) && ((numeric && isDigit(s[i])) || (!numeric && isAlpha(s[i]))) {
+				i++
+			}
+			return s[:i], s[i:]
+		}
+		var segA, segB string
+		segA, a = segment(a)
+		segB, b = segment(b)
+		if segB == "" {
+			// Different types. Numbers are newer than letters
+			if numeric {
+				return 1
+			}
+			return -1
+		}
+		if numeric {
+			segA = strings.TrimLeft(segA, "0")
+			segB = strings.TrimLeft(segB, "0")
+			if len(segA) != len(segB) {
+				return len(segA) - len(segB)
+			}
+		}
+		if c := strings.Compare(segA, segB); c != 0 {
+			return c
+		}
+	}
+	if len(a) == 0 && len(b) == 0 {
+		return 0
+	}
+	// Whichever has something left is newer
+	if len(a) > 0 {
+		return 1
+	}
+	return -1
+}
+
+// compareDpkgVersions compares [epoch:]upstream_version[-debian_revision] like dpkg does
+func compareDpkgVersions(a string, b string) int {
+	epochA, a := splitEpoch(a)
+	epochB, b := splitEpoch(b)
+	if epochA != epochB {
+		return epochA - epochB
+	}
+	upstreamA, revisionA := splitRevision(a)
+	upstreamB, revisionB := splitRevision(b)
+	if c := verrevcmp(upstreamA, upstreamB); c != 0 {
+		return c
+	}
+	return verrevcmp(revisionA, revisionB)
+}
+
+// dpkgOrder gives the sort order of a character in a dpkg version.
+// Letters sort before other characters, and a tilde sorts before anything, even the end.
+func dpkgOrder(s string) int {
+	if len(s) == 0 || isDigit(s[0]) {
+		return 0
+	}
+	c := s[0]
+	switch {
+	case isAlpha(c):
+		return int(c)
+	case c == '~':
+		return -1
+	}
+	return int(c) + 256
+}
+
+// verrevcmp is a port of the function with the same name in dpkg
+func verrevcmp(a string, b string) int {
+	for len(a) > 0 || len(b) > 0 {
+		// Compare the non-digit part
+		for (len(a) > 0 && !isDigit(a[0])) || (len(b) > 0 && !isDigit(b[0])) {
+			ac, bc := dpkgOrder(a), dpkgOrder(b)
+			if ac != bc {
+				return ac - bc
+			}
+			if len(a) > 0 {
+				a = a[1:]
+			}
+			if len(b) > 0 {
+				b = b[1:]
+			}
+		}
+		// Compare the numeric part
+		a = strings.TrimLeft(a, "0")
+		b = strings.TrimLeft(b, "0")
+		firstDiff := 0
+		for len(a) > 0 && isDigit(a[0]) && len(b) > 0 && isDigit(b[0]) {
+			if firstDiff == 0 {
+				firstDiff = int(a[0]) - int(b[0])
+			}
+			a, b = a[1:], b[1:]
+		}
+		if len(a) > 0 && isDigit(a[0]) {
+			return 1
+		}
+		if len(b) > 0 && isDigit(b[0]) {
+			return -1
+		}
+		if firstDiff != 0 {
+			return firstDiff
+		}
+	}
+	return 0
+}
@@ -0,0 +1,192 @@
+package main
+
+// The list of installed packages is extracted from the output of the package managers
+// (dpkg-query, rpm, and the list of installed programs on Windows),
+// and kept in the host_packages table.
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+)
+
+type hostPackage struct {
+	name, version, arch string
+}
+
+// A PackageParser returns the packages that are listed in the output from a package manager
+type PackageParser func(content string) ([]hostPackage, error)
+
+// RegisterPackageParser adds a table parser for files whose name matches the pattern.
+// Source is the name of the package system, e.g. "rpm".
+// It is stored with each package, and used to decide how to compare version numbers.
+// The packages from the source are replaced with the ones in the file.
+func RegisterPackageParser(source string, filenamePattern string, parser PackageParser) {
+	RegisterTableParser(source+"-packages", filenamePattern, []string{"host_packages"},
+		func(content string) (func(tx *sql.Tx, certfp string) error, error) {
+			list, err := parser(content)
+			if err != nil {
+				return nil, err
+			}
+			return func(tx *sql.Tx, certfp string) error {
+				return replaceHostPackages(tx, certfp, source, list)
+			}, nil
+		})
+}
+
+func init() {
+	RegisterPackageParser("dpkg", exactFilename("/usr/bin/dpkg-query -l"), parseDpkgQuery)
+	RegisterPackageParser("rpm", exactFilename(rpmQaCommand), parseRpmQa)
+	RegisterPackageParser("windows", exactFilenameFold("InstalledPrograms"), parseWindowsPrograms)
+}
+
+// replaceHostPackages replaces the packages from the source.
+// Only the differences are written, since the list usually doesn't change much.
+func replaceHostPackages(tx *sql.Tx, certfp string, source string, list []hostPackage) error {
+	rows, err := tx.Query("SELECT name, version, arch FROM host_packages "+
+		"WHERE certfp=$1 AND source=$2", certfp, source)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	existing := make(map[hostPackage]bool)
+	for rows.Next() {
+		var p hostPackage
+		if err = rows.Scan(&p.name, &p.version, &p.arch); err != nil {
+			return err
+		}
+		existing[p] = true
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	seen := make(map[hostPackage]bool, len(list))
+	for _, p := range list {
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		if existing[p] {
+			delete(existing, p)
+			continue
+		}
+		_, err = tx.Exec("INSERT INTO host_packages(certfp,source,name,version,arch) "+
+			"VALUES($1,$2,$3,$4,$5)", certfp, source, p.name, p.version, p.arch)
+		if err != nil {
+			return err
+		}
+	}
+	// Whatever is left wasn't in the new list
+	for p := range existing {
+		_, err = tx.Exec("DELETE FROM host_packages WHERE certfp=$1 AND source=$2 "+
+			"AND name=$3 AND version=$4 AND arch=$5", certfp, source, p.name, p.version, p.arch)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseDpkgQuery parses the output from "dpkg-query -l".
+// Only packages that are installed (status ii or hi) are included.
+func parseDpkgQuery(content string) ([]hostPackage, error) {
+	list := make([]hostPackage, 0)
+	hasArch := false
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(line, "||/") {
+			// The header. Old versions of dpkg don't have the architecture column
+			hasArch = strings.Contains(line, "Architecture")
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 || len(fields[0]) < 2 || len(fields[0]) > 3 || fields[0][1] != 'i' {
+			continue
+		}
+		p := hostPackage{name: fields[1], version: fields[2]}
+		if hasArch && len(fields) >= 4 {
+			p.arch = fields[3]
+		}
+		// Packages for other architectures than the native one are listed as name:arch
+		if i := strings.IndexByte(p.name, ':'); i > 0 {
+			if p.arch == "" {
+				p.arch = p.name[i+1:]
+			}
+			p.name = p.name[:i]
+		}
+		list = append(list, p)
+	}
+	return list, nil
+}
+
+var rpmArchitectures = map[string]bool{
+	"noarch": true, "x86_64": true, "i386": true, "i486": true, "i586": true, "i686": true,
+	"aarch64": true, "armv7hl": true, "ppc64": true, "ppc64le": true, "s390x": true,
+}
+
+// rpmQaCommand lists the installed packages with the epoch, which plain "rpm -qa" leaves out.
+// The epoch is needed to compare the versions with the ones in the advisories.
+// The clients must run exactly this command, since the output is recognized by the name.
+const rpmQaCommand = "/usr/bin/rpm -qa --queryformat '%{NAME}-%{EPOCHNUM}:%{VERSION}-%{RELEASE}.%{ARCH}\\n'"
+
+// parseRpmQa parses the output from rpmQaCommand, where each line is name-epoch:version-release.arch
+func parseRpmQa(content string) ([]hostPackage, error) {
+	list := make([]hostPackage, 0)
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		// Skip empty lines and error messages
+		if line == "" || strings.ContainsAny(line, " \t") {
+			continue
+		}
+		var p hostPackage
+		if i := strings.LastIndexByte(line, '.'); i > 0 && rpmArchitectures[line[i+1:]] {
+			p.arch = line[i+1:]
+			line = line[:i]
+		} else if strings.HasSuffix(line, ".(none)") {
+			// gpg-pubkey has no architecture
+			line = strings.TrimSuffix(line, ".(none)")
+		}
+		// The version and release can't contain dashes, but the name can
+		r := strings.LastIndexByte(line, '-')
+		if r <= 0 {
+			continue
+		}
+		v := strings.LastIndexByte(line[:r], '-')
+		if v <= 0 {
+			continue
+		}
+		// Epoch 0 is the same as no epoch, and is left out like rpm does when it shows versions
+		p.name, p.version = line[:v], strings.TrimPrefix(line[v+1:], "0:")
+		list = append(list, p)
+	}
+	return list, nil
+}
+
+// parseWindowsPrograms parses the list of installed programs from the registry, in JSON format.
+// ConvertTo-Json returns a single object instead of a list if there's only one.
+func parseWindowsPrograms(content string) ([]hostPackage, error) {
+	type program struct {
+		DisplayName    string
+		DisplayVersion string
+	}
+	var programs []program
+	content = strings.TrimSpace(content)
+	if strings.HasPrefix(content, "{") {
+		var single program
+		if err := json.Unmarshal([]byte(content), &single); err != nil {
+			return nil, err
+		}
+		programs = []program{single}
+	} else if err := json.Unmarshal([]byte(content), &programs); err != nil {
+		return nil, err
+	}
+	list := make([]hostPackage, 0, len(programs))
+	for _, prog := range programs {
+		p := hostPackage{name: strings.TrimSpace(prog.DisplayName), version: strings.TrimSpace(prog.DisplayVersion)}
+		if p.name != "" {
+			list = append(list, p)
+		}
+	}
+	return list, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPackageParsers(t *testing.T) {
+	tests := []struct {
+		parser  PackageParser
+		content string
+		expect  []hostPackage
+	}{
+		{
+			parser: parseDpkgQuery,
+			content: `Desired=Unknown/Install/Remove/Purge/Hold
+| Status=Not/Inst/Conf-files/Unpacked/halF-conf/Half-inst/trig-aWait/Trig-pend
+|/ Err?=(none)/Reinst-required (Status,Err: uppercase=bad)
+||/ Name                 Version           Architecture Description
++++-====================-=================-============-===============================
+ii  adduser              3.118ubuntu5      all          add and remove users and groups
+rc  linux-image-5.4.0-42 5.4.0-42.46       amd64        Signed kernel image generic
+ii  libc6:i386           2.31-0ubuntu9.9   i386         GNU C Library: Shared libraries
+hi  openssl              1.1.1f-1ubuntu2.1 amd64        Secure Sockets Layer toolkit
+`,
+			expect: []hostPackage{
+				{"adduser", "3.118ubuntu5", "all"},
+				{"libc6", "2.31-0ubuntu9.9", "i386"},
+				{"openssl", "1.1.1f-1ubuntu2.1", "amd64"},
+			},
+		},
+		{
+			parser: parseRpmQa,
+			content: "bash-0:4.2.46-34.el7.x86_64\n" +
+				"python3-libselinux-0:3.5-1.el9.x86_64\n" +
+				"openssl-1:1.1.1k-7.el8.x86_64\n" +
+				"tzdata-0:2023c-1.el9.noarch\n" +
+				"gpg-pubkey-0:fd431d51-4ae0493b.(none)\n" +
+				"sh: /usr/bin/rpm: No such file or directory\n",
+			expect: []hostPackage{
+				{"bash", "4.2.46-34.el7", "x86_64"},
+				{"python3-libselinux", "3.5-1.el9", "x86_64"},
+				{"openssl", "1:1.1.1k-7.el8", "x86_64"},
+				{"tzdata", "2023c-1.el9", "noarch"},
+				{"gpg-pubkey", "fd431d51-4ae0493b", ""},
+			},
+		},
+		{
+			parser: parseWindowsPrograms,
+			content: `[{"DisplayName": "Mozilla Firefox (x64 en-US)", "DisplayVersion": "118.0.1", "Publisher": "Mozilla"},
+				{"DisplayName": "7-Zip 22.01", "DisplayVersion": "22.01", "Publisher": "Igor Pavlov"}]`,
+			expect: []hostPackage{
+				{"Mozilla Firefox (x64 en-US)", "118.0.1", ""},
+				{"7-Zip 22.01", "22.01", ""},
+			},
+		},
+		{
+			parser:  parseWindowsPrograms,
+			content: `{"DisplayName": "Notepad++", "DisplayVersion": "8.5.7"}`,
+			expect:  []hostPackage{{"Notepad++", "8.5.7", ""}},
+		},
+	}
+	for i, test := range tests {
+		got, err := test.parser(test.content)
+		if err != nil {
+			t.Errorf("Test %d: %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("Test %d:\n got %v\nexpected %v", i, got, test.expect)
+		}
+	}
+	if _, err := parseWindowsPrograms("The term 'Get-ItemProperty' is not recognized"); err == nil {
+		t.Error("Expected an error when the output isn't JSON")
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		source, a, b string
+		expect       int
+	}{
+		{"rpm", "1.0", "1.0", 0},
+		{"rpm", "1.10", "1.9", 1},
+		{"rpm", "1.0-1.el7", "1.0-2.el7", -1},
+		{"rpm", "2.0", "1:1.0", -1},
+		{"rpm", "1.0a", "1.0", 1},
+		{"rpm", "1.0~rc1", "1.0", -1},
+		{"rpm", "1.0^git1", "1.0", 1},
+		{"rpm", "1.0^git1", "1.0.1", -1},
+		{"rpm", "1.1", "1.a", 1},
+		{"rpm", "1.001", "1.1", 0},
+		{"dpkg", "1.1.1f-1ubuntu2.1", "1.1.1f-1ubuntu2", 1},
+		{"dpkg", "1.0~rc1-1", "1.0-1", -1},
+		{"dpkg", "1:0.9", "2.0", 1},
+		{"dpkg", "1.0+dfsg-1", "1.0-1", 1},
+		{"dpkg", "1.0a", "1.0+", -1},
+		{"dpkg", "2.31-0ubuntu9.9", "2.31-0ubuntu9.10", -1},
+		{"windows", "118.0.1", "99.0", 1},
+		{"windows", "22.01", "22.1", 0},
+	}
+	for _, test := range tests {
+		if got := compareVersions(test.source, test.a, test.b); got != test.expect {
+			t.Errorf("compareVersions(%s, %s, %s) = %d, expected %d",
+				test.source, test.a, test.b, got, test.expect)
+		}
+		if got := compareVersions(test.source, test.b, test.a); got != -test.expect {
+			t.Errorf("compareVersions(%s, %s, %s) = %d, expected %d",
+				test.source, test.b, test.a, got, -test.expect)
+		}
+	}
+}
@@ -2,17 +2,14 @@ package main
 
 // Create tasks to parse new files that have been read into the database
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"log"
-	"regexp"
 	"strings"
 	"time"
 
 	"github.com/lib/pq"
-	"golang.org/x/text/cases"
-	"golang.org/x/text/language"
 )
 
 type parseFilesJob struct{}
@@ -28,7 +25,7 @@ func (s parseFilesJob) HowOften() time.Duration {
 	return time.Second * 3
 }
 
-func (s parseFilesJob) Run(db *sql.DB) {
+func (s parseFilesJob) Run(ctx context.Context, db *sql.DB) {
 	rows, err := db.Query("SELECT fileid FROM files WHERE NOT parsed" +
 		" ORDER BY fileid")
 	if err != nil {
@@ -36,7 +33,7 @@ func (s parseFilesJob) Run(db *sql.DB) {
 	}
 	defer rows.Close()
 	concurrent := make(chan bool, 8)
-	for rows.Next() {
+	for rows.Next() && ctx.Err() == nil {
 		var fileid sql.NullInt64
 		rows.Scan(&fileid)
 		if fileid.Valid {
@@ -147,320 +144,49 @@ func parseFile(database *sql.DB, fileID int64) {
 
 	parseCustomFields(tx, certfp.String, filename.String, content.String)
 
-	if filename.String == "/etc/redhat-release" {
-		var os, osEdition string
-		rhel := regexp.MustCompile("^Red Hat Enterprise Linux (\\w+)" +
-			".*(Tikanga|Santiago|Maipo|Ootpa|Plow|Coughlan)")
-		m := rhel.FindStringSubmatch(content.String)
-		if m != nil {
-			osEdition = m[1]
-			switch m[2] {
-			case "Tikanga":
-				os = "RHEL 5"
-			case "Santiago":
-				os = "RHEL 6"
-			case "Maipo":
-				os = "RHEL 7"
-			case "Ootpa":
-				os = "RHEL 8"
-				osEdition = "" // RHEL 8 doesn't come in workstation+server editions like the previous versions
-			case "Plow":
-				os = "RHEL 9"
-				osEdition = ""
-			case "Coughlan":
-				os = "RHEL 10"
-				osEdition = ""
-			}
-		} else {
-			fedora := regexp.MustCompile(`^Fedora release (\d+)`)
-			m = fedora.FindStringSubmatch(content.String)
-			if m != nil {
-				os = "Fedora " + m[1]
-			} else {
-				centos := regexp.MustCompile(`^CentOS Linux release (\d+)`)
-				m = centos.FindStringSubmatch(content.String)
-				if m != nil {
-					os = "CentOS " + m[1]
-				} else {
-					alma := regexp.MustCompile(`^AlmaLinux release (\d+)`)
-					m = alma.FindStringSubmatch(content.String)
-					if m != nil {
-						os = "AlmaLinux " + m[1]
-					}
-				}
-			}
-		}
-		if os != "" && osEdition != "" {
-			_, err = tx.Exec("UPDATE hostinfo SET os=$1, os_edition=$2, os_family='Linux' "+
-				"WHERE certfp=$3", os, osEdition, certfp.String)
-		} else if os != "" {
-			_, err = tx.Exec("UPDATE hostinfo SET os=$1, os_family='Linux' WHERE certfp=$2",
-				os, certfp.String)
-		}
-		return
-	}
-
-	edition := regexp.MustCompile("/usr/lib/os.release.d/os-release-([a-z]+)")
-	if m := edition.FindStringSubmatch(filename.String); m != nil {
-		_, err = tx.Exec("UPDATE hostinfo SET os_edition=$1 WHERE certfp=$2",
-			cases.Title(language.Und).String(m[1]), certfp.String)
-		return
-	}
-
-	if filename.String == "/usr/bin/dpkg-query -l" {
-		ubuntuEdition := regexp.MustCompile("ubuntu-(desktop|server)")
-		if m := ubuntuEdition.FindStringSubmatch(content.String); m != nil {
-			_, err = tx.Exec("UPDATE hostinfo SET os_edition=$1 WHERE certfp=$2",
-				cases.Title(language.Und).String(m[1]), certfp.String)
-		}
-		return
-	}
-
-	if filename.String == "/etc/debian_version" {
-		re := regexp.MustCompile(`^(\d+)\.`)
-		if m := re.FindStringSubmatch(content.String); m != nil {
-			_, err = tx.Exec("UPDATE hostinfo SET os=$1, os_family='Linux' WHERE certfp=$2",
-				"Debian "+m[1], certfp.String)
-		}
-		return
-	}
-
-	if filename.String == "/etc/lsb-release" {
-		re := regexp.MustCompile(`DISTRIB_ID=Ubuntu\nDISTRIB_RELEASE=(\d+)\.(\d+)`)
-		if m := re.FindStringSubmatch(content.String); m != nil {
-			_, err = tx.Exec("UPDATE hostinfo SET os=$1, os_family='Linux' WHERE certfp=$2",
-				fmt.Sprintf("Ubuntu %s.%s", m[1], m[2]), certfp.String)
-		}
-		return
-	}
-
-	if filename.String == "/usr/bin/sw_vers" {
-		re := regexp.MustCompile(`ProductName:\s+(Mac OS X|macOS)\nProductVersion:\s+(\d+\.\d+)`)
-		if m := re.FindStringSubmatch(content.String); m != nil {
-			_, err = tx.Exec("UPDATE hostinfo SET os=$1, os_edition=null, os_family='macOS' "+
-				"WHERE certfp=$2", "macOS "+m[2], certfp.String)
-		}
-		return
-	}
-
-	if strings.EqualFold(filename.String, "(Get-WmiObject Win32_OperatingSystem).Caption") {
-		reWinX := regexp.MustCompile(`Microsoft Windows (\d+) (\w*)`)
-		reWinServer := regexp.MustCompile(`Microsoft®? Windows Server®? (\d+)( R2)?`)
-		if m := reWinX.FindStringSubmatch(content.String); m != nil {
-			_, err = tx.Exec("UPDATE hostinfo SET os=$1, os_edition=$2, os_family='Windows' "+
-				"WHERE certfp=$3", "Windows "+m[1], m[2], certfp.String)
-		} else if m := reWinServer.FindStringSubmatch(content.String); m != nil {
-			_, err = tx.Exec("UPDATE hostinfo SET os=$1, os_edition='Server', os_family='Windows' "+
-				"WHERE certfp=$2", fmt.Sprintf("Windows %s%s", m[1], m[2]),
-				certfp.String)
-		}
-		return
-	}
-
-	if filename.String == "/bin/uname -a" || filename.String == "/usr/bin/uname -a" {
-		re := regexp.MustCompile(`(\S+) \S+ (\S+)`)
-		if m := re.FindStringSubmatch(content.String); m != nil {
-			os := m[1]
-			kernel := m[2]
-			if os == "FreeBSD" {
-				m = regexp.MustCompile(`^(\d+)`).FindStringSubmatch(kernel)
-				if m != nil {
-					os = "FreeBSD " + m[1]
-				}
-				_, err = tx.Exec("UPDATE hostinfo SET os=$1, os_edition=null, os_family='FreeBSD', "+
-					"kernel=$2 WHERE certfp=$3", os, kernel, certfp.String)
-			} else if os == "Darwin" {
-				_, err = tx.Exec("UPDATE hostinfo SET os_edition=null, os_family='macOS', kernel=$1 "+
-					"WHERE certfp=$2", kernel, certfp.String)
-			} else {
-				_, err = tx.Exec("UPDATE hostinfo SET kernel=$1 "+
-					"WHERE certfp=$2", kernel, certfp.String)
-			}
-		}
-		return
-	}
-
-	if filename.String == "/bin/uname -r" {
-		kernel := strings.TrimSpace(strings.SplitN(content.String, "\n", 2)[0])
-		_, err = tx.Exec("UPDATE hostinfo SET kernel=$1 "+
-			"WHERE certfp=$2", kernel, certfp.String)
-		return
-	}
-
-	if filename.String == "/usr/sbin/dmidecode -t system" {
-		var manufacturer, product, serial sql.NullString
-		if m := regexp.MustCompile(`Manufacturer: (.*)`).
-			FindStringSubmatch(content.String); m != nil {
-			manufacturer.String = strings.TrimSpace(m[1])
-			manufacturer.String = cases.Title(language.Und).String(strings.ToLower(manufacturer.String))
-			manufacturer.Valid = len(manufacturer.String) > 0
-		}
-		if m := regexp.MustCompile(`Product Name: (.*)`).
-			FindStringSubmatch(content.String); m != nil {
-			product.String = strings.TrimSpace(m[1])
-			product.String = cases.Title(language.Und).String(strings.ToLower(product.String))
-			product.Valid = len(product.String) > 0
-		}
-		if m := regexp.MustCompile(`Serial Number: (.*)`).
-			FindStringSubmatch(content.String); m != nil {
-			serial.String = m[1]
-			serial.Valid = len(serial.String) > 0
-		}
-		_, err = tx.Exec("UPDATE hostinfo SET manufacturer=$1,product=$2,serialno=$3 "+
-			"WHERE certfp=$4", manufacturer, product, serial, certfp.String)
-		return
-	}
-
-	if filename.String == "/usr/sbin/system_profiler SPHardwareDataType" ||
-		filename.String == "/etc/uio/info/hardware-info.txt" /* deprecated file */ {
-		var product, serial sql.NullString
-		if m := regexp.MustCompile(`Model Name: (.*)`).
-			FindStringSubmatch(content.String); m != nil {
-			product.String = strings.TrimSpace(m[1])
-			product.Valid = len(product.String) > 0
-		}
-		if m := regexp.MustCompile(`Serial Number \(system\): (.*)`).
-			FindStringSubmatch(content.String); m != nil {
-			serial.String = m[1]
-			serial.Valid = len(serial.String) > 0
-		}
-		_, err = tx.Exec("UPDATE hostinfo SET manufacturer='Apple',product=$1,serialno=$2 "+
-			"WHERE certfp=$3", product, serial, certfp.String)
-		return
-	}
-
-	if filename.String == "/bin/freebsd-version -ku" {
-		if m := regexp.MustCompile(`(\d+)\.(\d+)-RELEASE`).
-			FindStringSubmatch(content.String); m != nil {
-			_, err = tx.Exec("UPDATE hostinfo SET os=$1, os_family='FreeBSD' WHERE certfp=$2",
-				fmt.Sprintf("FreeBSD %s", m[1]), certfp.String)
-		}
-		return
-	}
-
-	if strings.EqualFold(filename.String,
-		"Get-WmiObject Win32_computersystemproduct|Select Name,Vendor|ConvertTo-Json") {
-		m := make(map[string]interface{})
-		err = json.Unmarshal([]byte(content.String), &m)
-		if err == nil {
-			manufacturer, product := "", ""
-			for k, v := range m {
-				switch strings.ToLower(k) {
-				case "vendor":
-					manufacturer, _ = v.(string)
-				case "name":
-					product, _ = v.(string)
-				}
-			}
-			_, err = tx.Exec("UPDATE hostinfo SET manufacturer=$1,product=$2 "+
-				"WHERE certfp=$3", manufacturer, product, certfp.String)
-		} else {
-			// If the JSON parsing fails, it's not going to change
-			// (the file contents will stay the same).
-			// Log the message and set err=nil here, so the system
-			// won't re-try parsing this file.
-			log.Printf("Error while parsing JSON from file %d: %s", fileID, err)
-			err = nil
-		}
+	// Let the registered parsers fill in the hostinfo columns
+	err = runFileParsers(tx, certfp.String, filename.String, content.String)
+	if err != nil {
 		return
 	}
 
-	if strings.EqualFold(filename.String,
-		"Get-WmiObject Win32_bios|Select smbiosbiosversion,manufacturer,name,serialnumber,version|ConvertTo-Json") {
-		m := make(map[string]interface{})
-		err = json.Unmarshal([]byte(content.String), &m)
-		if err == nil {
-			serial := ""
-			for k, v := range m {
-				if strings.ToLower(k) == "serialnumber" {
-					serial, _ = v.(string)
-				}
-			}
-			_, err = tx.Exec("UPDATE hostinfo SET serialno=$1 WHERE certfp=$2", serial, certfp.String)
-		} else {
-			log.Printf("Error while parsing JSON from file %d: %s", fileID, err)
-			err = nil
+	// The table parsers fill in e.g. the package and device lists.
+	// Old versions of the files shouldn't replace the current lists.
+	if isCurrent.Bool {
+		err = runTableParsers(tx, certfp.String, filename.String, content.String)
+		if err != nil {
+			return
 		}
-		return
 	}
 
-	if strings.EqualFold(filename.String, "[System.Environment]::OSVersion|ConvertTo-Json") {
-		m := make(map[string]interface{})
-		err = json.Unmarshal([]byte(content.String), &m)
-		if err == nil {
-			v, ok := m["VersionString"]
-			if ok {
-				str, ok := v.(string)
-				if ok {
-					re := regexp.MustCompile(`([\d\.]+)`)
-					m := re.FindStringSubmatch(str)
-					if m != nil {
-						_, err = tx.Exec("UPDATE hostinfo SET kernel=$1 WHERE certfp=$2", m[1], certfp.String)
-					}
-				}
-			}
-		} else {
-			log.Printf("Error while parsing JSON from file %d: %s", fileID, err)
-			err = nil
-		}
-	}
+	// The computed fields may depend on anything that was changed above
+	err = updateComputedFields(tx, certfp.String)
 }
 
 func parseCustomFields(tx *sql.Tx, certfp string, filename string, content string) {
-	// Custom fields
-	rows, err := tx.Query("SELECT fieldID, name, regexp FROM customfields "+
-		"WHERE $1 LIKE filename", filename)
-	if err != nil {
-		log.Panic(err)
-	}
-	defer rows.Close()
-	type Item struct {
-		fieldID int
-		value   string
-	}
-	// The reason for these arrays is that I want to close the result set before
+	// The fields are read into a list first, because I want to close the result set before
 	// starting a new database query, in order to only use 1 database connection.
 	// The unit tests depend on it, because they run on a temp schema.
-	found := make([]Item, 0)
-	notfound := make([]Item, 0)
-	for rows.Next() {
-		var fieldID int
-		var name, regexpStr sql.NullString
-		err = rows.Scan(&fieldID, &name, &regexpStr)
-		if err != nil {
-			log.Println(err)
-			break
-		}
-		re, err := regexp.Compile("(?m)" + regexpStr.String)
-		if err != nil {
-			notfound = append(notfound, Item{fieldID: fieldID})
-			continue
-		}
-		match := re.FindStringSubmatch(content)
-		if len(match) < 2 { // if match is nil, len(match) is 0
-			notfound = append(notfound, Item{fieldID: fieldID})
-			continue
-		}
-		found = append(found, Item{
-			fieldID: fieldID,
-			value:   match[1],
-		})
-	}
-	if err := rows.Err(); err != nil {
+	fields, err := loadCustomFields(tx, "$1 LIKE filename", filename)
+	if err != nil {
 		log.Panic(err)
 	}
-	rows.Close()
-	for _, item := range notfound {
-		_, err := tx.Exec("DELETE FROM hostinfo_customfields "+
-			"WHERE certfp=$1 AND fieldid=$2", certfp, item.fieldID)
+	for _, f := range fields {
+		value, err := f.extract(content)
 		if err != nil {
-			log.Panic(err)
+			if err != errNoMatch {
+				log.Printf("Custom field %s in %s from %s: %s", f.name, filename, certfp, err)
+			}
+			_, err = tx.Exec("DELETE FROM hostinfo_customfields "+
+				"WHERE certfp=$1 AND fieldid=$2", certfp, f.fieldID)
+			if err != nil {
+				log.Panic(err)
+			}
+			continue
 		}
-	}
-	for _, item := range found {
 		res, err := tx.Exec("UPDATE hostinfo_customfields SET value=$1 "+
 			"WHERE certfp=$2 AND fieldid=$3",
-			item.value, certfp, item.fieldID)
+			value, certfp, f.fieldID)
 		if err != nil {
 			log.Panic(err)
 		}
@@ -471,7 +197,7 @@ func parseCustomFields(tx *sql.Tx, certfp string, filename string, content strin
 		}
 		if rowsAffected == 0 {
 			tx.Exec("INSERT INTO hostinfo_customfields(certfp,fieldid,value) "+
-				"VALUES($1,$2,$3)", certfp, item.fieldID, item.value)
+				"VALUES($1,$2,$3)", certfp, f.fieldID, value)
 		}
 	}
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"os"
 	"testing"
@@ -44,7 +45,7 @@ func TestParseFilesLinux(t *testing.T) {
 
 	// run the parseFiles Job
 	job := parseFilesJob{}
-	job.Run(db)
+	job.Run(context.Background(), db)
 
 	// verify the results
 	var kernel, manufacturer, product, serial sql.NullString
@@ -147,7 +148,7 @@ func TestParseFilesWindows(t *testing.T) {
 
 	// run the parseFiles Job
 	job := parseFilesJob{}
-	job.Run(db)
+	job.Run(context.Background(), db)
 
 	// verify the results
 	var kernel, manufacturer, product, serial, edition sql.NullString
@@ -236,7 +237,7 @@ func TestParseFilesMacOS(t *testing.T) {
 
 	// run the parseFiles Job
 	job := parseFilesJob{}
-	job.Run(db)
+	job.Run(context.Background(), db)
 
 	// verify the results
 	var kernel, manufacturer, product, serial sql.NullString
@@ -401,6 +402,64 @@ BuildVersion:	20D74`,
 	}
 }
 
+func TestOSReleasePrecedence(t *testing.T) {
+	if os.Getenv("NOPOSTGRES") != "" {
+		t.Log("No Postgres, skipping test")
+		return
+	}
+	db := getDBconnForTesting(t)
+	defer db.Close()
+
+	const osRelease = "NAME=\"AlmaLinux\"\nID=\"almalinux\"\nVERSION_ID=\"9.2\"\n"
+	const redhatRelease = "AlmaLinux release 8.6 (Sky Tiger)"
+	type file struct {
+		filename, content string
+	}
+	tests := []struct {
+		certfp string
+		files  []file
+	}{
+		// os-release wins if it arrives first...
+		{"AA", []file{{"/etc/os-release", osRelease}, {"/etc/redhat-release", redhatRelease}}},
+		// ...and if it arrives last
+		{"BB", []file{{"/etc/redhat-release", redhatRelease}, {"/etc/os-release", osRelease}}},
+	}
+	fileID := 20000
+	for _, test := range tests {
+		for _, f := range test.files {
+			fileID++
+			_, err := db.Exec("INSERT INTO files(fileid,certfp,filename,content,received) "+
+				"VALUES($1,$2,$3,$4,now())", fileID, test.certfp, f.filename, f.content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parseFile(db, int64(fileID))
+		}
+		var os sql.NullString
+		err := db.QueryRow("SELECT os FROM hostinfo WHERE certfp=$1", test.certfp).Scan(&os)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if os.String != "AlmaLinux 9" {
+			t.Errorf("Host %s: OS is %s, expected AlmaLinux 9", test.certfp, os.String)
+		}
+	}
+
+	// A legacy file can still set columns that os-release doesn't know about
+	fileID++
+	_, err := db.Exec("INSERT INTO files(fileid,certfp,filename,content,received) "+
+		"VALUES($1,'AA','/usr/lib/os.release.d/os-release-server','',now())", fileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parseFile(db, int64(fileID))
+	var edition sql.NullString
+	db.QueryRow("SELECT os_edition FROM hostinfo WHERE certfp='AA'").Scan(&edition)
+	if edition.String != "Server" {
+		t.Errorf("os_edition is %s, expected Server", edition.String)
+	}
+}
+
 const dmiDecodeOutput = `# dmidecode 3.1
 Getting SMBIOS data from sysfs.
 SMBIOS 2.7 present.
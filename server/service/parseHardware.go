@@ -0,0 +1,288 @@
+package main
+
+// Parsers that find the manufacturer, product name and serial number of the machine,
+// and the processor and amount of memory
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+)
+
+func init() {
+	RegisterFileParser("dmidecode", exactFilename("/usr/sbin/dmidecode -t system"), 0,
+		[]string{"manufacturer", "product", "serialno"}, FileParserFunc(parseDmidecode))
+	RegisterFileParser("system_profiler",
+		`^(/usr/sbin/system_profiler SPHardwareDataType|/etc/uio/info/hardware-info\.txt)$`, 0,
+		[]string{"manufacturer", "product", "serialno", "cpu_model", "cpu_sockets", "cpu_cores", "memory_mb"},
+		FileParserFunc(parseSystemProfiler))
+	RegisterFileParser("windows-computersystemproduct",
+		exactFilenameFold("Get-WmiObject Win32_computersystemproduct|Select Name,Vendor|ConvertTo-Json"), 0,
+		[]string{"manufacturer", "product"}, FileParserFunc(parseWindowsComputerSystemProduct))
+	RegisterFileParser("windows-bios",
+		exactFilenameFold("Get-WmiObject Win32_bios|Select smbiosbiosversion,manufacturer,name,serialnumber,version|ConvertTo-Json"), 0,
+		[]string{"serialno"}, FileParserFunc(parseWindowsBios))
+	RegisterFileParser("dmidecode-processor", exactFilename("/usr/sbin/dmidecode -t processor"), 0,
+		[]string{"cpu_model", "cpu_sockets", "cpu_cores"}, FileParserFunc(parseDmidecodeProcessor))
+	RegisterFileParser("dmidecode-memory", exactFilename("/usr/sbin/dmidecode -t memory"), 0,
+		[]string{"memory_mb"}, FileParserFunc(parseDmidecodeMemory))
+	RegisterFileParser("windows-processor",
+		exactFilenameFold("Get-WmiObject Win32_processor|select caption,deviceid,manufacturer,maxclockspeed,name,socketdesignation|ConvertTo-Json"), 0,
+		[]string{"cpu_model", "cpu_sockets"}, FileParserFunc(parseWindowsProcessor))
+	RegisterFileParser("windows-physicalmemory",
+		exactFilenameFold("Get-WmiObject Win32_physicalmemory|select manufacturer,partnumber,serialnumber,devicelocator,speed,capacity|ConvertTo-Json"), 0,
+		[]string{"memory_mb"}, FileParserFunc(parseWindowsPhysicalMemory))
+}
+
+var reDmiManufacturer = regexp.MustCompile(`Manufacturer: (.*)`)
+var reDmiProduct = regexp.MustCompile(`Product Name: (.*)`)
+var reDmiSerial = regexp.MustCompile(`Serial Number: (.*)`)
+
+func parseDmidecode(filename string, content string) (map[string]interface{}, error) {
+	var manufacturer, product, serial string
+	if m := reDmiManufacturer.FindStringSubmatch(content); m != nil {
+		manufacturer = cases.Title(language.Und).String(strings.ToLower(strings.TrimSpace(m[1])))
+	}
+	if m := reDmiProduct.FindStringSubmatch(content); m != nil {
+		product = cases.Title(language.Und).String(strings.ToLower(strings.TrimSpace(m[1])))
+	}
+	if m := reDmiSerial.FindStringSubmatch(content); m != nil {
+		serial = m[1]
+	}
+	return map[string]interface{}{
+		"manufacturer": nullIfEmpty(manufacturer),
+		"product":      nullIfEmpty(product),
+		"serialno":     nullIfEmpty(serial),
+	}, nil
+}
+
+var reAppleModel = regexp.MustCompile(`Model Name: (.*)`)
+var reAppleSerial = regexp.MustCompile(`Serial Number \(system\): (.*)`)
+
+// Intel Macs have "Processor Name", Apple silicon has "Chip"
+var reAppleCPU = regexp.MustCompile(`(?:Processor Name|Chip): (.*)`)
+var reAppleSockets = regexp.MustCompile(`Number of Processors: (\d+)`)
+var reAppleCores = regexp.MustCompile(`Total Number of Cores: (\d+)`)
+var reAppleMemory = regexp.MustCompile(`Memory: (\d+) ([KMGT]B)`)
+
+func parseSystemProfiler(filename string, content string) (map[string]interface{}, error) {
+	var product, serial, cpu string
+	var sockets, cores, memory int64
+	if m := reAppleModel.FindStringSubmatch(content); m != nil {
+		product = strings.TrimSpace(m[1])
+	}
+	if m := reAppleSerial.FindStringSubmatch(content); m != nil {
+		serial = m[1]
+	}
+	if m := reAppleCPU.FindStringSubmatch(content); m != nil {
+		cpu = strings.TrimSpace(m[1])
+	}
+	if m := reAppleSockets.FindStringSubmatch(content); m != nil {
+		sockets, _ = strconv.ParseInt(m[1], 10, 64)
+	} else if cpu != "" {
+		sockets = 1
+	}
+	if m := reAppleCores.FindStringSubmatch(content); m != nil {
+		cores, _ = strconv.ParseInt(m[1], 10, 64)
+	}
+	if m := reAppleMemory.FindStringSubmatch(content); m != nil {
+		memory = memorySizeToMB(m[1], m[2])
+	}
+	return map[string]interface{}{
+		"manufacturer": "Apple",
+		"product":      nullIfEmpty(product),
+		"serialno":     nullIfEmpty(serial),
+		"cpu_model":    nullIfEmpty(cpu),
+		"cpu_sockets":  nullIfZero(sockets),
+		"cpu_cores":    nullIfZero(cores),
+		"memory_mb":    nullIfZero(memory),
+	}, nil
+}
+
+func parseWindowsComputerSystemProduct(filename string, content string) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(content), &m); err != nil {
+		return nil, err
+	}
+	manufacturer, product := "", ""
+	for k, v := range m {
+		switch strings.ToLower(k) {
+		case "vendor":
+			manufacturer, _ = v.(string)
+		case "name":
+			product, _ = v.(string)
+		}
+	}
+	return map[string]interface{}{"manufacturer": manufacturer, "product": product}, nil
+}
+
+func parseWindowsBios(filename string, content string) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(content), &m); err != nil {
+		return nil, err
+	}
+	serial := ""
+	for k, v := range m {
+		if strings.ToLower(k) == "serialnumber" {
+			serial, _ = v.(string)
+		}
+	}
+	return map[string]interface{}{"serialno": serial}, nil
+}
+
+var reSpaces = regexp.MustCompile(`\s+`)
+
+// parseDmidecodeProcessor counts the populated sockets and the total number of cores,
+// and uses the version string of the first processor as the model name.
+func parseDmidecodeProcessor(filename string, content string) (map[string]interface{}, error) {
+	var model string
+	var sockets, cores int64
+	for _, section := range dmiSections(content, "Processor Information") {
+		if status := section["Status"]; !strings.HasPrefix(status, "Populated") {
+			continue
+		}
+		sockets++
+		if model == "" {
+			model = reSpaces.ReplaceAllString(section["Version"], " ")
+		}
+		if n, err := strconv.ParseInt(section["Core Count"], 10, 64); err == nil {
+			cores += n
+		}
+	}
+	return map[string]interface{}{
+		"cpu_model":   nullIfEmpty(model),
+		"cpu_sockets": nullIfZero(sockets),
+		"cpu_cores":   nullIfZero(cores),
+	}, nil
+}
+
+// parseDmidecodeMemory adds up the size of the installed memory modules
+func parseDmidecodeMemory(filename string, content string) (map[string]interface{}, error) {
+	var total int64
+	for _, section := range dmiSections(content, "Memory Device") {
+		// e.g. "16384 MB", "16 GB" or "No Module Installed"
+		f := strings.Fields(section["Size"])
+		if len(f) != 2 {
+			continue
+		}
+		total += memorySizeToMB(f[0], f[1])
+	}
+	return map[string]interface{}{"memory_mb": nullIfZero(total)}, nil
+}
+
+// dmiSections returns the key/value pairs of each section in the output from dmidecode
+// that has the given title. Sections are separated by blank lines, and the title is
+// the first line after the "Handle" line.
+func dmiSections(content string, title string) []map[string]string {
+	result := make([]map[string]string, 0)
+	var current map[string]string
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimRight(line, " \r")
+		if line == "" {
+			current = nil
+			continue
+		}
+		if line == title {
+			current = make(map[string]string)
+			result = append(result, current)
+			continue
+		}
+		if current == nil || !strings.HasPrefix(line, "\t") {
+			continue
+		}
+		if i := strings.Index(line, ": "); i > 0 {
+			current[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+2:])
+		}
+	}
+	return result
+}
+
+func parseWindowsProcessor(filename string, content string) (map[string]interface{}, error) {
+	list, err := unmarshalWmiList(content)
+	if err != nil {
+		return nil, err
+	}
+	var model string
+	for _, m := range list {
+		for k, v := range m {
+			if strings.ToLower(k) == "name" && model == "" {
+				model, _ = v.(string)
+				model = strings.TrimSpace(model)
+			}
+		}
+	}
+	return map[string]interface{}{
+		"cpu_model":   nullIfEmpty(model),
+		"cpu_sockets": nullIfZero(int64(len(list))),
+	}, nil
+}
+
+func parseWindowsPhysicalMemory(filename string, content string) (map[string]interface{}, error) {
+	list, err := unmarshalWmiList(content)
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	for _, m := range list {
+		for k, v := range m {
+			if strings.ToLower(k) == "capacity" {
+				total += jsonNumberToInt64(v)
+			}
+		}
+	}
+	return map[string]interface{}{"memory_mb": nullIfZero(total / (1024 * 1024))}, nil
+}
+
+// unmarshalWmiList parses the output from ConvertTo-Json, which is an object
+// if there's only one item, and a list otherwise.
+func unmarshalWmiList(content string) ([]map[string]interface{}, error) {
+	content = strings.TrimSpace(content)
+	if strings.HasPrefix(content, "{") {
+		m := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(content), &m); err != nil {
+			return nil, err
+		}
+		return []map[string]interface{}{m}, nil
+	}
+	list := make([]map[string]interface{}, 0)
+	if err := json.Unmarshal([]byte(content), &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// jsonNumberToInt64 accepts both numbers and numbers in strings,
+// since different versions of the tools output either.
+func jsonNumberToInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case float64:
+		return int64(n)
+	case string:
+		i, _ := strconv.ParseInt(strings.TrimSpace(n), 10, 64)
+		return i
+	}
+	return 0
+}
+
+// memorySizeToMB converts a size like "16 GB" to megabytes. Unknown units give 0.
+func memorySizeToMB(number string, unit string) int64 {
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil {
+		return 0
+	}
+	switch strings.ToUpper(unit) {
+	case "KB":
+		return n / 1024
+	case "MB":
+		return n
+	case "GB":
+		return n * 1024
+	case "TB":
+		return n * 1024 * 1024
+	}
+	return 0
+}
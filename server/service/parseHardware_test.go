@@ -0,0 +1,134 @@
+package main
+
+import "testing"
+
+func TestHardwareParsers(t *testing.T) {
+	testFileParsers(t, []fileParserTest{
+		{
+			filename: "/usr/sbin/dmidecode -t system",
+			content:  dmiDecodeOutput,
+			expect: map[string]interface{}{"manufacturer": "Dell Inc.",
+				"product": "Latitude E7240", "serialno": "AFK5678"},
+		},
+		{
+			filename: "/usr/sbin/dmidecode -t system",
+			content:  "# No SMBIOS nor DMI entry point found, sorry.",
+			expect:   map[string]interface{}{"manufacturer": nil, "product": nil, "serialno": nil},
+		},
+		{
+			filename: "/usr/sbin/system_profiler SPHardwareDataType",
+			content: "Hardware:\n\n    Hardware Overview:\n\n      Model Name: MacBook Pro\n" +
+				"      Serial Number (system): C02ABCDEFGH\n",
+			expect: map[string]interface{}{"manufacturer": "Apple",
+				"product": "MacBook Pro", "serialno": "C02ABCDEFGH", "cpu_model": nil,
+				"cpu_sockets": nil, "cpu_cores": nil, "memory_mb": nil},
+		},
+		{
+			filename: "/usr/sbin/system_profiler SPHardwareDataType",
+			content: "      Model Name: MacBook Air\n      Chip: Apple M1\n" +
+				"      Total Number of Cores: 8 (4 performance and 4 efficiency)\n      Memory: 16 GB\n",
+			expect: map[string]interface{}{"manufacturer": "Apple",
+				"product": "MacBook Air", "serialno": nil, "cpu_model": "Apple M1",
+				"cpu_sockets": int64(1), "cpu_cores": int64(8), "memory_mb": int64(16384)},
+		},
+		{
+			filename: "/etc/uio/info/hardware-info.txt",
+			content:  "Model Name: iMac\n",
+			expect: map[string]interface{}{"manufacturer": "Apple", "product": "iMac", "serialno": nil,
+				"cpu_model": nil, "cpu_sockets": nil, "cpu_cores": nil, "memory_mb": nil},
+		},
+		{
+			filename: "Get-WmiObject Win32_computersystemproduct|Select Name,Vendor|ConvertTo-Json",
+			content:  `{"Name": "HP EliteBook 840 G5", "Vendor": "HP"}`,
+			expect:   map[string]interface{}{"manufacturer": "HP", "product": "HP EliteBook 840 G5"},
+		},
+		{
+			filename: "Get-WmiObject Win32_bios|Select smbiosbiosversion,manufacturer,name,serialnumber,version|ConvertTo-Json",
+			content:  `{"SerialNumber": "5CG1234XYZ", "Manufacturer": "HP"}`,
+			expect:   map[string]interface{}{"serialno": "5CG1234XYZ"},
+		},
+		{
+			filename: "get-wmiobject win32_bios|select smbiosbiosversion,manufacturer,name,serialnumber,version|convertto-json",
+			content:  `not json`,
+		},
+		{
+			filename: "/usr/sbin/dmidecode -t processor",
+			content:  dmiDecodeProcessorOutput,
+			expect: map[string]interface{}{"cpu_model": "Intel(R) Xeon(R) Gold 6130 CPU @ 2.10GHz",
+				"cpu_sockets": int64(2), "cpu_cores": int64(32)},
+		},
+		{
+			filename: "/usr/sbin/dmidecode -t memory",
+			content:  dmiDecodeMemoryOutput,
+			expect:   map[string]interface{}{"memory_mb": int64(24576)},
+		},
+		{
+			filename: "/usr/sbin/dmidecode -t memory",
+			content:  "# No SMBIOS nor DMI entry point found, sorry.",
+			expect:   map[string]interface{}{"memory_mb": nil},
+		},
+		{
+			filename: "Get-WmiObject Win32_processor|select caption,deviceid,manufacturer,maxclockspeed,name,socketdesignation|ConvertTo-Json",
+			content:  `{"Name": "Intel(R) Core(TM) i7-8650U CPU @ 1.90GHz", "DeviceID": "CPU0"}`,
+			expect: map[string]interface{}{"cpu_model": "Intel(R) Core(TM) i7-8650U CPU @ 1.90GHz",
+				"cpu_sockets": int64(1)},
+		},
+		{
+			filename: "Get-WmiObject Win32_physicalmemory|select manufacturer,partnumber,serialnumber,devicelocator,speed,capacity|ConvertTo-Json",
+			content:  `[{"Capacity": 8589934592}, {"Capacity": "8589934592"}]`,
+			expect:   map[string]interface{}{"memory_mb": int64(16384)},
+		},
+	})
+}
+
+const dmiDecodeProcessorOutput = `# dmidecode 3.2
+Getting SMBIOS data from sysfs.
+SMBIOS 3.0.0 present.
+
+Handle 0x0400, DMI type 4, 48 bytes
+Processor Information
+	Socket Designation: CPU1
+	Type: Central Processor
+	Version: Intel(R) Xeon(R) Gold 6130 CPU @ 2.10GHz
+	Status: Populated, Enabled
+	Core Count: 16
+	Thread Count: 32
+
+Handle 0x0401, DMI type 4, 48 bytes
+Processor Information
+	Socket Designation: CPU2
+	Version: Intel(R) Xeon(R) Gold 6130 CPU @ 2.10GHz
+	Status: Populated, Enabled
+	Core Count: 16
+
+Handle 0x0402, DMI type 4, 48 bytes
+Processor Information
+	Socket Designation: CPU3
+	Version: Not Specified
+	Status: Unpopulated
+`
+
+const dmiDecodeMemoryOutput = `# dmidecode 3.2
+SMBIOS 3.0.0 present.
+
+Handle 0x1000, DMI type 16, 23 bytes
+Physical Memory Array
+	Maximum Capacity: 1536 GB
+	Number Of Devices: 3
+
+Handle 0x1100, DMI type 17, 84 bytes
+Memory Device
+	Size: 16 GB
+	Locator: A1
+	Volatile Size: 16 GB
+
+Handle 0x1101, DMI type 17, 84 bytes
+Memory Device
+	Size: 8192 MB
+	Locator: A2
+
+Handle 0x1102, DMI type 17, 84 bytes
+Memory Device
+	Size: No Module Installed
+	Locator: A3
+`
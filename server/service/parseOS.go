@@ -0,0 +1,346 @@
+package main
+
+// Parsers that detect the operating system and kernel version
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+)
+
+// os-release is the standard way for Linux distributions to identify themselves,
+// so it takes precedence over the older distribution-specific files
+const osReleasePriority = 10
+
+func init() {
+	RegisterFileParser("os-release", exactFilename("/etc/os-release"), osReleasePriority,
+		[]string{"os", "os_edition", "os_family"}, FileParserFunc(parseOSRelease))
+	RegisterFileParser("redhat-release", exactFilename("/etc/redhat-release"), 0,
+		[]string{"os", "os_edition", "os_family"}, FileParserFunc(parseRedhatRelease))
+	RegisterFileParser("os-release-edition", `^/usr/lib/os.release.d/os-release-([a-z]+)`, 0,
+		[]string{"os_edition"}, FileParserFunc(parseOSReleaseEdition))
+	RegisterFileParser("ubuntu-edition", exactFilename("/usr/bin/dpkg-query -l"), 0,
+		[]string{"os_edition"}, FileParserFunc(parseUbuntuEdition))
+	RegisterFileParser("debian_version", exactFilename("/etc/debian_version"), 0,
+		[]string{"os", "os_family"}, FileParserFunc(parseDebianVersion))
+	RegisterFileParser("lsb-release", exactFilename("/etc/lsb-release"), 0,
+		[]string{"os", "os_family"}, FileParserFunc(parseLsbRelease))
+	RegisterFileParser("sw_vers", exactFilename("/usr/bin/sw_vers"), 0,
+		[]string{"os", "os_edition", "os_family"}, FileParserFunc(parseSwVers))
+	RegisterFileParser("windows-caption",
+		exactFilenameFold("(Get-WmiObject Win32_OperatingSystem).Caption"), 0,
+		[]string{"os", "os_edition", "os_family"}, FileParserFunc(parseWindowsCaption))
+	RegisterFileParser("uname-a", `^(/usr)?/bin/uname -a$`, 0,
+		[]string{"os", "os_edition", "os_family", "kernel"}, FileParserFunc(parseUnameA))
+	RegisterFileParser("uname-r", exactFilename("/bin/uname -r"), 0,
+		[]string{"kernel"}, FileParserFunc(parseUnameR))
+	RegisterFileParser("freebsd-version", exactFilename("/bin/freebsd-version -ku"), 0,
+		[]string{"os", "os_family"}, FileParserFunc(parseFreeBSDVersion))
+	RegisterFileParser("windows-osversion",
+		exactFilenameFold("[System.Environment]::OSVersion|ConvertTo-Json"), 0,
+		[]string{"kernel"}, FileParserFunc(parseWindowsOSVersion))
+}
+
+// osReleaseDistros maps the ID field in os-release to the name used for the os column,
+// and how many parts of the version number to include.
+// The names are the same as the legacy parsers use, so a host doesn't change os when
+// the os-release file arrives. Distributions that aren't listed use the NAME field.
+var osReleaseDistros = map[string]struct {
+	name         string
+	versionParts int
+}{
+	"rhel":                {"RHEL", 1},
+	"centos":              {"CentOS", 1},
+	"fedora":              {"Fedora", 1},
+	"almalinux":           {"AlmaLinux", 1},
+	"rocky":               {"Rocky Linux", 1},
+	"ol":                  {"Oracle Linux", 1},
+	"amzn":                {"Amazon Linux", 1},
+	"debian":              {"Debian", 1},
+	"ubuntu":              {"Ubuntu", 2},
+	"sles":                {"SLES", 1},
+	"sled":                {"SLED", 1},
+	"opensuse-leap":       {"openSUSE Leap", 2},
+	"opensuse-tumbleweed": {"openSUSE Tumbleweed", 0}, // rolling release
+	"arch":                {"Arch Linux", 0},
+	"alpine":              {"Alpine Linux", 2},
+	"freebsd":             {"FreeBSD", 1},
+}
+
+// parseOSRelease parses /etc/os-release, see https://www.freedesktop.org/software/systemd/man/os-release.html
+func parseOSRelease(filename string, content string) (map[string]interface{}, error) {
+	vars := parseShellVariables(content)
+	id := strings.ToLower(vars["ID"])
+	if id == "" {
+		return nil, nil
+	}
+	idLike := strings.Fields(strings.ToLower(vars["ID_LIKE"]))
+
+	var os string
+	if distro, ok := osReleaseDistros[id]; ok {
+		os = distro.name
+		if id == "centos" && strings.Contains(vars["NAME"], "Stream") {
+			os = "CentOS Stream"
+		}
+		os = appendVersion(os, vars["VERSION_ID"], distro.versionParts)
+	} else if vars["NAME"] != "" {
+		// Use the same version format as the distribution it is based on, if it's a known one
+		parts := 2
+		for _, like := range idLike {
+			if distro, ok := osReleaseDistros[like]; ok {
+				parts = distro.versionParts
+				break
+			}
+		}
+		os = appendVersion(vars["NAME"], vars["VERSION_ID"], parts)
+	} else if vars["PRETTY_NAME"] != "" {
+		os = vars["PRETTY_NAME"]
+	} else {
+		return nil, nil
+	}
+
+	family := "Linux"
+	if id == "freebsd" || contains("freebsd", idLike) {
+		family = "FreeBSD"
+	}
+	result := map[string]interface{}{"os": os, "os_family": family}
+	// Some distributions (e.g. Fedora and RHEL 7) tell which edition it is.
+	// If not, os_edition is left alone, since another file may know (e.g. dpkg-query on Ubuntu)
+	if variant := vars["VARIANT_ID"]; variant != "" {
+		result["os_edition"] = cases.Title(language.Und).String(variant)
+	}
+	return result, nil
+}
+
+// appendVersion adds the first parts of the version number to the name
+func appendVersion(name string, version string, parts int) string {
+	if version == "" || parts == 0 {
+		return name
+	}
+	list := strings.Split(version, ".")
+	if len(list) > parts {
+		list = list[:parts]
+	}
+	return name + " " + strings.Join(list, ".")
+}
+
+// parseShellVariables parses lines with variable assignments, as in os-release.
+// Values may be quoted, with backslash escapes inside double quotes.
+func parseShellVariables(content string) map[string]string {
+	vars := make(map[string]string)
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq <= 0 {
+			continue
+		}
+		key, value := line[:eq], line[eq+1:]
+		if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = value[1 : len(value)-1]
+		} else if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			var sb strings.Builder
+			value = value[1 : len(value)-1]
+			for i := 0; i < len(value); i++ {
+				if value[i] == '\\' && i+1 < len(value) {
+					i++
+				}
+				sb.WriteByte(value[i])
+			}
+			value = sb.String()
+		}
+		vars[key] = value
+	}
+	return vars
+}
+
+var reRHEL = regexp.MustCompile("^Red Hat Enterprise Linux (\\w+)" +
+	".*(Tikanga|Santiago|Maipo|Ootpa|Plow|Coughlan)")
+var reFedora = regexp.MustCompile(`^Fedora release (\d+)`)
+var reCentOS = regexp.MustCompile(`^CentOS Linux release (\d+)`)
+var reAlma = regexp.MustCompile(`^AlmaLinux release (\d+)`)
+
+func parseRedhatRelease(filename string, content string) (map[string]interface{}, error) {
+	var os, osEdition string
+	if m := reRHEL.FindStringSubmatch(content); m != nil {
+		osEdition = m[1]
+		switch m[2] {
+		case "Tikanga":
+			os = "RHEL 5"
+		case "Santiago":
+			os = "RHEL 6"
+		case "Maipo":
+			os = "RHEL 7"
+		case "Ootpa":
+			os = "RHEL 8"
+			osEdition = "" // RHEL 8 doesn't come in workstation+server editions like the previous versions
+		case "Plow":
+			os = "RHEL 9"
+			osEdition = ""
+		case "Coughlan":
+			os = "RHEL 10"
+			osEdition = ""
+		}
+	} else if m := reFedora.FindStringSubmatch(content); m != nil {
+		os = "Fedora " + m[1]
+	} else if m := reCentOS.FindStringSubmatch(content); m != nil {
+		os = "CentOS " + m[1]
+	} else if m := reAlma.FindStringSubmatch(content); m != nil {
+		os = "AlmaLinux " + m[1]
+	}
+	if os == "" {
+		return nil, nil
+	}
+	result := map[string]interface{}{"os": os, "os_family": "Linux"}
+	if osEdition != "" {
+		result["os_edition"] = osEdition
+	}
+	return result, nil
+}
+
+var reOSReleaseEdition = regexp.MustCompile("/usr/lib/os.release.d/os-release-([a-z]+)")
+
+func parseOSReleaseEdition(filename string, content string) (map[string]interface{}, error) {
+	m := reOSReleaseEdition.FindStringSubmatch(filename)
+	if m == nil {
+		return nil, nil
+	}
+	return map[string]interface{}{"os_edition": cases.Title(language.Und).String(m[1])}, nil
+}
+
+var reUbuntuEdition = regexp.MustCompile("ubuntu-(desktop|server)")
+
+func parseUbuntuEdition(filename string, content string) (map[string]interface{}, error) {
+	m := reUbuntuEdition.FindStringSubmatch(content)
+	if m == nil {
+		return nil, nil
+	}
+	return map[string]interface{}{"os_edition": cases.Title(language.Und).String(m[1])}, nil
+}
+
+var reDebianVersion = regexp.MustCompile(`^(\d+)\.`)
+
+func parseDebianVersion(filename string, content string) (map[string]interface{}, error) {
+	m := reDebianVersion.FindStringSubmatch(content)
+	if m == nil {
+		return nil, nil
+	}
+	return map[string]interface{}{"os": "Debian " + m[1], "os_family": "Linux"}, nil
+}
+
+var reLsbRelease = regexp.MustCompile(`DISTRIB_ID=Ubuntu\nDISTRIB_RELEASE=(\d+)\.(\d+)`)
+
+func parseLsbRelease(filename string, content string) (map[string]interface{}, error) {
+	m := reLsbRelease.FindStringSubmatch(content)
+	if m == nil {
+		return nil, nil
+	}
+	return map[string]interface{}{
+		"os":        fmt.Sprintf("Ubuntu %s.%s", m[1], m[2]),
+		"os_family": "Linux",
+	}, nil
+}
+
+var reSwVers = regexp.MustCompile(`ProductName:\s+(Mac OS X|macOS)\nProductVersion:\s+(\d+\.\d+)`)
+
+func parseSwVers(filename string, content string) (map[string]interface{}, error) {
+	m := reSwVers.FindStringSubmatch(content)
+	if m == nil {
+		return nil, nil
+	}
+	return map[string]interface{}{
+		"os":         "macOS " + m[2],
+		"os_edition": nil,
+		"os_family":  "macOS",
+	}, nil
+}
+
+var reWinX = regexp.MustCompile(`Microsoft Windows (\d+) (\w*)`)
+var reWinServer = regexp.MustCompile(`Microsoft®? Windows Server®? (\d+)( R2)?`)
+
+func parseWindowsCaption(filename string, content string) (map[string]interface{}, error) {
+	if m := reWinX.FindStringSubmatch(content); m != nil {
+		return map[string]interface{}{
+			"os":         "Windows " + m[1],
+			"os_edition": m[2],
+			"os_family":  "Windows",
+		}, nil
+	}
+	if m := reWinServer.FindStringSubmatch(content); m != nil {
+		return map[string]interface{}{
+			"os":         fmt.Sprintf("Windows %s%s", m[1], m[2]),
+			"os_edition": "Server",
+			"os_family":  "Windows",
+		}, nil
+	}
+	return nil, nil
+}
+
+var reUnameA = regexp.MustCompile(`(\S+) \S+ (\S+)`)
+var reLeadingNumber = regexp.MustCompile(`^(\d+)`)
+
+func parseUnameA(filename string, content string) (map[string]interface{}, error) {
+	m := reUnameA.FindStringSubmatch(content)
+	if m == nil {
+		return nil, nil
+	}
+	os, kernel := m[1], m[2]
+	switch os {
+	case "FreeBSD":
+		if m := reLeadingNumber.FindStringSubmatch(kernel); m != nil {
+			os = "FreeBSD " + m[1]
+		}
+		return map[string]interface{}{
+			"os":         os,
+			"os_edition": nil,
+			"os_family":  "FreeBSD",
+			"kernel":     kernel,
+		}, nil
+	case "Darwin":
+		return map[string]interface{}{
+			"os_edition": nil,
+			"os_family":  "macOS",
+			"kernel":     kernel,
+		}, nil
+	}
+	return map[string]interface{}{"kernel": kernel}, nil
+}
+
+func parseUnameR(filename string, content string) (map[string]interface{}, error) {
+	kernel := strings.TrimSpace(strings.SplitN(content, "\n", 2)[0])
+	return map[string]interface{}{"kernel": kernel}, nil
+}
+
+var reFreeBSDVersion = regexp.MustCompile(`(\d+)\.(\d+)-RELEASE`)
+
+func parseFreeBSDVersion(filename string, content string) (map[string]interface{}, error) {
+	m := reFreeBSDVersion.FindStringSubmatch(content)
+	if m == nil {
+		return nil, nil
+	}
+	return map[string]interface{}{"os": "FreeBSD " + m[1], "os_family": "FreeBSD"}, nil
+}
+
+var reWindowsVersion = regexp.MustCompile(`([\d\.]+)`)
+
+func parseWindowsOSVersion(filename string, content string) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(content), &m); err != nil {
+		return nil, err
+	}
+	str, ok := m["VersionString"].(string)
+	if !ok {
+		return nil, nil
+	}
+	v := reWindowsVersion.FindStringSubmatch(str)
+	if v == nil {
+		return nil, nil
+	}
+	return map[string]interface{}{"kernel": v[1]}, nil
+}
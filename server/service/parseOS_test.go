@@ -0,0 +1,203 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+type fileParserTest struct {
+	filename, content string
+	expect            map[string]interface{}
+}
+
+func testFileParsers(t *testing.T, tests []fileParserTest) {
+	for _, test := range tests {
+		got, _ := parseFileContent("test", test.filename, test.content)
+		if test.expect == nil {
+			test.expect = map[string]interface{}{}
+		}
+		if !reflect.DeepEqual(got, test.expect) {
+			t.Errorf("Parsed %s with content %q:\n got %v\nexpected %v",
+				test.filename, test.content, got, test.expect)
+		}
+	}
+}
+
+func TestOSParsers(t *testing.T) {
+	testFileParsers(t, []fileParserTest{
+		{
+			filename: "/etc/redhat-release",
+			content:  "Red Hat Enterprise Linux Workstation release 7.4 (Maipo)",
+			expect:   map[string]interface{}{"os": "RHEL 7", "os_edition": "Workstation", "os_family": "Linux"},
+		},
+		{
+			filename: "/etc/redhat-release",
+			content:  "Red Hat Enterprise Linux release 9.0 (Plow)",
+			expect:   map[string]interface{}{"os": "RHEL 9", "os_family": "Linux"},
+		},
+		{
+			filename: "/etc/redhat-release",
+			content:  "CentOS Linux release 7.5.1804 (Core)",
+			expect:   map[string]interface{}{"os": "CentOS 7", "os_family": "Linux"},
+		},
+		{
+			filename: "/etc/redhat-release",
+			content:  "Something else entirely",
+		},
+		{
+			filename: "/usr/lib/os.release.d/os-release-workstation",
+			expect:   map[string]interface{}{"os_edition": "Workstation"},
+		},
+		{
+			filename: "/usr/bin/dpkg-query -l",
+			content:  "ii  ubuntu-desktop   1.361   amd64   The Ubuntu desktop system",
+			expect:   map[string]interface{}{"os_edition": "Desktop"},
+		},
+		{
+			filename: "/etc/debian_version",
+			content:  "9.4\n",
+			expect:   map[string]interface{}{"os": "Debian 9", "os_family": "Linux"},
+		},
+		{
+			filename: "/etc/lsb-release",
+			content:  "DISTRIB_ID=Ubuntu\nDISTRIB_RELEASE=16.04\nDISTRIB_CODENAME=xenial\n",
+			expect:   map[string]interface{}{"os": "Ubuntu 16.04", "os_family": "Linux"},
+		},
+		{
+			filename: "/usr/bin/sw_vers",
+			content:  "ProductName:	macOS\nProductVersion:	11.2\nBuildVersion:	20D64\n",
+			expect:   map[string]interface{}{"os": "macOS 11.2", "os_edition": nil, "os_family": "macOS"},
+		},
+		{
+			filename: "(Get-WmiObject Win32_OperatingSystem).Caption",
+			content:  "Microsoft Windows 10 Enterprise",
+			expect:   map[string]interface{}{"os": "Windows 10", "os_edition": "Enterprise", "os_family": "Windows"},
+		},
+		{
+			filename: "(get-wmiobject win32_operatingsystem).caption",
+			content:  "Microsoft® Windows Server® 2008 R2 Standard",
+			expect:   map[string]interface{}{"os": "Windows 2008 R2", "os_edition": "Server", "os_family": "Windows"},
+		},
+		{
+			filename: "/bin/uname -a",
+			content:  "Linux host.example.com 3.10.0-862.el7.x86_64 #1 SMP x86_64 GNU/Linux",
+			expect:   map[string]interface{}{"kernel": "3.10.0-862.el7.x86_64"},
+		},
+		{
+			filename: "/usr/bin/uname -a",
+			content:  "FreeBSD host.example.com 11.1-RELEASE-p10 FreeBSD 11.1-RELEASE-p10",
+			expect: map[string]interface{}{"os": "FreeBSD 11", "os_edition": nil,
+				"os_family": "FreeBSD", "kernel": "11.1-RELEASE-p10"},
+		},
+		{
+			filename: "/usr/bin/uname -a",
+			content:  "Darwin mac.example.com 20.3.0 Darwin Kernel Version 20.3.0",
+			expect:   map[string]interface{}{"os_edition": nil, "os_family": "macOS", "kernel": "20.3.0"},
+		},
+		{
+			filename: "/bin/uname -r",
+			content:  "4.18.0-80.el8.x86_64\n",
+			expect:   map[string]interface{}{"kernel": "4.18.0-80.el8.x86_64"},
+		},
+		{
+			filename: "/bin/freebsd-version -ku",
+			content:  "12.1-RELEASE-p3\n12.1-RELEASE-p5\n",
+			expect:   map[string]interface{}{"os": "FreeBSD 12", "os_family": "FreeBSD"},
+		},
+		{
+			filename: "[System.Environment]::OSVersion|ConvertTo-Json",
+			content:  `{"Platform": 2, "VersionString": "Microsoft Windows NT 10.0.17763.0"}`,
+			expect:   map[string]interface{}{"kernel": "10.0.17763.0"},
+		},
+		// Invalid JSON is an error, so nothing is set
+		{
+			filename: "[System.Environment]::OSVersion|ConvertTo-Json",
+			content:  `{"Platform": 2,`,
+		},
+		{
+			filename: "/etc/os-release",
+			content: `NAME="Rocky Linux"
+VERSION="9.3 (Blue Onyx)"
+ID="rocky"
+ID_LIKE="rhel centos fedora"
+VERSION_ID="9.3"
+PRETTY_NAME="Rocky Linux 9.3 (Blue Onyx)"`,
+			expect: map[string]interface{}{"os": "Rocky Linux 9", "os_family": "Linux"},
+		},
+		{
+			filename: "/etc/os-release",
+			content: `NAME="Red Hat Enterprise Linux Server"
+VERSION="7.9 (Maipo)"
+ID="rhel"
+ID_LIKE="fedora"
+VARIANT="Server"
+VARIANT_ID="server"
+VERSION_ID="7.9"`,
+			expect: map[string]interface{}{"os": "RHEL 7", "os_edition": "Server", "os_family": "Linux"},
+		},
+		{
+			filename: "/etc/os-release",
+			content:  "PRETTY_NAME=\"Ubuntu 22.04.3 LTS\"\nNAME=\"Ubuntu\"\nVERSION_ID=\"22.04\"\nID=ubuntu\nID_LIKE=debian\n",
+			expect:   map[string]interface{}{"os": "Ubuntu 22.04", "os_family": "Linux"},
+		},
+		{
+			filename: "/etc/os-release",
+			content:  "NAME=\"Alpine Linux\"\nID=alpine\nVERSION_ID=3.18.4\n",
+			expect:   map[string]interface{}{"os": "Alpine Linux 3.18", "os_family": "Linux"},
+		},
+		{
+			filename: "/etc/os-release",
+			content:  "NAME=\"Arch Linux\"\nPRETTY_NAME=\"Arch Linux\"\nID=arch\nBUILD_ID=rolling\n",
+			expect:   map[string]interface{}{"os": "Arch Linux", "os_family": "Linux"},
+		},
+		{
+			filename: "/etc/os-release",
+			content:  "NAME=\"SLES\"\nVERSION=\"15-SP5\"\nVERSION_ID=\"15.5\"\nID=\"sles\"\nID_LIKE=\"suse\"\n",
+			expect:   map[string]interface{}{"os": "SLES 15", "os_family": "Linux"},
+		},
+		{
+			filename: "/etc/os-release",
+			content:  "NAME=\"Amazon Linux\"\nVERSION=\"2023\"\nID=\"amzn\"\nID_LIKE=\"fedora\"\nVERSION_ID=\"2023\"\n",
+			expect:   map[string]interface{}{"os": "Amazon Linux 2023", "os_family": "Linux"},
+		},
+		// A distribution that isn't in the list, based on a known one
+		{
+			filename: "/etc/os-release",
+			content:  "NAME=\"Linux Mint\"\nID=linuxmint\nID_LIKE=\"ubuntu debian\"\nVERSION_ID=\"21.2\"\n",
+			expect:   map[string]interface{}{"os": "Linux Mint 21.2", "os_family": "Linux"},
+		},
+		{
+			filename: "/etc/os-release",
+			content:  "# no content",
+		},
+		// Files that no parser is interested in
+		{
+			filename: "/etc/redhat-release.rpmnew",
+			content:  "Red Hat Enterprise Linux release 9.0 (Plow)",
+		},
+	})
+}
+
+func TestFileParserPriority(t *testing.T) {
+	saved := fileParsers
+	defer func() { fileParsers = saved }()
+	fileParsers = nil
+	constant := func(value string) FileParser {
+		return FileParserFunc(func(filename string, content string) (map[string]interface{}, error) {
+			return map[string]interface{}{"os": value}, nil
+		})
+	}
+	RegisterFileParser("low", "^/etc/", 1, []string{"os"}, constant("low"))
+	RegisterFileParser("high", exactFilename("/etc/issue"), 10, []string{"os"}, constant("high"))
+	RegisterFileParser("undeclared", "^/etc/", 5, []string{"kernel"}, constant("undeclared"))
+	testFileParsers(t, []fileParserTest{
+		{filename: "/etc/issue", expect: map[string]interface{}{"os": "high"}},
+		{filename: "/etc/motd", expect: map[string]interface{}{"os": "low"}},
+	})
+	for _, p := range fileParsers {
+		if p.name == "undeclared" && (p.handled != 2 || p.failed != 2) {
+			t.Errorf("The parser that sets an undeclared column handled %d files and failed %d times",
+				p.handled, p.failed)
+		}
+	}
+}
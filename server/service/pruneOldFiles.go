@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"log"
 	"time"
@@ -21,7 +22,7 @@ func (p pruneOldFilesJob) HowOften() time.Duration {
 	return time.Hour
 }
 
-func (p pruneOldFilesJob) Run(db *sql.DB) {
+func (p pruneOldFilesJob) Run(ctx context.Context, db *sql.DB) {
 	// Find all machines
 	machineList := make([]string, 0, 100)
 	rows, err := db.Query("SELECT DISTINCT certfp FROM files")
@@ -46,6 +47,10 @@ func (p pruneOldFilesJob) Run(db *sql.DB) {
 
 	// For every machine
 	for _, certfp := range machineList {
+		if ctx.Err() != nil {
+			// The server is shutting down. The rest can wait until the next run.
+			return
+		}
 		// Finn all unique filenames on the machine
 		rows, err = db.Query("SELECT DISTINCT filename FROM files "+
 			"WHERE certfp=$1", certfp)
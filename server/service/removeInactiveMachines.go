@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"log"
 	"nivlheim/utility"
@@ -17,7 +18,7 @@ func (job removeInactiveMachinesJob) HowOften() time.Duration {
 	return time.Minute * 19
 }
 
-func (job removeInactiveMachinesJob) Run(db *sql.DB) {
+func (job removeInactiveMachinesJob) Run(ctx context.Context, db *sql.DB) {
 	// Log some numbers at the end. Defer func in case of panic.
 	var acount, dcount int
 	defer func() {
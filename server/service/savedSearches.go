@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"nivlheim/utility"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// savedSearchJob evaluates the saved searches that are due,
+// and records which hosts entered or left the result of each search.
+type savedSearchJob struct{}
+
+// savedSearchHistoryDays is how long the runs and changes of saved searches are kept
+const savedSearchHistoryDays = 90
+
+// savedSearchMaxRetryMinutes is the longest time a failing saved search waits before it is tried again
+const savedSearchMaxRetryMinutes = 24 * 60
+
+func init() {
+	RegisterJob(savedSearchJob{})
+}
+
+func (job savedSearchJob) HowOften() time.Duration {
+	return time.Minute
+}
+
+func (job savedSearchJob) Run(ctx context.Context, db *sql.DB) {
+	list, err := QueryColumn(db, "SELECT searchid FROM savedsearches "+
+		"WHERE (lastrun IS NULL OR lastrun < now() - interval_minutes * interval '1 minute') "+
+		"AND (retryafter IS NULL OR retryafter < now()) "+
+		"ORDER BY lastrun NULLS FIRST")
+	if err != nil {
+		log.Panic(err)
+	}
+	for _, id := range list {
+		searchID, ok := id.(int64)
+		if !ok {
+			continue
+		}
+		changes, hErr := runSavedSearch(db, int(searchID))
+		if hErr == errNotReadyForSearch {
+			// Try again later, when the search cache has been loaded
+			return
+		}
+		if hErr != nil {
+			log.Printf("Saved search %d failed: %s", searchID, hErr.message)
+			// Wait for one interval before trying again, then twice as long for each failure
+			_, err = db.Exec("UPDATE savedsearches SET lasterror=$2, failures=failures+1, "+
+				"retryafter=now() + least(interval_minutes * power(2, least(failures, 20)), $3) "+
+				"* interval '1 minute' WHERE searchid=$1",
+				searchID, hErr.message, savedSearchMaxRetryMinutes)
+			if err != nil {
+				log.Panic(err)
+			}
+			continue
+		}
+		if changes != nil && (len(changes.Entered) > 0 || len(changes.Left) > 0) {
+			postSavedSearchChanges(db, changes)
+		}
+	}
+}
+
+// savedSearchHost is a host in the result of a saved search
+type savedSearchHost struct {
+	Certfp   string `json:"certfp"`
+	Hostname string `json:"hostname"`
+}
+
+// savedSearchChanges describes the hosts that entered or left the result
+// of a saved search in one run. It is also the payload that is posted to the webhook.
+type savedSearchChanges struct {
+	SearchID  int               `json:"searchID"`
+	Name      string            `json:"name"`
+	Time      time.Time         `json:"time"`
+	HostCount int               `json:"hostCount"`
+	Entered   []savedSearchHost `json:"entered"`
+	Left      []savedSearchHost `json:"left"`
+}
+
+// findHostsForSavedSearch evaluates the query of a saved search.
+// The query has the same parameters as the host list API (field filters and content search).
+// The result is limited to the hosts owned by the owner group,
+// unless the owner group is the admin group.
+// Returns a map from certificate fingerprint to hostname.
+func findHostsForSavedSearch(db *sql.DB, query string, ownerGroup string) (map[string]string, *httpError) {
+	req, err := http.NewRequest(httpGET, "/?"+query, nil)
+	if err != nil {
+		return nil, &httpError{message: err.Error(), code: http.StatusBadRequest}
+	}
+	customFields, customFieldIDs, err := getListOfCustomFields(db)
+	if err != nil {
+		return nil, &httpError{message: err.Error(), code: http.StatusInternalServerError}
+	}
+	allowedFields := make([]string, len(apiHostListStandardFields))
+	for i, f := range apiHostListStandardFields {
+		allowedFields[i] = f.publicName
+	}
+	allowedFields = append(allowedFields, customFields...)
+
+	searchResult, hErr := hostsMatchingContentSearch(db, req, allowedFields, customFieldIDs)
+	if hErr != nil {
+		return nil, hErr
+	}
+	customFieldMap, err := getCustomFieldMap(db)
+	if err != nil {
+		return nil, &httpError{message: err.Error(), code: http.StatusInternalServerError}
+	}
+	where, qparams, hErr := buildSQLWhere(query, allowedFields, customFieldMap)
+	if hErr != nil {
+		return nil, hErr
+	}
+	if searchResult != nil {
+		certs := make([]string, 0, len(searchResult))
+		for certfp := range searchResult {
+			certs = append(certs, certfp)
+		}
+		qparams = append(qparams, pq.Array(certs))
+		if len(where) > 0 {
+			where += " AND "
+		}
+		where += fmt.Sprintf("certfp = ANY($%d)", len(qparams))
+	}
+	if config.LDAPAdminGroup == "" || ownerGroup != config.LDAPAdminGroup {
+		qparams = append(qparams, ownerGroup)
+		if len(where) > 0 {
+			where += " AND "
+		}
+		where += fmt.Sprintf("ownergroup = $%d", len(qparams))
+	}
+
+	// Same as in the hostlist API, so both return the same hosts for the same query
+	statement := hostFieldsStatement(customFields, customFieldIDs, query)
+	if config.HideUnknownHosts {
+		statement += " WHERE h.hostname IS NOT NULL"
+	}
+	statement = "SELECT certfp, hostname FROM (" + statement + ") as foo"
+	if len(where) > 0 {
+		statement += " WHERE " + where
+	}
+	rows, err := db.Query(statement, qparams...)
+	if err != nil {
+		return nil, &httpError{message: err.Error(), code: http.StatusInternalServerError}
+	}
+	defer rows.Close()
+	result := make(map[string]string)
+	for rows.Next() {
+		var certfp, hostname sql.NullString
+		if err = rows.Scan(&certfp, &hostname); err != nil {
+			return nil, &httpError{message: err.Error(), code: http.StatusInternalServerError}
+		}
+		result[certfp.String] = hostname.String
+	}
+	if err = rows.Err(); err != nil {
+		return nil, &httpError{message: err.Error(), code: http.StatusInternalServerError}
+	}
+	return result, nil
+}
+
+// runSavedSearch evaluates a saved search and stores the result and the changes.
+// The first time a search is evaluated, the result is stored without any changes,
+// so a new search won't report all the hosts as entered.
+// Returns the changes, or nil if it was the first run.
+func runSavedSearch(db *sql.DB, searchID int) (*savedSearchChanges, *httpError) {
+	var name, query, ownerGroup string
+	var lastrun pq.NullTime
+	err := db.QueryRow("SELECT name,query,ownergroup,lastrun FROM savedsearches WHERE searchid=$1",
+		searchID).Scan(&name, &query, &ownerGroup, &lastrun)
+	if err == sql.ErrNoRows {
+		return nil, &httpError{message: "Saved search not found", code: http.StatusNotFound}
+	} else if err != nil {
+		return nil, &httpError{message: err.Error(), code: http.StatusInternalServerError}
+	}
+	hosts, hErr := findHostsForSavedSearch(db, query, ownerGroup)
+	if hErr != nil {
+		return nil, hErr
+	}
+
+	changes := &savedSearchChanges{
+		SearchID:  searchID,
+		Name:      name,
+		Time:      time.Now(),
+		HostCount: len(hosts),
+		Entered:   make([]savedSearchHost, 0),
+		Left:      make([]savedSearchHost, 0),
+	}
+	err = utility.RunInTransaction(db, func(tx *sql.Tx) error {
+		// Compare with the previous result
+		// A host that has been deleted since then has left, with the hostname it had
+		rows, err := tx.Query("SELECT s.certfp, COALESCE(h.hostname, s.hostname) FROM savedsearch_hosts s "+
+			"LEFT JOIN hostinfo h ON h.certfp=s.certfp WHERE s.searchid=$1", searchID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		previous := make(map[string]bool)
+		for rows.Next() {
+			var certfp, hostname sql.NullString
+			if err = rows.Scan(&certfp, &hostname); err != nil {
+				return err
+			}
+			previous[certfp.String] = true
+			if _, ok := hosts[certfp.String]; !ok {
+				changes.Left = append(changes.Left,
+					savedSearchHost{Certfp: certfp.String, Hostname: hostname.String})
+			}
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+		for certfp, hostname := range hosts {
+			if !previous[certfp] {
+				changes.Entered = append(changes.Entered,
+					savedSearchHost{Certfp: certfp, Hostname: hostname})
+			}
+		}
+		if !lastrun.Valid {
+			changes.Entered = changes.Entered[0:0]
+		}
+
+		// Store the run and the changes
+		var runID int64
+		err = tx.QueryRow("INSERT INTO savedsearch_runs(searchid,time,hostcount,entered_count,left_count) "+
+			"VALUES($1,$2,$3,$4,$5) RETURNING runid", searchID, changes.Time, len(hosts),
+			len(changes.Entered), len(changes.Left)).Scan(&runID)
+		if err != nil {
+			return err
+		}
+		for _, list := range []struct {
+			hosts   []savedSearchHost
+			entered bool
+		}{{changes.Entered, true}, {changes.Left, false}} {
+			for _, h := range list.hosts {
+				_, err = tx.Exec("INSERT INTO savedsearch_changes(runid,certfp,hostname,entered) "+
+					"VALUES($1,$2,$3,$4)", runID, h.Certfp, h.Hostname, list.entered)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		// Replace the stored result
+		certs := make([]string, 0, len(hosts))
+		hostnames := make([]string, 0, len(hosts))
+		for certfp, hostname := range hosts {
+			certs = append(certs, certfp)
+			hostnames = append(hostnames, hostname)
+		}
+		_, err = tx.Exec("DELETE FROM savedsearch_hosts WHERE searchid=$1", searchID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO savedsearch_hosts(searchid,certfp,hostname) "+
+			"SELECT $1, c, nullif(h,'') FROM unnest($2::text[], $3::text[]) AS t(c,h)", searchID,
+			pq.Array(certs), pq.Array(hostnames))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE savedsearches SET lastrun=$1, lasterror=NULL, failures=0, "+
+			"retryafter=NULL WHERE searchid=$2", changes.Time, searchID)
+		return err
+	})
+	if err != nil {
+		return nil, &httpError{message: err.Error(), code: http.StatusInternalServerError}
+	}
+	if !lastrun.Valid {
+		return nil, nil
+	}
+	// Sort the lists, to make them easier to read
+	for _, list := range [][]savedSearchHost{changes.Entered, changes.Left} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Hostname < list[j].Hostname })
+	}
+	return changes, nil
+}
+
+// postSavedSearchChanges sends the changes to the webhook of the saved search, if it has one
+func postSavedSearchChanges(db *sql.DB, changes *savedSearchChanges) {
+	var webhook sql.NullString
+	err := db.QueryRow("SELECT webhook FROM savedsearches WHERE searchid=$1",
+		changes.SearchID).Scan(&webhook)
+	if err != nil || !webhook.Valid || webhook.String == "" {
+		return
+	}
+	body, err := json.Marshal(changes)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	u, err := url.Parse(webhook.String)
+	if err != nil {
+		log.Printf("Webhook for saved search %d failed: %s", changes.SearchID, err)
+		return
+	}
+	resp, err := webhookClient(u.Hostname()).Post(webhook.String, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Webhook for saved search %d failed: %s", changes.SearchID, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Webhook for saved search %d returned %s", changes.SearchID, resp.Status)
+	}
+}
+
+// webhookHostInAllowList returns true if the host is in the list of allowed hosts in the config.
+// Those hosts can be called even if they have internal addresses.
+func webhookHostInAllowList(host string) bool {
+	for _, h := range config.WebhookAllowedHosts {
+		if h = strings.TrimSpace(h); h != "" && strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookHostAllowed returns false if the host is obviously an internal address.
+// Host names are checked again when the webhook is called, see webhookClient.
+func webhookHostAllowed(host string) bool {
+	if webhookHostInAllowList(host) {
+		return true
+	}
+	host = strings.ToLower(host)
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return !isInternalIP(ip)
+	}
+	return true
+}
+
+// isInternalIP returns true for loopback, link-local, private and unspecified addresses
+func isInternalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast()
+}
+
+// webhookClient returns a http client for calling a webhook on the host.
+// Unless the host is in the list of allowed hosts, the client refuses to connect
+// to internal addresses. That is checked after the name has been resolved,
+// so a name that points to an internal address can't be used to get around it.
+// Redirects aren't followed, since they could lead anywhere.
+func webhookClient(host string) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !webhookHostInAllowList(host) {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			h, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(h); ip == nil || isInternalIP(ip) {
+				return fmt.Errorf("%s is an internal address", h)
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// pruneSavedSearchHistoryJob removes old runs of saved searches, and the changes they recorded
+type pruneSavedSearchHistoryJob struct{}
+
+func init() {
+	RegisterJob(pruneSavedSearchHistoryJob{})
+}
+
+func (job pruneSavedSearchHistoryJob) HowOften() time.Duration {
+	return time.Hour * 6
+}
+
+func (job pruneSavedSearchHistoryJob) Run(ctx context.Context, db *sql.DB) {
+	// The changes are deleted by cascade
+	_, err := db.Exec("DELETE FROM savedsearch_runs WHERE time < now() - $1 * interval '1 day'",
+		savedSearchHistoryDays)
+	if err != nil {
+		log.Panic(err)
+	}
+}
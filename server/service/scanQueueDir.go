@@ -2,6 +2,7 @@ package main
 
 // Scan the directory for new files and create tasks for them
 import (
+	"context"
 	"database/sql"
 	"io/ioutil"
 	"log"
@@ -19,7 +20,7 @@ func (s scanQueueDirJob) HowOften() time.Duration {
 	return time.Second * 10
 }
 
-func (s scanQueueDirJob) Run(db *sql.DB) {
+func (s scanQueueDirJob) Run(ctx context.Context, db *sql.DB) {
 	// Scan the directory for new files and create tasks for them
 	files, err := ioutil.ReadDir(config.QueueDir)
 	if err != nil {
@@ -32,14 +33,7 @@ func (s scanQueueDirJob) Run(db *sql.DB) {
 			continue
 		}
 		// New task
-		var err error
-		if postgresSupportsOnConflict {
-			_, err = db.Exec("INSERT INTO tasks(url) VALUES($1)"+
-				" ON CONFLICT DO NOTHING", f.Name())
-		} else {
-			_, err = db.Exec("INSERT INTO tasks(url) SELECT $1 WHERE "+
-				"(SELECT count(*) FROM tasks WHERE url=$1) = 0", f.Name())
-		}
+		err := enqueueTask(db, "archive", f.Name())
 		if err != nil {
 			log.Println(err.Error())
 		}
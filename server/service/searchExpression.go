@@ -0,0 +1,387 @@
+package main
+
+// This file implements the query language for the multi-stage search API.
+// Examples of queries:
+//
+//	PermitRootLogin
+//	"PermitRootLogin yes" AND NOT sshd
+//	os:"RHEL 9" AND file:/etc/ssh/sshd_config "PermitRootLogin yes"
+//	(nginx OR httpd) AND NOT osFamily:windows
+//
+// - A word or a quoted phrase is searched for in the file content.
+// - file:<filename> in front of a word or phrase limits the search to that file.
+//   On its own, it matches hosts that have the file.
+// - re:"<expression>" searches with a regular expression.
+// - <field>:<value> matches a host field, like the parameters for the host list API,
+//   including wildcards (*) and the prefixes !, < and >.
+// - The operators are AND, OR and NOT (in uppercase), and parentheses can be used
+//   for grouping. Terms with no operator in between are ANDed together.
+//   NOT binds tighter than AND, which binds tighter than OR.
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// searchExpression is a node in the syntax tree of a parsed query
+type searchExpression struct {
+	// op is "AND", "OR" or "NOT" for operator nodes, or empty for leaf nodes
+	op       string
+	children []*searchExpression
+	// field is the name of a host field, if the leaf node matches a field.
+	// Otherwise, the leaf node is a content search.
+	field string
+	// text is the string to search for, or the field value.
+	// If the text is empty, the node matches all hosts that have the file.
+	text     string
+	filename string
+	isRegex  bool
+}
+
+type searchToken struct {
+	// paren is '(' or ')' for parentheses, or zero for other tokens
+	paren     byte
+	qualifier string
+	value     string
+	quoted    bool
+}
+
+// isOperator returns true if the token is the given operator
+func (t *searchToken) isOperator(op string) bool {
+	return t.paren == 0 && !t.quoted && t.qualifier == "" && t.value == op
+}
+
+// isContentTerm returns true if the token is a word or phrase to search for in the content
+func (t *searchToken) isContentTerm() bool {
+	return t.paren == 0 && (t.qualifier == "" || t.qualifier == "re") &&
+		!t.isOperator("AND") && !t.isOperator("OR") && !t.isOperator("NOT")
+}
+
+func syntaxError(format string, args ...interface{}) *httpError {
+	return &httpError{
+		message: "Syntax error in query: " + fmt.Sprintf(format, args...),
+		code:    http.StatusBadRequest,
+	}
+}
+
+// tokenizeSearchExpression splits the query into tokens.
+// A word of the form qualifier:value is only split if the qualifier is
+// one of the given names, since words like "root:x:0:0" are common in files.
+// The qualifiers map must have lowercase keys, and the values are the proper names.
+func tokenizeSearchExpression(query string, qualifiers map[string]string) ([]searchToken, *httpError) {
+	tokens := make([]searchToken, 0)
+	for i := 0; i < len(query); {
+		switch c := query[i]; c {
+		case ' ', '\t', '\r', '\n':
+			i++
+		case '(', ')':
+			tokens = append(tokens, searchToken{paren: c})
+			i++
+		case '"':
+			value, n, hErr := readQuotedString(query[i:])
+			if hErr != nil {
+				return nil, hErr
+			}
+			tokens = append(tokens, searchToken{value: value, quoted: true})
+			i += n
+		default:
+			start := i
+			for i < len(query) && !strings.ContainsRune(" \t\r\n()\"", rune(query[i])) {
+				i++
+			}
+			token := searchToken{value: query[start:i]}
+			if j := strings.IndexByte(token.value, ':'); j > 0 {
+				if name, ok := qualifiers[strings.ToLower(token.value[:j])]; ok {
+					token.qualifier = name
+					token.value = token.value[j+1:]
+					if token.value == "" && i < len(query) && query[i] == '"' {
+						value, n, hErr := readQuotedString(query[i:])
+						if hErr != nil {
+							return nil, hErr
+						}
+						token.value = value
+						token.quoted = true
+						i += n
+					}
+				}
+			}
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, nil
+}
+
+// readQuotedString reads a string in double quotes from the start of s.
+// Inside the quotes, a backslash escapes the next character.
+// Returns the string and the number of bytes that were read.
+func readQuotedString(s string) (string, int, *httpError) {
+	var sb strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return sb.String(), i + 1, nil
+		case '\\':
+			if i+1 < len(s) {
+				i++
+			}
+		}
+		sb.WriteByte(s[i])
+	}
+	return "", 0, syntaxError("missing end quote")
+}
+
+type searchExpressionParser struct {
+	tokens []searchToken
+	pos    int
+}
+
+// parseSearchExpression parses a query. The fields are the names of the
+// host fields that can be used as qualifiers.
+func parseSearchExpression(query string, fields []string) (*searchExpression, *httpError) {
+	qualifiers := map[string]string{"file": "file", "re": "re"}
+	for _, f := range fields {
+		qualifiers[strings.ToLower(f)] = f
+	}
+	tokens, hErr := tokenizeSearchExpression(query, qualifiers)
+	if hErr != nil {
+		return nil, hErr
+	}
+	if len(tokens) == 0 {
+		return nil, syntaxError("the query is empty")
+	}
+	p := &searchExpressionParser{tokens: tokens}
+	expr, hErr := p.parseOr()
+	if hErr != nil {
+		return nil, hErr
+	}
+	if p.pos < len(p.tokens) {
+		// parseOr only stops early at a closing parenthesis
+		return nil, syntaxError("unexpected )")
+	}
+	return expr, nil
+}
+
+func (p *searchExpressionParser) peek() *searchToken {
+	if p.pos < len(p.tokens) {
+		return &p.tokens[p.pos]
+	}
+	return nil
+}
+
+func (p *searchExpressionParser) parseOr() (*searchExpression, *httpError) {
+	left, hErr := p.parseAnd()
+	if hErr != nil {
+		return nil, hErr
+	}
+	for t := p.peek(); t != nil && t.isOperator("OR"); t = p.peek() {
+		p.pos++
+		right, hErr := p.parseAnd()
+		if hErr != nil {
+			return nil, hErr
+		}
+		left = &searchExpression{op: "OR", children: []*searchExpression{left, right}}
+	}
+	return left, nil
+}
+
+func (p *searchExpressionParser) parseAnd() (*searchExpression, *httpError) {
+	left, hErr := p.parseNot()
+	if hErr != nil {
+		return nil, hErr
+	}
+	for t := p.peek(); t != nil && t.paren != ')' && !t.isOperator("OR"); t = p.peek() {
+		// The AND operator is optional
+		if t.isOperator("AND") {
+			p.pos++
+		}
+		right, hErr := p.parseNot()
+		if hErr != nil {
+			return nil, hErr
+		}
+		left = &searchExpression{op: "AND", children: []*searchExpression{left, right}}
+	}
+	return left, nil
+}
+
+func (p *searchExpressionParser) parseNot() (*searchExpression, *httpError) {
+	if t := p.peek(); t != nil && t.isOperator("NOT") {
+		p.pos++
+		child, hErr := p.parseNot()
+		if hErr != nil {
+			return nil, hErr
+		}
+		return &searchExpression{op: "NOT", children: []*searchExpression{child}}, nil
+	}
+	return p.parseTerm()
+}
+
+func (p *searchExpressionParser) parseTerm() (*searchExpression, *httpError) {
+	t := p.peek()
+	if t == nil {
+		return nil, syntaxError("unexpected end of query")
+	}
+	p.pos++
+	switch {
+	case t.paren == '(':
+		expr, hErr := p.parseOr()
+		if hErr != nil {
+			return nil, hErr
+		}
+		if t = p.peek(); t == nil || t.paren != ')' {
+			return nil, syntaxError("missing )")
+		}
+		p.pos++
+		return expr, nil
+	case t.paren == ')':
+		return nil, syntaxError("unexpected )")
+	case t.isOperator("AND") || t.isOperator("OR"):
+		return nil, syntaxError("unexpected %s", t.value)
+	case t.qualifier == "file":
+		expr := &searchExpression{filename: t.value}
+		// If a word or phrase follows, the search is limited to this file
+		if next := p.peek(); next != nil && next.isContentTerm() {
+			p.pos++
+			expr.text = next.value
+			expr.isRegex = next.qualifier == "re"
+		}
+		return expr, nil
+	case t.qualifier == "re":
+		return &searchExpression{text: t.value, isRegex: true}, nil
+	case t.qualifier != "":
+		return &searchExpression{field: t.qualifier, text: t.value}, nil
+	default:
+		return &searchExpression{text: t.value}, nil
+	}
+}
+
+// searchExpressionEvaluator computes which hosts match a search expression.
+// The result of each node is a set of certificate fingerprints.
+type searchExpressionEvaluator struct {
+	db             *sql.DB
+	opts           searchOptions
+	history        *historicalSearch
+	customFieldIDs map[string]int
+	// allHosts is loaded when needed, for NOT operations
+	allHosts map[string]bool
+}
+
+func (e *searchExpressionEvaluator) eval(expr *searchExpression) (map[string]bool, *httpError) {
+	switch expr.op {
+	case "AND", "OR":
+		left, hErr := e.eval(expr.children[0])
+		if hErr != nil {
+			return nil, hErr
+		}
+		right, hErr := e.eval(expr.children[1])
+		if hErr != nil {
+			return nil, hErr
+		}
+		if expr.op == "OR" {
+			for certfp := range right {
+				left[certfp] = true
+			}
+			return left, nil
+		}
+		for certfp := range left {
+			if !right[certfp] {
+				delete(left, certfp)
+			}
+		}
+		return left, nil
+	case "NOT":
+		child, hErr := e.eval(expr.children[0])
+		if hErr != nil {
+			return nil, hErr
+		}
+		if e.allHosts == nil {
+			list, err := QueryColumn(e.db, "SELECT certfp FROM hostinfo")
+			if err != nil {
+				return nil, &httpError{message: err.Error(), code: http.StatusInternalServerError}
+			}
+			e.allHosts = make(map[string]bool, len(list))
+			for _, s := range list {
+				if str, ok := s.(string); ok {
+					e.allHosts[str] = true
+				}
+			}
+		}
+		result := make(map[string]bool, len(e.allHosts))
+		for certfp := range e.allHosts {
+			if !child[certfp] {
+				result[certfp] = true
+			}
+		}
+		return result, nil
+	}
+	if expr.field != "" {
+		return e.hostsWithFieldValue(expr.field, expr.text)
+	}
+	// A content search
+	opts := e.opts
+	// regex=true in the request makes every search string a regular expression
+	opts.isRegex = opts.isRegex || expr.isRegex
+	if expr.text == "" {
+		// Matches every file with the given name
+		opts = searchOptions{}
+	}
+	q, hErr := newSearchQuery(expr.text, opts)
+	if hErr != nil {
+		return nil, hErr
+	}
+	if e.history == nil {
+		return searchForHosts(q, expr.filename)
+	}
+	hits, hErr := e.history.search(e.db, q, expr.filename, nil)
+	if hErr != nil {
+		return nil, hErr
+	}
+	result := make(map[string]bool, len(hits))
+	for _, certfp := range hits {
+		result[certfp] = true
+	}
+	return result, nil
+}
+
+// hostsWithFieldValue returns the hosts where the field has the given value.
+// The value is interpreted the same way as in the host list API.
+func (e *searchExpressionEvaluator) hostsWithFieldValue(field string, value string) (map[string]bool, *httpError) {
+	operator := "="
+	for _, prefix := range []string{"!", "<", ">"} {
+		if strings.HasPrefix(value, prefix) {
+			operator = strings.Replace(prefix, "!", "!=", 1)
+			value = value[1:]
+			break
+		}
+	}
+	customFieldMap, err := getCustomFieldMap(e.db)
+	if err != nil {
+		return nil, &httpError{message: err.Error(), code: http.StatusInternalServerError}
+	}
+	where, qparams, hErr := buildSQLWhere(field+operator+url.QueryEscape(value), nil, customFieldMap)
+	if hErr != nil {
+		return nil, hErr
+	}
+
+	// Like in the host list API, the statement is wrapped so the WHERE clause
+	// operates on the field expressions instead of the original columns.
+	customFields := make([]string, 0, 1)
+	if _, ok := e.customFieldIDs[field]; ok {
+		customFields = append(customFields, field)
+	}
+	statement := "SELECT certfp FROM (" + hostFieldsStatement(customFields, e.customFieldIDs, field) +
+		") as foo WHERE " + where
+	list, err := QueryColumn(e.db, statement, qparams...)
+	if err != nil {
+		return nil, &httpError{message: err.Error(), code: http.StatusInternalServerError}
+	}
+	result := make(map[string]bool, len(list))
+	for _, s := range list {
+		if str, ok := s.(string); ok {
+			result[str] = true
+		}
+	}
+	return result, nil
+}
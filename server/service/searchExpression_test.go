@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Returns a string with the syntax tree in prefix notation, for testing
+func (expr *searchExpression) String() string {
+	if expr.op != "" {
+		children := make([]string, len(expr.children))
+		for i, c := range expr.children {
+			children[i] = c.String()
+		}
+		return "(" + expr.op + " " + strings.Join(children, " ") + ")"
+	}
+	s := fmt.Sprintf("%q", expr.text)
+	if expr.isRegex {
+		s = "re" + s
+	}
+	if expr.field != "" {
+		s = expr.field + "=" + s
+	}
+	if expr.filename != "" {
+		s = expr.filename + ":" + s
+	}
+	return s
+}
+
+func TestParseSearchExpression(t *testing.T) {
+	fields := []string{"os", "osFamily", "hostname"}
+	tests := []struct {
+		query, expect string
+	}{
+		{`PermitRootLogin`, `"PermitRootLogin"`},
+		{`"PermitRootLogin yes"`, `"PermitRootLogin yes"`},
+		{`os:"RHEL 9" AND file:/etc/ssh/sshd_config "PermitRootLogin yes"`,
+			`(AND os="RHEL 9" /etc/ssh/sshd_config:"PermitRootLogin yes")`},
+		{`a OR b AND c`, `(OR "a" (AND "b" "c"))`},
+		{`(a OR b) c`, `(AND (OR "a" "b") "c")`},
+		{`NOT NOT a AND NOT b`, `(AND (NOT (NOT "a")) (NOT "b"))`},
+		{`file:/etc/hosts`, `/etc/hosts:""`},
+		{`file:/etc/hosts AND localhost`, `(AND /etc/hosts:"" "localhost")`},
+		{`file:/etc/hosts re:"^127\\.0"`, `/etc/hosts:re"^127\\.0"`},
+		{`OSFAMILY:windows`, `osFamily="windows"`},
+		{`hostname:*.example.com OR os:!Fedora*`,
+			`(OR hostname="*.example.com" os="!Fedora*")`},
+		// Unknown qualifiers are just part of the word
+		{`root:x:0:0`, `"root:x:0:0"`},
+		// Operators must be uppercase, quoted operators are search strings
+		{`this and that`, `(AND (AND "this" "and") "that")`},
+		{`"AND" OR "\"quoted\""`, `(OR "AND" "\"quoted\"")`},
+	}
+	for _, test := range tests {
+		expr, hErr := parseSearchExpression(test.query, fields)
+		if hErr != nil {
+			t.Errorf("%s: %s", test.query, hErr.message)
+			continue
+		}
+		if expr.String() != test.expect {
+			t.Errorf("%s\nParsed as %s\nExpected  %s", test.query, expr.String(), test.expect)
+		}
+	}
+
+	for _, query := range []string{``, `(a`, `a)`, `a AND`, `OR b`, `NOT`, `"unterminated`, `os:"RHEL`} {
+		if _, hErr := parseSearchExpression(query, fields); hErr == nil || hErr.code != 400 {
+			t.Errorf("Expected a syntax error for %s", query)
+		}
+	}
+}
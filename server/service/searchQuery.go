@@ -0,0 +1,330 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// searchQuery holds a parsed search string for the in-memory search cache.
+// It is either a plain substring search, or a search with a regular expression.
+// Searches are case-insensitive unless the caseSensitive option is used.
+type searchQuery struct {
+	// For plain searches, text is the search string. It is lowercase
+	// unless the search is case-sensitive.
+	// For regular expressions, it is the original expression.
+	text string
+	// re is nil for plain searches
+	re *regexp.Regexp
+	// literals are strings that must be present in the (lowercase)
+	// content for it to possibly match. Used with the trigram index.
+	literals []string
+	// caseSensitive queries must be matched against the original content
+	caseSensitive bool
+	// wholeWord queries only match when not surrounded by letters, digits or underscore
+	wholeWord bool
+	// deadline is the point in time where the search will be aborted.
+	// A zero value means no deadline.
+	deadline time.Time
+}
+
+// searchOptions are the options for a search, as given in the request
+type searchOptions struct {
+	isRegex       bool
+	caseSensitive bool
+	wholeWord     bool
+}
+
+// defaultRegexSearchTimeLimit is short, since searches of the cache hold a read lock,
+// and a writer that waits for it holds up all the other searches too
+const defaultRegexSearchTimeLimit = 2 // seconds
+
+// regexReaderMinSize is the size of content where a regular expression is matched through
+// a deadlineReader, so the match can be stopped in the middle when the time is up.
+// Reading rune by rune is slower, so it is only done where it is needed.
+const regexReaderMinSize = 256 * 1024
+
+// newSearchQuery parses the search string. If opts.isRegex is true, the string
+// is compiled as a regular expression (RE2 syntax), and a compile error
+// is returned as a http error with status 400 Bad Request.
+func newSearchQuery(str string, opts searchOptions) (*searchQuery, *httpError) {
+	q := &searchQuery{
+		text:          str,
+		caseSensitive: opts.caseSensitive,
+		wholeWord:     opts.wholeWord,
+	}
+	if !opts.isRegex {
+		if !q.caseSensitive {
+			q.text = strings.ToLower(str)
+		}
+		q.literals = []string{strings.ToLower(str)}
+		return q, nil
+	}
+	// Files are searched as a whole, but ^ and $ should match at line breaks,
+	// since most of the files are line-oriented.
+	// Unless the search is case-sensitive, the expression is matched against
+	// lowercase content, so it must be case-insensitive to give the same
+	// results as a plain search.
+	expr := "(?m)" + str
+	if !q.caseSensitive {
+		expr = "(?im)" + str
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, &httpError{
+			message: "Invalid regular expression: " + err.Error(),
+			code:    http.StatusBadRequest,
+		}
+	}
+	q.re = re
+	if parsed, err := syntax.Parse(expr, syntax.Perl); err == nil {
+		q.literals = requiredLiterals(parsed)
+	}
+	// Regular expressions can be expensive, so they get a time limit.
+	// That way, one bad expression won't hold the search cache lock for long.
+	q.deadline = time.Now().Add(regexTimeLimit())
+	return q, nil
+}
+
+// regexTimeLimit is how long a regular expression may run over the search cache,
+// and how long any search in old versions of files may run in the database
+func regexTimeLimit() time.Duration {
+	limit := config.RegexSearchTimeLimit
+	if limit <= 0 {
+		limit = defaultRegexSearchTimeLimit
+	}
+	return time.Duration(limit) * time.Second
+}
+
+// isRegex returns true if the query is a regular expression
+func (q *searchQuery) isRegex() bool {
+	return q.re != nil
+}
+
+// hasExpired returns true if the query has used up its time budget
+func (q *searchQuery) hasExpired() bool {
+	return !q.deadline.IsZero() && time.Now().After(q.deadline)
+}
+
+// matches returns true if the content matches the query.
+// The content must be in its original case if the query is case-sensitive,
+// and lowercase otherwise.
+// For large content, a regular expression stops when the query has expired,
+// so the caller must check hasExpired before trusting a negative result.
+func (q *searchQuery) matches(content string) bool {
+	if q.re != nil && !q.deadline.IsZero() && len(content) >= regexReaderMinSize {
+		// For whole words, this rules out most of the content before the slower check below
+		if !q.re.MatchReader(&deadlineReader{s: content, q: q}) || q.hasExpired() {
+			return false
+		}
+	}
+	if q.wholeWord {
+		return len(q.findAll(content, 1)) > 0
+	}
+	if q.re != nil {
+		return q.re.MatchString(content)
+	}
+	return strings.Contains(content, q.text)
+}
+
+// deadlineReader reads the runes of a string until the query has expired,
+// and then pretends the string has ended
+type deadlineReader struct {
+	s   string
+	pos int
+	q   *searchQuery
+	n   int
+}
+
+func (r *deadlineReader) ReadRune() (rune, int, error) {
+	if r.pos >= len(r.s) {
+		return 0, 0, io.EOF
+	}
+	// Looking at the clock for every rune would be too slow
+	r.n++
+	if r.n%65536 == 0 && r.q.hasExpired() {
+		r.pos = len(r.s)
+		return 0, 0, io.EOF
+	}
+	c, size := utf8.DecodeRuneInString(r.s[r.pos:])
+	r.pos += size
+	return c, size, nil
+}
+
+// mayMatch is a cheap test that can rule out lowercase content before
+// doing a case-sensitive match against the original content.
+func (q *searchQuery) mayMatch(lowercase string) bool {
+	for _, s := range q.literals {
+		if !strings.Contains(lowercase, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// findAll returns the start and end positions of up to max matches in the
+// content, in the same format as regexp.FindAllStringIndex.
+// The content must be in the same case as for the matches function.
+func (q *searchQuery) findAll(content string, max int) [][]int {
+	if q.re != nil {
+		n := max
+		if q.wholeWord {
+			// Some of the matches may be filtered out
+			n = -1
+		}
+		result := make([][]int, 0, Min(max, 10))
+		for _, m := range q.re.FindAllStringIndex(content, n) {
+			if len(result) >= max {
+				break
+			}
+			// Empty matches aren't useful for highlighting
+			if m[0] < m[1] && (!q.wholeWord || isWholeWord(content, m[0], m[1])) {
+				result = append(result, m)
+			}
+		}
+		return result
+	}
+	if q.text == "" {
+		return nil
+	}
+	result := make([][]int, 0, Min(max, 10))
+	offset := 0
+	for len(result) < max {
+		i := strings.Index(content[offset:], q.text)
+		if i == -1 {
+			break
+		}
+		start, end := offset+i, offset+i+len(q.text)
+		if q.wholeWord && !isWholeWord(content, start, end) {
+			// Overlapping occurrences might still be whole words
+			_, size := utf8.DecodeRuneInString(content[start:])
+			offset = start + size
+			continue
+		}
+		result = append(result, []int{start, end})
+		offset = end
+	}
+	return result
+}
+
+// isWholeWord returns true if the part of s from start to end isn't
+// directly preceded or followed by a word character, like grep -w.
+func isWholeWord(s string, start int, end int) bool {
+	if start > 0 {
+		r, _ := utf8.DecodeLastRuneInString(s[:start])
+		if isWordRune(r) {
+			return false
+		}
+	}
+	if end < len(s) {
+		r, _ := utf8.DecodeRuneInString(s[end:])
+		if isWordRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// isWordRune returns true for letters, digits and underscore
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// errSearchTimeLimit is returned when a search has used up its time budget
+var errSearchTimeLimit = &httpError{
+	message: "The search took too long and was aborted. Try a more specific regular expression.",
+	code:    http.StatusUnprocessableEntity,
+}
+
+// requiredLiterals walks the syntax tree of a regular expression and returns
+// strings that must occur in any text the expression matches.
+// The strings are lowercase, since they will be looked for in lowercase content.
+func requiredLiterals(re *syntax.Regexp) []string {
+	result := make([]string, 0)
+	switch re.Op {
+	case syntax.OpLiteral:
+		for _, s := range literalPieces(re) {
+			if s != "" {
+				result = append(result, s)
+			}
+		}
+	case syntax.OpCapture, syntax.OpPlus:
+		result = requiredLiterals(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min >= 1 {
+			result = requiredLiterals(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		// Adjacent literals make up a longer string
+		var run strings.Builder
+		flush := func() {
+			if run.Len() > 0 {
+				result = append(result, run.String())
+				run.Reset()
+			}
+		}
+		for _, sub := range re.Sub {
+			if sub.Op != syntax.OpLiteral {
+				flush()
+				result = append(result, requiredLiterals(sub)...)
+				continue
+			}
+			for i, s := range literalPieces(sub) {
+				if i > 0 {
+					flush()
+				}
+				run.WriteString(s)
+			}
+		}
+		flush()
+	}
+	return result
+}
+
+// literalPieces returns the lowercase string for a literal node in a syntax tree.
+// The trigram index is built from lowercase content, so case-sensitive
+// literals are lowercased too.
+// For case-insensitive literals, runes that can match more than their
+// lowercase and uppercase variants (e.g. k and the Kelvin sign) split the
+// string in pieces, because the content might contain any of the variants.
+func literalPieces(re *syntax.Regexp) []string {
+	pieces := make([]string, 0, 1)
+	var sb strings.Builder
+	for _, r := range re.Rune {
+		if re.Flags&syntax.FoldCase != 0 &&
+			unicode.SimpleFold(unicode.SimpleFold(r)) != r {
+			pieces = append(pieces, sb.String())
+			sb.Reset()
+			continue
+		}
+		sb.WriteRune(unicode.ToLower(r))
+	}
+	return append(pieces, sb.String())
+}
+
+// searchStringFromRequest reads the search string and options from the request.
+// The string can be given in a parameter named qName, or in a parameter named
+// reName for a regular expression. The parameter "regex" can also be used to
+// say that the string in qName is a regular expression.
+func searchStringFromRequest(req *http.Request, qName string, reName string) (string, searchOptions) {
+	opts := searchOptionsFromRequest(req)
+	if re := req.FormValue(reName); re != "" {
+		opts.isRegex = true
+		return re, opts
+	}
+	return req.FormValue(qName), opts
+}
+
+// searchOptionsFromRequest reads the parameters "regex", "caseSensitive" and "wholeWord"
+func searchOptionsFromRequest(req *http.Request) searchOptions {
+	return searchOptions{
+		isRegex:       isTrueish(req.FormValue("regex")),
+		caseSensitive: isTrueish(req.FormValue("caseSensitive")),
+		wholeWord:     isTrueish(req.FormValue("wholeWord")),
+	}
+}
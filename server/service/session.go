@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"net/http"
 	"nivlheim/utility"
@@ -143,14 +144,14 @@ func apiGetUserInfo(w http.ResponseWriter, req *http.Request) {
 type cleanupSessionsJob struct{}
 
 func init() {
-	RegisterJob(cleanupSessionsJob{})
+	RegisterLocalJob(cleanupSessionsJob{})
 }
 
 func (job cleanupSessionsJob) HowOften() time.Duration {
 	return time.Minute * 29
 }
 
-func (job cleanupSessionsJob) Run(db *sql.DB) {
+func (job cleanupSessionsJob) Run(ctx context.Context, db *sql.DB) {
 	sessionMutex.Lock()
 	defer sessionMutex.Unlock()
 	for id, sPtr := range sessions {
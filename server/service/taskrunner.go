@@ -3,7 +3,9 @@ package main
 // This program acts as a task queue manager.
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"log"
 	"net/http"
 	"sync"
@@ -14,21 +16,73 @@ import (
 
 // Task is a struct that holds an entry in a task queue.
 // The queue itself is stored in a database table.
-// Other parts of the system can create tasks by inserting rows.
-// A task will be retried until it succeeds, and then discarded.
-// A task has a url. To run a task, a http get request will be performed.
-// A return status in the 2xx range is interpreted as success, everything else as failure.
-// In case of failure, the task will be retried after a while.
-// An exception is http status 410 which is interpreted as a permanent failure
-// that is pointless to retry.
-// Another exception is redirect status codes (3xx), the http client follows redirects.
+// Other parts of the system can create tasks with enqueueTask.
+// A task has a type, which decides which handler runs it, and a url, which is the argument for the handler.
+// If the handler returns an error, the task will be retried after a while.
+// A task that has failed too many times is kept in a dead-letter state (taskStatusDead)
+// together with the last error, until it is retried or discarded through the API.
+// When a task succeeds, it is removed.
+// Several server instances can share the queue, as long as they also share the queue directory.
+// Each task is claimed before it runs (see claimTask), so only one instance runs it.
+// The claim is renewed while the task runs.
 type Task struct {
-	taskid  int64
-	url     string
-	lasttry time.Time
-	status  int
-	delay   int
-	delay2  int
+	taskid   int64
+	taskType string
+	url      string
+	lasttry  time.Time
+	status   int
+	delay    int
+	delay2   int
+	attempts int
+}
+
+// Values for the status column in the tasks table
+const (
+	taskStatusNew     = 0
+	taskStatusFailing = 1
+	taskStatusDead    = 2
+)
+
+// defaultTaskMaxAttempts is used if TaskMaxAttempts isn't set in config.
+// With the Fibonacci delay, 25 attempts take about 2 days.
+const defaultTaskMaxAttempts = 25
+
+// A taskHandler runs a task. arg is the url column of the task.
+type taskHandler func(arg string, db *sql.DB) error
+
+var taskHandlers = make(map[string]taskHandler)
+
+// RegisterTaskType makes a handler run the tasks of a type.
+// It should be called from an init() function.
+func RegisterTaskType(taskType string, handler taskHandler) {
+	taskHandlers[taskType] = handler
+}
+
+func init() {
+	RegisterTaskType("archive", processArchive)
+}
+
+// enqueueTask creates a task, unless there already is one with the same type and argument
+func enqueueTask(db *sql.DB, taskType string, arg string) error {
+	if _, ok := taskHandlers[taskType]; !ok {
+		return fmt.Errorf("unknown task type: %s", taskType)
+	}
+	var err error
+	if postgresSupportsOnConflict {
+		_, err = db.Exec("INSERT INTO tasks(type,url) VALUES($1,$2)"+
+			" ON CONFLICT DO NOTHING", taskType, arg)
+	} else {
+		_, err = db.Exec("INSERT INTO tasks(type,url) SELECT $1,$2 WHERE "+
+			"(SELECT count(*) FROM tasks WHERE type=$1 AND url=$2) = 0", taskType, arg)
+	}
+	return err
+}
+
+func taskMaxAttempts() int {
+	if config.TaskMaxAttempts > 0 {
+		return config.TaskMaxAttempts
+	}
+	return defaultTaskMaxAttempts
 }
 
 var mu sync.RWMutex
@@ -50,14 +104,17 @@ func markTaskDone(id int64) {
 	delete(runningTasks, id)
 }
 
-// taskRunner is intended to be run as a goroutine. It enters an infinite loop
+// taskRunner is intended to be run as a goroutine. It enters a loop
 // where it periodically reads the "task" database table and executes tasks.
-func taskRunner(db *sql.DB, devmode bool) {
+// When ctx is cancelled, it stops starting new tasks, and returns when the running ones are done.
+func taskRunner(ctx context.Context, db *sql.DB, devmode bool) {
 	taskSlots := make(chan bool, 10) // max concurrent running tasks
-	for {
+	for ctx.Err() == nil {
 		// Read the current active tasks from the database
-		rows, err := db.Query("SELECT taskid, url, lasttry, " +
-			"status, delay, delay2 FROM tasks")
+		// Tasks that are claimed by another server instance are left alone
+		rows, err := db.Query("SELECT taskid, type, url, lasttry, "+
+			"status, delay, delay2, attempts FROM tasks WHERE status < $1 "+
+			"AND (claimed_until IS NULL OR claimed_until < now())", taskStatusDead)
 		if err != nil {
 			log.Panic(err)
 		}
@@ -66,8 +123,8 @@ func taskRunner(db *sql.DB, devmode bool) {
 			var task Task
 			var taskurl sql.NullString
 			var timestamp pq.NullTime
-			err = rows.Scan(&task.taskid, &taskurl, &timestamp,
-				&task.status, &task.delay, &task.delay2)
+			err = rows.Scan(&task.taskid, &task.taskType, &taskurl, &timestamp,
+				&task.status, &task.delay, &task.delay2, &task.attempts)
 			if err != nil {
 				log.Panic(err)
 			}
@@ -90,6 +147,9 @@ func taskRunner(db *sql.DB, devmode bool) {
 		// Find tasks that should be run/re-tried right now
 		canWaitMaxSeconds := 20
 		for _, task := range tasks {
+			if ctx.Err() != nil {
+				break
+			}
 			if task.lasttry.IsZero() ||
 				time.Since(task.lasttry).Seconds() > float64(task.delay) {
 				taskSlots <- true // this will block until there's a free slot
@@ -111,23 +171,60 @@ func taskRunner(db *sql.DB, devmode bool) {
 
 		// Sleep
 		freeSlots := len(taskSlots)
+	sleep:
 		for second := 0; second < canWaitMaxSeconds; second++ {
-			time.Sleep(time.Second)
+			select {
+			case <-ctx.Done():
+				break sleep
+			case <-time.After(time.Second):
+			}
 			if freeSlots != len(taskSlots) {
 				// A task finished. Stop sleeping and see if there's more work to do now
 				break
 			}
 		}
 	}
+	// Wait for the running tasks, so no archive is left half processed
+	for i := 0; i < cap(taskSlots); i++ {
+		taskSlots <- true
+	}
 }
 
+// executeTask runs a task, unless another server instance is already running it
+// or has run it since the task list was read.
+// If it fails, the error is stored, and the task is retried later or moved to the dead-letter state.
 func executeTask(db *sql.DB, task Task) {
-	err := processArchive(task.url, db)
-	if err == nil {
-		db.Exec("DELETE FROM tasks WHERE taskid=$1", task.taskid)
+	claimed, err := claimTask(db, task)
+	if err != nil {
+		log.Printf("Unable to claim task %d: %v", task.taskid, err)
+		return
+	}
+	if !claimed {
 		return
+	}
+	handler, ok := taskHandlers[task.taskType]
+	if ok {
+		stopRenewing := renewTaskClaim(db, task.taskid)
+		err = handler(task.url, db)
+		stopRenewing()
 	} else {
-		task.status = 1
+		err = fmt.Errorf("unknown task type: %s", task.taskType)
+	}
+	if err == nil {
+		if _, err = db.Exec("DELETE FROM tasks WHERE taskid=$1", task.taskid); err != nil {
+			// The task will be run again when the claim expires
+			log.Printf("Unable to remove task %d (%s %s) after it succeeded: %v",
+				task.taskid, task.taskType, task.url, err)
+		}
+		return
+	}
+	task.attempts++
+	task.status = taskStatusFailing
+	if !ok || task.attempts >= taskMaxAttempts() {
+		// Give up, until someone retries it through the API
+		task.status = taskStatusDead
+		log.Printf("Task %d (%s %s) failed %d times, giving up: %v",
+			task.taskid, task.taskType, task.url, task.attempts, err)
 	}
 	task.lasttry = time.Now()
 
@@ -145,9 +242,73 @@ func executeTask(db *sql.DB, task Task) {
 		task.delay = 86400
 	}
 
-	db.Exec("UPDATE tasks SET lasttry=$1, delay=$2, delay2=$3, status=$4 "+
-		" WHERE taskid=$5",
-		task.lasttry, task.delay, task.delay2, task.status, task.taskid)
+	_, dbErr := db.Exec("UPDATE tasks SET lasttry=$1, delay=$2, delay2=$3, status=$4, "+
+		"attempts=$5, lasterror=$6, claimed_until=NULL WHERE taskid=$7",
+		task.lasttry, task.delay, task.delay2, task.status,
+		task.attempts, err.Error(), task.taskid)
+	if dbErr != nil {
+		log.Printf("Unable to update task %d (%s %s) after it failed with \"%v\": %v",
+			task.taskid, task.taskType, task.url, err, dbErr)
+	}
+}
+
+// taskClaimSeconds is how long a claimed task is left alone by the other server instances.
+// The claim is renewed while the task runs (see renewTaskClaim), so if the instance that
+// claimed it stops before the task is finished, the task is retried after this.
+const taskClaimSeconds = 600
+
+// taskClaimRenewInterval is how often the claim of a running task is renewed
+var taskClaimRenewInterval = taskClaimSeconds / 3 * time.Second
+
+// claimTask marks the task as being run, by setting claimed_until to taskClaimSeconds from now,
+// so the task isn't run by any other server instance until the claim expires.
+// The delay isn't touched, so if the instance stops while running the task, it is retried
+// when the claim expires, with the same backoff as before.
+// The row is locked with SKIP LOCKED while it is claimed, so if two instances try to claim it
+// at the same time, one of them gets it and the other one moves on without waiting.
+// It returns false if the row is locked, if the task is claimed already, or if lasttry has changed
+// since the task list was read, which means that another server instance has tried it meanwhile.
+func claimTask(db *sql.DB, task Task) (bool, error) {
+	lasttry := pq.NullTime{Time: task.lasttry, Valid: !task.lasttry.IsZero()}
+	res, err := db.Exec("UPDATE tasks SET claimed_until=now()+$1*interval '1 second' WHERE taskid="+
+		"(SELECT taskid FROM tasks WHERE taskid=$2 AND lasttry IS NOT DISTINCT FROM $3 "+
+		"AND (claimed_until IS NULL OR claimed_until < now()) AND status < $4 FOR UPDATE SKIP LOCKED)",
+		taskClaimSeconds, task.taskid, lasttry, taskStatusDead)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// renewTaskClaim keeps the claim on a task from expiring while it runs, so a task that
+// runs for a long time isn't claimed and run by another server instance too.
+// The returned function stops the renewal, and must be called when the task is done.
+func renewTaskClaim(db *sql.DB, taskid int64) func() {
+	done := make(chan bool)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(taskClaimRenewInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_, err := db.Exec("UPDATE tasks SET claimed_until=now()+$1*interval '1 second' "+
+					"WHERE taskid=$2", taskClaimSeconds, taskid)
+				if err != nil {
+					log.Printf("Unable to renew the claim on task %d: %v", taskid, err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
 }
 
 type apiMethodResetWaitingTime struct {
@@ -159,6 +320,7 @@ func (vars *apiMethodResetWaitingTime) ServeHTTP(w http.ResponseWriter, req *htt
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	vars.db.Exec("UPDATE tasks SET delay=0, delay2=0 WHERE lasttry IS NOT NULL AND delay>0")
+	vars.db.Exec("UPDATE tasks SET delay=0, delay2=0 WHERE lasttry IS NOT NULL AND delay>0 AND status < $1",
+		taskStatusDead)
 	http.Error(w, "", http.StatusNoContent) // 204 OK
 }